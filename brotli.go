@@ -0,0 +1,706 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/base64"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// brotli decoder, RFC 7932. Data is decoded as a whole in memory, the output is limited in size
+
+var errBrotliInvalid = errors.New("brotli: invalid data")
+
+// brotliTransform is a transform applied to words of the static dictionary
+type brotliTransform struct {
+	prefix string
+	kind   int
+	suffix string
+}
+
+var (
+	brotliDictionaryOnce sync.Once
+	brotliDictionary     []byte
+)
+
+// the static dictionary, decompressed on first use
+func brotliStaticDictionary() []byte {
+	brotliDictionaryOnce.Do(func() {
+		compressed, _ := base64.StdEncoding.DecodeString(brotliDictionaryData)
+		brotliDictionary, _ = ioutil.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	})
+	return brotliDictionary
+}
+
+// brotliBitReader read bits of data from the lowest bit of each byte
+type brotliBitReader struct {
+	data  []byte
+	pos   int    // next byte to load
+	value uint64 // bits loaded but not read, lowest first
+	count uint   // number of bits in value
+	err   error  // first error, bits read after error are zero
+}
+
+// load bits until there are n bits, or data end. return if there are n bits
+func (r *brotliBitReader) fill(n uint) bool {
+	for r.count < n {
+		if r.pos >= len(r.data) {
+			return false
+		}
+		r.value |= uint64(r.data[r.pos]) << r.count
+		r.pos++
+		r.count += 8
+	}
+	return true
+}
+
+func (r *brotliBitReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// read n bits, n <= 32
+func (r *brotliBitReader) readBits(n uint) int {
+	if n == 0 {
+		return 0
+	}
+	if !r.fill(n) {
+		r.fail(io.ErrUnexpectedEOF)
+		r.value, r.count = 0, 0
+		return 0
+	}
+	value := int(r.value & (1<<n - 1))
+	r.value >>= n
+	r.count -= n
+	return value
+}
+
+// the next n bits without reading them, bits after data end are zero
+func (r *brotliBitReader) peekBits(n uint) int {
+	r.fill(n)
+	return int(r.value & (1<<n - 1))
+}
+
+// skip bits to the byte boundary
+func (r *brotliBitReader) alignToByte() {
+	r.readBits(r.count % 8)
+}
+
+// read n bytes, should be at the byte boundary
+func (r *brotliBitReader) readBytes(n int) []byte {
+	// bits loaded are whole bytes after aligned
+	r.pos -= int(r.count / 8)
+	r.value, r.count = 0, 0
+	if n > len(r.data)-r.pos {
+		r.fail(io.ErrUnexpectedEOF)
+		r.pos = len(r.data)
+		return nil
+	}
+	data := r.data[r.pos : r.pos+n]
+	r.pos += n
+	return data
+}
+
+// 1-8 bits value, for numbers of block types and trees: 1 to 256
+func (r *brotliBitReader) readVarLen8() int {
+	if r.readBits(1) == 0 {
+		return 0
+	}
+	n := uint(r.readBits(3))
+	if n == 0 {
+		return 1
+	}
+	return r.readBits(n) + 1<<n
+}
+
+// brotliHuffman is a canonical prefix code, decoded bit by bit
+type brotliHuffman struct {
+	count  [16]int // number of codes of each length
+	symbol []int   // symbols ordered by code length, then symbol value
+}
+
+// build prefix code from code length of each symbol
+func newBrotliHuffman(lengths []uint8) *brotliHuffman {
+	h := &brotliHuffman{}
+	for _, length := range lengths {
+		h.count[length]++
+	}
+	var offsets [16]int
+	for length := 2; length < 16; length++ {
+		offsets[length] = offsets[length-1] + h.count[length-1]
+	}
+	h.symbol = make([]int, len(lengths)-h.count[0])
+	for symbol, length := range lengths {
+		if length != 0 {
+			h.symbol[offsets[length]] = symbol
+			offsets[length]++
+		}
+	}
+	return h
+}
+
+// read one symbol. Code of single symbol takes no bits
+func (r *brotliBitReader) readSymbol(h *brotliHuffman) int {
+	if len(h.symbol) == 1 {
+		return h.symbol[0]
+	}
+	code, first, index := 0, 0, 0
+	for length := 1; length < 16; length++ {
+		code |= r.readBits(1)
+		count := h.count[length]
+		if code-count < first {
+			return h.symbol[index+code-first]
+		}
+		index += count
+		first = (first + count) << 1
+		code <<= 1
+	}
+	r.fail(errBrotliInvalid)
+	return 0
+}
+
+// order of code length code lengths in complex prefix codes
+var brotliCodeLengthOrder = [18]int{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// code length code lengths are read by a fixed code, indexed by the next 4 bits
+var brotliCodeLengthPrefixLength = [16]uint{2, 2, 2, 3, 2, 2, 2, 4, 2, 2, 2, 3, 2, 2, 2, 4}
+var brotliCodeLengthPrefixValue = [16]uint8{0, 4, 3, 2, 0, 4, 3, 1, 0, 4, 3, 2, 0, 4, 3, 5}
+
+// read a prefix code of the alphabet, section 3.4 and 3.5
+func (r *brotliBitReader) readPrefixCode(alphabetSize int) *brotliHuffman {
+	skip := r.readBits(2)
+	if skip == 1 {
+		return r.readSimplePrefixCode(alphabetSize)
+	}
+
+	var codeLengthLengths [18]uint8
+	space, codes := 32, 0
+	for i := skip; i < len(brotliCodeLengthOrder); i++ {
+		index := r.peekBits(4)
+		r.readBits(brotliCodeLengthPrefixLength[index])
+		length := brotliCodeLengthPrefixValue[index]
+		codeLengthLengths[brotliCodeLengthOrder[i]] = length
+		if length != 0 {
+			space -= 32 >> length
+			codes++
+			if space <= 0 {
+				break
+			}
+		}
+	}
+	if codes != 1 && space != 0 {
+		r.fail(errBrotliInvalid)
+		return nil
+	}
+	codeLengthCode := newBrotliHuffman(codeLengthLengths[:])
+
+	lengths := make([]uint8, alphabetSize)
+	symbol, previous, repeat, repeatLength := 0, uint8(8), 0, uint8(0)
+	space = 32768
+	for symbol < alphabetSize && space > 0 && r.err == nil {
+		length := r.readSymbol(codeLengthCode)
+		if length < 16 {
+			repeat = 0
+			lengths[symbol] = uint8(length)
+			symbol++
+			if length != 0 {
+				previous = uint8(length)
+				space -= 32768 >> uint(length)
+			}
+			continue
+		}
+		// 16 repeat the previous non-zero length, 17 repeat zero
+		extraBits, newLength := uint(2), previous
+		if length == 17 {
+			extraBits, newLength = 3, 0
+		}
+		if repeatLength != newLength {
+			repeat, repeatLength = 0, newLength
+		}
+		old := repeat
+		if repeat > 0 {
+			repeat = (repeat - 2) << extraBits
+		}
+		repeat += r.readBits(extraBits) + 3
+		delta := repeat - old
+		if symbol+delta > alphabetSize {
+			r.fail(errBrotliInvalid)
+			return nil
+		}
+		for i := 0; i < delta; i++ {
+			lengths[symbol] = repeatLength
+			symbol++
+		}
+		if repeatLength != 0 {
+			space -= delta << (15 - repeatLength)
+		}
+	}
+	if space != 0 {
+		r.fail(errBrotliInvalid)
+		return nil
+	}
+	return newBrotliHuffman(lengths)
+}
+
+// simple prefix code of 1 to 4 symbols
+func (r *brotliBitReader) readSimplePrefixCode(alphabetSize int) *brotliHuffman {
+	count := r.readBits(2) + 1
+	bits := uint(0)
+	for 1<<bits < alphabetSize {
+		bits++
+	}
+	var symbols [4]int
+	for i := 0; i < count; i++ {
+		symbols[i] = r.readBits(bits)
+		if symbols[i] >= alphabetSize {
+			r.fail(errBrotliInvalid)
+			return nil
+		}
+		for j := 0; j < i; j++ {
+			if symbols[j] == symbols[i] {
+				r.fail(errBrotliInvalid)
+				return nil
+			}
+		}
+	}
+	lengths := make([]uint8, alphabetSize)
+	switch count {
+	case 1:
+		lengths[symbols[0]] = 1
+	case 2:
+		lengths[symbols[0]], lengths[symbols[1]] = 1, 1
+	case 3:
+		lengths[symbols[0]], lengths[symbols[1]], lengths[symbols[2]] = 1, 2, 2
+	case 4:
+		if r.readBits(1) == 0 {
+			lengths[symbols[0]], lengths[symbols[1]], lengths[symbols[2]], lengths[symbols[3]] = 2, 2, 2, 2
+		} else {
+			lengths[symbols[0]], lengths[symbols[1]], lengths[symbols[2]], lengths[symbols[3]] = 1, 2, 3, 3
+		}
+	}
+	return newBrotliHuffman(lengths)
+}
+
+// base and extra bits of block count codes
+var brotliBlockCountBase = [26]int{1, 5, 9, 13, 17, 25, 33, 41, 49, 65, 81, 97, 113, 145, 177, 209, 241, 305, 369, 497,
+	753, 1265, 2289, 4337, 8433, 16625}
+var brotliBlockCountExtra = [26]uint{2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 4, 4, 5, 5, 5, 5, 6, 6, 7, 8, 9, 10, 11, 12, 13, 24}
+
+// brotliBlockSwitch track block type and count of one category: literal, insert-and-copy, or distance
+type brotliBlockSwitch struct {
+	types     int
+	typeCode  *brotliHuffman
+	countCode *brotliHuffman
+	current   int
+	previous  int
+	remaining int // symbols left of the current block
+}
+
+func (r *brotliBitReader) readBlockSwitch() *brotliBlockSwitch {
+	s := &brotliBlockSwitch{types: r.readVarLen8() + 1, previous: 1, remaining: 1 << 28}
+	if s.types >= 2 {
+		s.typeCode = r.readPrefixCode(s.types + 2)
+		s.countCode = r.readPrefixCode(26)
+		if r.err == nil {
+			s.remaining = r.readBlockCount(s.countCode)
+		}
+	}
+	return s
+}
+
+func (r *brotliBitReader) readBlockCount(code *brotliHuffman) int {
+	symbol := r.readSymbol(code)
+	return brotliBlockCountBase[symbol] + r.readBits(brotliBlockCountExtra[symbol])
+}
+
+// start the next block, when symbols of the current block are used up
+func (s *brotliBlockSwitch) next(r *brotliBitReader) {
+	if s.types < 2 {
+		r.fail(errBrotliInvalid)
+		return
+	}
+	blockType := r.readSymbol(s.typeCode)
+	switch blockType {
+	case 0:
+		blockType = s.previous
+	case 1:
+		blockType = s.current + 1
+	default:
+		blockType -= 2
+	}
+	if blockType >= s.types {
+		blockType -= s.types
+	}
+	s.previous, s.current = s.current, blockType
+	s.remaining = r.readBlockCount(s.countCode)
+}
+
+// read context map of size, section 7.3
+func (r *brotliBitReader) readContextMap(size int, trees int) []uint8 {
+	contextMap := make([]uint8, size)
+	if trees < 2 {
+		return contextMap
+	}
+	maxRunLengthPrefix := 0
+	if r.readBits(1) == 1 {
+		maxRunLengthPrefix = r.readBits(4) + 1
+	}
+	code := r.readPrefixCode(trees + maxRunLengthPrefix)
+	for i := 0; i < size && r.err == nil; {
+		symbol := r.readSymbol(code)
+		switch {
+		case symbol == 0:
+			i++
+		case symbol <= maxRunLengthPrefix:
+			// run of zeros
+			i += 1<<uint(symbol) + r.readBits(uint(symbol))
+			if i > size {
+				r.fail(errBrotliInvalid)
+			}
+		default:
+			contextMap[i] = uint8(symbol - maxRunLengthPrefix)
+			i++
+		}
+	}
+	if r.readBits(1) == 1 {
+		// inverse move-to-front transform
+		var mtf [256]uint8
+		for i := range mtf {
+			mtf[i] = uint8(i)
+		}
+		for i, index := range contextMap {
+			value := mtf[index]
+			contextMap[i] = value
+			copy(mtf[1:index+1], mtf[:index])
+			mtf[0] = value
+		}
+	}
+	for _, tree := range contextMap {
+		if int(tree) >= trees {
+			r.fail(errBrotliInvalid)
+		}
+	}
+	return contextMap
+}
+
+// base and extra bits of insert length codes and copy length codes
+var brotliInsertBase = [24]int{0, 1, 2, 3, 4, 5, 6, 8, 10, 14, 18, 26, 34, 50, 66, 98, 130, 194, 322, 578, 1090,
+	2114, 6210, 22594}
+var brotliInsertExtra = [24]uint{0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 12, 14, 24}
+var brotliCopyBase = [24]int{2, 3, 4, 5, 6, 7, 8, 9, 10, 12, 14, 18, 22, 30, 38, 54, 70, 102, 134, 198, 326, 582,
+	1094, 2118}
+var brotliCopyExtra = [24]uint{0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 2, 2, 3, 3, 4, 4, 5, 5, 6, 7, 8, 9, 10, 24}
+
+// insert and copy length code of each cell of 64 insert-and-copy symbols
+var brotliInsertCells = [11]int{0, 0, 0, 0, 8, 8, 0, 16, 8, 16, 16}
+var brotliCopyCells = [11]int{0, 8, 0, 8, 0, 8, 16, 0, 16, 8, 16}
+
+// brotliDecoder decode meta-blocks of a brotli stream
+type brotliDecoder struct {
+	r         *brotliBitReader
+	out       []byte
+	window    int    // max backward distance
+	distances [4]int // last distances, the last one first
+}
+
+// decode brotli data, return errDecodedTooLarge if the output is more than limit
+func brotliDecode(data []byte, limit int) ([]byte, error) {
+	r := &brotliBitReader{data: data}
+	d := &brotliDecoder{r: r, window: 1<<r.readWindowBits() - 16, distances: [4]int{4, 11, 15, 16}}
+	for r.err == nil {
+		last := r.readBits(1) == 1
+		if last && r.readBits(1) == 1 {
+			// last and empty
+			break
+		}
+		nibbles := r.readBits(2)
+		if nibbles == 3 {
+			// metadata, skipped
+			if r.readBits(1) != 0 {
+				r.fail(errBrotliInvalid)
+				break
+			}
+			skipBytes, skip := r.readBits(2), 0
+			for i := 0; i < skipBytes; i++ {
+				skip |= r.readBits(8) << uint(8*i)
+			}
+			if skipBytes > 0 {
+				skip++
+			}
+			r.alignToByte()
+			r.readBytes(skip)
+			if last {
+				break
+			}
+			continue
+		}
+		length := 0
+		for i := 0; i < nibbles+4; i++ {
+			length |= r.readBits(4) << uint(4*i)
+		}
+		length++
+		uncompressed := !last && r.readBits(1) == 1
+		if r.err != nil {
+			break
+		}
+		if len(d.out)+length > limit {
+			return nil, errDecodedTooLarge
+		}
+		if uncompressed {
+			r.alignToByte()
+			d.out = append(d.out, r.readBytes(length)...)
+			continue
+		}
+		d.decodeMetaBlock(length)
+		if last {
+			break
+		}
+	}
+	if r.err != nil {
+		if r.err == io.ErrUnexpectedEOF {
+			return nil, errors.New("brotli: unexpected end of data")
+		}
+		return nil, r.err
+	}
+	return d.out, nil
+}
+
+// WBITS of stream header, section 9.1
+func (r *brotliBitReader) readWindowBits() uint {
+	if r.readBits(1) == 0 {
+		return 16
+	}
+	if n := r.readBits(3); n != 0 {
+		return 17 + uint(n)
+	}
+	n := r.readBits(3)
+	if n == 1 {
+		// large window brotli is not the standard format
+		r.fail(errBrotliInvalid)
+	}
+	if n != 0 {
+		return 8 + uint(n)
+	}
+	return 17
+}
+
+// decode a compressed meta-block of length bytes, section 9.2 and 9.3
+func (d *brotliDecoder) decodeMetaBlock(length int) {
+	r := d.r
+	literalSwitch := r.readBlockSwitch()
+	commandSwitch := r.readBlockSwitch()
+	distanceSwitch := r.readBlockSwitch()
+	postfixBits := uint(r.readBits(2))
+	directCodes := r.readBits(4) << postfixBits
+	contextModes := make([]int, literalSwitch.types)
+	for i := range contextModes {
+		contextModes[i] = r.readBits(2)
+	}
+	literalTrees := r.readVarLen8() + 1
+	literalMap := r.readContextMap(64*literalSwitch.types, literalTrees)
+	distanceTrees := r.readVarLen8() + 1
+	distanceMap := r.readContextMap(4*distanceSwitch.types, distanceTrees)
+	if r.err != nil {
+		return
+	}
+	literalCodes := make([]*brotliHuffman, literalTrees)
+	for i := range literalCodes {
+		literalCodes[i] = r.readPrefixCode(256)
+	}
+	commandCodes := make([]*brotliHuffman, commandSwitch.types)
+	for i := range commandCodes {
+		commandCodes[i] = r.readPrefixCode(704)
+	}
+	distanceCodes := make([]*brotliHuffman, distanceTrees)
+	for i := range distanceCodes {
+		distanceCodes[i] = r.readPrefixCode(16 + directCodes + 48<<postfixBits)
+	}
+
+	end := len(d.out) + length
+	for len(d.out) < end && r.err == nil {
+		if commandSwitch.remaining == 0 {
+			commandSwitch.next(r)
+		}
+		commandSwitch.remaining--
+		symbol := r.readSymbol(commandCodes[commandSwitch.current])
+		cell := symbol >> 6
+		insertCode := brotliInsertCells[cell] + symbol>>3&7
+		copyCode := brotliCopyCells[cell] + symbol&7
+		insertLength := brotliInsertBase[insertCode] + r.readBits(brotliInsertExtra[insertCode])
+		copyLength := brotliCopyBase[copyCode] + r.readBits(brotliCopyExtra[copyCode])
+
+		if insertLength > end-len(d.out) {
+			r.fail(errBrotliInvalid)
+			return
+		}
+		for i := 0; i < insertLength && r.err == nil; i++ {
+			if literalSwitch.remaining == 0 {
+				literalSwitch.next(r)
+			}
+			literalSwitch.remaining--
+			var p1, p2 byte
+			if n := len(d.out); n > 1 {
+				p1, p2 = d.out[n-1], d.out[n-2]
+			} else if n == 1 {
+				p1 = d.out[0]
+			}
+			context := brotliLiteralContext(contextModes[literalSwitch.current], p1, p2)
+			tree := literalMap[64*literalSwitch.current+context]
+			d.out = append(d.out, byte(r.readSymbol(literalCodes[tree])))
+		}
+		if len(d.out) >= end {
+			// the copy length is ignored when the meta-block ends after the insert
+			break
+		}
+
+		distanceCode := 0
+		if cell >= 2 {
+			if distanceSwitch.remaining == 0 {
+				distanceSwitch.next(r)
+			}
+			distanceSwitch.remaining--
+			context := 3
+			if copyLength <= 4 {
+				context = copyLength - 2
+			}
+			tree := distanceMap[4*distanceSwitch.current+context]
+			distanceCode = r.readSymbol(distanceCodes[tree])
+		}
+		distance := d.distance(distanceCode, postfixBits, directCodes)
+		if distance <= 0 || r.err != nil {
+			r.fail(errBrotliInvalid)
+			return
+		}
+
+		maxDistance := d.window
+		if len(d.out) < maxDistance {
+			maxDistance = len(d.out)
+		}
+		if distance > maxDistance {
+			// reference to the static dictionary
+			word := brotliDictionaryWord(copyLength, distance-maxDistance-1)
+			if word == nil || len(word) > end-len(d.out) {
+				r.fail(errBrotliInvalid)
+				return
+			}
+			d.out = append(d.out, word...)
+			continue
+		}
+		if distanceCode != 0 {
+			d.distances = [4]int{distance, d.distances[0], d.distances[1], d.distances[2]}
+		}
+		if copyLength > end-len(d.out) {
+			r.fail(errBrotliInvalid)
+			return
+		}
+		for i := 0; i < copyLength; i++ {
+			d.out = append(d.out, d.out[len(d.out)-distance])
+		}
+	}
+}
+
+// distance of distance code, section 4
+func (d *brotliDecoder) distance(code int, postfixBits uint, directCodes int) int {
+	switch {
+	case code < 4:
+		return d.distances[code]
+	case code < 10:
+		return d.distances[0] + brotliDistanceOffsets[code-4]
+	case code < 16:
+		return d.distances[1] + brotliDistanceOffsets[code-10]
+	case code < 16+directCodes:
+		return code - 15
+	}
+	code -= 16 + directCodes
+	extraBits := uint(1 + code>>(postfixBits+1))
+	offset := (2+(code>>postfixBits)&1)<<extraBits - 4
+	return (offset+d.r.readBits(extraBits))<<postfixBits + code&(1<<postfixBits-1) + directCodes + 1
+}
+
+// offsets to the last or second-to-last distance of distance code 4-9 and 10-15
+var brotliDistanceOffsets = [6]int{-1, 1, -2, 2, -3, 3}
+
+// context id of literal by context mode and the last two bytes, section 7.1
+func brotliLiteralContext(mode int, p1, p2 byte) int {
+	switch mode {
+	case 0:
+		// LSB6
+		return int(p1 & 0x3f)
+	case 1:
+		// MSB6
+		return int(p1 >> 2)
+	case 2:
+		// UTF8
+		return int(brotliContextLUT0[p1] | brotliContextLUT1[p2])
+	}
+	// signed
+	return int(brotliContextLUT2[p1]<<3 | brotliContextLUT2[p2])
+}
+
+// transformed word of the static dictionary, nil if invalid, section 8
+func brotliDictionaryWord(length int, id int) []byte {
+	if length < 4 || length > 24 {
+		return nil
+	}
+	bits := brotliDictionarySizeBits[length]
+	index, transform := id&(1<<bits-1), id>>bits
+	if transform >= len(brotliTransforms) {
+		return nil
+	}
+	offset := brotliDictionaryOffsets[length] + index*length
+	return brotliTransforms[transform].apply(brotliStaticDictionary()[offset : offset+length])
+}
+
+func (t *brotliTransform) apply(word []byte) []byte {
+	switch {
+	case t.kind >= 1 && t.kind <= 9:
+		if t.kind > len(word) {
+			word = nil
+		} else {
+			word = word[:len(word)-t.kind]
+		}
+	case t.kind >= 12:
+		if t.kind-11 > len(word) {
+			word = nil
+		} else {
+			word = word[t.kind-11:]
+		}
+	}
+	out := make([]byte, 0, len(t.prefix)+len(word)+len(t.suffix))
+	out = append(out, t.prefix...)
+	start := len(out)
+	out = append(out, word...)
+	transformed := out[start:]
+	if t.kind == 10 && len(transformed) > 0 {
+		brotliUppercase(transformed)
+	} else if t.kind == 11 {
+		for i := 0; i < len(transformed); {
+			i += brotliUppercase(transformed[i:])
+		}
+	}
+	return append(out, t.suffix...)
+}
+
+// uppercase the first utf-8 character in the way of RFC 7932, return its length
+func brotliUppercase(word []byte) int {
+	if word[0] < 0xc0 {
+		if word[0] >= 'a' && word[0] <= 'z' {
+			word[0] ^= 32
+		}
+		return 1
+	}
+	if word[0] < 0xe0 {
+		if len(word) > 1 {
+			word[1] ^= 32
+		}
+		return 2
+	}
+	if len(word) > 2 {
+		word[2] ^= 5
+	}
+	return 3
+}
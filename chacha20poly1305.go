@@ -0,0 +1,218 @@
+package main
+
+import (
+	"crypto/cipher"
+	"crypto/subtle"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+)
+
+// ChaCha20-Poly1305 AEAD of RFC 8439, for decrypting tls records
+
+const (
+	chacha20KeySize   = 32
+	chacha20NonceSize = 12
+	poly1305TagSize   = 16
+)
+
+var errChaCha20Poly1305Open = errors.New("chacha20poly1305: message authentication failed")
+
+type chacha20Poly1305 struct {
+	key [8]uint32
+}
+
+func newChaCha20Poly1305(key []byte) (cipher.AEAD, error) {
+	if len(key) != chacha20KeySize {
+		return nil, errors.New("chacha20poly1305: bad key length")
+	}
+	c := &chacha20Poly1305{}
+	for i := range c.key {
+		c.key[i] = binary.LittleEndian.Uint32(key[i*4:])
+	}
+	return c, nil
+}
+
+func (c *chacha20Poly1305) NonceSize() int {
+	return chacha20NonceSize
+}
+
+func (c *chacha20Poly1305) Overhead() int {
+	return poly1305TagSize
+}
+
+func (c *chacha20Poly1305) Seal(dst, nonce, plaintext, additionalData []byte) []byte {
+	ret, out := sliceForAppend(dst, len(plaintext)+poly1305TagSize)
+	polyKey := c.polyKey(nonce)
+	c.xorKeyStream(out[:len(plaintext)], plaintext, nonce, 1)
+	tag := poly1305AEADTag(&polyKey, additionalData, out[:len(plaintext)])
+	copy(out[len(plaintext):], tag[:])
+	return ret
+}
+
+func (c *chacha20Poly1305) Open(dst, nonce, ciphertext, additionalData []byte) ([]byte, error) {
+	if len(ciphertext) < poly1305TagSize {
+		return nil, errChaCha20Poly1305Open
+	}
+	tag := ciphertext[len(ciphertext)-poly1305TagSize:]
+	ciphertext = ciphertext[:len(ciphertext)-poly1305TagSize]
+	polyKey := c.polyKey(nonce)
+	expected := poly1305AEADTag(&polyKey, additionalData, ciphertext)
+	if subtle.ConstantTimeCompare(expected[:], tag) != 1 {
+		return nil, errChaCha20Poly1305Open
+	}
+	ret, out := sliceForAppend(dst, len(ciphertext))
+	c.xorKeyStream(out, ciphertext, nonce, 1)
+	return ret, nil
+}
+
+// the one-time poly1305 key, from the first block of key stream
+func (c *chacha20Poly1305) polyKey(nonce []byte) [32]byte {
+	var block [64]byte
+	c.block(nonce, 0, &block)
+	var key [32]byte
+	copy(key[:], block[:32])
+	return key
+}
+
+func (c *chacha20Poly1305) xorKeyStream(dst, src, nonce []byte, counter uint32) {
+	var block [64]byte
+	for len(src) > 0 {
+		c.block(nonce, counter, &block)
+		counter++
+		n := len(src)
+		if n > len(block) {
+			n = len(block)
+		}
+		for i := 0; i < n; i++ {
+			dst[i] = src[i] ^ block[i]
+		}
+		dst, src = dst[n:], src[n:]
+	}
+}
+
+// the chacha20 block function
+func (c *chacha20Poly1305) block(nonce []byte, counter uint32, out *[64]byte) {
+	state := [16]uint32{0x61707865, 0x3320646e, 0x79622d32, 0x6b206574,
+		c.key[0], c.key[1], c.key[2], c.key[3], c.key[4], c.key[5], c.key[6], c.key[7],
+		counter, binary.LittleEndian.Uint32(nonce[0:]), binary.LittleEndian.Uint32(nonce[4:]),
+		binary.LittleEndian.Uint32(nonce[8:])}
+	x := state
+	for i := 0; i < 10; i++ {
+		chacha20QuarterRound(&x, 0, 4, 8, 12)
+		chacha20QuarterRound(&x, 1, 5, 9, 13)
+		chacha20QuarterRound(&x, 2, 6, 10, 14)
+		chacha20QuarterRound(&x, 3, 7, 11, 15)
+		chacha20QuarterRound(&x, 0, 5, 10, 15)
+		chacha20QuarterRound(&x, 1, 6, 11, 12)
+		chacha20QuarterRound(&x, 2, 7, 8, 13)
+		chacha20QuarterRound(&x, 3, 4, 9, 14)
+	}
+	for i := range x {
+		binary.LittleEndian.PutUint32(out[i*4:], x[i]+state[i])
+	}
+}
+
+func chacha20QuarterRound(x *[16]uint32, a, b, c, d int) {
+	x[a] += x[b]
+	x[d] = bits.RotateLeft32(x[d]^x[a], 16)
+	x[c] += x[d]
+	x[b] = bits.RotateLeft32(x[b]^x[c], 12)
+	x[a] += x[b]
+	x[d] = bits.RotateLeft32(x[d]^x[a], 8)
+	x[c] += x[d]
+	x[b] = bits.RotateLeft32(x[b]^x[c], 7)
+}
+
+// tag of aead construction: additional data and ciphertext, each padded to 16 bytes, then their lengths
+func poly1305AEADTag(key *[32]byte, additionalData, ciphertext []byte) [16]byte {
+	data := make([]byte, 0, len(additionalData)+len(ciphertext)+48)
+	data = append(data, additionalData...)
+	data = append(data, make([]byte, (16-len(additionalData)%16)%16)...)
+	data = append(data, ciphertext...)
+	data = append(data, make([]byte, (16-len(ciphertext)%16)%16)...)
+	var lengths [16]byte
+	binary.LittleEndian.PutUint64(lengths[0:], uint64(len(additionalData)))
+	binary.LittleEndian.PutUint64(lengths[8:], uint64(len(ciphertext)))
+	data = append(data, lengths[:]...)
+	return poly1305Sum(key, data)
+}
+
+// poly1305 one-time authenticator. h is kept in three 64 bits limbs, reduced partially after each block
+func poly1305Sum(key *[32]byte, msg []byte) [16]byte {
+	r0 := binary.LittleEndian.Uint64(key[0:]) & 0x0FFFFFFC0FFFFFFF
+	r1 := binary.LittleEndian.Uint64(key[8:]) & 0x0FFFFFFC0FFFFFFC
+	s0 := binary.LittleEndian.Uint64(key[16:])
+	s1 := binary.LittleEndian.Uint64(key[24:])
+
+	var h0, h1, h2 uint64
+	for len(msg) > 0 {
+		var block [16]byte
+		n := copy(block[:], msg)
+		msg = msg[n:]
+		hibit := uint64(1)
+		if n < len(block) {
+			block[n] = 1
+			hibit = 0
+		}
+		var c uint64
+		h0, c = bits.Add64(h0, binary.LittleEndian.Uint64(block[0:]), 0)
+		h1, c = bits.Add64(h1, binary.LittleEndian.Uint64(block[8:]), c)
+		h2 += c + hibit
+
+		// h * r, h2 and r are small enough that h2 * r fit in 64 bits
+		h0r0hi, h0r0lo := bits.Mul64(h0, r0)
+		h1r0hi, h1r0lo := bits.Mul64(h1, r0)
+		h0r1hi, h0r1lo := bits.Mul64(h0, r1)
+		h1r1hi, h1r1lo := bits.Mul64(h1, r1)
+		h2r0 := h2 * r0
+		h2r1 := h2 * r1
+
+		m1lo, c := bits.Add64(h1r0lo, h0r1lo, 0)
+		m1hi := h1r0hi + h0r1hi + c
+		m2lo, c := bits.Add64(h1r1lo, h2r0, 0)
+		m2hi := h1r1hi + c
+
+		t0 := h0r0lo
+		t1, c := bits.Add64(h0r0hi, m1lo, 0)
+		t2, c := bits.Add64(m1hi, m2lo, c)
+		t3 := m2hi + h2r1 + c
+
+		// h = t mod 2^130 + 5 * (t >> 130), as 2^130 = 5 mod p
+		h0, h1, h2 = t0, t1, t2&3
+		cclo, cchi := t2&^3, t3
+		h0, c = bits.Add64(h0, cclo, 0)
+		h1, c = bits.Add64(h1, cchi, c)
+		h2 += c
+		cclo, cchi = cclo>>2|cchi<<62, cchi>>2
+		h0, c = bits.Add64(h0, cclo, 0)
+		h1, c = bits.Add64(h1, cchi, c)
+		h2 += c
+	}
+
+	// h mod p, p = 2^130 - 5
+	t0, b := bits.Sub64(h0, 0xFFFFFFFFFFFFFFFB, 0)
+	t1, b := bits.Sub64(h1, 0xFFFFFFFFFFFFFFFF, b)
+	_, b = bits.Sub64(h2, 3, b)
+	if b == 0 {
+		h0, h1 = t0, t1
+	}
+	var c uint64
+	h0, c = bits.Add64(h0, s0, 0)
+	h1, _ = bits.Add64(h1, s1, c)
+	var tag [16]byte
+	binary.LittleEndian.PutUint64(tag[0:], h0)
+	binary.LittleEndian.PutUint64(tag[8:], h1)
+	return tag
+}
+
+// extend dst by n bytes, return the whole slice and the extended part
+func sliceForAppend(dst []byte, n int) (whole, tail []byte) {
+	if cap(dst)-len(dst) >= n {
+		whole = dst[:len(dst)+n]
+	} else {
+		whole = make([]byte, len(dst)+n)
+		copy(whole, dst)
+	}
+	return whole, whole[len(dst):]
+}
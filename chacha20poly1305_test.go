@@ -0,0 +1,48 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mustDecodeHex(t *testing.T, s string) []byte {
+	data, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	assert.NoError(t, err)
+	return data
+}
+
+// RFC 8439 2.5.2
+func TestPoly1305Sum(t *testing.T) {
+	var key [32]byte
+	copy(key[:], mustDecodeHex(t, "85d6be7857556d337f4452fe42d506a80103808afb0db2fd4abff6af4149f51b"))
+	tag := poly1305Sum(&key, []byte("Cryptographic Forum Research Group"))
+	assert.Equal(t, "a8061dc1305136c6c22b8baf0c0127a9", hex.EncodeToString(tag[:]))
+}
+
+// RFC 8439 2.8.2
+func TestChaCha20Poly1305(t *testing.T) {
+	key := mustDecodeHex(t, "808182838485868788898a8b8c8d8e8f909192939495969798999a9b9c9d9e9f")
+	nonce := mustDecodeHex(t, "070000004041424344454647")
+	aad := mustDecodeHex(t, "50515253c0c1c2c3c4c5c6c7")
+	plaintext := "Ladies and Gentlemen of the class of '99: If I could offer you only one tip for the future, " +
+		"sunscreen would be it."
+	ciphertext := "d31a8d34648e60db7b86afbc53ef7ec2a4aded51296e08fea9e2b5a736ee62d63dbea45e8ca9671282fafb69da92728b" +
+		"1a71de0a9e060b2905d6a5b67ecd3b3692ddbd7f2d778b8c9803aee328091b58fab324e4fad675945585808b4831d7bc3ff4de" +
+		"f08e4b7a9de576d26586cec64b6116" + "1ae10b594f09e26a7e902ecbd0600691"
+
+	aead, err := newChaCha20Poly1305(key)
+	assert.NoError(t, err)
+	sealed := aead.Seal(nil, nonce, []byte(plaintext), aad)
+	assert.Equal(t, ciphertext, hex.EncodeToString(sealed))
+
+	opened, err := aead.Open(nil, nonce, sealed, aad)
+	assert.NoError(t, err)
+	assert.Equal(t, plaintext, string(opened))
+
+	sealed[0] ^= 1
+	_, err = aead.Open(nil, nonce, sealed, aad)
+	assert.Error(t, err)
+}
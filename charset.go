@@ -0,0 +1,247 @@
+package main
+
+import (
+	"bytes"
+	"regexp"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// detect charset of bodies which have no charset parameter in content-type
+
+var xmlDeclarationPattern = regexp.MustCompile(`^\s*<\?xml\s[^>]*?encoding\s*=\s*["']([\w.:-]+)["']`)
+var htmlMetaCharsetPattern = regexp.MustCompile(`(?i)<meta\s[^>]*?charset\s*=\s*["']?\s*([\w.:-]+)`)
+
+// html meta tags are searched in the first 1024 bytes, as browsers do
+const charsetPrescanLength = 1024
+
+// detect charset by byte order mark, xml declaration, html meta tag, then byte statistics.
+// Return empty charset for utf-8 or ascii text, how the charset is detected, and length of the BOM to skip
+func detectCharset(data []byte) (charset string, by string, bom int) {
+	switch {
+	case bytes.HasPrefix(data, []byte{0xef, 0xbb, 0xbf}):
+		return "", "bom", 3
+	case bytes.HasPrefix(data, []byte{0xff, 0xfe}):
+		return "UTF-16LE", "bom", 2
+	case bytes.HasPrefix(data, []byte{0xfe, 0xff}):
+		return "UTF-16BE", "bom", 2
+	}
+
+	head := data
+	if len(head) > charsetPrescanLength {
+		head = head[:charsetPrescanLength]
+	}
+	if charset, ok := declaredCharset(xmlDeclarationPattern, head); ok {
+		return charset, "xml declaration", 0
+	}
+	if charset, ok := declaredCharset(htmlMetaCharsetPattern, head); ok {
+		return charset, "html meta", 0
+	}
+
+	if charset := detectUTF16(data); charset != "" {
+		return charset, "statistics", 0
+	}
+	if validUTF8(data) {
+		return "", "", 0
+	}
+	return detectMultiByteCharset(data), "statistics", 0
+}
+
+// charset declared in document, ok is false if not found or not known. Empty charset for utf-8
+func declaredCharset(pattern *regexp.Regexp, head []byte) (string, bool) {
+	match := pattern.FindSubmatch(head)
+	if match == nil {
+		return "", false
+	}
+	encoding, err := htmlindex.Get(string(match[1]))
+	if err != nil {
+		return "", false
+	}
+	if name, _ := htmlindex.Name(encoding); name == "utf-8" {
+		return "", true
+	}
+	return string(match[1]), true
+}
+
+// if data is valid utf-8, a rune cut at the end is allowed since body may be truncated
+func validUTF8(data []byte) bool {
+	for i := len(data) - 1; i >= 0 && i >= len(data)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(data[i]) {
+			if !utf8.FullRune(data[i:]) {
+				data = data[:i]
+			}
+			break
+		}
+	}
+	return utf8.Valid(data)
+}
+
+// utf-16 text without BOM, in which most ascii characters have a zero byte
+func detectUTF16(data []byte) string {
+	if len(data) < 4 {
+		return ""
+	}
+	var zeros [2]int
+	for i, b := range data {
+		if b == 0 {
+			zeros[i%2]++
+		}
+	}
+	pairs := len(data) / 2
+	switch {
+	case zeros[1] > pairs/2 && zeros[0] < pairs/10:
+		return "UTF-16LE"
+	case zeros[0] > pairs/2 && zeros[1] < pairs/10:
+		return "UTF-16BE"
+	}
+	return ""
+}
+
+// multiByteCharset describe a legacy multi-byte charset, for detection by byte statistics
+type multiByteCharset struct {
+	name string
+	// length of the character at the start of data, 0 if invalid
+	width func(data []byte) int
+	// if the double-byte character is in the range of commonly used characters
+	frequent func(lead, trail byte) bool
+}
+
+func between(b byte, low byte, high byte) bool {
+	return b >= low && b <= high
+}
+
+// when scores are equal, the former wins. Korean text is mostly in the frequent ranges of gb18030 and euc-jp too,
+// while chinese and japanese text is not for euc-kr; and big5 text usually has trail bytes invalid for euc-jp
+var multiByteCharsets = []multiByteCharset{
+	{
+		name: "EUC-KR",
+		width: func(data []byte) int {
+			if len(data) < 2 || !between(data[0], 0x81, 0xfe) {
+				return 0
+			}
+			// with extension of cp949
+			trail := data[1]
+			if between(trail, 0x41, 0x5a) || between(trail, 0x61, 0x7a) || between(trail, 0x81, 0xfe) {
+				return 2
+			}
+			return 0
+		},
+		frequent: func(lead, trail byte) bool {
+			// hangul syllables
+			return between(lead, 0xb0, 0xc8) && trail >= 0xa1
+		},
+	},
+	{
+		name: "GB18030",
+		width: func(data []byte) int {
+			if len(data) < 2 || !between(data[0], 0x81, 0xfe) {
+				return 0
+			}
+			if trail := data[1]; between(trail, 0x40, 0xfe) && trail != 0x7f {
+				return 2
+			}
+			if len(data) >= 4 && between(data[1], 0x30, 0x39) && between(data[2], 0x81, 0xfe) &&
+				between(data[3], 0x30, 0x39) {
+				return 4
+			}
+			return 0
+		},
+		frequent: func(lead, trail byte) bool {
+			// punctuations, and the level 1 hanzi of gb2312
+			return (lead == 0xa1 || lead == 0xa3 || between(lead, 0xb0, 0xd7)) && trail >= 0xa1
+		},
+	},
+	{
+		name: "EUC-JP",
+		width: func(data []byte) int {
+			switch {
+			case len(data) >= 2 && data[0] == 0x8e && between(data[1], 0xa1, 0xdf):
+				// half-width katakana
+				return 2
+			case len(data) >= 3 && data[0] == 0x8f && between(data[1], 0xa1, 0xfe) && between(data[2], 0xa1, 0xfe):
+				return 3
+			case len(data) >= 2 && between(data[0], 0xa1, 0xfe) && between(data[1], 0xa1, 0xfe):
+				return 2
+			}
+			return 0
+		},
+		frequent: func(lead, trail byte) bool {
+			// punctuations, hiragana, katakana, and the level 1 kanji
+			return lead == 0xa1 || lead == 0xa4 || lead == 0xa5 || between(lead, 0xb0, 0xcf)
+		},
+	},
+	{
+		name: "Big5",
+		width: func(data []byte) int {
+			if len(data) < 2 || !between(data[0], 0x81, 0xfe) {
+				return 0
+			}
+			if trail := data[1]; between(trail, 0x40, 0x7e) || between(trail, 0xa1, 0xfe) {
+				return 2
+			}
+			return 0
+		},
+		frequent: func(lead, trail byte) bool {
+			// punctuations, and the frequently used hanzi
+			return lead == 0xa1 || between(lead, 0xa4, 0xc6)
+		},
+	},
+	{
+		name: "Shift_JIS",
+		width: func(data []byte) int {
+			if between(data[0], 0xa1, 0xdf) {
+				// half-width katakana
+				return 1
+			}
+			if len(data) < 2 || !(between(data[0], 0x81, 0x9f) || between(data[0], 0xe0, 0xfc)) {
+				return 0
+			}
+			if trail := data[1]; between(trail, 0x40, 0xfc) && trail != 0x7f {
+				return 2
+			}
+			return 0
+		},
+		frequent: func(lead, trail byte) bool {
+			// punctuations, hiragana, katakana, and the level 1 kanji
+			return between(lead, 0x81, 0x83) || between(lead, 0x88, 0x98)
+		},
+	},
+}
+
+// the multi-byte charset which most non-ascii characters are valid and frequently used in, or windows-1252
+// if none fits
+func detectMultiByteCharset(data []byte) string {
+	best, bestScore := "windows-1252", 0.5
+	for _, charset := range multiByteCharsets {
+		var total, frequent, invalid int
+		for i := 0; i < len(data); {
+			if data[i] < 0x80 {
+				i++
+				continue
+			}
+			width := charset.width(data[i:])
+			if width == 0 {
+				if len(data)-i < 4 {
+					// may be a character cut at the end
+					break
+				}
+				invalid++
+				i++
+				continue
+			}
+			total++
+			if width >= 2 && charset.frequent(data[i], data[i+1]) {
+				frequent++
+			}
+			i += width
+		}
+		if total == 0 || invalid*50 > total {
+			continue
+		}
+		if score := float64(frequent) / float64(total); score > bestScore {
+			best, bestScore = charset.name, score
+		}
+	}
+	return best
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/charmap"
+	"golang.org/x/text/encoding/japanese"
+	"golang.org/x/text/encoding/korean"
+	"golang.org/x/text/encoding/simplifiedchinese"
+	"golang.org/x/text/encoding/traditionalchinese"
+	"golang.org/x/text/encoding/unicode"
+)
+
+func encodeText(t *testing.T, text string, e encoding.Encoding) []byte {
+	data, err := e.NewEncoder().Bytes([]byte(text))
+	assert.NoError(t, err)
+	return data
+}
+
+func TestDetectCharsetByStatistics(t *testing.T) {
+	cases := []struct {
+		text     string
+		encoding encoding.Encoding
+		charset  string
+	}{
+		{"中华人民共和国是世界上人口最多的国家之一，首都北京。这个问题需要认真研究和讨论。", simplifiedchinese.GBK, "GB18030"},
+		{"你好，世界", simplifiedchinese.GBK, "GB18030"},
+		{"中華民國的首都是臺北市，這裡有許多著名的觀光景點。這個問題需要認真研究與討論。", traditionalchinese.Big5, "Big5"},
+		{"日本語のテキストです。今日はとても良い天気ですね。東京は日本の首都です。", japanese.ShiftJIS, "Shift_JIS"},
+		{"日本語のテキストです。今日はとても良い天気ですね。東京は日本の首都です。", japanese.EUCJP, "EUC-JP"},
+		{"こんにちは", japanese.EUCJP, "EUC-JP"},
+		{"대한민국의 수도는 서울입니다. 오늘은 날씨가 아주 좋습니다.", korean.EUCKR, "EUC-KR"},
+		{"Le café est très bon à Paris. C'est déjà l'été.", charmap.Windows1252, "windows-1252"},
+		{"für", charmap.Windows1252, "windows-1252"},
+		{"<p>hello, 世界</p>", unicode.UTF16(unicode.LittleEndian, unicode.IgnoreBOM), "UTF-16LE"},
+	}
+	for _, c := range cases {
+		data := encodeText(t, c.text, c.encoding)
+		charset, by, bom := detectCharset(data)
+		assert.Equal(t, c.charset, charset, c.text)
+		assert.Equal(t, "statistics", by)
+		text, err := byteToStringWithCharset(data[bom:], charset)
+		assert.NoError(t, err)
+		assert.Equal(t, c.text, text)
+	}
+
+	// utf-8, with a rune cut at the end
+	charset, _, _ := detectCharset([]byte("hello, 世界")[:11])
+	assert.Equal(t, "", charset)
+}
+
+func TestDetectCharsetDeclared(t *testing.T) {
+	charset, by, bom := detectCharset(append([]byte{0xfe, 0xff}, encodeText(t, "hi", unicode.UTF16(unicode.BigEndian,
+		unicode.IgnoreBOM))...))
+	assert.Equal(t, []interface{}{"UTF-16BE", "bom", 2}, []interface{}{charset, by, bom})
+	charset, by, bom = detectCharset([]byte("\xef\xbb\xbfhello"))
+	assert.Equal(t, []interface{}{"", "bom", 3}, []interface{}{charset, by, bom})
+
+	charset, by, _ = detectCharset([]byte("<?xml version=\"1.0\" encoding='Shift_JIS'?>\n<a>\x82\xa0</a>"))
+	assert.Equal(t, "Shift_JIS", charset)
+	assert.Equal(t, "xml declaration", by)
+	charset, by, _ = detectCharset([]byte("<html><head><META http-equiv=\"Content-Type\" " +
+		"content=\"text/html; charset=gb2312\"></head><body>\xc4\xe3\xba\xc3</body></html>"))
+	assert.Equal(t, "gb2312", charset)
+	assert.Equal(t, "html meta", by)
+	charset, by, _ = detectCharset([]byte("<meta charset=\"utf-8\"><p>\xc4\xe3</p>"))
+	assert.Equal(t, "", charset)
+	assert.Equal(t, "html meta", by)
+
+	// unknown charset is ignored
+	charset, by, _ = detectCharset([]byte("<meta charset=\"no-such\"><p>\xc4\xe3\xba\xc3\xa3\xac</p>"))
+	assert.Equal(t, "GB18030", charset)
+	assert.Equal(t, "statistics", by)
+}
+
+func TestConversationDetectCharset(t *testing.T) {
+	body := "<html><head><meta charset=\"gbk\"></head><body>\xc4\xe3\xba\xc3</body></html>"
+	response := "HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: " + strconv.Itoa(len(body)) +
+		"\r\n\r\n" + body
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(testRequest, response, 1460).
+		close()
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "\n\n// charset: gbk, detected by html meta\n"+
+		"<html><head><meta charset=\"gbk\"></head><body>你好</body></html>\n")
+}
@@ -9,21 +9,33 @@ import (
 
 // Command line options
 type Option struct {
-	Level     string        `default:"header" description:"Output level, options are: url(only url) | header(http headers) | all(headers, and textuary http body)"`
-	File      string        `description:"Read from pcap file. If not set, will capture data from network device by default"`
-	Device    string        `default:"any" description:"Capture packet from network device. If is any, capture all interface traffics"`
-	Ip        string        `description:"Filter by ip, if either source or target ip is matched, the packet will be processed"`
-	Port      uint          `description:"Filter by port, if either source or target port is matched, the packet will be processed."`
-	Host      string        `description:"Filter by request host, using wildcard match(*, ?)"`
-	Uri       string        `description:"Filter by request url path, using wildcard match(*, ?)"`
-	Status    string        `description:"Filter by response status code. Can use range. eg: 200, 200-300 or 200:300-400"`
-	StatusSet *IntSet       `ignore:"true"`
-	Force     bool          `description:"Force print unknown content-type http body even if it seems not to be text content"`
-	Pretty    bool          `description:"Try to format and prettify json content"`
-	Curl      bool          `description:"Output an equivalent curl command for each http request"`
-	DumpBody  bool          `description:"dump http request/response body to file"`
-	Output    string        `description:"Write result to file [output] instead of stdout"`
-	Idle      time.Duration `default:"4m" description:"Idle time to remove connection if no package received"`
+	Level            string          `default:"header" description:"Output level, options are: url(only url) | header(http headers) | all(headers, and textuary http body)"`
+	File             string          `description:"Read from pcap file. If not set, will capture data from network device by default"`
+	Device           string          `default:"any" description:"Capture packet from network device. If is any, capture all interface traffics"`
+	Ip               string          `description:"Filter by ip, if either source or target ip is matched, the packet will be processed"`
+	Port             uint            `description:"Filter by port, if either source or target port is matched, the packet will be processed."`
+	Host             string          `description:"Filter by request host, using wildcard match(*, ?). TLS connections not decrypted are matched by SNI"`
+	Uri              string          `description:"Filter by request url path, using wildcard match(*, ?)"`
+	Status           string          `description:"Filter by response status code. Can use range. eg: 200, 200-300 or 200:300-400"`
+	StatusSet        *IntSet         `ignore:"true"`
+	Force            bool            `description:"Force print unknown content-type http body even if it seems not to be text content"`
+	Pretty           bool            `description:"Try to format and prettify json content"`
+	Curl             bool            `description:"Output an equivalent curl command for each http request"`
+	Stream           bool            `description:"Print chunked response body chunk by chunk once received, with the capture time. Server-sent events are always printed once received"`
+	DumpBody         bool            `description:"dump http request/response body to file"`
+	ExtractDir       string          `description:"Write file parts of multipart bodies to the directory, with their original names. Bodies are parsed at level all"`
+	Output           string          `description:"Write result to file [output] instead of stdout"`
+	Idle             time.Duration   `default:"4m" description:"Idle time to remove connection if no package received"`
+	Shards           int             `description:"Number of tcp assembler workers, connections are spread to them by hash. 0 means the number of cpu cores"`
+	TcpStats         bool            `description:"Print tcp diagnostics(handshake rtt, retransmissions, out-of-order, zero-window, who closed) when connection closed"`
+	Events           bool            `description:"Print connection open/close/reset/idle-timeout events"`
+	Methods          string          `description:"Extra http methods to recognise besides standard and WebDAV methods, separated by comma. eg: PURGE,BAN"`
+	ExtraMethods     map[string]bool `ignore:"true"`
+	ProtoDescriptors string          `description:"Protobuf descriptor set files(by protoc --include_imports --descriptor_set_out), separated by comma. Used to show field names of grpc messages"`
+	ProtoRegistry    *protoRegistry  `ignore:"true"`
+	Keylog           string          `description:"NSS key log file(written by browsers and curl with SSLKEYLOGFILE env set), to decrypt TLS 1.2/1.3 traffics with AES-GCM and ChaCha20-Poly1305 cipher suites"`
+	KeyLogSecrets    *keyLog         `ignore:"true"`
+	Backpressure     string          `default:"block" description:"What to do when http parsing can not keep up with traffic of a connection: block(wait, stalls other connections) | spill(buffer data to temp file) | drop(drop the connection)"`
 }
 
 // parse int set
@@ -58,6 +70,24 @@ func ParseIntSet(str string) (*IntSet, error) {
 	return &intSet, nil
 }
 
+// parse http methods separated by comma
+func parseMethods(str string) (map[string]bool, error) {
+	methods := map[string]bool{}
+	for _, method := range strings.Split(str, ",") {
+		method = strings.TrimSpace(method)
+		if method == "" {
+			continue
+		}
+		// method is a token, which has no separators
+		if len(method) > maxMethodLen || !isRequestTarget([]byte(method)) ||
+			strings.ContainsAny(method, "()<>@,;:\\\"/[]?={}") {
+			return nil, errors.New("illegal http method: " + method)
+		}
+		methods[method] = true
+	}
+	return methods, nil
+}
+
 // A set of int values
 type IntSet struct {
 	ranges []IntRange
@@ -16,3 +16,16 @@ func TestParseIntSet(t *testing.T) {
 	assert.Equal(t, 1, intRange.ranges[1].Start)
 	assert.Equal(t, 2, intRange.ranges[1].End)
 }
+
+func TestParseMethods(t *testing.T) {
+	methods, err := parseMethods("PURGE, BAN,")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]bool{"PURGE": true, "BAN": true}, methods)
+
+	methods, err = parseMethods("")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, len(methods))
+
+	_, err = parseMethods("PURGE,BAD/METHOD")
+	assert.Error(t, err)
+}
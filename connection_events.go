@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// connection lifecycle event kinds
+const (
+	connectionOpen        = "OPEN"
+	connectionClose       = "CLOSE"
+	connectionReset       = "RESET"
+	connectionIdleTimeout = "IDLE-TIMEOUT"
+	connectionDropped     = "DROPPED"
+	connectionCaptureEnd  = "CAPTURE-END"
+)
+
+// connectionEvent is open or close of a tcp connection
+type connectionEvent struct {
+	kind         string
+	timestamp    time.Time
+	client       Endpoint
+	server       Endpoint
+	duration     time.Duration
+	transactions int32
+	upBytes      int64
+	downBytes    int64
+}
+
+func (e *connectionEvent) String() string {
+	var sb strings.Builder
+	sb.WriteString(strings.Repeat("*", 10) + " CONNECTION " + e.kind + " " + e.client.String() + " <----> " +
+		e.server.String() + " // " + e.timestamp.Format(time.RFC3339Nano))
+	if e.kind != connectionOpen {
+		sb.WriteString(", duration: " + e.duration.String())
+		sb.WriteString(", http transactions: " + strconv.Itoa(int(e.transactions)))
+		sb.WriteString(", bytes: " + strconv.FormatInt(e.upBytes, 10) + "/" + strconv.FormatInt(e.downBytes, 10) +
+			" (client/server)")
+	}
+	sb.WriteString("\n")
+	return sb.String()
+}
+
+// connectionEvents send connection lifecycle events to printer. A nil connectionEvents ignores all events
+type connectionEvents struct {
+	printer *Printer
+}
+
+// when a connection is created. src and dst are endpoints of the first packet
+func (e *connectionEvents) opened(src, dst Endpoint, timestamp time.Time) {
+	if e == nil {
+		return
+	}
+	event := &connectionEvent{kind: connectionOpen, timestamp: timestamp, client: src, server: dst}
+	e.printer.send(event.String())
+}
+
+// when a connection is removed from assembler.
+// The event is sent after the handler consumed all data, so the http transactions count is complete
+func (e *connectionEvents) closed(connection *TCPConnection, kind string, timestamp time.Time) {
+	if e == nil {
+		return
+	}
+	event := &connectionEvent{
+		kind:      kind,
+		timestamp: timestamp,
+		client:    connection.clientID,
+		server:    connection.serverID(),
+		duration:  timestamp.Sub(connection.firstTimestamp),
+	}
+	waitGroup.Add(1)
+	go func() {
+		defer waitGroup.Done()
+		<-connection.upStream.eof
+		<-connection.downStream.eof
+		event.transactions = atomic.LoadInt32(&connection.transactions)
+		event.upBytes = connection.upStream.stats.bytes
+		event.downBytes = connection.downStream.stats.bytes
+		e.printer.send(event.String())
+	}()
+}
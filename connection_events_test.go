@@ -0,0 +1,49 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnectionEvents(t *testing.T) {
+	printer := &Printer{outputQueue: make(chan string, 16)}
+	handler := &collectConnectionHandler{upData: map[string][]byte{}}
+	assembler := newTCPAssembler(handler, 2, time.Minute)
+	assembler.dissectors = httpDissectors()
+	assembler.events = &connectionEvents{printer: printer}
+
+	client := newEndpoint(net.IP{10, 0, 0, 1}, 10000)
+	server := newEndpoint(net.IP{10, 0, 0, 2}, 80)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	request := []byte("GET / HTTP/1.1\r\n\r\n")
+	assembler.assemble(client, server, &layers.TCP{Seq: 1, ACK: true, Ack: 1,
+		BaseLayer: layers.BaseLayer{Payload: request}}, now)
+	assembler.assemble(server, client, &layers.TCP{Seq: 1, ACK: true, Ack: 1 + uint32(len(request)), RST: true},
+		now.Add(time.Second))
+
+	// this one is not closed
+	idleClient := newEndpoint(net.IP{10, 0, 0, 1}, 10001)
+	assembler.assemble(idleClient, server, &layers.TCP{Seq: 1, ACK: true, Ack: 1,
+		BaseLayer: layers.BaseLayer{Payload: request}}, now)
+
+	assembler.finishAll()
+	handler.waitGroup.Wait()
+	waitGroup.Wait()
+	close(printer.outputQueue)
+
+	var events []string
+	for event := range printer.outputQueue {
+		events = append(events, event)
+	}
+	assert.Equal(t, 4, len(events))
+	joined := strings.Join(events, "")
+	assert.Contains(t, joined, "CONNECTION OPEN 10.0.0.1:10000 <----> 10.0.0.2:80 // 2020-01-01T00:00:00Z\n")
+	assert.Contains(t, joined, "CONNECTION RESET 10.0.0.1:10000 <----> 10.0.0.2:80 // 2020-01-01T00:00:01Z, "+
+		"duration: 1s, http transactions: 0, bytes: 18/0 (client/server)\n")
+	assert.Contains(t, joined, "CONNECTION CAPTURE-END 10.0.0.1:10001 <----> 10.0.0.2:80")
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+
+	"github.com/hsiafan/httpdump/httpport"
+)
+
+// limits of decoding bodies by content-encoding, against decompression bombs
+const (
+	maxEncodedBodySize  = 16 << 20 // encoded body read for decoding
+	maxDecodedBodySize  = 64 << 20 // output of each encoding decoded
+	maxContentEncodings = 4
+)
+
+var errDecodedTooLarge = fmt.Errorf("decoded size exceeds %d bytes", maxDecodedBodySize)
+
+// content codings of header Content-Encoding, in the order they are applied. identity is omitted
+func parseContentEncodings(header httpport.Header) []string {
+	var encodings []string
+	for _, value := range header["Content-Encoding"] {
+		for _, encoding := range strings.Split(value, ",") {
+			encoding = strings.ToLower(strings.TrimSpace(encoding))
+			if encoding != "" && encoding != "identity" {
+				encodings = append(encodings, encoding)
+			}
+		}
+	}
+	return encodings
+}
+
+// decode data by content codings, the last applied is decoded first
+func decodeContent(data []byte, encodings []string) ([]byte, error) {
+	if len(encodings) > maxContentEncodings {
+		return nil, fmt.Errorf("too many content encodings: %v", strings.Join(encodings, ", "))
+	}
+	for i := len(encodings) - 1; i >= 0; i-- {
+		decoded, err := decodeContentEncoding(data, encodings[i], maxDecodedBodySize)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %w", encodings[i], err)
+		}
+		data = decoded
+	}
+	return data, nil
+}
+
+func decodeContentEncoding(data []byte, encoding string, limit int) ([]byte, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return readAllLimited(reader, limit)
+	case "deflate":
+		// should be zlib format, while some servers send raw deflate data
+		if reader, err := zlib.NewReader(bytes.NewReader(data)); err == nil {
+			return readAllLimited(reader, limit)
+		}
+		return readAllLimited(flate.NewReader(bytes.NewReader(data)), limit)
+	case "br":
+		return brotliDecode(data, limit)
+	case "zstd":
+		return zstdDecode(data, limit)
+	}
+	return nil, errors.New("unsupported encoding")
+}
+
+// read all data of reader, return errDecodedTooLarge if more than limit
+func readAllLimited(reader io.Reader, limit int) ([]byte, error) {
+	data, err := ioutil.ReadAll(io.LimitReader(reader, int64(limit)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > limit {
+		return nil, errDecodedTooLarge
+	}
+	return data, nil
+}
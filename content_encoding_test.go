@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/hsiafan/httpdump/httpport"
+	"github.com/stretchr/testify/assert"
+)
+
+// texts compressed by the reference brotli and zstd encoders
+var encodingTestEnglish = strings.Repeat("The quick brown fox jumps over the lazy dog. ", 3) +
+	"Information about the international community, available for everyone.\n"
+
+func encodingTestJSON() string {
+	var items []string
+	for i := 0; i < 40; i++ {
+		items = append(items, fmt.Sprintf(`{"id": %d, "name": "item-%d", "tags": ["a", "b"]}`, i, i))
+	}
+	return `{"items": [` + strings.Join(items, ", ") + "]}"
+}
+
+func encodingTestLines() string {
+	var builder strings.Builder
+	for i := 0; i < 40; i++ {
+		fmt.Fprintf(&builder, "line %d: %x\n", i, i*i*7919)
+	}
+	return builder.String()
+}
+
+func decodeBase64(s string) []byte {
+	data, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+func TestBrotliDecode(t *testing.T) {
+	cases := []struct {
+		name       string
+		compressed string
+		text       string
+	}{
+		// quality 11, with words of the static dictionary
+		{"english q11", "G80AAKwOeNPQq2y6hNg98SVVGVqSmbGVAkiDnOHpqbC3BnGZy+uUA4e22gLJf6JnTPcYO1MSw3GsgxO1aBodGZaH7tMCej67K9osXn/4t44B",
+			encodingTestEnglish},
+		// window of 10 bits
+		{"english q5", "oWgGACCGnXqFLt68UUF+jFVoxoHD3yUJZgkNwMY6QZzn8LkQKfdaPiPheQvW8k5Q+cDNWDryku0HxocG+l+IrAkEs0UjOhwdPANZaADPMc5kx32Rn6nQcnOS5AE=",
+			encodingTestEnglish},
+		{"english q1", "g2YAAICqqqrq/+6XE8PdwS53v/vhImou6ibuqsLu4qLqrg4OuQVuYYSBYIIHwmBjzDOUiL0eivew/YkS/Doqf3iM/vqAUwN5KJr8F268bxhcsi9eGV3S6JDCke8q89TwIkgadvY+3HKdIVOsSWmKyoBOjUXX7TQ=",
+			encodingTestEnglish},
+		{"json q11", "G+4H4CwK7Aa9hsh9IuCrVr4mrBY7o9tj0in5cyG3MojbImEtZJtFp6tPgPAPdluub3257ZACK6BEC7O2FAMP2QSl+QiOLZ38dTnre4XLFtxXj1cSv8JDQxMFZCFVRBczJezSnDLcsrxy7/j5G/zgT+DNRCvJTnZS3Kk9abxpfeWGrCmWkWAmWkl2spPiTu1J403rKzdUTamMBDPRSrKTnRR3ak8ab1rfitsb",
+			encodingTestJSON()},
+		{"json q5", "oXA/ACBQb9ur7OXpI2Fn+CtLEDStbIVpgEJP90tPpQWrlAe6ZEDL5JNXGIODMRoPlnGcf70wetXRzvx919HG3up3fz+x+rdhrN7qFHNw1115vOp6elvCmCAG1IiTmXA2My5mwdWsuJkNd7PnnLuLF5/kqCJHFTmqyFFFjipyVJGjihxVMApGwSgYBaNgFIyCUTAKRsEqWSWrZJWsklWySlbJKtkR9/UA",
+			encodingTestJSON()},
+		{"json q1", "A/cDAICqqqrq/3QVkLM6gBGzrXq6OthBHdzAwA7mF7ebgfH//9yzag3bmXfZN37CMCAMRbcacSCI/bc7j2s7/1njfefxzRpdify1c8sa5+/vV5cl8mr7xfeTbfL6+OT6lHj0BwF3EuTOgt31Qu9uEAZ3ozC6m4TJ3SzM7hZhcUfuQu8FHwWKD0heaD4geqH6gOyF7gPCF8oPSF9oPyB+of6A/IX+AxagsAEDKTKQIgMpMpAiAykykCIDKTKQIgMpMpAiAys2sGIDKzawYgMrNrBiAys2sGIDKzawYv8/6zM=",
+			encodingTestJSON()},
+		// one uncompressed meta-block
+		{"uncompressed", "iwKAaGVsbG8KAw==", "hello\n"},
+		{"empty", "Bg==", ""},
+	}
+	for _, c := range cases {
+		decoded, err := brotliDecode(decodeBase64(c.compressed), 1<<20)
+		assert.NoError(t, err, c.name)
+		assert.Equal(t, c.text, string(decoded), c.name)
+	}
+
+	compressed := decodeBase64(cases[0].compressed)
+	_, err := brotliDecode(compressed[:len(compressed)-5], 1<<20)
+	assert.Error(t, err)
+	_, err = brotliDecode(compressed, 100)
+	assert.Equal(t, errDecodedTooLarge, err)
+}
+
+func TestBrotliDictionary(t *testing.T) {
+	dictionary := brotliStaticDictionary()
+	assert.Equal(t, brotliDictionarySize, len(dictionary))
+	hash := sha256.Sum256(dictionary)
+	assert.Equal(t, "20e42eb1b511c21806d4d227d07e5dd06877d8ce7b3a817f378f313653f35c70", hex.EncodeToString(hash[:]))
+}
+
+func TestZstdDecode(t *testing.T) {
+	// with content checksum
+	english := decodeBase64("KLUv/QRoHQMAokYVF4BrG8CgUmS220Zm38UXx4oJWAyKOuAJgJDLUOfLN6vnSrgUHz6Amq5jjIsv3M622hwn/LI2ZM1qhwsHG4ciXE+kvfPxm4W55A+rr8OdrhTqmCdCBAMAOaUc6lo9OKkywkCYVA==")
+	decoded, err := zstdDecode(english, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, encodingTestEnglish, string(decoded))
+
+	// literals compressed by huffman, in four streams
+	lines := decodeBase64("KLUv/QBoHQcAwg8mE6AledE4pL/pP4jIZu92I9Sh+wpCd/J3NLn4hbwYbxg94YejkaPHoocdPWAKMirI2rrGR4sFMZO4dR6OJpEnFjlXD3Wj2D+yR6MBW1owYD/YN8cVkZ06N/loJ81bzEZP2ERij7sMH+fFIcjeJcto8V3xKFVnco4mkd4tN3rOvDGKvyMxejSOWDUqePej1qXUaAk0SlMGAUE9qBCIEl0QPUAraNIGgAJBHz8GA1uA0Rn9GmEUxsj0aIaRSSPWhuUVjD7woXmsjVF0+w1GQB2SElVb5eEn1Fpmo5aO8F9siCk=")
+	decoded, err = zstdDecode(lines, 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, encodingTestLines(), string(decoded))
+
+	// frames are concatenated, skippable frames are ignored
+	skippable := []byte{0x50, 0x2a, 0x4d, 0x18, 3, 0, 0, 0, 1, 2, 3}
+	decoded, err = zstdDecode(append(append(append([]byte{}, english...), skippable...), lines...), 1<<20)
+	assert.NoError(t, err)
+	assert.Equal(t, encodingTestEnglish+encodingTestLines(), string(decoded))
+
+	corrupted := append([]byte{}, english...)
+	corrupted[len(corrupted)-1] ^= 1
+	_, err = zstdDecode(corrupted, 1<<20)
+	assert.EqualError(t, err, "zstd: checksum mismatch")
+	_, err = zstdDecode(english[:50], 1<<20)
+	assert.Error(t, err)
+	_, err = zstdDecode(lines, 100)
+	assert.Equal(t, errDecodedTooLarge, err)
+}
+
+func TestXXH64(t *testing.T) {
+	assert.Equal(t, uint64(0xef46db3751d8e999), xxh64(nil))
+	assert.Equal(t, uint64(0xd24ec4f1a98c6e5b), xxh64([]byte("a")))
+	assert.Equal(t, uint64(0x44bc2cf5ad770999), xxh64([]byte("abc")))
+}
+
+func TestDecodeContent(t *testing.T) {
+	header := httpport.Header{"Content-Encoding": []string{"br, identity", "Gzip"}}
+	assert.Equal(t, []string{"br", "gzip"}, parseContentEncodings(header))
+
+	// br applied first, then gzip
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(decodeBase64("G80AAKwOeNPQq2y6hNg98SVVGVqSmbGVAkiDnOHpqbC3BnGZy+uUA4e22gLJf6JnTPcYO1MSw3GsgxO1aBodGZaH7tMCej67K9osXn/4t44B"))
+	writer.Close()
+	decoded, err := decodeContent(compressed.Bytes(), []string{"br", "gzip"})
+	assert.NoError(t, err)
+	assert.Equal(t, encodingTestEnglish, string(decoded))
+
+	_, err = decodeContent(compressed.Bytes(), []string{"gzip", "br"})
+	assert.EqualError(t, err, "br: brotli: invalid data")
+	_, err = decodeContent([]byte("data"), []string{"compress"})
+	assert.EqualError(t, err, "compress: unsupported encoding")
+	_, err = decodeContent([]byte("data"), []string{"gzip", "gzip", "gzip", "gzip", "gzip"})
+	assert.Error(t, err)
+
+	// raw deflate data without zlib header
+	decoded, err = decodeContent([]byte{0xcb, 0x48, 0xcd, 0xc9, 0xc9, 0x07, 0x00}, []string{"deflate"})
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(decoded))
+}
+
+func TestDecodeContentBomb(t *testing.T) {
+	// 100MB zeros
+	bomb := decodeBase64("z///f/gnAOKxQCD3/p/////wTwDEYQGA7v0/////4Z8AiMMiAN37f/7//8M/ARCHBQC69//8//+HfwIgDgsAdO//8x+8Hv8EQBwWAOhi1wM=")
+	_, err := decodeContent(bomb, []string{"br"})
+	assert.True(t, errors.Is(err, errDecodedTooLarge))
+
+	// rle blocks of 128KB zeros
+	zstdBomb := []byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58}
+	for i := 0; i < 800; i++ {
+		header := uint32(1)<<1 | uint32(128<<10)<<3
+		if i == 799 {
+			header |= 1
+		}
+		zstdBomb = append(zstdBomb, byte(header), byte(header>>8), byte(header>>16), 0)
+	}
+	_, err = decodeContent(zstdBomb, []string{"zstd"})
+	assert.True(t, errors.Is(err, errDecodedTooLarge))
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write(make([]byte, maxDecodedBodySize+1))
+	writer.Close()
+	_, err = decodeContent(compressed.Bytes(), []string{"gzip"})
+	assert.True(t, errors.Is(err, errDecodedTooLarge))
+}
+
+func TestConversationContentEncoding(t *testing.T) {
+	body := string(decodeBase64("KLUv/QRoHQMAokYVF4BrG8CgUmS220Zm38UXx4oJWAyKOuAJgJDLUOfLN6vnSrgUHz6Amq5jjIsv3M622hwn/LI2ZM1qhwsHG4ciXE+kvfPxm4W55A+rr8OdrhTqmCdCBAMAOaUc6lo9OKkywkCYVA=="))
+	response := "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Encoding: zstd\r\nContent-Length: " +
+		strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(testRequest, response, 1460).
+		close()
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "\n\n"+encodingTestEnglish)
+
+	// decoding failed
+	response = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Encoding: br\r\nContent-Length: 5\r\n\r\nhello"
+	conversation = newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(testRequest, response, 1460).
+		close()
+	output = runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "\n\n{Decode content-encoding failed: br: brotli: unexpected end of data , len: 5 }\n")
+}
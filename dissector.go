@@ -0,0 +1,82 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Dissector parse one application protocol from tcp connections.
+// The assembler detect the protocol by the first data of a connection sent by either side, and the connection is
+// routed to the first dissector which recognise the data. Data before it are ignored
+type Dissector interface {
+	// if the data, the first payload of a connection, start the protocol. fromClient is if the data is sent by
+	// the side which start the connection, or, if the connection start is not captured, guessed to be the client
+	detect(data []byte, fromClient bool) bool
+	// read both streams of the connection to the end, and send output to printer. key is client to server
+	handle(key ConnectionKey, connection *TCPConnection)
+}
+
+// dissectors of protocols to parse, in the order to be tried
+func newDissectors(option *Option, printer *Printer) []Dissector {
+	return []Dissector{
+		&httpDissector{option: option, printer: printer},
+		&redisDissector{option: option, printer: printer},
+		&mysqlDissector{option: option, printer: printer},
+		&postgresDissector{option: option, printer: printer},
+	}
+}
+
+// the first dissector recognise the data, nil if none
+func detectDissector(dissectors []Dissector, data []byte, fromClient bool) Dissector {
+	for _, dissector := range dissectors {
+		if dissector.detect(data, fromClient) {
+			return dissector
+		}
+	}
+	return nil
+}
+
+// if filters of http (host, uri, status) are set, which connections of other protocols never match
+func httpFiltersSet(option *Option) bool {
+	return option.Host != "" || option.Uri != "" || option.StatusSet != nil
+}
+
+// DissectorConnectionHandler impl ConnectionHandler, hand each connection to the dissector detected
+type DissectorConnectionHandler struct {
+	option  *Option
+	printer *Printer
+}
+
+func (handler *DissectorConnectionHandler) handle(src Endpoint, dst Endpoint, connection *TCPConnection) {
+	waitGroup.Add(1)
+	go handler.run(connection)
+}
+
+func (handler *DissectorConnectionHandler) run(connection *TCPConnection) {
+	defer waitGroup.Done()
+	// the client is known after the protocol is detected
+	<-connection.detected
+	key := ConnectionKey{connection.clientID, connection.serverID()}
+	if connection.proxy != nil && connection.proxy.hasAddress {
+		// connection from load balancer, show the original client
+		key.src = connection.proxy.source
+	}
+	if connection.dissector != nil {
+		connection.dissector.handle(key, connection)
+	}
+	// connection without data detected, or dissector stop parsing, read the rest so the connection can end
+	discardAll(connection.upStream)
+	discardAll(connection.downStream)
+	connection.upStream.Close()
+	connection.downStream.Close()
+
+	if handler.option.TcpStats {
+		// the stats are complete after streams are drained
+		handler.printer.send(fmt.Sprintln(strings.Repeat("*", 10), " CONNECTION ", key.srcString(), " <----> ",
+			key.dstString(), " // ", connection.stats.format(connection.clientID, &connection.upStream.stats,
+				&connection.downStream.stats)))
+	}
+}
+
+func (handler *DissectorConnectionHandler) finish() {
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// bannerDissector recognise protocols server send a greeting first, such as smtp
+type bannerDissector struct {
+	printer *Printer
+}
+
+func (d *bannerDissector) detect(data []byte, fromClient bool) bool {
+	return !fromClient && strings.HasPrefix(string(data), "220 ")
+}
+
+func (d *bannerDissector) handle(key ConnectionKey, connection *TCPConnection) {
+	up, _ := ioutil.ReadAll(connection.upStream)
+	down, _ := ioutil.ReadAll(connection.downStream)
+	d.printer.send(key.srcString() + " -> " + key.dstString() + "\n" + string(up) + string(down))
+}
+
+func runDissectors(conversation *tcpConversation) string {
+	printer := &Printer{outputQueue: make(chan string, 16)}
+	handler := &DissectorConnectionHandler{option: &Option{}, printer: printer}
+	assembler := newTCPAssembler(handler, 2, time.Minute)
+	assembler.dissectors = []Dissector{&httpDissector{option: &Option{}, printer: printer},
+		&bannerDissector{printer: printer}}
+	for _, packet := range conversation.packets {
+		assembler.assemble(packet.src, packet.dst, packet.tcp, packet.timestamp)
+	}
+	assembler.finishAll()
+	waitGroup.Wait()
+	close(printer.outputQueue)
+
+	var output string
+	for msg := range printer.outputQueue {
+		output += msg
+	}
+	return output
+}
+
+func TestDissectorServerFirst(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.handshake()
+	conversation.add(conversation.send(false, "220 ready\r\n", 1460)...)
+	conversation.add(conversation.send(true, "HELO test\r\n", 1460)...)
+	conversation.close()
+	assert.Equal(t, "10.0.0.1:10000 -> 10.0.0.2:80\nHELO test\r\n220 ready\r\n", runDissectors(conversation))
+
+	// connection start not captured, the client is the side not sending the greeting
+	conversation = newTCPConversation(10000, 1000, 5000)
+	conversation.add(conversation.send(false, "220 ready\r\n", 1460)...)
+	conversation.add(conversation.send(true, "HELO test\r\n", 1460)...)
+	conversation.close()
+	assert.Equal(t, "10.0.0.1:10000 -> 10.0.0.2:80\nHELO test\r\n220 ready\r\n", runDissectors(conversation))
+
+	// data not recognised by any dissector is ignored
+	conversation = newTCPConversation(10000, 1000, 5000)
+	conversation.handshake()
+	conversation.add(conversation.send(false, "SSH-2.0-OpenSSH\r\n", 1460)...)
+	conversation.close()
+	assert.Equal(t, "", runDissectors(conversation))
+}
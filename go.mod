@@ -3,9 +3,15 @@ module github.com/hsiafan/httpdump
 require (
 	github.com/google/gopacket v1.1.16
 	github.com/hsiafan/glow v1.3.2
-	github.com/mdlayher/raw v0.1.0 // indirect
 	github.com/stretchr/testify v1.6.1
 	golang.org/x/text v0.3.0
 )
 
-go 1.13
+require (
+	github.com/davecgh/go-spew v1.1.0 // indirect
+	github.com/mdlayher/raw v0.1.0 // indirect
+	github.com/pmezard/go-difflib v1.0.0 // indirect
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c // indirect
+)
+
+go 1.18
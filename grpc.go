@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// each grpc message has a prefix: compressed flag, and message length
+const grpcMessagePrefixLen = 5
+
+var grpcStatusNames = []string{"OK", "CANCELLED", "UNKNOWN", "INVALID_ARGUMENT", "DEADLINE_EXCEEDED", "NOT_FOUND",
+	"ALREADY_EXISTS", "PERMISSION_DENIED", "RESOURCE_EXHAUSTED", "FAILED_PRECONDITION", "ABORTED", "OUT_OF_RANGE",
+	"UNIMPLEMENTED", "INTERNAL", "UNAVAILABLE", "DATA_LOSS", "UNAUTHENTICATED"}
+
+// if is content type of grpc: application/grpc, or application/grpc+proto, etc.
+func isGRPCContentType(contentType string) bool {
+	mimeType, _ := parseContentType(strings.ToLower(contentType))
+	return mimeType == "application/grpc" || strings.HasPrefix(mimeType, "application/grpc+")
+}
+
+// grpcMessage is a length-prefixed message in grpc request or response body
+type grpcMessage struct {
+	compressed bool
+	data       []byte
+}
+
+// split body to messages. rest is the data of the last message not complete
+func splitGRPCMessages(body []byte) (messages []grpcMessage, rest []byte) {
+	for len(body) >= grpcMessagePrefixLen {
+		length := binary.BigEndian.Uint32(body[1:])
+		if uint64(length) > uint64(len(body)-grpcMessagePrefixLen) {
+			break
+		}
+		messages = append(messages, grpcMessage{
+			compressed: body[0]&1 != 0,
+			data:       body[grpcMessagePrefixLen : grpcMessagePrefixLen+int(length)],
+		})
+		body = body[grpcMessagePrefixLen+int(length):]
+	}
+	return messages, body
+}
+
+// decompress message by grpc-encoding
+func decompressGRPCMessage(data []byte, encoding string) ([]byte, error) {
+	switch encoding {
+	case "gzip":
+		reader, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	case "deflate":
+		reader, err := zlib.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	case "", "identity":
+		return data, nil
+	default:
+		return nil, errors.New("unsupported grpc-encoding: " + encoding)
+	}
+}
+
+// grpc-status with the name of status code, such as: 5 (NOT_FOUND)
+func grpcStatusText(status string) string {
+	code, err := strconv.Atoi(status)
+	if err != nil || code < 0 || code >= len(grpcStatusNames) {
+		return status
+	}
+	return status + " (" + grpcStatusNames[code] + ")"
+}
+
+// grpc-message is percent-encoded
+func decodeGRPCMessage(message string) string {
+	decoded, err := url.PathUnescape(message)
+	if err != nil {
+		return message
+	}
+	return decoded
+}
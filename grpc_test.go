@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsGRPCContentType(t *testing.T) {
+	assert.True(t, isGRPCContentType("application/grpc"))
+	assert.True(t, isGRPCContentType("application/grpc+proto"))
+	assert.True(t, isGRPCContentType("Application/GRPC; charset=utf-8"))
+	assert.False(t, isGRPCContentType("application/grpc-web"))
+	assert.False(t, isGRPCContentType("application/json"))
+}
+
+func TestSplitGRPCMessages(t *testing.T) {
+	body := []byte{0, 0, 0, 0, 2, 0x08, 0x01, 1, 0, 0, 0, 0, 0, 0, 0, 0, 9, 0x08}
+	messages, rest := splitGRPCMessages(body)
+	assert.Equal(t, []grpcMessage{{data: []byte{0x08, 0x01}}, {compressed: true, data: []byte{}}}, messages)
+	assert.Equal(t, []byte{0, 0, 0, 0, 9, 0x08}, rest)
+}
+
+func TestGRPCStatus(t *testing.T) {
+	assert.Equal(t, "0 (OK)", grpcStatusText("0"))
+	assert.Equal(t, "5 (NOT_FOUND)", grpcStatusText("5"))
+	assert.Equal(t, "99", grpcStatusText("99"))
+	assert.Equal(t, "user 42 not found", decodeGRPCMessage("user%2042%20not%20found"))
+	assert.Equal(t, "100%", decodeGRPCMessage("100%"))
+}
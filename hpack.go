@@ -0,0 +1,386 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+)
+
+// hpackField is a header field decoded from a HPACK header block
+type hpackField struct {
+	name  string
+	value string
+}
+
+// the initial max size of dynamic table, before size update
+const hpackDefaultTableSize = 4096
+
+var errHPACKTruncated = errors.New("hpack: header block truncated")
+
+// hpackDecoder decode header blocks of one direction (RFC 7541).
+// The dynamic table is shared by all header blocks of the direction, so all blocks should be decoded in order
+type hpackDecoder struct {
+	dynamic []hpackField // the newest entry is the last
+	size    int
+	maxSize int
+}
+
+func newHPACKDecoder() *hpackDecoder {
+	return &hpackDecoder{maxSize: hpackDefaultTableSize}
+}
+
+// decode a complete header block
+func (d *hpackDecoder) decode(block []byte) ([]hpackField, error) {
+	var fields []hpackField
+	for len(block) > 0 {
+		b := block[0]
+		switch {
+		case b&0x80 != 0:
+			// indexed header field
+			index, rest, err := hpackReadInt(block, 7)
+			if err != nil {
+				return nil, err
+			}
+			field, err := d.field(index)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			block = rest
+		case b&0xc0 == 0x40:
+			// literal with incremental indexing
+			field, rest, err := d.readLiteral(block, 6)
+			if err != nil {
+				return nil, err
+			}
+			d.add(field)
+			fields = append(fields, field)
+			block = rest
+		case b&0xe0 == 0x20:
+			// dynamic table size update
+			size, rest, err := hpackReadInt(block, 5)
+			if err != nil {
+				return nil, err
+			}
+			d.maxSize = int(size)
+			d.evict()
+			block = rest
+		default:
+			// literal without indexing, or never indexed
+			field, rest, err := d.readLiteral(block, 4)
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, field)
+			block = rest
+		}
+	}
+	return fields, nil
+}
+
+// field by index, static table first, then dynamic table from the newest
+func (d *hpackDecoder) field(index uint64) (hpackField, error) {
+	if index == 0 {
+		return hpackField{}, errors.New("hpack: index 0")
+	}
+	if index <= uint64(len(hpackStaticTable)) {
+		return hpackStaticTable[index-1], nil
+	}
+	index -= uint64(len(hpackStaticTable))
+	if index > uint64(len(d.dynamic)) {
+		return hpackField{}, errors.New("hpack: index out of table: " + strconv.FormatUint(index, 10))
+	}
+	return d.dynamic[len(d.dynamic)-int(index)], nil
+}
+
+// read a literal field, with name index in prefix bits
+func (d *hpackDecoder) readLiteral(block []byte, prefix uint) (hpackField, []byte, error) {
+	index, rest, err := hpackReadInt(block, prefix)
+	if err != nil {
+		return hpackField{}, nil, err
+	}
+	var field hpackField
+	if index > 0 {
+		indexed, err := d.field(index)
+		if err != nil {
+			return hpackField{}, nil, err
+		}
+		field.name = indexed.name
+	} else if field.name, rest, err = hpackReadString(rest); err != nil {
+		return hpackField{}, nil, err
+	}
+	if field.value, rest, err = hpackReadString(rest); err != nil {
+		return hpackField{}, nil, err
+	}
+	return field, rest, nil
+}
+
+func (d *hpackDecoder) add(field hpackField) {
+	d.dynamic = append(d.dynamic, field)
+	d.size += hpackEntrySize(field)
+	d.evict()
+}
+
+// remove the oldest entries until the table fit max size
+func (d *hpackDecoder) evict() {
+	evicted := 0
+	for d.size > d.maxSize && evicted < len(d.dynamic) {
+		d.size -= hpackEntrySize(d.dynamic[evicted])
+		evicted++
+	}
+	if evicted > 0 {
+		d.dynamic = append([]hpackField(nil), d.dynamic[evicted:]...)
+	}
+}
+
+func hpackEntrySize(field hpackField) int {
+	return len(field.name) + len(field.value) + 32
+}
+
+// read an integer with prefix bits in the first byte
+func hpackReadInt(data []byte, prefix uint) (uint64, []byte, error) {
+	if len(data) == 0 {
+		return 0, nil, errHPACKTruncated
+	}
+	mask := uint64(1)<<prefix - 1
+	value := uint64(data[0]) & mask
+	data = data[1:]
+	if value < mask {
+		return value, data, nil
+	}
+	for shift := uint(0); ; shift += 7 {
+		if len(data) == 0 {
+			return 0, nil, errHPACKTruncated
+		}
+		if shift > 56 {
+			return 0, nil, errors.New("hpack: integer overflow")
+		}
+		b := data[0]
+		data = data[1:]
+		value += uint64(b&0x7f) << shift
+		if b&0x80 == 0 {
+			return value, data, nil
+		}
+	}
+}
+
+// read a string literal, which may be huffman encoded
+func hpackReadString(data []byte) (string, []byte, error) {
+	if len(data) == 0 {
+		return "", nil, errHPACKTruncated
+	}
+	huffman := data[0]&0x80 != 0
+	length, rest, err := hpackReadInt(data, 7)
+	if err != nil {
+		return "", nil, err
+	}
+	if length > uint64(len(rest)) {
+		return "", nil, errHPACKTruncated
+	}
+	value := rest[:length]
+	rest = rest[length:]
+	if !huffman {
+		return string(value), rest, nil
+	}
+	decoded, err := hpackHuffmanDecode(value)
+	if err != nil {
+		return "", nil, err
+	}
+	return string(decoded), rest, nil
+}
+
+// hpackHuffmanNode is node of the huffman decoding tree. Leaf has no children
+type hpackHuffmanNode struct {
+	children [2]*hpackHuffmanNode
+	symbol   int
+}
+
+var hpackHuffmanRoot *hpackHuffmanNode
+var hpackHuffmanOnce sync.Once
+
+// build the decoding tree from codes
+func buildHPACKHuffmanTree() {
+	hpackHuffmanRoot = &hpackHuffmanNode{}
+	for symbol, code := range hpackHuffmanCodes {
+		node := hpackHuffmanRoot
+		for i := int(code.length) - 1; i >= 0; i-- {
+			bit := (code.code >> uint(i)) & 1
+			if node.children[bit] == nil {
+				node.children[bit] = &hpackHuffmanNode{}
+			}
+			node = node.children[bit]
+		}
+		node.symbol = symbol
+	}
+}
+
+func hpackHuffmanDecode(data []byte) ([]byte, error) {
+	hpackHuffmanOnce.Do(buildHPACKHuffmanTree)
+	decoded := make([]byte, 0, len(data)*8/5)
+	node := hpackHuffmanRoot
+	// bits consumed since last symbol, and if they are all 1
+	pending, allOnes := 0, true
+	for _, b := range data {
+		for i := 7; i >= 0; i-- {
+			bit := (b >> uint(i)) & 1
+			node = node.children[bit]
+			if node == nil {
+				return nil, errors.New("hpack: invalid huffman code")
+			}
+			pending++
+			allOnes = allOnes && bit == 1
+			if node.children[0] != nil || node.children[1] != nil {
+				continue
+			}
+			if node.symbol == hpackHuffmanEOS {
+				return nil, errors.New("hpack: huffman EOS in string")
+			}
+			decoded = append(decoded, byte(node.symbol))
+			node, pending, allOnes = hpackHuffmanRoot, 0, true
+		}
+	}
+	// padding is the most significant bits of EOS, no more than 7 bits
+	if pending > 7 || !allOnes {
+		return nil, errors.New("hpack: invalid huffman padding")
+	}
+	return decoded, nil
+}
+
+var hpackStaticTable = []hpackField{
+	{":authority", ""},
+	{":method", "GET"},
+	{":method", "POST"},
+	{":path", "/"},
+	{":path", "/index.html"},
+	{":scheme", "http"},
+	{":scheme", "https"},
+	{":status", "200"},
+	{":status", "204"},
+	{":status", "206"},
+	{":status", "304"},
+	{":status", "400"},
+	{":status", "404"},
+	{":status", "500"},
+	{"accept-charset", ""},
+	{"accept-encoding", "gzip, deflate"},
+	{"accept-language", ""},
+	{"accept-ranges", ""},
+	{"accept", ""},
+	{"access-control-allow-origin", ""},
+	{"age", ""},
+	{"allow", ""},
+	{"authorization", ""},
+	{"cache-control", ""},
+	{"content-disposition", ""},
+	{"content-encoding", ""},
+	{"content-language", ""},
+	{"content-length", ""},
+	{"content-location", ""},
+	{"content-range", ""},
+	{"content-type", ""},
+	{"cookie", ""},
+	{"date", ""},
+	{"etag", ""},
+	{"expect", ""},
+	{"expires", ""},
+	{"from", ""},
+	{"host", ""},
+	{"if-match", ""},
+	{"if-modified-since", ""},
+	{"if-none-match", ""},
+	{"if-range", ""},
+	{"if-unmodified-since", ""},
+	{"last-modified", ""},
+	{"link", ""},
+	{"location", ""},
+	{"max-forwards", ""},
+	{"proxy-authenticate", ""},
+	{"proxy-authorization", ""},
+	{"range", ""},
+	{"referer", ""},
+	{"refresh", ""},
+	{"retry-after", ""},
+	{"server", ""},
+	{"set-cookie", ""},
+	{"strict-transport-security", ""},
+	{"transfer-encoding", ""},
+	{"user-agent", ""},
+	{"vary", ""},
+	{"via", ""},
+	{"www-authenticate", ""},
+}
+
+// symbol of end of string
+const hpackHuffmanEOS = 256
+
+// huffman codes of symbols 0-255 and EOS, in RFC 7541 Appendix B
+var hpackHuffmanCodes = [257]struct {
+	code   uint32
+	length uint8
+}{
+	{0x1ff8, 13}, {0x7fffd8, 23}, {0xfffffe2, 28}, {0xfffffe3, 28},
+	{0xfffffe4, 28}, {0xfffffe5, 28}, {0xfffffe6, 28}, {0xfffffe7, 28},
+	{0xfffffe8, 28}, {0xffffea, 24}, {0x3ffffffc, 30}, {0xfffffe9, 28},
+	{0xfffffea, 28}, {0x3ffffffd, 30}, {0xfffffeb, 28}, {0xfffffec, 28},
+	{0xfffffed, 28}, {0xfffffee, 28}, {0xfffffef, 28}, {0xffffff0, 28},
+	{0xffffff1, 28}, {0xffffff2, 28}, {0x3ffffffe, 30}, {0xffffff3, 28},
+	{0xffffff4, 28}, {0xffffff5, 28}, {0xffffff6, 28}, {0xffffff7, 28},
+	{0xffffff8, 28}, {0xffffff9, 28}, {0xffffffa, 28}, {0xffffffb, 28},
+	{0x14, 6}, {0x3f8, 10}, {0x3f9, 10}, {0xffa, 12},
+	{0x1ff9, 13}, {0x15, 6}, {0xf8, 8}, {0x7fa, 11},
+	{0x3fa, 10}, {0x3fb, 10}, {0xf9, 8}, {0x7fb, 11},
+	{0xfa, 8}, {0x16, 6}, {0x17, 6}, {0x18, 6},
+	{0x0, 5}, {0x1, 5}, {0x2, 5}, {0x19, 6},
+	{0x1a, 6}, {0x1b, 6}, {0x1c, 6}, {0x1d, 6},
+	{0x1e, 6}, {0x1f, 6}, {0x5c, 7}, {0xfb, 8},
+	{0x7ffc, 15}, {0x20, 6}, {0xffb, 12}, {0x3fc, 10},
+	{0x1ffa, 13}, {0x21, 6}, {0x5d, 7}, {0x5e, 7},
+	{0x5f, 7}, {0x60, 7}, {0x61, 7}, {0x62, 7},
+	{0x63, 7}, {0x64, 7}, {0x65, 7}, {0x66, 7},
+	{0x67, 7}, {0x68, 7}, {0x69, 7}, {0x6a, 7},
+	{0x6b, 7}, {0x6c, 7}, {0x6d, 7}, {0x6e, 7},
+	{0x6f, 7}, {0x70, 7}, {0x71, 7}, {0x72, 7},
+	{0xfc, 8}, {0x73, 7}, {0xfd, 8}, {0x1ffb, 13},
+	{0x7fff0, 19}, {0x1ffc, 13}, {0x3ffc, 14}, {0x22, 6},
+	{0x7ffd, 15}, {0x3, 5}, {0x23, 6}, {0x4, 5},
+	{0x24, 6}, {0x5, 5}, {0x25, 6}, {0x26, 6},
+	{0x27, 6}, {0x6, 5}, {0x74, 7}, {0x75, 7},
+	{0x28, 6}, {0x29, 6}, {0x2a, 6}, {0x7, 5},
+	{0x2b, 6}, {0x76, 7}, {0x2c, 6}, {0x8, 5},
+	{0x9, 5}, {0x2d, 6}, {0x77, 7}, {0x78, 7},
+	{0x79, 7}, {0x7a, 7}, {0x7b, 7}, {0x7ffe, 15},
+	{0x7fc, 11}, {0x3ffd, 14}, {0x1ffd, 13}, {0xffffffc, 28},
+	{0xfffe6, 20}, {0x3fffd2, 22}, {0xfffe7, 20}, {0xfffe8, 20},
+	{0x3fffd3, 22}, {0x3fffd4, 22}, {0x3fffd5, 22}, {0x7fffd9, 23},
+	{0x3fffd6, 22}, {0x7fffda, 23}, {0x7fffdb, 23}, {0x7fffdc, 23},
+	{0x7fffdd, 23}, {0x7fffde, 23}, {0xffffeb, 24}, {0x7fffdf, 23},
+	{0xffffec, 24}, {0xffffed, 24}, {0x3fffd7, 22}, {0x7fffe0, 23},
+	{0xffffee, 24}, {0x7fffe1, 23}, {0x7fffe2, 23}, {0x7fffe3, 23},
+	{0x7fffe4, 23}, {0x1fffdc, 21}, {0x3fffd8, 22}, {0x7fffe5, 23},
+	{0x3fffd9, 22}, {0x7fffe6, 23}, {0x7fffe7, 23}, {0xffffef, 24},
+	{0x3fffda, 22}, {0x1fffdd, 21}, {0xfffe9, 20}, {0x3fffdb, 22},
+	{0x3fffdc, 22}, {0x7fffe8, 23}, {0x7fffe9, 23}, {0x1fffde, 21},
+	{0x7fffea, 23}, {0x3fffdd, 22}, {0x3fffde, 22}, {0xfffff0, 24},
+	{0x1fffdf, 21}, {0x3fffdf, 22}, {0x7fffeb, 23}, {0x7fffec, 23},
+	{0x1fffe0, 21}, {0x1fffe1, 21}, {0x3fffe0, 22}, {0x1fffe2, 21},
+	{0x7fffed, 23}, {0x3fffe1, 22}, {0x7fffee, 23}, {0x7fffef, 23},
+	{0xfffea, 20}, {0x3fffe2, 22}, {0x3fffe3, 22}, {0x3fffe4, 22},
+	{0x7ffff0, 23}, {0x3fffe5, 22}, {0x3fffe6, 22}, {0x7ffff1, 23},
+	{0x3ffffe0, 26}, {0x3ffffe1, 26}, {0xfffeb, 20}, {0x7fff1, 19},
+	{0x3fffe7, 22}, {0x7ffff2, 23}, {0x3fffe8, 22}, {0x1ffffec, 25},
+	{0x3ffffe2, 26}, {0x3ffffe3, 26}, {0x3ffffe4, 26}, {0x7ffffde, 27},
+	{0x7ffffdf, 27}, {0x3ffffe5, 26}, {0xfffff1, 24}, {0x1ffffed, 25},
+	{0x7fff2, 19}, {0x1fffe3, 21}, {0x3ffffe6, 26}, {0x7ffffe0, 27},
+	{0x7ffffe1, 27}, {0x3ffffe7, 26}, {0x7ffffe2, 27}, {0xfffff2, 24},
+	{0x1fffe4, 21}, {0x1fffe5, 21}, {0x3ffffe8, 26}, {0x3ffffe9, 26},
+	{0xffffffd, 28}, {0x7ffffe3, 27}, {0x7ffffe4, 27}, {0x7ffffe5, 27},
+	{0xfffec, 20}, {0xfffff3, 24}, {0xfffed, 20}, {0x1fffe6, 21},
+	{0x3fffe9, 22}, {0x1fffe7, 21}, {0x1fffe8, 21}, {0x7ffff3, 23},
+	{0x3fffea, 22}, {0x3fffeb, 22}, {0x1ffffee, 25}, {0x1ffffef, 25},
+	{0xfffff4, 24}, {0xfffff5, 24}, {0x3ffffea, 26}, {0x7ffff4, 23},
+	{0x3ffffeb, 26}, {0x7ffffe6, 27}, {0x3ffffec, 26}, {0x3ffffed, 26},
+	{0x7ffffe7, 27}, {0x7ffffe8, 27}, {0x7ffffe9, 27}, {0x7ffffea, 27},
+	{0x7ffffeb, 27}, {0xffffffe, 28}, {0x7ffffec, 27}, {0x7ffffed, 27},
+	{0x7ffffee, 27}, {0x7ffffef, 27}, {0x7fffff0, 27}, {0x3ffffee, 26},
+	{0x3fffffff, 30},
+}
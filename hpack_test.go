@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/hex"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func decodeHPACKHex(t *testing.T, decoder *hpackDecoder, data string) []hpackField {
+	block, err := hex.DecodeString(data)
+	assert.NoError(t, err)
+	fields, err := decoder.decode(block)
+	assert.NoError(t, err)
+	return fields
+}
+
+// examples in RFC 7541 Appendix C.4, requests with huffman coding
+func TestHPACKDecodeRequests(t *testing.T) {
+	decoder := newHPACKDecoder()
+	assert.Equal(t, []hpackField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"},
+		{":authority", "www.example.com"}},
+		decodeHPACKHex(t, decoder, "828684418cf1e3c2e5f23a6ba0ab90f4ff"))
+	assert.Equal(t, []hpackField{{":method", "GET"}, {":scheme", "http"}, {":path", "/"},
+		{":authority", "www.example.com"}, {"cache-control", "no-cache"}},
+		decodeHPACKHex(t, decoder, "828684be5886a8eb10649cbf"))
+	assert.Equal(t, []hpackField{{":method", "GET"}, {":scheme", "https"}, {":path", "/index.html"},
+		{":authority", "www.example.com"}, {"custom-key", "custom-value"}},
+		decodeHPACKHex(t, decoder, "828785bf408825a849e95ba97d7f8925a849e95bb8e8b4bf"))
+	assert.Equal(t, 164, decoder.size)
+	assert.Equal(t, 3, len(decoder.dynamic))
+}
+
+// examples in RFC 7541 Appendix C.6, responses with huffman coding and eviction
+func TestHPACKDecodeResponsesWithEviction(t *testing.T) {
+	decoder := newHPACKDecoder()
+	decoder.maxSize = 256
+	assert.Equal(t, []hpackField{{":status", "302"}, {"cache-control", "private"},
+		{"date", "Mon, 21 Oct 2013 20:13:21 GMT"}, {"location", "https://www.example.com"}},
+		decodeHPACKHex(t, decoder, "488264025885aec3771a4b6196d07abe941054d444a8200595040b8166e082a62d1bff6e919d"+
+			"29ad171863c78f0b97c8e9ae82ae43d3"))
+	assert.Equal(t, 222, decoder.size)
+	assert.Equal(t, []hpackField{{":status", "307"}, {"cache-control", "private"},
+		{"date", "Mon, 21 Oct 2013 20:13:21 GMT"}, {"location", "https://www.example.com"}},
+		decodeHPACKHex(t, decoder, "4883640effc1c0bf"))
+	assert.Equal(t, 222, decoder.size)
+	// size update to 0 clear the table
+	decodeHPACKHex(t, decoder, "20")
+	assert.Equal(t, 0, decoder.size)
+	assert.Equal(t, 0, len(decoder.dynamic))
+}
+
+func TestHPACKDecodeErrors(t *testing.T) {
+	for _, data := range []string{
+		"80",       // index 0
+		"c0",       // index out of table
+		"41",       // truncated literal
+		"418cf1e3", // truncated string
+		"0f",       // truncated integer
+		"4081ff80", // invalid huffman padding
+	} {
+		block, _ := hex.DecodeString(data)
+		_, err := newHPACKDecoder().decode(block)
+		assert.Error(t, err, data)
+	}
+}
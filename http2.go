@@ -0,0 +1,403 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hsiafan/httpdump/httpport"
+)
+
+// client send the connection preface before frames
+const http2Preface = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+
+// frame types
+const (
+	http2FrameData         = 0x0
+	http2FrameHeaders      = 0x1
+	http2FrameRSTStream    = 0x3
+	http2FramePushPromise  = 0x5
+	http2FrameContinuation = 0x9
+)
+
+// frame flags
+const (
+	http2FlagEndStream  = 0x1
+	http2FlagEndHeaders = 0x4
+	http2FlagPadded     = 0x8
+	http2FlagPriority   = 0x20
+)
+
+const http2FrameHeaderLen = 9
+
+var errHTTP2FrameInvalid = errors.New("http2: invalid frame")
+
+// if data is start of http2 connection with prior knowledge: the first line of connection preface
+func isHTTP2Preface(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(http2Preface[:16]))
+}
+
+// http2Frame is one frame of RFC 7540
+type http2Frame struct {
+	frameType byte
+	flags     byte
+	streamID  uint32
+	payload   []byte
+}
+
+func readHTTP2Frame(reader io.Reader) (*http2Frame, error) {
+	var header [http2FrameHeaderLen]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	length := uint32(header[0])<<16 | uint32(header[1])<<8 | uint32(header[2])
+	frame := &http2Frame{
+		frameType: header[3],
+		flags:     header[4],
+		streamID:  binary.BigEndian.Uint32(header[5:]) & 0x7fffffff,
+		payload:   make([]byte, length),
+	}
+	if _, err := io.ReadFull(reader, frame.payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return frame, nil
+}
+
+// payload of DATA, HEADERS and PUSH_PROMISE frame, with padding and priority fields removed
+func (f *http2Frame) data() ([]byte, error) {
+	payload := f.payload
+	padding := 0
+	if f.flags&http2FlagPadded != 0 {
+		if len(payload) == 0 {
+			return nil, errHTTP2FrameInvalid
+		}
+		padding = int(payload[0])
+		payload = payload[1:]
+	}
+	if f.frameType == http2FrameHeaders && f.flags&http2FlagPriority != 0 {
+		// stream dependency and weight
+		if len(payload) < 5 {
+			return nil, errHTTP2FrameInvalid
+		}
+		payload = payload[5:]
+	}
+	if padding > len(payload) {
+		return nil, errHTTP2FrameInvalid
+	}
+	return payload[:len(payload)-padding], nil
+}
+
+// body of stream larger than this is truncated, the data after it is discarded
+const maxHTTP2BodySize = maxEncodedBodySize
+
+// http2Message is the request or response of a stream
+type http2Message struct {
+	fields   []hpackField
+	trailers []hpackField
+	body     bytes.Buffer
+	// size of body data discarded for exceeding maxHTTP2BodySize
+	bodyTruncated int64
+	timing        messageTiming
+	ended         bool
+}
+
+// http2Stream is a request/response exchange on a stream
+type http2Stream struct {
+	id       uint32
+	request  *http2Message
+	interims []*http2Message // 1xx responses
+	response *http2Message
+	reset    bool
+}
+
+// http2Connection collect streams from frames of both directions of a h2c connection.
+// When a stream is finished, onStream is called, with the lock hold
+type http2Connection struct {
+	lock     sync.Mutex
+	streams  map[uint32]*http2Stream
+	onStream func(stream *http2Stream)
+}
+
+func newHTTP2Connection(onStream func(stream *http2Stream)) *http2Connection {
+	return &http2Connection{streams: map[uint32]*http2Stream{}, onStream: onStream}
+}
+
+// read the connection preface the client send
+func readHTTP2Preface(reader io.Reader) error {
+	var preface [len(http2Preface)]byte
+	if _, err := io.ReadFull(reader, preface[:]); err != nil {
+		return err
+	}
+	if string(preface[:]) != http2Preface {
+		return errors.New("http2: invalid connection preface")
+	}
+	return nil
+}
+
+// read frames of one direction until the stream end. Header blocks are decoded in order,
+// since HPACK dynamic table of each direction depends on all the blocks before
+func (c *http2Connection) readFrames(reader *streamReader, fromClient bool) error {
+	decoder := newHPACKDecoder()
+	var block []byte
+	var blockFrame *http2Frame // the HEADERS or PUSH_PROMISE frame start the block
+	var promisedID uint32
+	var blockStart time.Time
+	for {
+		start := reader.position()
+		frame, err := readHTTP2Frame(reader)
+		if err != nil {
+			return err
+		}
+		if blockFrame != nil && (frame.frameType != http2FrameContinuation || frame.streamID != blockFrame.streamID) {
+			return errors.New("http2: header block not continued")
+		}
+
+		switch frame.frameType {
+		case http2FrameData:
+			data, err := frame.data()
+			if err != nil {
+				return err
+			}
+			c.onData(frame.streamID, fromClient, data, reader.lastTimestamp(), frame.flags&http2FlagEndStream != 0)
+			continue
+		case http2FrameHeaders, http2FramePushPromise:
+			data, err := frame.data()
+			if err != nil {
+				return err
+			}
+			promisedID = 0
+			if frame.frameType == http2FramePushPromise {
+				if len(data) < 4 {
+					return errHTTP2FrameInvalid
+				}
+				promisedID = binary.BigEndian.Uint32(data) & 0x7fffffff
+				data = data[4:]
+			}
+			block = append([]byte(nil), data...)
+			blockFrame = frame
+			blockStart = reader.timestampAt(start)
+		case http2FrameContinuation:
+			if blockFrame == nil {
+				return errors.New("http2: unexpected CONTINUATION frame")
+			}
+			block = append(block, frame.payload...)
+		case http2FrameRSTStream:
+			c.onReset(frame.streamID)
+			continue
+		default:
+			// SETTINGS, PING, WINDOW_UPDATE, etc., not about the content
+			continue
+		}
+
+		if frame.flags&http2FlagEndHeaders == 0 {
+			continue
+		}
+		fields, err := decoder.decode(block)
+		if err != nil {
+			return err
+		}
+		if promisedID != 0 {
+			c.onPushPromise(promisedID, fields, blockStart, reader.lastTimestamp())
+		} else {
+			c.onHeaders(blockFrame.streamID, fromClient, fields, blockStart, reader.lastTimestamp(),
+				blockFrame.flags&http2FlagEndStream != 0)
+		}
+		blockFrame, block = nil, nil
+	}
+}
+
+func (c *http2Connection) stream(id uint32) *http2Stream {
+	stream := c.streams[id]
+	if stream == nil {
+		stream = &http2Stream{id: id}
+		c.streams[id] = stream
+	}
+	return stream
+}
+
+func (c *http2Connection) onHeaders(id uint32, fromClient bool, fields []hpackField, start, end time.Time,
+	endStream bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stream := c.stream(id)
+	message := stream.response
+	if fromClient {
+		message = stream.request
+	}
+	if message != nil {
+		message.trailers = append(message.trailers, fields...)
+	} else {
+		message = &http2Message{fields: fields, timing: messageTiming{firstByte: start, lastByte: end}}
+		if fromClient {
+			stream.request = message
+		} else if status := http2Status(fields); status >= 100 && status < 200 {
+			stream.interims = append(stream.interims, message)
+			return
+		} else {
+			stream.response = message
+		}
+	}
+	if endStream {
+		c.endMessage(stream, message, end)
+	}
+}
+
+func (c *http2Connection) onData(id uint32, fromClient bool, data []byte, end time.Time, endStream bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	stream := c.streams[id]
+	if stream == nil {
+		return
+	}
+	message := stream.response
+	if fromClient {
+		message = stream.request
+	}
+	if message == nil {
+		return
+	}
+	if room := maxHTTP2BodySize - message.body.Len(); len(data) > room {
+		message.bodyTruncated += int64(len(data) - room)
+		data = data[:room]
+	}
+	message.body.Write(data)
+	message.timing.lastByte = end
+	if endStream {
+		c.endMessage(stream, message, end)
+	}
+}
+
+// server push a response, with the request it promised
+func (c *http2Connection) onPushPromise(id uint32, fields []hpackField, start, end time.Time) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.stream(id).request = &http2Message{fields: fields, timing: messageTiming{firstByte: start, lastByte: end},
+		ended: true}
+}
+
+func (c *http2Connection) onReset(id uint32) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if stream := c.streams[id]; stream != nil {
+		stream.reset = true
+		c.finish(stream)
+	}
+}
+
+func (c *http2Connection) endMessage(stream *http2Stream, message *http2Message, end time.Time) {
+	message.ended = true
+	message.timing.lastByte = end
+	if stream.request != nil && stream.request.ended && stream.response != nil && stream.response.ended {
+		c.finish(stream)
+	}
+}
+
+func (c *http2Connection) finish(stream *http2Stream) {
+	delete(c.streams, stream.id)
+	c.onStream(stream)
+}
+
+// finish streams not finished when connection closed, in the order of stream id
+func (c *http2Connection) finishAll() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	var ids []uint32
+	for id := range c.streams {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		c.finish(c.streams[id])
+	}
+}
+
+// the :status of response headers
+func http2Status(fields []hpackField) int {
+	for _, field := range fields {
+		if field.name == ":status" {
+			status, _ := strconv.Atoi(field.value)
+			return status
+		}
+	}
+	return 0
+}
+
+// convert to http/1 request, so it can be printed the same way
+func (m *http2Message) toRequest() *httpport.Request {
+	req := &httpport.Request{Proto: "HTTP/2.0", ProtoMajor: 2, Header: httpport.Header{}}
+	for _, field := range m.fields {
+		switch field.name {
+		case ":method":
+			req.Method = field.value
+		case ":path":
+			req.RequestURI = field.value
+		case ":authority":
+			req.Host = field.value
+			req.Header.Add(field.name, field.value)
+		default:
+			req.Header.Add(field.name, field.value)
+		}
+		req.RawHeaders = append(req.RawHeaders, field.name+": "+field.value)
+	}
+	if req.Host == "" {
+		req.Host = req.Header.Get("Host")
+	}
+	req.RequestLine = req.Method + " " + req.RequestURI + " " + req.Proto
+	req.Body = ioutil.NopCloser(bytes.NewReader(m.body.Bytes()))
+	req.ContentLength = int64(m.body.Len())
+	return req
+}
+
+// convert to http/1 response, so it can be printed the same way
+func (m *http2Message) toResponse() *httpport.Response {
+	resp := &httpport.Response{Proto: "HTTP/2.0", ProtoMajor: 2, Header: httpport.Header{}}
+	for _, field := range m.fields {
+		if field.name == ":status" {
+			resp.StatusCode, _ = strconv.Atoi(field.value)
+			resp.Status = field.value
+			continue
+		}
+		resp.Header.Add(field.name, field.value)
+		resp.RawHeaders = append(resp.RawHeaders, http2FieldLine(field))
+	}
+	resp.StatusLine = resp.Proto + " " + resp.Status
+	resp.Body = ioutil.NopCloser(bytes.NewReader(m.body.Bytes()))
+	resp.ContentLength = int64(m.body.Len())
+	return resp
+}
+
+// header line to print. grpc status is shown with its name, and grpc message is decoded
+func http2FieldLine(field hpackField) string {
+	value := field.value
+	switch field.name {
+	case "grpc-status":
+		value = grpcStatusText(value)
+	case "grpc-message":
+		value = decodeGRPCMessage(value)
+	}
+	return field.name + ": " + value
+}
+
+// the request sent by http/1 with Upgrade: h2c, which is stream 1 after upgraded
+func http2UpgradeRequest(req *httpport.Request, timing messageTiming) *http2Message {
+	message := &http2Message{timing: timing, ended: true}
+	message.fields = append(message.fields, hpackField{":method", req.Method}, hpackField{":path", req.RequestURI},
+		hpackField{":authority", req.Host})
+	for name, values := range req.Header {
+		if name == "Host" {
+			// it is :authority in http/2
+			continue
+		}
+		for _, value := range values {
+			message.fields = append(message.fields, hpackField{strings.ToLower(name), value})
+		}
+	}
+	return message
+}
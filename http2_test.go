@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// encode a http2 frame
+func encodeHTTP2Frame(frameType, flags byte, streamID uint32, payload []byte) string {
+	var header [http2FrameHeaderLen]byte
+	header[0], header[1], header[2] = byte(len(payload)>>16), byte(len(payload)>>8), byte(len(payload))
+	header[3], header[4] = frameType, flags
+	binary.BigEndian.PutUint32(header[5:], streamID)
+	return string(header[:]) + string(payload)
+}
+
+// HPACK string literal without huffman coding, shorter than 127 bytes
+func hpackString(value string) []byte {
+	return append([]byte{byte(len(value))}, value...)
+}
+
+func TestHTTP2FrameData(t *testing.T) {
+	// padded HEADERS with priority
+	frame := &http2Frame{frameType: http2FrameHeaders, flags: http2FlagPadded | http2FlagPriority,
+		payload: []byte{2, 0, 0, 0, 1, 16, 0x82, 0x86, 0, 0}}
+	data, err := frame.data()
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{0x82, 0x86}, data)
+
+	// padding longer than payload
+	frame = &http2Frame{frameType: http2FrameData, flags: http2FlagPadded, payload: []byte{5, 'a'}}
+	_, err = frame.data()
+	assert.Error(t, err)
+}
+
+func TestIsHTTP2Preface(t *testing.T) {
+	assert.True(t, isHTTP2Preface([]byte(http2Preface)))
+	assert.True(t, isHTTP2Preface([]byte(http2Preface+"\x00\x00\x00\x04")))
+	assert.False(t, isHTTP2Preface([]byte("PRI * HTTP/2.0")))
+	assert.False(t, isHTTP2Preface([]byte("GET / HTTP/1.1\r\n")))
+}
+
+func TestHTTP2BodyTruncated(t *testing.T) {
+	var finished *http2Stream
+	connection := newHTTP2Connection(func(stream *http2Stream) { finished = stream })
+	now := time.Now()
+	connection.onHeaders(1, true, []hpackField{{":method", "POST"}, {":path", "/upload"}}, now, now, false)
+	data := make([]byte, 1<<20)
+	for i := 0; i < maxHTTP2BodySize>>20+2; i++ {
+		connection.onData(1, true, data, now, false)
+	}
+	connection.onData(1, true, []byte("end"), now, true)
+	connection.onHeaders(1, false, []hpackField{{":status", "204"}}, now, now, true)
+
+	assert.NotNil(t, finished)
+	assert.Equal(t, maxHTTP2BodySize, finished.request.body.Len())
+	assert.Equal(t, int64(2<<20+3), finished.request.bodyTruncated)
+}
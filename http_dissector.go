@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+)
+
+// httpDissector parse http/1 and h2c connections, and tls connections which may carry http when decrypted
+type httpDissector struct {
+	option  *Option
+	printer *Printer
+}
+
+// client send first: http request, http/2 preface, or tls ClientHello
+func (d *httpDissector) detect(data []byte, fromClient bool) bool {
+	if !fromClient {
+		return false
+	}
+	return isHTTPRequestData(data, d.option.ExtraMethods) || isHTTP2Preface(data) || isClientHelloRecord(data)
+}
+
+func (d *httpDissector) handle(key ConnectionKey, connection *TCPConnection) {
+	handler := &HTTPTrafficHandler{
+		key:     key,
+		buffer:  new(bytes.Buffer),
+		option:  d.option,
+		printer: d.printer,
+	}
+	handler.handle(connection)
+}
+
+// httpMethods are request methods recognised when detecting http connections:
+// methods of RFC 7231, PATCH, and methods of WebDAV and its extensions
+var httpMethods = map[string]bool{"GET": true, "POST": true, "PUT": true, "DELETE": true, "HEAD": true,
+	"TRACE": true, "OPTIONS": true, "PATCH": true, "CONNECT": true,
+	"PROPFIND": true, "PROPPATCH": true, "MKCOL": true, "COPY": true, "MOVE": true, "LOCK": true, "UNLOCK": true,
+	"REPORT": true, "SEARCH": true, "MKCALENDAR": true, "ACL": true, "BIND": true, "UNBIND": true, "REBIND": true,
+	"CHECKIN": true, "CHECKOUT": true, "UNCHECKOUT": true, "VERSION-CONTROL": true, "MKWORKSPACE": true,
+	"UPDATE": true, "LABEL": true, "MERGE": true, "MKACTIVITY": true, "BASELINE-CONTROL": true, "ORDERPATCH": true,
+	"MKREDIRECTREF": true, "UPDATEREDIRECTREF": true, "LINK": true, "UNLINK": true}
+
+// longest method name checked
+const maxMethodLen = 32
+
+// if is first http request packet: starts with a request line, with a known method.
+// If the request line is longer than the packet, such as a very long url, the part in the packet is checked
+func isHTTPRequestData(body []byte, extraMethods map[string]bool) bool {
+	head := body
+	if len(head) > maxMethodLen+1 {
+		head = head[:maxMethodLen+1]
+	}
+	idx := bytes.IndexByte(head, ' ')
+	if idx <= 0 {
+		return false
+	}
+	method := body[:idx]
+	if !httpMethods[string(method)] && !extraMethods[string(method)] {
+		return false
+	}
+
+	line := body[idx+1:]
+	complete := false
+	if end := bytes.IndexByte(line, '\n'); end >= 0 {
+		line = bytes.TrimSuffix(line[:end], []byte{'\r'})
+		complete = true
+	}
+	idx = bytes.IndexByte(line, ' ')
+	if idx < 0 {
+		return !complete && isRequestTarget(line)
+	}
+	if idx == 0 || !isRequestTarget(line[:idx]) {
+		return false
+	}
+	return isHTTPVersion(line[idx+1:], complete)
+}
+
+// if data is non-empty, and has no space or control character
+func isRequestTarget(data []byte) bool {
+	if len(data) == 0 {
+		return false
+	}
+	for _, c := range data {
+		if c <= ' ' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// if data is http version: HTTP/x.y. if complete is false, data can be a prefix of http version
+func isHTTPVersion(data []byte, complete bool) bool {
+	const pattern = "HTTP/0.0"
+	if len(data) > len(pattern) || complete && len(data) != len(pattern) {
+		return false
+	}
+	for i, c := range data {
+		if pattern[i] == '0' {
+			if c < '0' || c > '9' {
+				return false
+			}
+		} else if c != pattern[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// dissectors for tests which only need connections detected
+func httpDissectors() []Dissector {
+	return []Dissector{&httpDissector{option: &Option{}}}
+}
+
+func TestIsHTTPRequestData(t *testing.T) {
+	extra := map[string]bool{"PURGE": true}
+	for data, expected := range map[string]bool{
+		"GET / HTTP/1.1\r\nHost: test\r\n\r\n":             true,
+		"GET / HTTP/1.0\n\n":                               true,
+		"CONNECT example.com:443 HTTP/1.1\r\n\r\n":         true,
+		"PROPFIND /dav/ HTTP/1.1\r\n":                      true,
+		"VERSION-CONTROL /file HTTP/1.1\r\n":               true,
+		"PURGE /cached HTTP/1.1\r\n":                       true,
+		"GET /" + strings.Repeat("a", 2000):                true,
+		"GET /very-long-url HTT":                           true,
+		"GET /index.html HTTP/1.1":                         true,
+		"BAN /cached HTTP/1.1\r\n":                         false,
+		"get / HTTP/1.1\r\n":                               false,
+		"GET  / HTTP/1.1\r\n":                              false,
+		"GET / HTTP/1.1 extra\r\n":                         false,
+		"GET /\r\n":                                        false,
+		"GET / FTP/1.1\r\n":                                false,
+		"GET / HTTP/11\r\n":                                false,
+		"GET /a\x01b HTTP/1.1\r\n":                         false,
+		"GET ":                                             false,
+		"HTTP/1.1 200 OK\r\n":                              false,
+		"\x16\x03\x01\x02\x00\x01\x00\x01\xfc\x03\x03 GET": false,
+		"": false,
+	} {
+		assert.Equal(t, expected, isHTTPRequestData([]byte(data), extra), data)
+	}
+}
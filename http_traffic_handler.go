@@ -2,8 +2,8 @@ package main
 
 import (
 	"bytes"
-	"compress/gzip"
-	"compress/zlib"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -11,14 +11,14 @@ import (
 	"os"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/hsiafan/glow/iox/filex"
 	"github.com/hsiafan/httpdump/httpport"
 
 	"bufio"
-
-	"github.com/google/gopacket/tcpassembly/tcpreader"
 )
 
 // ConnectionKey contains src and dst endpoint identify a connection
@@ -41,64 +41,164 @@ func (ck *ConnectionKey) dstString() string {
 	return ck.dst.String()
 }
 
-// HTTPConnectionHandler impl ConnectionHandler
-type HTTPConnectionHandler struct {
-	option  *Option
-	printer *Printer
+// HTTPTrafficHandler parse a http connection traffic and send to printer
+type HTTPTrafficHandler struct {
+	requestTiming  messageTiming
+	responseTiming messageTiming
+	key            ConnectionKey
+	buffer         *bytes.Buffer
+	option         *Option
+	printer        *Printer
+	// message type of grpc body to print, nil if unknown
+	protoMessage *protoMessageType
+}
+
+// messageTiming is the capture time of the first and last byte of a http message
+type messageTiming struct {
+	firstByte time.Time
+	lastByte  time.Time
+}
+
+// streamReader is buffered reader of one direction of tcp connection, it can tell the capture time of data parsed
+type streamReader struct {
+	*bufio.Reader
+	stream *NetworkStream
+}
+
+func newStreamReader(stream *NetworkStream) *streamReader {
+	return &streamReader{Reader: bufio.NewReader(stream), stream: stream}
+}
+
+// the stream offset of next byte to parse
+func (r *streamReader) position() int64 {
+	return r.stream.offset - int64(r.Buffered())
+}
+
+// capture time of the byte at stream offset, which should have been read
+func (r *streamReader) timestampAt(position int64) time.Time {
+	return r.stream.timestampAt(position)
+}
+
+// capture time of the last byte parsed
+func (r *streamReader) lastTimestamp() time.Time {
+	return r.timestampAt(r.position() - 1)
+}
+
+// bodyReader read body of a message from streamReader, and tell the capture time of bytes of the body.
+// Body data is mapped to the stream data read at the same time. Chunked body is read chunk by chunk,
+// so data of each read is contiguous in the stream
+type bodyReader struct {
+	io.Reader
+	stream  *streamReader
+	chunked bool
+	offset  int64      // body bytes read
+	marks   []bodyMark // start of data of each read
+}
+
+// bodyMark record the stream offset of body data at a body offset
+type bodyMark struct {
+	offset       int64
+	streamOffset int64
 }
 
-func (handler *HTTPConnectionHandler) handle(src Endpoint, dst Endpoint, connection *TCPConnection) {
-	ck := ConnectionKey{src, dst}
-	trafficHandler := &HTTPTrafficHandler{
-		key:       ck,
-		buffer:    new(bytes.Buffer),
-		option:    handler.option,
-		printer:   handler.printer,
-		startTime: connection.lastTimestamp,
+func newBodyReader(body io.Reader, stream *streamReader) *bodyReader {
+	return &bodyReader{Reader: body, stream: stream, chunked: httpport.ReadChunkByChunk(body)}
+}
+
+func (r *bodyReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		// body data is at the end of stream data consumed, after chunk header
+		end := r.stream.position()
+		if r.chunked {
+			// the CRLF after chunk data, which is read with the end of the chunk
+			end -= 2
+		}
+		r.marks = append(r.marks, bodyMark{offset: r.offset, streamOffset: end - int64(n)})
+		r.offset += int64(n)
+	}
+	return n, err
+}
+
+// capture time of the body byte at offset, the byte should have been read.
+// Should be called with non-decreasing offsets
+func (r *bodyReader) timestampAt(offset int64) time.Time {
+	idx := 0
+	for idx+1 < len(r.marks) && r.marks[idx+1].offset <= offset {
+		idx++
+	}
+	r.marks = r.marks[idx:]
+	if len(r.marks) == 0 {
+		return r.stream.lastTimestamp()
 	}
-	waitGroup.Add(1)
-	go trafficHandler.handle(connection)
+	return r.stream.timestampAt(r.marks[0].streamOffset + offset - r.marks[0].offset)
 }
 
-func (handler *HTTPConnectionHandler) finish() {
-	//handler.printer.finish()
+// messageEnd tell the capture time of the last byte of a message read
+type messageEnd interface {
+	lastTimestamp() time.Time
 }
 
-// HTTPTrafficHandler parse a http connection traffic and send to printer
-type HTTPTrafficHandler struct {
-	startTime time.Time
-	endTime   time.Time
-	key       ConnectionKey
-	buffer    *bytes.Buffer
-	option    *Option
-	printer   *Printer
+// capturedAt is the capture time of a message already read into memory
+type capturedAt time.Time
+
+func (t capturedAt) lastTimestamp() time.Time {
+	return time.Time(t)
 }
 
 // read http request/response stream, and do output
 func (h *HTTPTrafficHandler) handle(connection *TCPConnection) {
-	defer waitGroup.Done()
-	defer connection.upStream.Close()
-	defer connection.downStream.Close()
-	// filter by args setting
-
-	requestReader := bufio.NewReader(connection.upStream)
-	defer discardAll(requestReader)
-	responseReader := bufio.NewReader(connection.downStream)
-	defer discardAll(responseReader)
+	requestReader := newStreamReader(connection.upStream)
+	responseReader := newStreamReader(connection.downStream)
+
+	// tls connection. http is parsed from the plaintext if decrypted by secrets in key log,
+	// otherwise the handshake info is printed after the streams drained
+	if isTLSHandshakeStart(requestReader) {
+		decrypter := newTLSDecrypter(h.option.KeyLogSecrets)
+		requestReader, responseReader = decrypter.start(requestReader, responseReader)
+		defer h.printTLSConnection(decrypter)
+		defer decrypter.close()
+	}
 
-	for {
-		h.buffer = new(bytes.Buffer)
-		filtered := false
-		req, err := httpport.ReadRequest(requestReader)
-		h.startTime = connection.lastTimestamp
+	// http/2 with prior knowledge, client send the connection preface first
+	if data, err := requestReader.Peek(4); err == nil && string(data) == http2Preface[:4] {
+		h.handleHTTP2(requestReader, responseReader, nil)
+		return
+	}
 
-		if err != nil {
-			if err != io.EOF {
-				fmt.Fprintln(os.Stderr, "Error parsing HTTP requests:", err)
-			}
-			break
+	// requests are read ahead by another goroutine, and matched with responses in order
+	queue := make(chan *pendingRequest, maxPendingRequests)
+	stop := make(chan struct{})
+	requestsDone := make(chan struct{})
+	var requestErr error
+	go func() {
+		defer close(requestsDone)
+		requestErr = h.readRequests(connection, requestReader, queue, stop)
+		close(queue)
+	}()
+	var current *pendingRequest
+	defer func() {
+		close(stop)
+		discardAll(responseReader)
+		<-requestsDone
+		discardAll(requestReader)
+		// bodies of requests read may be in temp files
+		if current != nil {
+			current.release()
 		}
+		for pending := range queue {
+			pending.release()
+		}
+	}()
 
+	for pending := range queue {
+		if current != nil {
+			current.release()
+		}
+		current = pending
+		h.buffer = new(bytes.Buffer)
+		req := pending.req
+		filtered := false
 		if h.option.Host != "" && !wildcardMatch(req.Host, h.option.Host) {
 			filtered = true
 		}
@@ -106,87 +206,592 @@ func (h *HTTPTrafficHandler) handle(connection *TCPConnection) {
 			filtered = true
 		}
 
-		// if is websocket request,  by header: Upgrade: websocket
-		websocket := req.Header.Get("Upgrade") == "websocket"
-		expectContinue := req.Header.Get("Expect") == "100-continue"
-
-		resp, err := httpport.ReadResponse(responseReader, nil)
+		// response is framed by request method, such as response of HEAD request has no body
+		responseStart := responseReader.position()
+		resp, err := httpport.ReadResponse(responseReader.Reader, req)
+		// interim responses, such as 100 Continue and 103 Early Hints, come before the final response
+		var interims []*interimResponse
+		continued := false
+		for err == nil && isInterimResponse(resp.StatusCode) {
+			interims = append(interims, &interimResponse{Response: resp,
+				timestamp: responseReader.timestampAt(responseStart)})
+			if resp.StatusCode == 100 && !continued && pending.decision != nil {
+				// client send the body after 100 Continue, before the final response
+				pending.decision <- responseDecision{continued: true}
+				continued = true
+			}
+			responseStart = responseReader.position()
+			resp, err = httpport.ReadResponse(responseReader.Reader, req)
+		}
 
 		if err != nil {
 			if err == io.EOF || err == io.ErrUnexpectedEOF {
-				break
-			} else {
+				return
+			} else if err != errStreamDropped {
 				fmt.Fprintln(os.Stderr, "Error parsing HTTP response:", err, connection.clientID)
 			}
+			if pending.decision != nil {
+				pending.decision <- responseDecision{}
+			}
+			<-pending.ready
+			h.requestTiming = pending.timing
 			if !filtered {
-				h.printRequest(req)
+				h.printRequest(req, pending.bodyTruncated)
 				h.writeLine("")
+				if err == errStreamDropped {
+					h.printDroppedMark()
+				}
 				h.printer.send(h.buffer.String())
-			} else {
-				discardAll(req.Body)
 			}
-			break
+			return
+		}
+
+		tunnel := req.Method == "CONNECT" && resp.StatusCode/100 == 2
+		switched := tunnel || resp.StatusCode == 101
+		if pending.decision != nil {
+			pending.decision <- responseDecision{switched: switched, noContinue: !continued}
+		}
+		<-pending.ready
+
+		if tunnel {
+			// successful CONNECT response has no body, data after it is tunnel data
+			resp.Body = ioutil.NopCloser(bytes.NewReader(nil))
+			resp.ContentLength = 0
 		}
 
 		if h.option.StatusSet != nil && !h.option.StatusSet.Contains(resp.StatusCode) {
 			filtered = true
 		}
 
+		h.requestTiming = pending.timing
 		if !filtered {
-			h.printRequest(req)
+			h.responseTiming = messageTiming{firstByte: responseReader.timestampAt(responseStart)}
+			h.printRequest(req, pending.bodyTruncated)
 			h.writeLine("")
-			h.endTime = connection.lastTimestamp
-			h.printResponse(req.RequestURI, resp)
+			h.printInterimResponses(interims)
+			h.printResponse(req.RequestURI, resp, responseReader)
 			h.printer.send(h.buffer.String())
 		} else {
-			discardAll(req.Body)
 			discardAll(resp.Body)
-
 		}
 
-		if websocket {
-			if resp.StatusCode == 101 && resp.Header.Get("Upgrade") == "websocket" {
+		if tunnel {
+			// tunnel established, the following data is not http
+			h.handleTunnel(req.RequestURI, requestReader, responseReader, filtered)
+			h.printer.send(h.buffer.String())
+			return
+		}
+		if switched {
+			switch upgrade := resp.Header.Get("Upgrade"); {
+			case strings.EqualFold(upgrade, "websocket"):
 				// change to handle websocket
-				h.handleWebsocket(requestReader, responseReader)
-				break
+				h.handleWebsocket(resp.Header, requestReader, responseReader, filtered)
+				h.printer.send(h.buffer.String())
+			case strings.EqualFold(upgrade, "h2c"):
+				// the upgrade request is stream 1 of http/2 connection
+				h.handleHTTP2(requestReader, responseReader, http2UpgradeRequest(req, h.requestTiming))
 			}
+			return
 		}
+	}
 
-		if expectContinue {
-			if resp.StatusCode == 100 {
-				// read next response, the real response
-				resp, err := httpport.ReadResponse(responseReader, nil)
-				if err == io.EOF {
-					fmt.Fprintln(os.Stderr, "Error parsing HTTP requests: unexpected end, ", err)
-					break
-				}
-				if err == io.ErrUnexpectedEOF {
-					fmt.Fprintln(os.Stderr, "Error parsing HTTP requests: unexpected end, ", err)
-					// here return directly too, to avoid error when long polling connection is used
-					break
+	if requestErr == errStreamDropped {
+		h.buffer = new(bytes.Buffer)
+		h.printDroppedMark()
+		h.printer.send(h.buffer.String())
+	} else if requestErr != nil && requestErr != io.EOF {
+		fmt.Fprintln(os.Stderr, "Error parsing HTTP requests:", requestErr)
+	}
+}
+
+// requests can be read ahead of responses
+const maxPendingRequests = 16
+
+// request body is read ahead into memory up to this size, the rest is spilled to a temp file
+const maxBufferedRequestBody = 1 << 20
+
+// pendingRequest is a request read, waiting for its response
+type pendingRequest struct {
+	req    *httpport.Request
+	timing messageTiming
+	// closed when the body has been read
+	ready chan struct{}
+	// size of body discarded, when the part larger than maxBufferedRequestBody can not be spilled
+	bodyTruncated int64
+	// if not nil, request reader may wait for responses, to know if the body is sent or protocol switched
+	decision chan responseDecision
+}
+
+// close the body read, which may be spilled to temp file. Do nothing if the body is not read
+func (p *pendingRequest) release() {
+	select {
+	case <-p.ready:
+		_ = p.req.Body.Close()
+	default:
+	}
+}
+
+// what request reader need to know about the responses. After a decision of 100 Continue,
+// another one is sent for the final response
+type responseDecision struct {
+	continued  bool // 100 Continue received, the final response has not come yet
+	switched   bool // tunnel established, or protocol switched, there are no more http requests
+	noContinue bool // the final response come without 100 Continue
+}
+
+// read requests and queue them, until the request stream end, or stop is closed.
+// The request reader is used only by this goroutine. Bodies are read without waiting for the response side,
+// except a body that may not be sent for Expect: 100-continue, when data after the request header is not the body
+func (h *HTTPTrafficHandler) readRequests(connection *TCPConnection, requestReader *streamReader,
+	queue chan<- *pendingRequest, stop <-chan struct{}) error {
+	for {
+		requestStart := requestReader.position()
+		req, err := httpport.ReadRequest(requestReader.Reader)
+		if err != nil {
+			return err
+		}
+		atomic.AddInt32(&connection.transactions, 1)
+
+		pending := &pendingRequest{
+			req:    req,
+			timing: messageTiming{firstByte: requestReader.timestampAt(requestStart)},
+			ready:  make(chan struct{}),
+		}
+		expectContinue := strings.EqualFold(req.Header.Get("Expect"), "100-continue")
+		switchable := req.Method == "CONNECT" || req.Header.Get("Upgrade") != ""
+		if expectContinue || switchable {
+			pending.decision = make(chan responseDecision, 2)
+		}
+		select {
+		case <-stop:
+			return nil
+		default:
+		}
+		select {
+		case queue <- pending:
+		case <-stop:
+			return nil
+		}
+
+		var decision responseDecision
+		decided := false
+		if expectContinue && h.requestBodySkipped(requestReader) {
+			// no data, or data like next request after the header. The final response come before the data,
+			// it tells if the body is sent
+			select {
+			case decision = <-pending.decision:
+			case <-stop:
+				return nil
+			}
+			decided = !decision.continued
+			if decision.switched {
+				pending.timing.lastByte = requestReader.lastTimestamp()
+				close(pending.ready)
+				return nil
+			}
+			if decision.noContinue {
+				// server send final response without 100 Continue, such as 417, and client did not send the body
+				req.Body = ioutil.NopCloser(bytes.NewReader(nil))
+				req.ContentLength = 0
+			}
+		}
+
+		req.Body, pending.bodyTruncated = readAhead(req.Body, maxBufferedRequestBody)
+		pending.timing.lastByte = requestReader.lastTimestamp()
+
+		if switchable && !decided {
+			// the body is framed by the request, data after it may be of another protocol,
+			// wait the final response to know it
+			for {
+				select {
+				case decision = <-pending.decision:
+				case <-stop:
+					close(pending.ready)
+					return nil
 				}
-				if err != nil {
-					fmt.Fprintln(os.Stderr, "Error parsing HTTP response:", err, connection.clientID)
+				if !decision.continued {
 					break
 				}
-				if !filtered {
-					h.printResponse(req.RequestURI, resp)
-					h.printer.send(h.buffer.String())
-				} else {
-					discardAll(resp.Body)
-				}
-			} else if resp.StatusCode == 417 {
+			}
+			if decision.switched {
+				close(pending.ready)
+				return nil
+			}
+		}
+		close(pending.ready)
+	}
+}
+
+// read the whole body, return a reader of the data. Data not larger than limit is kept in memory, the rest is
+// spilled to a temp file which is removed when the reader closed. If spill failed, the rest is discarded,
+// and the size discarded is returned
+func readAhead(body io.ReadCloser, limit int) (io.ReadCloser, int64) {
+	defer body.Close()
+	data, _ := ioutil.ReadAll(io.LimitReader(body, int64(limit)))
+	if len(data) < limit {
+		return ioutil.NopCloser(bytes.NewReader(data)), 0
+	}
+	file, err := ioutil.TempFile("", "httpdump-body-")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "spill request body to file failed:", err)
+		discarded, _ := io.Copy(ioutil.Discard, body)
+		return ioutil.NopCloser(bytes.NewReader(data)), discarded
+	}
+	spilled := &spilledBody{file: file}
+	if _, err := io.Copy(file, body); err != nil && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+		fmt.Fprintln(os.Stderr, "spill request body to file failed:", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		fmt.Fprintln(os.Stderr, "read spilled request body failed:", err)
+	}
+	spilled.Reader = io.MultiReader(bytes.NewReader(data), file)
+	return spilled, 0
+}
+
+// spilledBody is a body in memory followed by the rest in a temp file
+type spilledBody struct {
+	io.Reader
+	file *os.File
+}
+
+// close and remove the temp file
+func (b *spilledBody) Close() error {
+	_ = b.file.Close()
+	return os.Remove(b.file.Name())
+}
+
+// interimResponse is a 1xx response before the final response
+type interimResponse struct {
+	*httpport.Response
+	timestamp time.Time
+}
 
+// 1xx responses are interim, except 101 Switching Protocols, which is the last response before protocol changed
+func isInterimResponse(statusCode int) bool {
+	return statusCode/100 == 1 && statusCode != 101
+}
+
+// for request with Expect: 100-continue, client do not send body if the final response come before 100 Continue.
+// Return true if the body may be not sent: there is no more data, or the data after request header is like
+// the next request. Wait until data come
+func (h *HTTPTrafficHandler) requestBodySkipped(requestReader *streamReader) bool {
+	if _, err := requestReader.Peek(1); err != nil {
+		return true
+	}
+	data, _ := requestReader.Peek(requestReader.Buffered())
+	return isHTTPRequestData(data, h.option.ExtraMethods)
+}
+
+// print interim responses of the transaction
+func (h *HTTPTrafficHandler) printInterimResponses(interims []*interimResponse) {
+	if h.option.Level == "url" {
+		return
+	}
+	for _, interim := range interims {
+		h.writeLine(strings.Repeat("*", 10), " INTERIM RESPONSE ", h.key.srcString(), " <----- ", h.key.dstString(),
+			" // ", interim.timestamp.Format(time.RFC3339Nano))
+		h.writeLine(interim.StatusLine)
+		for _, header := range interim.RawHeaders {
+			h.writeLine(header)
+		}
+		h.writeLine()
+	}
+}
+
+// print mark for connection dropped by backpressure policy
+func (h *HTTPTrafficHandler) printDroppedMark() {
+	h.writeLine("{Connection", h.key.srcString(), "-", h.key.dstString(), "dropped: handler can not keep up with traffic}")
+}
+
+// print handshake info of tls connection not decrypted: sni, alpn, version, cipher suite, certificate and
+// JA3/JA3S fingerprints
+func (h *HTTPTrafficHandler) printTLSConnection(decrypter *tlsDecrypter) {
+	client := decrypter.clientHello
+	if decrypter.isDecrypted() || client == nil {
+		return
+	}
+	// only host can be matched, by sni
+	if h.option.Host != "" && !wildcardMatch(client.serverName, h.option.Host) || h.option.Uri != "" ||
+		h.option.StatusSet != nil {
+		return
+	}
+	h.buffer = new(bytes.Buffer)
+	requestReader, responseReader := decrypter.client.reader, decrypter.server.reader
+	established := decrypter.started
+	closed := established
+	if requestReader.lastTimestamp().After(closed) {
+		closed = requestReader.lastTimestamp()
+	}
+	if responseReader.position() > 0 && responseReader.lastTimestamp().After(closed) {
+		closed = responseReader.lastTimestamp()
+	}
+	serverName := client.serverName
+	if serverName == "" {
+		serverName = "not visible"
+	}
+	server := decrypter.serverHello
+	summary := "duration: " + closed.Sub(established).String() + ", bytes: " +
+		strconv.FormatInt(requestReader.position(), 10) + "/" + strconv.FormatInt(responseReader.position(), 10) +
+		" (client/server)"
+
+	if h.option.Level == "url" {
+		if server != nil {
+			summary = tlsVersionName(server.version) + ", " + tlsCipherSuiteName(server.cipherSuite) + ", " + summary
+		}
+		h.writeLine("TLS", serverName, summary)
+		h.printer.send(h.buffer.String())
+		return
+	}
+	h.writeLine()
+	h.writeLine(strings.Repeat("*", 10), " TLS ", h.key.srcString(), " -----> ", h.key.dstString(), " // ",
+		established.Format(time.RFC3339Nano))
+	h.writeLine("sni:", serverName)
+	if len(client.alpn) > 0 {
+		offered := "offered: " + strings.Join(client.alpn, ",")
+		if server != nil && server.alpn != "" {
+			h.writeLine("alpn:", server.alpn, "("+offered+")")
+		} else {
+			h.writeLine("alpn:", offered)
+		}
+	}
+	if server != nil {
+		h.writeLine("version:", tlsVersionName(server.version))
+		h.writeLine("cipher:", tlsCipherSuiteName(server.cipherSuite))
+		if certificate := decrypter.certificate; certificate != nil {
+			var names []string
+			names = append(names, certificate.DNSNames...)
+			for _, ip := range certificate.IPAddresses {
+				names = append(names, ip.String())
 			}
+			h.writeLine("certificate:", "subject: "+certificate.Subject.String()+", san: "+strings.Join(names, ",")+
+				", expire: "+certificate.NotAfter.UTC().Format(time.RFC3339))
+		} else {
+			h.writeLine("certificate: not visible")
 		}
 	}
+	h.writeLine("ja3:", ja3Hash(client.ja3()), "("+client.ja3()+")")
+	if server != nil {
+		h.writeLine("ja3s:", ja3Hash(server.ja3s()), "("+server.ja3s()+")")
+	}
+	if decrypter.failure != "" {
+		h.writeLine("not decrypted:", decrypter.failure)
+	}
+	h.writeLine(summary)
+	h.printer.send(h.buffer.String())
+}
 
+// read data in CONNECT tunnel until connection closed, and print a tunnel record
+func (h *HTTPTrafficHandler) handleTunnel(authority string, requestReader, responseReader *streamReader,
+	filtered bool) {
+	h.buffer = new(bytes.Buffer)
+	established := responseReader.lastTimestamp()
+	requestStart, responseStart := requestReader.position(), responseReader.position()
+
+	// read both directions at the same time, the streams do not wait each other
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		discardAll(responseReader)
+	}()
+	var serverName string
+	if hello := readClientHello(requestReader); hello != nil {
+		serverName = hello.serverName
+	}
+	discardAll(requestReader)
+	wg.Wait()
+
+	if filtered {
+		return
+	}
+	upBytes, downBytes := requestReader.position()-requestStart, responseReader.position()-responseStart
+	closed := established
+	if upBytes > 0 && requestReader.lastTimestamp().After(closed) {
+		closed = requestReader.lastTimestamp()
+	}
+	if downBytes > 0 && responseReader.lastTimestamp().After(closed) {
+		closed = responseReader.lastTimestamp()
+	}
+	if serverName == "" {
+		serverName = "not visible"
+	}
+	summary := "sni: " + serverName + ", duration: " + closed.Sub(established).String() + ", bytes: " +
+		strconv.FormatInt(upBytes, 10) + "/" + strconv.FormatInt(downBytes, 10) + " (client/server)"
+
+	if h.option.Level == "url" {
+		h.writeLine("TUNNEL", authority, summary)
+		return
+	}
+	h.writeLine()
+	h.writeLine(strings.Repeat("*", 10), " TUNNEL ", h.key.srcString(), " -----> ", h.key.dstString(), " // ",
+		established.Format(time.RFC3339Nano))
+	h.writeLine("target:", authority)
+	h.writeLine(summary)
+}
+
+// read http/2 frames of both directions until connection closed, and print each stream as a request/response pair.
+// upgrade is the request of stream 1 if the connection is upgraded from http/1
+func (h *HTTPTrafficHandler) handleHTTP2(requestReader, responseReader *streamReader, upgrade *http2Message) {
+	connection := newHTTP2Connection(h.printHTTP2Stream)
+	if upgrade != nil {
+		connection.streams[1] = &http2Stream{id: 1, request: upgrade}
+	}
+
+	// read both directions at the same time, the streams do not wait each other
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.handleHTTP2Error(connection, connection.readFrames(responseReader, false))
+		discardAll(responseReader)
+	}()
+	err := readHTTP2Preface(requestReader)
+	if err == nil {
+		err = connection.readFrames(requestReader, true)
+	}
+	h.handleHTTP2Error(connection, err)
+	discardAll(requestReader)
+	wg.Wait()
+	connection.finishAll()
+}
+
+func (h *HTTPTrafficHandler) handleHTTP2Error(connection *http2Connection, err error) {
+	if err == errStreamDropped {
+		connection.lock.Lock()
+		defer connection.lock.Unlock()
+		h.buffer = new(bytes.Buffer)
+		h.printDroppedMark()
+		h.printer.send(h.buffer.String())
+	} else if err != io.EOF && err != io.ErrUnexpectedEOF {
+		fmt.Fprintln(os.Stderr, "Error parsing HTTP/2 frames:", err)
+	}
+}
+
+// print request and response of a http/2 stream
+func (h *HTTPTrafficHandler) printHTTP2Stream(stream *http2Stream) {
+	if stream.request == nil {
+		return
+	}
+	req := stream.request.toRequest()
+	if h.option.Host != "" && !wildcardMatch(req.Host, h.option.Host) {
+		return
+	}
+	if h.option.Uri != "" && !wildcardMatch(req.RequestURI, h.option.Uri) {
+		return
+	}
+	var resp *httpport.Response
+	if stream.response != nil {
+		resp = stream.response.toResponse()
+		if h.option.StatusSet != nil && !h.option.StatusSet.Contains(resp.StatusCode) {
+			return
+		}
+	}
+
+	h.buffer = new(bytes.Buffer)
+	h.requestTiming = stream.request.timing
+	requestType, responseType := h.option.ProtoRegistry.methodTypes(req.RequestURI)
+	h.protoMessage = requestType
+	h.printRequest(req, stream.request.bodyTruncated)
+	h.writeLine("")
+	if resp != nil {
+		var interims []*interimResponse
+		for _, interim := range stream.interims {
+			interims = append(interims, &interimResponse{Response: interim.toResponse(),
+				timestamp: interim.timing.firstByte})
+		}
+		h.printInterimResponses(interims)
+		h.responseTiming = stream.response.timing
+		h.protoMessage = responseType
+		h.printResponse(req.RequestURI, resp, capturedAt(stream.response.timing.lastByte))
+		h.printBodyTruncated(stream.response.bodyTruncated)
+		if len(stream.response.trailers) > 0 && h.option.Level != "url" {
+			h.writeLine("// trailers")
+			for _, field := range stream.response.trailers {
+				h.writeLine(http2FieldLine(field))
+			}
+			h.writeLine()
+		}
+	}
+	h.protoMessage = nil
+	if stream.reset {
+		h.writeLine("{Stream", stream.id, "reset}")
+	}
 	h.printer.send(h.buffer.String())
 }
 
-func (h *HTTPTrafficHandler) handleWebsocket(requestReader *bufio.Reader, responseReader *bufio.Reader) {
-	//TODO: websocket
+// read websocket frames of both directions until connection closed, and print messages.
+// header is of the handshake response, which has the negotiated extensions
+func (h *HTTPTrafficHandler) handleWebsocket(header httpport.Header, requestReader, responseReader *streamReader,
+	filtered bool) {
+	h.buffer = new(bytes.Buffer)
+	deflate := parseWebsocketDeflate(header.Get("Sec-WebSocket-Extensions"))
+
+	// read both directions at the same time, the streams do not wait each other
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		h.printWebsocketMessages(&websocketDecoder{reader: responseReader, deflate: deflate.enabled,
+			noContextTakeover: deflate.serverNoContextTakeover}, false, filtered)
+	}()
+	h.printWebsocketMessages(&websocketDecoder{reader: requestReader, deflate: deflate.enabled,
+		noContextTakeover: deflate.clientNoContextTakeover}, true, filtered)
+	wg.Wait()
+}
+
+// decode and print messages of one direction. Called by two goroutines, so do not use h.buffer
+func (h *HTTPTrafficHandler) printWebsocketMessages(decoder *websocketDecoder, fromClient bool, filtered bool) {
+	for {
+		message, err := decoder.next()
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+				fmt.Fprintln(os.Stderr, "Error parsing websocket frame:", err, h.key.srcString())
+			}
+			return
+		}
+		if filtered || h.option.Level == "url" {
+			continue
+		}
+		h.printer.send(h.formatWebsocketMessage(message, fromClient))
+	}
+}
 
+func (h *HTTPTrafficHandler) formatWebsocketMessage(message *websocketMessage, fromClient bool) string {
+	var buffer bytes.Buffer
+	direction := " -----> "
+	if !fromClient {
+		direction = " <----- "
+	}
+	kind := websocketOpcodeNames[message.opcode]
+	if kind == "" {
+		kind = "OPCODE-" + strconv.Itoa(int(message.opcode))
+	}
+	if message.compressed {
+		kind += "(compressed)"
+	}
+	fmt.Fprintln(&buffer)
+	fmt.Fprintln(&buffer, strings.Repeat("*", 10), " WEBSOCKET ", h.key.srcString(), direction, h.key.dstString(),
+		" // ", message.timestamp.Format(time.RFC3339Nano), kind, "size:", len(message.payload))
+	if h.option.Level == "header" || len(message.payload) == 0 {
+		return buffer.String()
+	}
+
+	switch message.opcode {
+	case websocketText, websocketPing, websocketPong:
+		fmt.Fprintln(&buffer, string(message.payload))
+	case websocketClose:
+		if len(message.payload) >= 2 {
+			fmt.Fprintln(&buffer, "code:", binary.BigEndian.Uint16(message.payload), "reason:",
+				string(message.payload[2:]))
+		}
+	default:
+		if h.option.Force {
+			fmt.Fprint(&buffer, hex.Dump(message.payload))
+		} else {
+			fmt.Fprintln(&buffer, "{Binary message, set [force] to display, len:", len(message.payload), "}")
+		}
+	}
+	return buffer.String()
 }
 
 func (h *HTTPTrafficHandler) writeLineFormat(format string, a ...interface{}) {
@@ -213,29 +818,36 @@ func (h *HTTPTrafficHandler) printHeader(header httpport.Header) {
 	}
 }
 
-// print http request
-func (h *HTTPTrafficHandler) printRequest(req *httpport.Request) {
+// print http request. truncated is the size of body discarded for exceeding the buffer limit
+func (h *HTTPTrafficHandler) printRequest(req *httpport.Request, truncated int64) {
 	defer discardAll(req.Body)
 	if h.option.Curl {
 		h.printCurlRequest(req)
 	} else {
 		h.printNormalRequest(req)
 	}
+	h.printBodyTruncated(truncated)
+}
+
+// print note for body too large to be kept in memory, of which the last truncated bytes are discarded
+func (h *HTTPTrafficHandler) printBodyTruncated(truncated int64) {
+	if truncated > 0 && h.option.Level != "url" {
+		h.writeLine("{Body truncated,", truncated, "bytes discarded}")
+	}
 }
 
 var blockHeaders = map[string]bool{
 	"Content-Length":    true,
 	"Transfer-Encoding": true,
 	"Connection":        true,
+	"Expect":            true, // curl send Expect: 100-continue itself for large body
 	"Accept-Encoding:":  true,
 }
 
 // print http request curl command
 func (h *HTTPTrafficHandler) printCurlRequest(req *httpport.Request) {
-	//TODO: expect-100 continue handle
-
 	h.writeLine()
-	h.writeLine(strings.Repeat("*", 10), " REQUEST ", h.key.srcString(), " -----> ", h.key.dstString(), " // ", h.startTime.Format(time.RFC3339Nano))
+	h.writeLine(strings.Repeat("*", 10), " REQUEST ", h.key.srcString(), " -----> ", h.key.dstString(), " // ", h.requestTiming.firstByte.Format(time.RFC3339Nano))
 	h.writeLineFormat("curl -X %v http://%v%v \\\n", req.Method, h.key.dstString(), req.RequestURI)
 	var reader io.ReadCloser
 	var deCompressed bool
@@ -243,12 +855,10 @@ func (h *HTTPTrafficHandler) printCurlRequest(req *httpport.Request) {
 		reader = req.Body
 		deCompressed = false
 	} else {
-		reader, deCompressed = h.tryDecompress(req.Header, req.Body)
+		// body is sent as received if decoding failed
+		reader, deCompressed, _ = h.tryDecompress(req.Header, req.Body)
 	}
 
-	if deCompressed {
-		defer reader.Close()
-	}
 	seq := 0
 	for name, values := range req.Header {
 		seq++
@@ -276,7 +886,7 @@ func (h *HTTPTrafficHandler) printCurlRequest(req *httpport.Request) {
 	}
 
 	if h.option.DumpBody {
-		filename := "request-" + uriToFileName(req.RequestURI, h.startTime)
+		filename := "request-" + uriToFileName(req.RequestURI, h.requestTiming.firstByte)
 		h.writeLineFormat("    -d '@%v'", filename)
 
 		err := filex.WriteAllFromReader(filename, reader)
@@ -313,17 +923,27 @@ func (h *HTTPTrafficHandler) printCurlRequest(req *httpport.Request) {
 
 // print http request
 func (h *HTTPTrafficHandler) printNormalRequest(req *httpport.Request) {
-	//TODO: expect-100 continue handle
 	if h.option.Level == "url" {
-		h.writeLine(req.Method, req.Host+req.RequestURI)
+		if req.Method == "CONNECT" {
+			// request target is the authority
+			h.writeLine(req.Method, req.RequestURI)
+		} else {
+			h.writeLine(req.Method, req.Host+req.RequestURI)
+		}
 		return
 	}
 
 	h.writeLine()
-	h.writeLine(strings.Repeat("*", 10), " REQUEST ", h.key.srcString(), " -----> ", h.key.dstString(), " // ", h.startTime.Format(time.RFC3339Nano))
+	h.writeLine(strings.Repeat("*", 10), " REQUEST ", h.key.srcString(), " -----> ", h.key.dstString(), " // ", h.requestTiming.firstByte.Format(time.RFC3339Nano))
 
 	h.writeLine(req.Method, req.RequestURI, req.Proto)
 	h.printHeader(req.Header)
+	if query := rawQuery(req); query != "" && h.option.Level == "all" {
+		// query is usually encoded in the same charset as the body
+		_, charset := parseContentType(req.Header.Get("Content-Type"))
+		h.writeLine()
+		h.printURLEncoded("query", decodeURLEncoded(query, charset))
+	}
 
 	var hasBody = true
 	if req.ContentLength == 0 || req.Method == "GET" || req.Method == "HEAD" || req.Method == "TRACE" ||
@@ -332,7 +952,7 @@ func (h *HTTPTrafficHandler) printNormalRequest(req *httpport.Request) {
 	}
 
 	if h.option.DumpBody {
-		filename := "request-" + uriToFileName(req.RequestURI, h.startTime)
+		filename := "request-" + uriToFileName(req.RequestURI, h.requestTiming.firstByte)
 		h.writeLine("\n// dump body to file:", filename)
 
 		err := filex.WriteAllFromReader(filename, req.Body)
@@ -357,14 +977,47 @@ func (h *HTTPTrafficHandler) printNormalRequest(req *httpport.Request) {
 	}
 }
 
-// print http response
-func (h *HTTPTrafficHandler) printResponse(uri string, resp *httpport.Response) {
+// raw query of request target. req.URL is not set for http/2 requests
+func rawQuery(req *httpport.Request) string {
+	if req.URL != nil {
+		return req.URL.RawQuery
+	}
+	if idx := strings.IndexByte(req.RequestURI, '?'); idx >= 0 {
+		return req.RequestURI[idx+1:]
+	}
+	return ""
+}
+
+// print decoded fields of url-encoded form or query, one line each
+func (h *HTTPTrafficHandler) printURLEncoded(title string, fields []urlEncodedField) {
+	h.writeLine("//", title+",", len(fields), "fields")
+	for _, field := range fields {
+		h.writeLine(field.key+":", field.value)
+	}
+}
+
+// print http response. the reader is used to get the capture time of the response end
+func (h *HTTPTrafficHandler) printResponse(uri string, resp *httpport.Response, reader messageEnd) {
 	defer discardAll(resp.Body)
 	if h.option.Level == "url" {
 		return
 	}
+	if sse, streaming := h.streamingResponse(resp); streaming {
+		h.printStreamingResponse(resp, reader, sse)
+		return
+	}
 
-	h.writeLine(strings.Repeat("*", 10), " RESPONSE ", h.key.srcString(), " <----- ", h.key.dstString(), " // ", h.startTime.Format(time.RFC3339Nano), "-", h.endTime.Format(time.RFC3339Nano), "=", h.endTime.Sub(h.startTime).String())
+	// the response title contains timings, which are known only after the whole response body is read
+	buffer := h.buffer
+	h.buffer = new(bytes.Buffer)
+	defer func() {
+		discardAll(resp.Body)
+		h.responseTiming.lastByte = reader.lastTimestamp()
+		content := h.buffer
+		h.buffer = buffer
+		h.printResponseTitle()
+		_, _ = content.WriteTo(h.buffer)
+	}()
 
 	h.writeLine(resp.StatusLine)
 	for _, header := range resp.RawHeaders {
@@ -377,7 +1030,7 @@ func (h *HTTPTrafficHandler) printResponse(uri string, resp *httpport.Response)
 	}
 
 	if h.option.DumpBody {
-		filename := "response-" + uriToFileName(uri, h.startTime)
+		filename := "response-" + uriToFileName(uri, h.requestTiming.firstByte)
 		h.writeLine("\n// dump body to file:", filename)
 
 		err := filex.WriteAllFromReader(filename, resp.Body)
@@ -401,37 +1054,146 @@ func (h *HTTPTrafficHandler) printResponse(uri string, resp *httpport.Response)
 	}
 }
 
-func (h *HTTPTrafficHandler) tryDecompress(header httpport.Header, reader io.ReadCloser) (io.ReadCloser, bool) {
-	contentEncoding := header.Get("Content-Encoding")
-	var nr io.ReadCloser
-	var err error
-	if contentEncoding == "" {
-		// do nothing
-		return reader, false
-	} else if strings.Contains(contentEncoding, "gzip") {
-		nr, err = gzip.NewReader(reader)
-		if err != nil {
-			return reader, false
+// print response title line, with the time from request begin to response end,
+// and time used by request sending, waiting for the first response byte(TTFB), and response receiving
+func (h *HTTPTrafficHandler) printResponseTitle() {
+	h.writeLine(strings.Repeat("*", 10), " RESPONSE ", h.key.srcString(), " <----- ", h.key.dstString(), " // ",
+		h.transactionTimings())
+}
+
+func (h *HTTPTrafficHandler) transactionTimings() string {
+	request, response := h.requestTiming, h.responseTiming
+	return strings.Join([]string{
+		request.firstByte.Format(time.RFC3339Nano), "-", response.lastByte.Format(time.RFC3339Nano), "=",
+		response.lastByte.Sub(request.firstByte).String(),
+		"(send:", request.lastByte.Sub(request.firstByte).String() + ",",
+		"wait:", response.firstByte.Sub(request.lastByte).String() + ",",
+		"receive:", response.lastByte.Sub(response.firstByte).String() + ")",
+	}, " ")
+}
+
+// if response body should be printed as it arrives: server-sent events, or chunked body if stream option is set.
+// sse is true for server-sent events
+func (h *HTTPTrafficHandler) streamingResponse(resp *httpport.Response) (sse bool, streaming bool) {
+	// http/2 streams are printed after finished
+	if h.option.Level != "all" || h.option.DumpBody || resp.ProtoMajor != 1 {
+		return false, false
+	}
+	if encoding := resp.Header.Get("Content-Encoding"); encoding != "" && encoding != "identity" {
+		return false, false
+	}
+	mimeType, _ := parseContentType(strings.ToLower(resp.Header.Get("Content-Type")))
+	if mimeType == "text/event-stream" {
+		return true, true
+	}
+	return false, h.option.Stream && len(resp.TransferEncoding) > 0 && resp.TransferEncoding[0] == "chunked"
+}
+
+// max data of a chunk printed at once
+const maxStreamChunkLen = 64 << 10
+
+// print response head at once, then each event or chunk once received, with the capture time.
+// The response title has no timings, which are printed at the end of stream
+func (h *HTTPTrafficHandler) printStreamingResponse(resp *httpport.Response, reader messageEnd, sse bool) {
+	h.writeLine(strings.Repeat("*", 10), " RESPONSE ", h.key.srcString(), " <----- ", h.key.dstString(), " // ",
+		h.responseTiming.firstByte.Format(time.RFC3339Nano), "(streaming)")
+	h.writeLine(resp.StatusLine)
+	for _, header := range resp.RawHeaders {
+		h.writeLine(header)
+	}
+	h.writeLine()
+	h.flush()
+
+	if sse {
+		// events are read ahead by buffer, the capture time is of the event start instead of the stream read position
+		eventTimestamp := func(start int64) time.Time { return reader.lastTimestamp() }
+		body := io.Reader(resp.Body)
+		if stream, ok := reader.(*streamReader); ok {
+			positioned := newBodyReader(resp.Body, stream)
+			eventTimestamp = positioned.timestampAt
+			body = positioned
 		}
-		return nr, true
-	} else if strings.Contains(contentEncoding, "deflate") {
-		nr, err = zlib.NewReader(reader)
-		if err != nil {
-			return reader, false
+		events := newEventStreamReader(body)
+		for index := 1; ; index++ {
+			event, err := events.next()
+			if err != nil {
+				break
+			}
+			h.writeLine("// event", strconv.Itoa(index)+",", eventTimestamp(event.start).Format(time.RFC3339Nano))
+			for _, field := range event.fields {
+				h.writeLine(field)
+			}
+			h.writeLine()
+			h.flush()
 		}
-		return nr, true
 	} else {
-		return reader, false
+		httpport.ReadChunkByChunk(resp.Body)
+		buffer := make([]byte, maxStreamChunkLen)
+		for index := 1; ; index++ {
+			n, err := resp.Body.Read(buffer)
+			if n > 0 {
+				h.writeLine("// chunk", strconv.Itoa(index)+", len:", strconv.Itoa(n)+",",
+					reader.lastTimestamp().Format(time.RFC3339Nano))
+				if isPrintableString(buffer[:n]) || h.option.Force {
+					h.writeLine(strings.TrimSuffix(string(buffer[:n]), "\n"))
+				} else {
+					h.writeLine("{Non-text chunk, set [force] to display}")
+				}
+				h.writeLine()
+				h.flush()
+			}
+			if err != nil {
+				break
+			}
+		}
+	}
+
+	discardAll(resp.Body)
+	h.responseTiming.lastByte = reader.lastTimestamp()
+	h.writeLine(strings.Repeat("*", 10), " END OF STREAM ", h.key.srcString(), " <----- ", h.key.dstString(), " // ",
+		h.transactionTimings())
+}
+
+// send the output so far to printer
+func (h *HTTPTrafficHandler) flush() {
+	h.printer.send(h.buffer.String())
+	h.buffer = new(bytes.Buffer)
+}
+
+// decode body by Content-Encoding, with encodings applied in order such as "gzip, br" decoded from the last.
+// Return the decoded body and true if decoded; if decoding failed, return the body as received and the error
+func (h *HTTPTrafficHandler) tryDecompress(header httpport.Header, reader io.ReadCloser) (io.ReadCloser, bool, error) {
+	encodings := parseContentEncodings(header)
+	if len(encodings) == 0 {
+		return reader, false, nil
+	}
+	data, err := ioutil.ReadAll(io.LimitReader(reader, maxEncodedBodySize+1))
+	if err == nil && len(data) > maxEncodedBodySize {
+		err = fmt.Errorf("encoded body exceeds %d bytes", maxEncodedBodySize)
+	}
+	if err != nil {
+		return ioutil.NopCloser(io.MultiReader(bytes.NewReader(data), reader)), false, err
 	}
+	decoded, err := decodeContent(data, encodings)
+	if err != nil {
+		return ioutil.NopCloser(bytes.NewReader(data)), false, err
+	}
+	return ioutil.NopCloser(bytes.NewReader(decoded)), true, nil
 }
 
 // print http request/response body
 func (h *HTTPTrafficHandler) printBody(header httpport.Header, reader io.ReadCloser) {
+	if isGRPCContentType(header.Get("Content-Type")) {
+		// grpc messages may be compressed each, by grpc-encoding instead of content-encoding
+		h.printGRPCBody(header, reader)
+		return
+	}
 
-	// deal with content encoding such as gzip, deflate
-	nr, decompressed := h.tryDecompress(header, reader)
-	if decompressed {
-		defer nr.Close()
+	// deal with content encoding such as gzip, br
+	nr, _, err := h.tryDecompress(header, reader)
+	if err != nil {
+		h.writeLine("{Decode content-encoding failed:", err, ", len:", discardAll(nr), "}")
+		return
 	}
 
 	// check mime type and charset
@@ -444,6 +1206,11 @@ func (h *HTTPTrafficHandler) printBody(header httpport.Header, reader io.ReadClo
 	isText := mimeType.isTextContent()
 	isBinary := mimeType.isBinaryContent()
 
+	if mimeType.Type == "multipart" {
+		h.printMultipartBody(contentType, nr)
+		return
+	}
+
 	if !isText {
 		err := h.printNonTextTypeBody(nr, contentType, isBinary)
 		if err != nil {
@@ -452,15 +1219,24 @@ func (h *HTTPTrafficHandler) printBody(header httpport.Header, reader io.ReadClo
 		return
 	}
 
+	if mimeType.subType == "www-form-urlencoded" {
+		data, err := ioutil.ReadAll(nr)
+		if err != nil {
+			h.writeLine("{Read body failed", err, "}")
+			return
+		}
+		h.printURLEncoded("form", decodeURLEncoded(string(data), charset))
+		h.writeLine()
+		return
+	}
+
 	var body string
-	var err error
 	if charset == "" {
 		// response do not set charset, try to detect
 		var data []byte
-		data, err := ioutil.ReadAll(nr)
+		data, err = ioutil.ReadAll(nr)
 		if err == nil {
-			// TODO: try to detect charset
-			body = string(data)
+			body = h.decodeUndeclaredCharset(data)
 		}
 	} else {
 		body, err = readToStringWithCharset(nr, charset)
@@ -483,15 +1259,45 @@ func (h *HTTPTrafficHandler) printBody(header httpport.Header, reader io.ReadClo
 	h.writeLine()
 }
 
+// print each message of grpc body, protobuf messages are decoded by wire format, or by message type if known
+func (h *HTTPTrafficHandler) printGRPCBody(header httpport.Header, reader io.Reader) {
+	data, err := ioutil.ReadAll(reader)
+	if err != nil {
+		h.writeLine("{Read body failed", err, "}")
+		return
+	}
+	mimeType, _ := parseContentType(strings.ToLower(header.Get("Content-Type")))
+	messages, rest := splitGRPCMessages(data)
+	for i, message := range messages {
+		payload := message.data
+		if message.compressed {
+			if payload, err = decompressGRPCMessage(payload, header.Get("Grpc-Encoding")); err != nil {
+				h.writeLine("{Decompress message", i+1, "failed", err, "}")
+				continue
+			}
+		}
+		h.writeLine("// message", strconv.Itoa(i+1)+", len:", len(payload))
+		if mimeType == "application/grpc+json" {
+			h.writeLine(string(payload))
+		} else if text, ok := formatProtoMessage(payload, h.protoMessage, h.option.ProtoRegistry); ok {
+			h.write(text)
+		} else {
+			h.writeLine("{Not valid protobuf message}")
+		}
+	}
+	if len(rest) > 0 {
+		h.writeLine("{Incomplete grpc message, len:", len(rest), "}")
+	}
+	h.writeLine()
+}
+
 func (h *HTTPTrafficHandler) printNonTextTypeBody(reader io.Reader, contentType string, isBinary bool) error {
 	if h.option.Force && !isBinary {
 		data, err := ioutil.ReadAll(reader)
 		if err != nil {
 			return err
 		}
-		// TODO: try to detect charset
-		str := string(data)
-		h.writeLine(str)
+		h.writeLine(h.decodeUndeclaredCharset(data))
 		h.writeLine()
 	} else {
 		h.writeLine("{Non-text body, content-type:", contentType, ", len:", discardAll(reader), "}")
@@ -499,8 +1305,24 @@ func (h *HTTPTrafficHandler) printNonTextTypeBody(reader io.Reader, contentType
 	return nil
 }
 
+// decode body which has no charset in content-type, by the charset detected. The charset is printed if not utf-8
+func (h *HTTPTrafficHandler) decodeUndeclaredCharset(data []byte) string {
+	charset, by, bom := detectCharset(data)
+	if charset == "" {
+		return string(data[bom:])
+	}
+	text, err := byteToStringWithCharset(data[bom:], charset)
+	if err != nil {
+		return string(data)
+	}
+	h.writeLine("// charset:", charset+", detected by", by)
+	return text
+}
+
+// read and discard all data until EOF or error. Safe to be called by multiple goroutines
 func discardAll(r io.Reader) (dicarded int) {
-	return tcpreader.DiscardBytesToEOF(r)
+	n, _ := io.Copy(ioutil.Discard, r)
+	return int(n)
 }
 
 func uriToFileName(uri string, t time.Time) string {
@@ -39,6 +39,9 @@ type chunkedReader struct {
 	n   uint64 // unread bytes in chunk
 	err error
 	buf [2]byte
+
+	// each Read wait for the whole chunk, and return data of one chunk only
+	chunkByChunk bool
 }
 
 func (cr *chunkedReader) beginChunk() {
@@ -69,7 +72,7 @@ func (cr *chunkedReader) chunkHeaderAvailable() bool {
 func (cr *chunkedReader) Read(b []uint8) (n int, err error) {
 	for cr.err == nil {
 		if cr.n == 0 {
-			if n > 0 && !cr.chunkHeaderAvailable() {
+			if n > 0 && (cr.chunkByChunk || !cr.chunkHeaderAvailable()) {
 				// We've read enough. Don't potentially block
 				// reading a new chunk header.
 				break
@@ -85,7 +88,11 @@ func (cr *chunkedReader) Read(b []uint8) (n int, err error) {
 			rbuf = rbuf[:cr.n]
 		}
 		var n0 int
-		n0, cr.err = cr.r.Read(rbuf)
+		if cr.chunkByChunk {
+			n0, cr.err = io.ReadFull(cr.r, rbuf)
+		} else {
+			n0, cr.err = cr.r.Read(rbuf)
+		}
 		n += n0
 		b = b[n0:]
 		cr.n -= uint64(n0)
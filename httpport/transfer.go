@@ -626,6 +626,23 @@ type body struct {
 	onHitEOF   func() // if non-nil, func to call when EOF is Read
 }
 
+// ReadChunkByChunk make each Read of chunked body wait for the whole chunk, and return data of one chunk only,
+// if the buffer is large enough. It returns false if r is not a chunked body.
+func ReadChunkByChunk(r io.Reader) bool {
+	b, ok := r.(*body)
+	if !ok {
+		return false
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	cr, ok := b.src.(*chunkedReader)
+	if !ok {
+		return false
+	}
+	cr.chunkByChunk = true
+	return true
+}
+
 // ErrBodyReadAfterClose is returned when reading a Request or Response
 // Body after the body has been closed. This typically happens when the body is
 // read after an HTTP Handler calls WriteHeader or Write on its
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"bufio"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// labels of secrets in NSS key log file
+const (
+	keyLogClientRandom                 = "CLIENT_RANDOM" // tls 1.2 master secret
+	keyLogClientHandshakeTrafficSecret = "CLIENT_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogServerHandshakeTrafficSecret = "SERVER_HANDSHAKE_TRAFFIC_SECRET"
+	keyLogClientTrafficSecret0         = "CLIENT_TRAFFIC_SECRET_0"
+	keyLogServerTrafficSecret0         = "SERVER_TRAFFIC_SECRET_0"
+)
+
+// interval to check the key log file when waiting for a secret
+const keyLogPollInterval = 100 * time.Millisecond
+
+// how long to wait for a secret when capturing live
+const keyLogLiveWait = 2 * time.Second
+
+// keyLog is the tls secrets in NSS key log file, written by browsers and curl with SSLKEYLOGFILE set.
+// The file is read again if a secret is not found and the file has changed, for capturing live traffic
+type keyLog struct {
+	path    string
+	lock    sync.Mutex
+	secrets map[string][]byte // by label and client random
+	size    int64
+	modTime time.Time
+	// how long to wait for a secret not in the file yet. When capturing live, the handshake may be captured
+	// before the client write its secrets
+	wait time.Duration
+}
+
+func loadKeyLog(path string) (*keyLog, error) {
+	keyLog := &keyLog{path: path, secrets: map[string][]byte{}}
+	if err := keyLog.load(); err != nil {
+		return nil, err
+	}
+	return keyLog, nil
+}
+
+// read the file if it has changed
+func (k *keyLog) load() error {
+	info, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	if info.Size() == k.size && info.ModTime().Equal(k.modTime) {
+		return nil
+	}
+	file, err := os.Open(k.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// each line: label, client random, secret, all but label in hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		clientRandom, err := hex.DecodeString(fields[1])
+		if err != nil || len(clientRandom) != 32 {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		k.secrets[keyLogKey(fields[0], clientRandom)] = secret
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	k.size, k.modTime = info.Size(), info.ModTime()
+	return nil
+}
+
+// the secret with label of the connection, nil if not found
+func (k *keyLog) secret(label string, clientRandom []byte) []byte {
+	key := keyLogKey(label, clientRandom)
+	deadline := time.Now().Add(k.wait)
+	for {
+		secret := k.lookup(key)
+		if secret != nil || !time.Now().Before(deadline) {
+			return secret
+		}
+		time.Sleep(keyLogPollInterval)
+	}
+}
+
+// find secret, read the file again if not found
+func (k *keyLog) lookup(key string) []byte {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	if secret, ok := k.secrets[key]; ok {
+		return secret
+	}
+	if err := k.load(); err != nil {
+		return nil
+	}
+	return k.secrets[key]
+}
+
+func keyLogKey(label string, clientRandom []byte) string {
+	return label + " " + string(clientRandom)
+}
@@ -4,27 +4,19 @@ import (
 	"errors"
 	"fmt"
 	"github.com/hsiafan/glow/flagx"
+	"net"
 	"os"
 	"runtime"
-	"time"
 
 	"strconv"
 	"sync"
 
-	"github.com/google/gopacket"
-	"github.com/google/gopacket/layers"
 	"github.com/google/gopacket/pcap"
 )
 
 var waitGroup sync.WaitGroup
 var printerWaitGroup sync.WaitGroup
 
-func listenOneSource(handle *pcap.Handle) chan gopacket.Packet {
-	packetSource := gopacket.NewPacketSource(handle, handle.LinkType())
-	packets := packetSource.Packets()
-	return packets
-}
-
 // set packet capture filter, by ip and port
 func setDeviceFilter(handle *pcap.Handle, filterIP string, filterPort uint16) error {
 	var bpfFilter = "tcp"
@@ -37,20 +29,7 @@ func setDeviceFilter(handle *pcap.Handle, filterIP string, filterPort uint16) er
 	return handle.SetBPFFilter(bpfFilter)
 }
 
-// adapter multi channels to one channel. used to aggregate multi devices data
-func mergeChannel(channels []chan gopacket.Packet) chan gopacket.Packet {
-	var channel = make(chan gopacket.Packet)
-	for _, ch := range channels {
-		go func(c chan gopacket.Packet) {
-			for packet := range c {
-				channel <- packet
-			}
-		}(ch)
-	}
-	return channel
-}
-
-func openSingleDevice(device string, filterIP string, filterPort uint16) (localPackets chan gopacket.Packet, err error) {
+func openSingleDevice(device string, filterIP string, filterPort uint16) (handle *pcap.Handle, err error) {
 	defer func() {
 		if msg := recover(); msg != nil {
 			switch x := msg.(type) {
@@ -61,10 +40,10 @@ func openSingleDevice(device string, filterIP string, filterPort uint16) (localP
 			default:
 				err = errors.New("unknown panic")
 			}
-			localPackets = nil
+			handle = nil
 		}
 	}()
-	handle, err := pcap.OpenLive(device, 65536, false, pcap.BlockForever)
+	handle, err = pcap.OpenLive(device, 65536, false, pcap.BlockForever)
 	if err != nil {
 		return
 	}
@@ -72,7 +51,6 @@ func openSingleDevice(device string, filterIP string, filterPort uint16) (localP
 	if err := setDeviceFilter(handle, filterIP, filterPort); err != nil {
 		fmt.Fprintln(os.Stderr, "set capture filter failed, ", err)
 	}
-	localPackets = listenOneSource(handle)
 	return
 }
 
@@ -102,7 +80,52 @@ func run(option *Option) error {
 		option.StatusSet = statusSet
 	}
 
-	var packets chan gopacket.Packet
+	backpressure, err := parseBackpressurePolicy(option.Backpressure)
+	if err != nil {
+		return err
+	}
+
+	extraMethods, err := parseMethods(option.Methods)
+	if err != nil {
+		return err
+	}
+	option.ExtraMethods = extraMethods
+
+	if option.ProtoDescriptors != "" {
+		registry, err := loadProtoDescriptorSets(option.ProtoDescriptors)
+		if err != nil {
+			return err
+		}
+		option.ProtoRegistry = registry
+	}
+
+	if option.Keylog != "" {
+		keyLog, err := loadKeyLog(option.Keylog)
+		if err != nil {
+			return fmt.Errorf("load key log file %v error: %w", option.Keylog, err)
+		}
+		if option.File == "" {
+			// client may write its secrets after the handshake captured
+			keyLog.wait = keyLogLiveWait
+		}
+		option.KeyLogSecrets = keyLog
+	}
+
+	if option.ExtractDir != "" {
+		if err := os.MkdirAll(option.ExtractDir, 0755); err != nil {
+			return fmt.Errorf("create extract dir %v error: %w", option.ExtractDir, err)
+		}
+	}
+
+	var filterIP net.IP
+	if option.Ip != "" {
+		filterIP = net.ParseIP(option.Ip)
+		if filterIP == nil {
+			return fmt.Errorf("ip filter not valid %v", option.Ip)
+		}
+	}
+
+	var handles []*pcap.Handle
 	if option.File != "" {
 		//TODO: read file stdin
 		// read from pcap file
@@ -110,7 +133,7 @@ func run(option *Option) error {
 		if err != nil {
 			return fmt.Errorf("open file %v error: %w", option.File, err)
 		}
-		packets = listenOneSource(handle)
+		handles = append(handles, handle)
 	} else if option.Device == "any" && runtime.GOOS != "linux" {
 		// capture all device
 		// Only linux 2.2+ support any interface. we have to list all network device and listened on them all
@@ -119,60 +142,49 @@ func run(option *Option) error {
 			return fmt.Errorf("find device error: %w", err)
 		}
 
-		var packetsSlice = make([]chan gopacket.Packet, len(interfaces))
 		for _, itf := range interfaces {
-			localPackets, err := openSingleDevice(itf.Name, option.Ip, uint16(option.Port))
+			handle, err := openSingleDevice(itf.Name, option.Ip, uint16(option.Port))
 			if err != nil {
 				fmt.Fprintln(os.Stderr, "open device", itf, "error:", err)
 				continue
 			}
-			packetsSlice = append(packetsSlice, localPackets)
+			handles = append(handles, handle)
 		}
-		packets = mergeChannel(packetsSlice)
 	} else if option.Device != "" {
 		// capture one device
-		var err error
-		packets, err = openSingleDevice(option.Device, option.Ip, uint16(option.Port))
+		handle, err := openSingleDevice(option.Device, option.Ip, uint16(option.Port))
 		if err != nil {
 			return fmt.Errorf("listen on device %v failed, error: %w", option.Device, err)
 		}
+		handles = append(handles, handle)
 	} else {
 		return errors.New("no device or pcap file specified")
 	}
 
-	var handler = &HTTPConnectionHandler{
+	var handler = &DissectorConnectionHandler{
 		option: option,
 		// TODO: stdout
 		printer: newPrinter(option.Output),
 	}
-	var assembler = newTCPAssembler(handler)
-	assembler.filterIP = option.Ip
+	var assembler = newTCPAssembler(handler, option.Shards, option.Idle)
+	assembler.filterIP = filterIP
 	assembler.filterPort = uint16(option.Port)
-	var ticker = time.Tick(time.Second * 10)
-
-outer:
-	for {
-		select {
-		case packet := <-packets:
-			// A nil packet indicates the end of a pcap file.
-			if packet == nil {
-				break outer
-			}
-
-			// only assembly tcp/ip packets
-			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil ||
-				packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
-				continue
-			}
-			var tcp = packet.TransportLayer().(*layers.TCP)
-
-			assembler.assemble(packet.NetworkLayer().NetworkFlow(), tcp, packet.Metadata().Timestamp)
+	assembler.backpressure = backpressure
+	assembler.dissectors = newDissectors(option, handler.printer)
+	if option.Events {
+		assembler.events = &connectionEvents{printer: handler.printer}
+	}
 
-		case <-ticker:
-			// flush connections that haven't been activity in the idle time
-			assembler.flushOlderThan(time.Now().Add(-option.Idle))
-		}
+	// decode packets of each source in its own goroutine, until all sources reach the end
+	var sourceWaitGroup sync.WaitGroup
+	for _, handle := range handles {
+		sourceWaitGroup.Add(1)
+		go func(handle *pcap.Handle) {
+			defer sourceWaitGroup.Done()
+			newPacketDecoder(assembler, handle.LinkType()).decodeFrom(handle)
+		}(handle)
 	}
+	sourceWaitGroup.Wait()
 
 	assembler.finishAll()
 	waitGroup.Wait()
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/hsiafan/httpdump/httpport"
+)
+
+// print body of multipart types, such as multipart/form-data, part by part with headers of each part.
+// File parts are summarised, and written to the extract dir if set; other parts are printed as bodies
+func (h *HTTPTrafficHandler) printMultipartBody(contentType string, reader io.Reader) {
+	_, params, err := mime.ParseMediaType(contentType)
+	if err != nil || params["boundary"] == "" {
+		h.writeLine("{Multipart body without boundary, content-type:", contentType, ", len:", discardAll(reader), "}")
+		return
+	}
+	multipartReader := multipart.NewReader(reader, params["boundary"])
+	for i := 1; ; i++ {
+		part, err := multipartReader.NextPart()
+		if err == io.EOF {
+			return
+		}
+		if err != nil {
+			h.writeLine("{Read multipart body failed", err, ", len of rest:", discardAll(reader), "}")
+			return
+		}
+		h.writeLine("// part", i)
+		h.printPartHeader(part.Header)
+		h.writeLine()
+		if filename := part.FileName(); filename != "" {
+			h.printFilePart(part, filename)
+			continue
+		}
+		header := httpport.Header(part.Header)
+		if header.Get("Content-Type") == "" {
+			// parts of form-data are text/plain by default
+			header = httpport.Header{"Content-Type": []string{"text/plain"}}
+		}
+		h.printBody(header, ioutil.NopCloser(part))
+	}
+}
+
+// part headers, sorted by name
+func (h *HTTPTrafficHandler) printPartHeader(header textproto.MIMEHeader) {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range header[name] {
+			h.writeLine(name+":", value)
+		}
+	}
+}
+
+// print filename, content-type, size and sha256 of the file, and write the file to extract dir
+func (h *HTTPTrafficHandler) printFilePart(part *multipart.Part, filename string) {
+	hash := sha256.New()
+	var writer io.Writer = hash
+	if h.option.ExtractDir != "" {
+		file, err := createExtractFile(h.option.ExtractDir, filename)
+		if err != nil {
+			h.writeLine("{Extract file failed", err, "}")
+		} else {
+			defer file.Close()
+			h.writeLine("// extract file to:", file.Name())
+			writer = io.MultiWriter(hash, file)
+		}
+	}
+	size, err := io.Copy(writer, part)
+	if err != nil {
+		h.writeLine("{Read file part failed", err, "}")
+	}
+	h.writeLine("{File part, filename:", filename, ", content-type:", part.Header.Get("Content-Type"),
+		", size:", size, ", sha256:", hex.EncodeToString(hash.Sum(nil)), "}")
+	h.writeLine()
+}
+
+// create file in dir for the filename client sent. Directories in the filename are removed, and a number is added
+// to the name if the file already exists
+func createExtractFile(dir string, filename string) (*os.File, error) {
+	name := filename
+	if idx := strings.LastIndexAny(name, `/\`); idx >= 0 {
+		name = name[idx+1:]
+	}
+	if name == "" || name == "." || name == ".." {
+		name = "unnamed"
+	}
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	for i := 1; ; i++ {
+		file, err := os.OpenFile(filepath.Join(dir, name), os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if !os.IsExist(err) {
+			return file, err
+		}
+		name = base + "-" + strconv.Itoa(i) + ext
+	}
+}
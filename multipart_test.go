@@ -0,0 +1,70 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMultipartBody(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	// a file of the same name already exists
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "a.txt"), []byte("old"), 0644))
+
+	body := "--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"title\"\r\n\r\n" +
+		"hello\r\n" +
+		"--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"meta\"\r\nContent-Type: application/json\r\n\r\n" +
+		"{\"a\":1}\r\n" +
+		"--xyz\r\n" +
+		"Content-Disposition: form-data; name=\"file\"; filename=\"../dir/a.txt\"\r\nContent-Type: text/plain\r\n\r\n" +
+		"file content\r\n" +
+		"--xyz--\r\n"
+	request := "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: multipart/form-data; boundary=xyz\r\n" +
+		"Content-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" + body
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(request, testResponse, 1460).
+		close()
+	output := runConversations(t, &Option{Level: "all", ExtractDir: dir}, conversation)
+
+	extracted := filepath.Join(dir, "a-1.txt")
+	assert.Contains(t, output, "\n\n// part 1\nContent-Disposition: form-data; name=\"title\"\n\nhello\n\n"+
+		"// part 2\nContent-Disposition: form-data; name=\"meta\"\nContent-Type: application/json\n\n{\n    \"a\": 1\n}\n\n"+
+		"// part 3\nContent-Disposition: form-data; name=\"file\"; filename=\"../dir/a.txt\"\nContent-Type: text/plain\n\n"+
+		"// extract file to: "+extracted+"\n"+
+		"{File part, filename: a.txt , content-type: text/plain , size: 12 , sha256: "+
+		"e0ac3601005dfa1864f5392aabaf7d898b1b5bab854f1acb4491bcd806b76b0c }\n\n")
+	data, err := ioutil.ReadFile(extracted)
+	assert.NoError(t, err)
+	assert.Equal(t, "file content", string(data))
+}
+
+func TestMultipartWithoutBoundary(t *testing.T) {
+	request := "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: multipart/form-data\r\n" +
+		"Content-Length: 5\r\n\r\nhello"
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(request, testResponse, 1460).
+		close()
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "{Multipart body without boundary, content-type: multipart/form-data , len: 5 }")
+}
+
+func TestCreateExtractFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "extract")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	for filename, expected := range map[string]string{`C:\Users\a\photo.png`: "photo.png", "..": "unnamed",
+		"/etc/passwd": "passwd"} {
+		file, err := createExtractFile(dir, filename)
+		assert.NoError(t, err)
+		assert.Equal(t, filepath.Join(dir, expected), file.Name())
+		file.Close()
+	}
+}
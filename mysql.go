@@ -0,0 +1,683 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// mysql client/server protocol. Each packet has 3 bytes payload length and 1 byte sequence id, payload not
+// shorter than mysqlMaxPayload continue in the next packet
+
+const mysqlMaxPayload = 0xffffff
+
+// commands
+const (
+	mysqlComQuit             = 0x01
+	mysqlComInitDB           = 0x02
+	mysqlComQuery            = 0x03
+	mysqlComFieldList        = 0x04
+	mysqlComChangeUser       = 0x11
+	mysqlComStmtPrepare      = 0x16
+	mysqlComStmtExecute      = 0x17
+	mysqlComStmtSendLongData = 0x18
+	mysqlComStmtClose        = 0x19
+	mysqlComStmtReset        = 0x1a
+	mysqlComStmtFetch        = 0x1c
+)
+
+var mysqlCommandNames = map[byte]string{
+	0x01: "COM_QUIT", 0x02: "COM_INIT_DB", 0x03: "COM_QUERY", 0x04: "COM_FIELD_LIST", 0x05: "COM_CREATE_DB",
+	0x06: "COM_DROP_DB", 0x07: "COM_REFRESH", 0x08: "COM_SHUTDOWN", 0x09: "COM_STATISTICS",
+	0x0a: "COM_PROCESS_INFO", 0x0c: "COM_PROCESS_KILL", 0x0d: "COM_DEBUG", 0x0e: "COM_PING",
+	0x11: "COM_CHANGE_USER", 0x12: "COM_BINLOG_DUMP", 0x16: "COM_STMT_PREPARE", 0x17: "COM_STMT_EXECUTE",
+	0x18: "COM_STMT_SEND_LONG_DATA", 0x19: "COM_STMT_CLOSE", 0x1a: "COM_STMT_RESET", 0x1b: "COM_SET_OPTION",
+	0x1c: "COM_STMT_FETCH", 0x1f: "COM_RESET_CONNECTION",
+}
+
+// capability flags
+const (
+	mysqlClientConnectWithDB              = 0x00000008
+	mysqlClientSSL                        = 0x00000800
+	mysqlClientSecureConnection           = 0x00008000
+	mysqlClientPluginAuthLenencClientData = 0x00200000
+	mysqlClientDeprecateEOF               = 0x01000000
+)
+
+var errMySQLPacketInvalid = errors.New("mysql: invalid packet")
+
+// server status flag, another result set follow
+const mysqlServerMoreResultsExists = 0x0008
+
+// mysqlPacket is a payload, which may be sent in multi packets
+type mysqlPacket struct {
+	seq     byte   // sequence id of the first packet
+	payload []byte // the first sqlMaxKept bytes
+	length  int
+}
+
+func readMySQLPacket(reader *bufio.Reader) (*mysqlPacket, error) {
+	packet := &mysqlPacket{}
+	for first := true; ; first = false {
+		var header [4]byte
+		if _, err := io.ReadFull(reader, header[:]); err != nil {
+			if !first {
+				err = unexpectedEOF(err)
+			}
+			return nil, err
+		}
+		length := int(header[0]) | int(header[1])<<8 | int(header[2])<<16
+		if first {
+			packet.seq = header[3]
+		}
+		var err error
+		if packet.payload, err = readSQLContent(reader, packet.payload, length); err != nil {
+			return nil, err
+		}
+		packet.length += length
+		if length < mysqlMaxPayload {
+			return packet, nil
+		}
+	}
+}
+
+// read packet server send, which is not empty
+func readMySQLServerPacket(reader *streamReader) (*mysqlPacket, error) {
+	packet, err := readMySQLPacket(reader.Reader)
+	if err == nil && len(packet.payload) == 0 {
+		err = errMySQLPacketInvalid
+	}
+	return packet, err
+}
+
+// if the packet is an EOF packet, or OK packet end rows when CLIENT_DEPRECATE_EOF is set
+func (p *mysqlPacket) isEOF() bool {
+	return len(p.payload) > 0 && p.payload[0] == 0xfe && p.length < mysqlMaxPayload
+}
+
+func (p *mysqlPacket) isError() bool {
+	return len(p.payload) > 0 && p.payload[0] == 0xff
+}
+
+// if data is the initial handshake packet server send: protocol version 10, and server version
+func isMySQLGreeting(data []byte) bool {
+	if len(data) < 7 || data[3] != 0 || data[4] != 10 || data[5] < '0' || data[5] > '9' {
+		return false
+	}
+	for _, c := range data[6:] {
+		if c == 0 {
+			return true
+		}
+		if c < 0x20 || c > 0x7e {
+			return false
+		}
+	}
+	return false
+}
+
+// if data is a query or prepare command in one packet, for connections the start of which is not captured
+func isMySQLQuery(data []byte) bool {
+	if len(data) < 6 || data[3] != 0 || data[4] != mysqlComQuery && data[4] != mysqlComStmtPrepare {
+		return false
+	}
+	length := int(data[0]) | int(data[1])<<8 | int(data[2])<<16
+	if length != len(data)-4 {
+		return false
+	}
+	query := data[5:]
+	if data[4] == mysqlComQuery && query[0] == 0 && len(query) > 2 {
+		// query attributes, none
+		query = query[2:]
+	}
+	for i, c := range query {
+		if i >= 16 {
+			break
+		}
+		if c < 0x20 && c != '\t' && c != '\r' && c != '\n' || c == 0x7f {
+			return false
+		}
+	}
+	return true
+}
+
+// mysqlParser parse fields of payload, integers are little endian
+type mysqlParser struct {
+	data   []byte
+	failed bool
+}
+
+func (p *mysqlParser) bytes(n int) []byte {
+	if p.failed || n < 0 || len(p.data) < n {
+		p.failed = true
+		return nil
+	}
+	value := p.data[:n]
+	p.data = p.data[n:]
+	return value
+}
+
+func (p *mysqlParser) uint(n int) uint64 {
+	var value uint64
+	for i, b := range p.bytes(n) {
+		value |= uint64(b) << (8 * i)
+	}
+	return value
+}
+
+// length-encoded integer
+func (p *mysqlParser) lenencInt() uint64 {
+	switch first := p.uint(1); first {
+	case 0xfc:
+		return p.uint(2)
+	case 0xfd:
+		return p.uint(3)
+	case 0xfe:
+		return p.uint(8)
+	default:
+		return first
+	}
+}
+
+func (p *mysqlParser) lenencString() string {
+	return string(p.bytes(int(p.lenencInt())))
+}
+
+// string terminated by NUL
+func (p *mysqlParser) nulString() string {
+	for i, c := range p.data {
+		if c == 0 {
+			value := string(p.data[:i])
+			p.data = p.data[i+1:]
+			return value
+		}
+	}
+	p.failed = true
+	return ""
+}
+
+// describe OK packet, and return the server status
+func parseMySQLOK(payload []byte) (string, uint16) {
+	p := &mysqlParser{data: payload[1:]}
+	affectedRows := p.lenencInt()
+	lastInsertID := p.lenencInt()
+	status := uint16(p.uint(2))
+	if p.failed {
+		return "OK", 0
+	}
+	result := "OK, affected rows: " + strconv.FormatUint(affectedRows, 10)
+	if lastInsertID > 0 {
+		result += ", last insert id: " + strconv.FormatUint(lastInsertID, 10)
+	}
+	return result, status
+}
+
+// describe ERR packet: error code, sql state and message
+func parseMySQLError(payload []byte) string {
+	p := &mysqlParser{data: payload[1:]}
+	code := p.uint(2)
+	result := "ERR " + strconv.FormatUint(code, 10)
+	if len(p.data) > 0 && p.data[0] == '#' {
+		p.bytes(1)
+		result += " (" + string(p.bytes(5)) + ")"
+	}
+	return result + ": " + string(p.data)
+}
+
+// server status in EOF packet, or OK packet end rows
+func parseMySQLEOFStatus(payload []byte) uint16 {
+	if len(payload) == 5 {
+		return binary.LittleEndian.Uint16(payload[3:])
+	}
+	_, status := parseMySQLOK(payload)
+	return status
+}
+
+// mysqlDissector parse mysql connections: server send greeting first, or client send queries
+type mysqlDissector struct {
+	option  *Option
+	printer *Printer
+}
+
+func (d *mysqlDissector) detect(data []byte, fromClient bool) bool {
+	if fromClient {
+		return isMySQLQuery(data)
+	}
+	return isMySQLGreeting(data)
+}
+
+func (d *mysqlDissector) handle(key ConnectionKey, connection *TCPConnection) {
+	handler := &mysqlHandler{
+		sqlPrinter: sqlPrinter{protocol: "MYSQL", key: key, option: d.option, printer: d.printer},
+		statements: map[uint32]string{},
+	}
+	handler.handle(connection)
+}
+
+// mysqlRequest is a command, or the login in handshake response
+type mysqlRequest struct {
+	command      byte
+	login        bool
+	ssl          bool   // login switch to tls
+	capabilities uint32 // of client, in login
+	user         string
+	database     string
+	query        string // query or prepared statement, schema of init db, table of field list
+	statementID  uint32
+	timing       messageTiming
+}
+
+// mysqlHandler pair commands and responses of a mysql connection
+type mysqlHandler struct {
+	sqlPrinter
+	serverVersion      string
+	serverCapabilities uint32
+	// capabilities both sides support, known if the handshake is captured
+	capabilities      uint32
+	capabilitiesKnown bool
+	statements        map[uint32]string // queries of prepared statements, by statement id
+}
+
+func (h *mysqlHandler) handle(connection *TCPConnection) {
+	requestReader := newStreamReader(connection.upStream)
+	responseReader := newStreamReader(connection.downStream)
+
+	// commands are read ahead by another goroutine, server response to them in order
+	queue := make(chan *mysqlRequest, maxPendingRequests)
+	stop := make(chan struct{})
+	requestsDone := make(chan struct{})
+	go func() {
+		defer close(requestsDone)
+		h.readRequests(requestReader, queue, stop)
+		close(queue)
+	}()
+	defer func() {
+		close(stop)
+		discardAll(responseReader)
+		<-requestsDone
+		discardAll(requestReader)
+	}()
+
+	if data, err := responseReader.Peek(5); err == nil && data[3] == 0 && data[4] == 10 {
+		packet, err := readMySQLPacket(responseReader.Reader)
+		if err != nil {
+			return
+		}
+		h.parseGreeting(packet.payload)
+	}
+
+	var err error
+	for request := range queue {
+		transaction := h.describeRequest(request)
+		if err != nil || !h.hasResponse(request) {
+			h.print(transaction)
+			continue
+		}
+		responseStart := responseReader.position()
+		if transaction.response, transaction.details, err = h.readResponse(responseReader, request,
+			transaction.details); err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+				fmt.Fprintln(os.Stderr, "Error parsing mysql response:", err, h.key.srcString())
+			}
+			transaction.response = nil
+		} else {
+			transaction.responseTiming = messageTiming{firstByte: responseReader.timestampAt(responseStart),
+				lastByte: responseReader.lastTimestamp()}
+		}
+		h.print(transaction)
+		if err == errStreamDropped {
+			h.printDroppedMark()
+			return
+		}
+	}
+}
+
+func (h *mysqlHandler) parseGreeting(payload []byte) {
+	p := &mysqlParser{data: payload[1:]}
+	h.serverVersion = p.nulString()
+	p.bytes(4 + 8 + 1) // thread id, auth data, filler
+	h.serverCapabilities = uint32(p.uint(2))
+	if len(p.data) >= 5 {
+		p.bytes(1 + 2) // character set, status
+		h.serverCapabilities |= uint32(p.uint(2)) << 16
+	}
+}
+
+func (h *mysqlHandler) readRequests(reader *streamReader, queue chan<- *mysqlRequest, stop <-chan struct{}) {
+	for first := true; ; first = false {
+		start := reader.position()
+		packet, err := readMySQLPacket(reader.Reader)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+				fmt.Fprintln(os.Stderr, "Error parsing mysql command:", err, h.key.srcString())
+			}
+			return
+		}
+		request := &mysqlRequest{timing: messageTiming{firstByte: reader.timestampAt(start),
+			lastByte: reader.lastTimestamp()}}
+		if first && packet.seq == 1 {
+			parseMySQLLogin(packet.payload, request)
+		} else if packet.seq != 0 || len(packet.payload) == 0 {
+			// auth data, or content of local infile
+			continue
+		} else {
+			parseMySQLCommand(packet.payload, request)
+		}
+		select {
+		case queue <- request:
+		case <-stop:
+			return
+		}
+		if request.ssl || request.command == mysqlComQuit {
+			return
+		}
+	}
+}
+
+// handshake response, or ssl request which has only the first fields
+func parseMySQLLogin(payload []byte, request *mysqlRequest) {
+	request.login = true
+	p := &mysqlParser{data: payload}
+	request.capabilities = uint32(p.uint(4))
+	p.bytes(4 + 1 + 23) // max packet size, character set, filler
+	if len(p.data) == 0 && request.capabilities&mysqlClientSSL != 0 {
+		request.ssl = true
+		return
+	}
+	request.user = p.nulString()
+	switch {
+	case request.capabilities&mysqlClientPluginAuthLenencClientData != 0:
+		p.lenencString()
+	case request.capabilities&mysqlClientSecureConnection != 0:
+		p.bytes(int(p.uint(1)))
+	default:
+		p.nulString()
+	}
+	if request.capabilities&mysqlClientConnectWithDB != 0 {
+		request.database = p.nulString()
+	}
+}
+
+func parseMySQLCommand(payload []byte, request *mysqlRequest) {
+	request.command = payload[0]
+	p := &mysqlParser{data: payload[1:]}
+	switch request.command {
+	case mysqlComQuery:
+		if len(p.data) > 0 && p.data[0] == 0 {
+			// query attributes: parameter count and parameter set count
+			if p.lenencInt() > 0 {
+				request.query = "(query with attributes)"
+				return
+			}
+			p.lenencInt()
+		}
+		request.query = string(p.data)
+	case mysqlComStmtPrepare, mysqlComInitDB:
+		request.query = string(p.data)
+	case mysqlComFieldList:
+		request.query = p.nulString()
+	case mysqlComChangeUser:
+		request.user = p.nulString()
+	case mysqlComStmtExecute, mysqlComStmtSendLongData, mysqlComStmtClose, mysqlComStmtReset, mysqlComStmtFetch:
+		request.statementID = uint32(p.uint(4))
+	}
+}
+
+func (h *mysqlHandler) describeRequest(request *mysqlRequest) *sqlTransaction {
+	transaction := &sqlTransaction{requestTiming: request.timing}
+	add := func(name, value string) {
+		transaction.request = append(transaction.request, sqlField{name, value})
+	}
+	name := mysqlCommandNames[request.command]
+	if name == "" {
+		name = "command 0x" + strconv.FormatUint(uint64(request.command), 16)
+	}
+	switch {
+	case request.ssl:
+		transaction.statement = "SSL REQUEST"
+		add("command", "SSL request, the rest of the connection is encrypted")
+	case request.login:
+		transaction.statement = "LOGIN " + request.user
+		add("login", request.user)
+		if request.database != "" {
+			add("database", request.database)
+		}
+		if h.serverVersion != "" {
+			add("server", h.serverVersion)
+		}
+	case request.command == mysqlComQuery:
+		transaction.statement = request.query
+		add("query", request.query)
+	case request.command == mysqlComStmtPrepare:
+		transaction.statement = "PREPARE " + request.query
+		add("prepare", request.query)
+	case request.command == mysqlComStmtExecute:
+		query := h.statements[request.statementID]
+		transaction.statement = "EXECUTE " + query
+		add("execute", "statement "+strconv.FormatUint(uint64(request.statementID), 10)+": "+query)
+	case request.statementID != 0:
+		transaction.statement = name + " " + strconv.FormatUint(uint64(request.statementID), 10)
+		add("command", transaction.statement)
+		if request.command == mysqlComStmtClose {
+			delete(h.statements, request.statementID)
+		}
+	case request.command == mysqlComInitDB || request.command == mysqlComFieldList:
+		transaction.statement = name + " " + request.query
+		add("command", transaction.statement)
+	case request.command == mysqlComChangeUser:
+		transaction.statement = name + " " + request.user
+		add("command", transaction.statement)
+	default:
+		transaction.statement = name
+		add("command", name)
+	}
+	return transaction
+}
+
+// commands server do not response
+func (h *mysqlHandler) hasResponse(request *mysqlRequest) bool {
+	switch request.command {
+	case mysqlComQuit, mysqlComStmtClose, mysqlComStmtSendLongData:
+		return false
+	}
+	return !request.ssl
+}
+
+// read the response of request, return fields of response and details
+func (h *mysqlHandler) readResponse(reader *streamReader, request *mysqlRequest,
+	details []sqlField) ([]sqlField, []sqlField, error) {
+	var response []sqlField
+	add := func(name, value string) {
+		response = append(response, sqlField{name, value})
+	}
+	switch {
+	case request.login || request.command == mysqlComChangeUser:
+		if request.login {
+			h.capabilities = h.serverCapabilities & request.capabilities
+			h.capabilitiesKnown = h.serverVersion != ""
+		}
+		for {
+			packet, err := readMySQLServerPacket(reader)
+			if err != nil {
+				return nil, nil, err
+			}
+			switch {
+			case packet.isError():
+				add("result", parseMySQLError(packet.payload))
+				return response, details, nil
+			case packet.payload[0] == 0x00:
+				add("result", "OK")
+				return response, details, nil
+			case packet.isEOF():
+				// auth switch request
+				p := &mysqlParser{data: packet.payload[1:]}
+				details = append(details, sqlField{"auth switch", p.nulString()})
+			}
+		}
+	case request.command == mysqlComStmtPrepare:
+		return h.readPrepareResponse(reader, request, details)
+	case request.command == mysqlComQuery || request.command == mysqlComStmtExecute ||
+		request.command == mysqlComStmtFetch:
+		return h.readResultSets(reader, details)
+	case request.command == mysqlComFieldList:
+		columns, err := h.readColumns(reader, -1)
+		if err != nil {
+			return nil, nil, err
+		}
+		add("result", "columns: "+strconv.Itoa(len(columns)))
+		details = append(details, sqlField{"columns", strings.Join(columns, ", ")})
+		return response, details, nil
+	}
+
+	packet, err := readMySQLServerPacket(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case packet.isError():
+		add("result", parseMySQLError(packet.payload))
+	case packet.payload[0] == 0x00:
+		result, _ := parseMySQLOK(packet.payload)
+		add("result", result)
+	case packet.isEOF():
+		add("result", "EOF")
+	default:
+		// statistics
+		add("result", string(packet.payload))
+	}
+	return response, details, nil
+}
+
+// read result sets of query or executed statement, there are more than one if the server status tell
+func (h *mysqlHandler) readResultSets(reader *streamReader, details []sqlField) ([]sqlField, []sqlField, error) {
+	var response []sqlField
+	add := func(name, value string) {
+		response = append(response, sqlField{name, value})
+	}
+	for {
+		packet, err := readMySQLServerPacket(reader)
+		if err != nil {
+			return nil, nil, err
+		}
+		if packet.isError() {
+			add("result", parseMySQLError(packet.payload))
+			return response, details, nil
+		}
+		var status uint16
+		switch packet.payload[0] {
+		case 0x00:
+			var result string
+			result, status = parseMySQLOK(packet.payload)
+			add("result", result)
+		case 0xfb:
+			// client send the file, then server send OK or ERR
+			details = append(details, sqlField{"local infile", string(packet.payload[1:])})
+			continue
+		default:
+			p := &mysqlParser{data: packet.payload}
+			columns, err := h.readColumns(reader, int(p.lenencInt()))
+			if err != nil {
+				return nil, nil, err
+			}
+			rows := 0
+			for {
+				packet, err := readMySQLServerPacket(reader)
+				if err != nil {
+					return nil, nil, err
+				}
+				if packet.isError() {
+					add("result", parseMySQLError(packet.payload))
+					return response, details, nil
+				}
+				if packet.isEOF() {
+					status = parseMySQLEOFStatus(packet.payload)
+					break
+				}
+				rows++
+			}
+			add("result", "rows: "+strconv.Itoa(rows)+", columns: "+strconv.Itoa(len(columns)))
+			details = append(details, sqlField{"columns", strings.Join(columns, ", ")})
+		}
+		if status&mysqlServerMoreResultsExists == 0 {
+			return response, details, nil
+		}
+	}
+}
+
+// response of prepare: statement id, parameter and column definitions
+func (h *mysqlHandler) readPrepareResponse(reader *streamReader, request *mysqlRequest,
+	details []sqlField) ([]sqlField, []sqlField, error) {
+	packet, err := readMySQLServerPacket(reader)
+	if err != nil {
+		return nil, nil, err
+	}
+	if packet.isError() {
+		return []sqlField{{"result", parseMySQLError(packet.payload)}}, details, nil
+	}
+	p := &mysqlParser{data: packet.payload[1:]}
+	statementID := uint32(p.uint(4))
+	columnCount := int(p.uint(2))
+	parameterCount := int(p.uint(2))
+	h.statements[statementID] = request.query
+	if parameterCount > 0 {
+		if _, err := h.readColumns(reader, parameterCount); err != nil {
+			return nil, nil, err
+		}
+	}
+	if columnCount > 0 {
+		columns, err := h.readColumns(reader, columnCount)
+		if err != nil {
+			return nil, nil, err
+		}
+		details = append(details, sqlField{"columns", strings.Join(columns, ", ")})
+	}
+	result := "statement " + strconv.FormatUint(uint64(statementID), 10) + ", parameters: " +
+		strconv.Itoa(parameterCount) + ", columns: " + strconv.Itoa(columnCount)
+	return []sqlField{{"result", result}}, details, nil
+}
+
+// read column definitions and the EOF packet after them, return the column names.
+// If count is -1, read until EOF packet
+func (h *mysqlHandler) readColumns(reader *streamReader, count int) ([]string, error) {
+	var columns []string
+	for i := 0; i < count || count < 0; i++ {
+		packet, err := readMySQLServerPacket(reader)
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 && (packet.isEOF() || packet.isError()) {
+			return columns, nil
+		}
+		// catalog, schema, table, original table, name
+		p := &mysqlParser{data: packet.payload}
+		for j := 0; j < 4; j++ {
+			p.lenencString()
+		}
+		columns = append(columns, p.lenencString())
+	}
+	return columns, h.skipEOF(reader)
+}
+
+// skip EOF packet after definitions, which is not sent if CLIENT_DEPRECATE_EOF is set
+func (h *mysqlHandler) skipEOF(reader *streamReader) error {
+	if h.capabilitiesKnown {
+		if h.capabilities&mysqlClientDeprecateEOF == 0 {
+			_, err := readMySQLServerPacket(reader)
+			return err
+		}
+		return nil
+	}
+	// the capabilities are not known, EOF packet has 5 bytes
+	data, err := reader.Peek(5)
+	if err != nil {
+		return err
+	}
+	if data[0] == 5 && data[1] == 0 && data[2] == 0 && data[4] == 0xfe {
+		_, err = readMySQLServerPacket(reader)
+	}
+	return err
+}
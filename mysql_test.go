@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mysql packets, each with sequence id and payload
+func mysqlPackets(seq byte, payloads ...string) string {
+	var builder strings.Builder
+	for _, payload := range payloads {
+		builder.Write([]byte{byte(len(payload)), byte(len(payload) >> 8), byte(len(payload) >> 16), seq})
+		builder.WriteString(payload)
+		seq++
+	}
+	return builder.String()
+}
+
+func mysqlLenenc(values ...string) string {
+	var builder strings.Builder
+	for _, value := range values {
+		builder.WriteByte(byte(len(value)))
+		builder.WriteString(value)
+	}
+	return builder.String()
+}
+
+func mysqlColumn(name string) string {
+	return mysqlLenenc("def", "test", "users", "users", name, name) + "\x0c\x21\x00\xff\x00\x00\x00\xfd\x00\x00\x00\x00"
+}
+
+func TestMySQL(t *testing.T) {
+	const eof = "\xfe\x00\x00\x02\x00"
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.server.port = 3306
+	conversation.handshake()
+	// protocol 41, connect with db, secure connection, plugin auth
+	conversation.add(conversation.send(false, mysqlPackets(0, "\x0a8.0.33\x00\x01\x00\x00\x00abcdefgh\x00"+
+		"\x08\xa2\x21\x02\x00\x08\x00\x15"+strings.Repeat("\x00", 10)+"ijklmnopqrstu\x00mysql_native_password\x00"),
+		1460)...)
+	conversation.add(conversation.ack(true))
+	conversation.exchange(mysqlPackets(1, "\x08\xa2\x08\x00\x00\x00\x00\x01\x21"+strings.Repeat("\x00", 23)+
+		"root\x00\x14"+strings.Repeat("x", 20)+"test\x00"), mysqlPackets(2, "\x00\x00\x00\x02\x00\x00\x00"), 1460)
+	conversation.exchange(mysqlPackets(0, "\x03SELECT id, name FROM users"),
+		mysqlPackets(1, "\x02", mysqlColumn("id"), mysqlColumn("name"), eof, mysqlLenenc("1", "alice"),
+			mysqlLenenc("2", "bob"), eof), 1460)
+	conversation.exchange(mysqlPackets(0, "\x03UPDATE users SET name = 'x'"),
+		mysqlPackets(1, "\x00\x03\x00\x02\x00\x00\x00"), 1460)
+	conversation.exchange(mysqlPackets(0, "\x03SELECT * FROM missing"),
+		mysqlPackets(1, "\xff\x7a\x04#42S02Table 'test.missing' doesn't exist"), 1460)
+	conversation.exchange(mysqlPackets(0, "\x16SELECT name FROM users WHERE id = ?"),
+		mysqlPackets(1, "\x00\x01\x00\x00\x00\x01\x00\x01\x00\x00\x00\x00", mysqlColumn("?"), eof,
+			mysqlColumn("name"), eof), 1460)
+	conversation.exchange(mysqlPackets(0, "\x17\x01\x00\x00\x00\x00\x01\x00\x00\x00\x01\x03\x00\x01\x00\x00\x00"),
+		mysqlPackets(1, "\x01", mysqlColumn("name"), eof, "\x00\x00"+mysqlLenenc("alice"), eof), 1460)
+	conversation.exchange(mysqlPackets(0, "\x19\x01\x00\x00\x00"), "", 1460)
+	conversation.exchange(mysqlPackets(0, "\x01"), "", 1460)
+	conversation.close()
+
+	output := runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "MYSQL LOGIN root -> OK, latency: 2ms\n"+
+		"MYSQL SELECT id, name FROM users -> rows: 2, columns: 2, latency: 2ms\n"+
+		"MYSQL UPDATE users SET name = 'x' -> OK, affected rows: 3, latency: 2ms\n"+
+		"MYSQL SELECT * FROM missing -> ERR 1146 (42S02): Table 'test.missing' doesn't exist, latency: 2ms\n"+
+		"MYSQL PREPARE SELECT name FROM users WHERE id = ? -> statement 1, parameters: 1, columns: 1, latency: 2ms\n"+
+		"MYSQL EXECUTE SELECT name FROM users WHERE id = ? -> rows: 1, columns: 1, latency: 2ms\n"+
+		"MYSQL COM_STMT_CLOSE 1 -> no response\n"+
+		"MYSQL COM_QUIT -> no response\n", output)
+
+	messages := runConversationMessages(t, &Option{Level: "all"}, conversation)
+	assert.Equal(t, "\n**********  MYSQL  10.0.0.1:10000  ----->  10.0.0.2:3306  //  "+
+		"2020-01-01T00:00:00.006Z - 2020-01-01T00:00:00.008Z = 2ms\n"+
+		"login: root\ndatabase: test\nserver: 8.0.33\nresult: OK\n", messages[0])
+	assert.Contains(t, messages[1], "\nquery: SELECT id, name FROM users\nresult: rows: 2, columns: 2\n"+
+		"columns: id, name\n")
+}
+
+func TestMySQLWithoutHandshake(t *testing.T) {
+	// CLIENT_DEPRECATE_EOF, rows end with OK packet
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.server.port = 3306
+	conversation.exchange(mysqlPackets(0, "\x03SELECT 1"),
+		mysqlPackets(1, "\x01", mysqlColumn("1"), mysqlLenenc("1"), "\xfe\x00\x00\x02\x00\x00\x00"), 1460)
+	conversation.exchange(mysqlPackets(0, "\x03select 2"),
+		mysqlPackets(1, "\x01", mysqlColumn("2"), "\xfe\x00\x00\x02\x00\x00\x00"), 1460)
+	output := runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "MYSQL SELECT 1 -> rows: 1, columns: 1, latency: 2ms\n"+
+		"MYSQL select 2 -> rows: 0, columns: 1, latency: 2ms\n", output)
+}
+
+func TestMySQLDetect(t *testing.T) {
+	assert.True(t, isMySQLGreeting([]byte(mysqlPackets(0, "\x0a5.7.44-log\x00\x01\x00\x00\x00"))))
+	assert.False(t, isMySQLGreeting([]byte(mysqlPackets(0, "\x0a\x00"))))
+	assert.True(t, isMySQLQuery([]byte(mysqlPackets(0, "\x03SELECT 1"))))
+	assert.True(t, isMySQLQuery([]byte(mysqlPackets(0, "\x03\x00\x01SELECT 1"))))
+	assert.False(t, isMySQLQuery([]byte(mysqlPackets(0, "\x03SELECT 1")+"x")))
+	assert.False(t, isMySQLQuery([]byte(mysqlPackets(1, "\x03SELECT 1"))))
+}
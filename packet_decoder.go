@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// packetDataSource is where raw packets come from, usually a pcap handle.
+// Data returned by ZeroCopyReadPacketData is only valid until next call.
+type packetDataSource interface {
+	ZeroCopyReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// packetDecoder decode packets from one source, and feed tcp packets to assembler.
+// Layers are decoded into reused structs, so decoding one packet do not allocate;
+// payload is copied only if it belongs to a connection tracked by assembler.
+// A packetDecoder should be used by only one goroutine.
+type packetDecoder struct {
+	assembler *TCPAssembler
+
+	ethernet layers.Ethernet
+	linuxSLL layers.LinuxSLL
+	loopback layers.Loopback
+	ipv4     layers.IPv4
+	ipv6     layers.IPv6
+	tcp      layers.TCP
+	parser   *gopacket.DecodingLayerParser
+	decoded  []gopacket.LayerType
+	linkType layers.LinkType // used by slow path, when link type is not supported by parser
+
+	// endpoints of current decoded packet
+	src Endpoint
+	dst Endpoint
+
+	// connections seen http data, payload of these connections should be copied and sent to assembler
+	tracked   map[ConnectionID]*trackedConnection
+	lastPrune time.Time
+}
+
+// trackedConnection record the close state of a connection with payload being copied
+type trackedConnection struct {
+	lastTimestamp time.Time
+	finished      [2]bool // if FIN has been sent from the lower endpoint, and the higher endpoint
+}
+
+func newPacketDecoder(assembler *TCPAssembler, linkType layers.LinkType) *packetDecoder {
+	d := &packetDecoder{
+		assembler: assembler,
+		tracked:   map[ConnectionID]*trackedConnection{},
+		linkType:  linkType,
+	}
+	if first, ok := linkLayerTypes[linkType]; ok {
+		d.parser = gopacket.NewDecodingLayerParser(first,
+			&d.ethernet, &d.linuxSLL, &d.loopback, &d.ipv4, &d.ipv6, &d.tcp)
+		// stop at tcp payload, or when meet layers we do not care, such as udp
+		d.parser.IgnoreUnsupported = true
+		d.decoded = make([]gopacket.LayerType, 0, 8)
+	}
+	return d
+}
+
+// the first layer of packets, for link types packetDecoder can decode without gopacket.NewPacket
+var linkLayerTypes = map[layers.LinkType]gopacket.LayerType{
+	layers.LinkTypeEthernet: layers.LayerTypeEthernet,
+	layers.LinkTypeLinuxSLL: layers.LayerTypeLinuxSLL,
+	layers.LinkTypeNull:     layers.LayerTypeLoopback,
+	layers.LinkTypeLoop:     layers.LayerTypeLoopback,
+	layers.LinkTypeRaw:      layers.LayerTypeIPv4,
+	layers.LinkTypeIPv4:     layers.LayerTypeIPv4,
+	layers.LinkTypeIPv6:     layers.LayerTypeIPv6,
+}
+
+// read and process packets until source reach the end
+func (d *packetDecoder) decodeFrom(source packetDataSource) {
+	for {
+		data, ci, err := source.ZeroCopyReadPacketData()
+		if err == io.EOF || err == syscall.EBADF {
+			return
+		}
+		if err != nil {
+			if temporary, ok := err.(interface{ Temporary() bool }); ok && temporary.Temporary() {
+				continue
+			}
+			fmt.Fprintln(os.Stderr, "read packet error:", err)
+			continue
+		}
+
+		if !d.decode(data) {
+			continue
+		}
+		tcp := d.segment(ci.Timestamp)
+		if tcp == nil {
+			continue
+		}
+		d.assembler.assemble(d.src, d.dst, tcp, ci.Timestamp)
+	}
+}
+
+// decode packet data into layers. return false if is not a tcp/ip packet
+func (d *packetDecoder) decode(data []byte) bool {
+	if d.parser == nil {
+		return d.decodeSlow(data)
+	}
+	if err := d.parser.DecodeLayers(data, &d.decoded); err != nil {
+		return false
+	}
+	var srcIP, dstIP []byte
+	var isTCP bool
+	for _, layerType := range d.decoded {
+		switch layerType {
+		case layers.LayerTypeIPv4:
+			srcIP, dstIP = d.ipv4.SrcIP, d.ipv4.DstIP
+		case layers.LayerTypeIPv6:
+			srcIP, dstIP = d.ipv6.SrcIP, d.ipv6.DstIP
+		case layers.LayerTypeTCP:
+			isTCP = true
+		}
+	}
+	if !isTCP || srcIP == nil {
+		return false
+	}
+	d.src = newEndpoint(srcIP, uint16(d.tcp.SrcPort))
+	d.dst = newEndpoint(dstIP, uint16(d.tcp.DstPort))
+	return true
+}
+
+// decode packet with all gopacket decoders, for link types the parser can not handle
+func (d *packetDecoder) decodeSlow(data []byte) bool {
+	packet := gopacket.NewPacket(data, d.linkType, gopacket.NoCopy)
+	tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP)
+	if !ok {
+		return false
+	}
+	var srcIP, dstIP net.IP
+	switch ip := packet.NetworkLayer().(type) {
+	case *layers.IPv4:
+		srcIP, dstIP = ip.SrcIP, ip.DstIP
+	case *layers.IPv6:
+		srcIP, dstIP = ip.SrcIP, ip.DstIP
+	default:
+		return false
+	}
+	d.tcp = *tcp
+	d.src = newEndpoint(srcIP, uint16(tcp.SrcPort))
+	d.dst = newEndpoint(dstIP, uint16(tcp.DstPort))
+	return true
+}
+
+// build the tcp packet to send to assembler, from current decoded packet.
+// return nil if the packet should be dropped
+func (d *packetDecoder) segment(timestamp time.Time) *layers.TCP {
+	if d.assembler.filtered(d.src, d.dst) {
+		return nil
+	}
+
+	id := newConnectionID(d.src, d.dst)
+	tracked := d.tracked[id]
+	payload := d.tcp.Payload
+	if len(payload) > 0 {
+		if tracked == nil && d.assembler.isStartData(payload) {
+			tracked = &trackedConnection{}
+			d.tracked[id] = tracked
+		}
+		if tracked != nil {
+			payload = append([]byte(nil), payload...)
+		} else {
+			// assembler will not use data of this connection
+			payload = nil
+		}
+	}
+
+	if tracked != nil {
+		tracked.lastTimestamp = timestamp
+		if d.tcp.FIN {
+			tracked.finished[id.indexOf(d.src)] = true
+		}
+		if d.tcp.RST || tracked.finished[0] && tracked.finished[1] {
+			delete(d.tracked, id)
+		}
+	}
+	d.pruneTracked(timestamp)
+
+	return &layers.TCP{
+		SrcPort:   d.tcp.SrcPort,
+		DstPort:   d.tcp.DstPort,
+		Seq:       d.tcp.Seq,
+		Ack:       d.tcp.Ack,
+		FIN:       d.tcp.FIN,
+		SYN:       d.tcp.SYN,
+		RST:       d.tcp.RST,
+		PSH:       d.tcp.PSH,
+		ACK:       d.tcp.ACK,
+		Window:    d.tcp.Window,
+		BaseLayer: layers.BaseLayer{Payload: payload},
+	}
+}
+
+// remove tracked connections have no packet in idle time, these are flushed by assembler too
+func (d *packetDecoder) pruneTracked(timestamp time.Time) {
+	idle := d.assembler.idle
+	if timestamp.Sub(d.lastPrune) < idle {
+		return
+	}
+	d.lastPrune = timestamp
+	for id, tracked := range d.tracked {
+		if timestamp.Sub(tracked.lastTimestamp) > idle {
+			delete(d.tracked, id)
+		}
+	}
+}
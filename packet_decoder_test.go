@@ -0,0 +1,130 @@
+package main
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcap"
+	"github.com/stretchr/testify/assert"
+)
+
+// sample pcap with 20 http connections, and 10 non-http connections on port 443
+const samplePcapFile = "testdata/http.pcap"
+
+// read all packet data in pcap file to memory
+func readPcapFile(tb testing.TB, file string) (layers.LinkType, [][]byte, []gopacket.CaptureInfo) {
+	handle, err := pcap.OpenOffline(file)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer handle.Close()
+	var packets [][]byte
+	var cis []gopacket.CaptureInfo
+	for {
+		data, ci, err := handle.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			tb.Fatal(err)
+		}
+		packets = append(packets, data)
+		cis = append(cis, ci)
+	}
+	return handle.LinkType(), packets, cis
+}
+
+func TestPacketDecoder(t *testing.T) {
+	assembler := &TCPAssembler{idle: time.Minute, dissectors: httpDissectors()}
+	linkType, packets, cis := readPcapFile(t, samplePcapFile)
+	decoder := newPacketDecoder(assembler, linkType)
+
+	var tcpCount, payloadCount int
+	for i, data := range packets {
+		if !decoder.decode(data) {
+			continue
+		}
+		tcpCount++
+		tcp := decoder.segment(cis[i].Timestamp)
+		if len(tcp.Payload) > 0 {
+			payloadCount++
+			// payload is copied
+			assert.False(t, &tcp.Payload[0] == &decoder.tcp.Payload[0])
+		} else if len(decoder.tcp.Payload) > 0 {
+			// non-http connection, payload not copied
+			assert.True(t, decoder.src.port == 443 || decoder.dst.port == 443)
+		}
+	}
+	assert.Equal(t, len(packets), tcpCount)
+	// 20 requests, and 2 packets for each response
+	assert.Equal(t, 20*3, payloadCount)
+	// all connections closed
+	assert.Equal(t, 0, len(decoder.tracked))
+}
+
+func TestPacketDecoderFilter(t *testing.T) {
+	assembler := &TCPAssembler{idle: time.Minute, dissectors: httpDissectors(), filterIP: net.ParseIP("10.0.0.3")}
+	linkType, packets, cis := readPcapFile(t, samplePcapFile)
+	decoder := newPacketDecoder(assembler, linkType)
+	for i, data := range packets {
+		assert.True(t, decoder.decode(data))
+		assert.Nil(t, decoder.segment(cis[i].Timestamp))
+	}
+}
+
+// the way packets were decoded before packetDecoder
+func BenchmarkPacketSourceDecode(b *testing.B) {
+	linkType, packets, _ := readPcapFile(b, samplePcapFile)
+	var size int64
+	for _, data := range packets {
+		size += int64(len(data))
+	}
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for _, data := range packets {
+			packet := gopacket.NewPacket(data, linkType, gopacket.Default)
+			if packet.NetworkLayer() == nil || packet.TransportLayer() == nil ||
+				packet.TransportLayer().LayerType() != layers.LayerTypeTCP {
+				continue
+			}
+			tcp := packet.TransportLayer().(*layers.TCP)
+			flow := packet.NetworkLayer().NetworkFlow()
+			src := flow.Src().String() + ":" + tcp.SrcPort.String()
+			dst := flow.Dst().String() + ":" + tcp.DstPort.String()
+			var key string
+			if src < dst {
+				key = src + "-" + dst
+			} else {
+				key = dst + "-" + src
+			}
+			_ = key
+		}
+	}
+}
+
+func BenchmarkPacketDecoder(b *testing.B) {
+	linkType, packets, cis := readPcapFile(b, samplePcapFile)
+	var size int64
+	for _, data := range packets {
+		size += int64(len(data))
+	}
+	decoder := newPacketDecoder(&TCPAssembler{idle: time.Minute, dissectors: httpDissectors()}, linkType)
+	b.SetBytes(size)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		for j, data := range packets {
+			if !decoder.decode(data) {
+				continue
+			}
+			_ = newConnectionID(decoder.src, decoder.dst).hash()
+			decoder.segment(cis[j].Timestamp)
+		}
+	}
+}
@@ -0,0 +1,525 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// postgresql frontend/backend protocol 3.0. Each message has a type byte and 4 bytes length including itself,
+// except the messages client send at connection start, which have no type byte
+
+// request codes of messages client send at connection start
+const (
+	postgresSSLRequest    = 80877103
+	postgresGSSENCRequest = 80877104
+	postgresCancelRequest = 80877102
+)
+
+var errPostgresMessageInvalid = errors.New("postgres: invalid message")
+
+// postgresMessage is a message, kind is 0 for messages without type byte
+type postgresMessage struct {
+	kind byte
+	body []byte // the first sqlMaxKept bytes
+}
+
+func readPostgresMessage(reader *bufio.Reader) (*postgresMessage, error) {
+	var header [5]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[1:]))
+	if length < 4 || length > 1<<30 {
+		return nil, errPostgresMessageInvalid
+	}
+	body, err := readSQLContent(reader, nil, length-4)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresMessage{kind: header[0], body: body}, nil
+}
+
+// read message without type byte, the body start with request code
+func readPostgresStartMessage(reader *bufio.Reader) (*postgresMessage, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, err
+	}
+	length := int(binary.BigEndian.Uint32(header[:]))
+	if length < 8 || length > 10000 {
+		return nil, errPostgresMessageInvalid
+	}
+	body, err := readSQLContent(reader, nil, length-4)
+	if err != nil {
+		return nil, err
+	}
+	return &postgresMessage{body: body}, nil
+}
+
+// if data is a message client send at connection start: startup message of protocol 3, or the requests for
+// ssl, gss encryption and cancel
+func isPostgresStartMessage(data []byte) bool {
+	if len(data) < 8 {
+		return false
+	}
+	length := binary.BigEndian.Uint32(data)
+	code := binary.BigEndian.Uint32(data[4:])
+	switch code {
+	case postgresSSLRequest, postgresGSSENCRequest:
+		return length == 8
+	case postgresCancelRequest:
+		return length == 16
+	}
+	// user parameter is required
+	return code>>16 == 3 && length > 8 && length <= 10000 &&
+		strings.Contains(string(data[8:]), "user\x00")
+}
+
+// if data start with a query or parse message, for connections the start of which is not captured
+func isPostgresQuery(data []byte) bool {
+	if len(data) < 6 || data[0] != 'Q' && data[0] != 'P' {
+		return false
+	}
+	length := int(binary.BigEndian.Uint32(data[1:]))
+	if length < 6 || length+1 > len(data) {
+		return false
+	}
+	if length+1 < len(data) && !strings.ContainsRune("PBDESHCQ", rune(data[length+1])) {
+		return false
+	}
+	body := data[5 : length+1]
+	if data[0] == 'Q' && body[len(body)-1] != 0 || data[0] == 'P' && strings.Count(string(body), "\x00") < 2 {
+		return false
+	}
+	for i, c := range body {
+		if c == 0 {
+			break
+		}
+		if i >= 16 || c < 0x20 && c != '\t' && c != '\r' && c != '\n' {
+			return i >= 16
+		}
+	}
+	return true
+}
+
+// postgresParser parse fields of message body, integers are big endian
+type postgresParser struct {
+	data   []byte
+	failed bool
+}
+
+func (p *postgresParser) bytes(n int) []byte {
+	if p.failed || n < 0 || len(p.data) < n {
+		p.failed = true
+		return nil
+	}
+	value := p.data[:n]
+	p.data = p.data[n:]
+	return value
+}
+
+func (p *postgresParser) int16() int {
+	value := p.bytes(2)
+	if value == nil {
+		return 0
+	}
+	return int(int16(binary.BigEndian.Uint16(value)))
+}
+
+// a count of items, 0 if invalid
+func (p *postgresParser) count() int {
+	count := p.int16()
+	if count < 0 {
+		p.failed = true
+		return 0
+	}
+	return count
+}
+
+func (p *postgresParser) int32() int {
+	value := p.bytes(4)
+	if value == nil {
+		return 0
+	}
+	return int(int32(binary.BigEndian.Uint32(value)))
+}
+
+// string terminated by NUL
+func (p *postgresParser) cstring() string {
+	for i, c := range p.data {
+		if c == 0 {
+			value := string(p.data[:i])
+			p.data = p.data[i+1:]
+			return value
+		}
+	}
+	p.failed = true
+	return ""
+}
+
+// describe ErrorResponse or NoticeResponse: severity, sql state and message
+func parsePostgresError(body []byte) string {
+	fields := map[byte]string{}
+	p := &postgresParser{data: body}
+	for len(p.data) > 0 && p.data[0] != 0 && !p.failed {
+		code := p.bytes(1)[0]
+		fields[code] = p.cstring()
+	}
+	severity := fields['V']
+	if severity == "" {
+		severity = fields['S']
+	}
+	return severity + " " + fields['C'] + ": " + fields['M']
+}
+
+// postgresDissector parse postgresql connections: client send startup message first, or queries
+type postgresDissector struct {
+	option  *Option
+	printer *Printer
+}
+
+func (d *postgresDissector) detect(data []byte, fromClient bool) bool {
+	return fromClient && (isPostgresStartMessage(data) || isPostgresQuery(data))
+}
+
+func (d *postgresDissector) handle(key ConnectionKey, connection *TCPConnection) {
+	handler := &postgresHandler{
+		sqlPrinter: sqlPrinter{protocol: "POSTGRES", key: key, option: d.option, printer: d.printer},
+	}
+	handler.handle(connection)
+}
+
+// postgresRequest is messages client send before server reply ReadyForQuery: a simple query, messages of
+// extended query end with Sync, a function call, or startup message.
+// Requests for encryption and cancel get no ReadyForQuery
+type postgresRequest struct {
+	code       int // request code of message without type byte
+	user       string
+	database   string
+	queries    []string // simple query, or queries of statements bound
+	prepares   []string // queries of statements parsed but not bound
+	parameters []string // values of bind parameters
+	function   bool
+	timing     messageTiming
+}
+
+// postgresHandler pair requests and responses of a postgresql connection
+type postgresHandler struct {
+	sqlPrinter
+}
+
+func (h *postgresHandler) handle(connection *TCPConnection) {
+	requestReader := newStreamReader(connection.upStream)
+	responseReader := newStreamReader(connection.downStream)
+
+	// requests are read ahead by another goroutine, server response to them in order
+	queue := make(chan *postgresRequest, maxPendingRequests)
+	stop := make(chan struct{})
+	requestsDone := make(chan struct{})
+	go func() {
+		defer close(requestsDone)
+		h.readRequests(requestReader, queue, stop)
+		close(queue)
+	}()
+	defer func() {
+		close(stop)
+		discardAll(responseReader)
+		<-requestsDone
+		discardAll(requestReader)
+	}()
+
+	var err error
+	for request := range queue {
+		transaction := h.describeRequest(request)
+		if err != nil || request.code == postgresCancelRequest {
+			h.print(transaction)
+			continue
+		}
+		responseStart := responseReader.position()
+		var encrypted bool
+		if request.code == postgresSSLRequest || request.code == postgresGSSENCRequest {
+			encrypted, err = h.readEncryptionResponse(responseReader, transaction)
+		} else {
+			err = h.readResponse(responseReader, transaction)
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+				fmt.Fprintln(os.Stderr, "Error parsing postgres response:", err, h.key.srcString())
+			}
+			transaction.response = nil
+		} else {
+			transaction.responseTiming = messageTiming{firstByte: responseReader.timestampAt(responseStart),
+				lastByte: responseReader.lastTimestamp()}
+		}
+		h.print(transaction)
+		if err == errStreamDropped {
+			h.printDroppedMark()
+			return
+		}
+		if encrypted {
+			return
+		}
+	}
+}
+
+func (h *postgresHandler) readRequests(reader *streamReader, queue chan<- *postgresRequest,
+	stop <-chan struct{}) {
+	send := func(request *postgresRequest) bool {
+		select {
+		case queue <- request:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	statements := map[string]string{} // queries of prepared statements, by name
+	var batch *postgresRequest        // extended query messages before Sync
+	var prepared []string             // names of statements parsed in the batch
+	for {
+		start := reader.position()
+		data, err := reader.Peek(1)
+		if err != nil {
+			return
+		}
+		var message *postgresMessage
+		if data[0] == 0 {
+			// message without type byte, length of which is less than 1<<24
+			message, err = readPostgresStartMessage(reader.Reader)
+		} else {
+			message, err = readPostgresMessage(reader.Reader)
+		}
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+				fmt.Fprintln(os.Stderr, "Error parsing postgres request:", err, h.key.srcString())
+			}
+			return
+		}
+		timing := messageTiming{firstByte: reader.timestampAt(start), lastByte: reader.lastTimestamp()}
+		p := &postgresParser{data: message.body}
+
+		switch message.kind {
+		case 0:
+			request := &postgresRequest{code: p.int32(), timing: timing}
+			for request.code>>16 == 3 && len(p.data) > 1 && !p.failed {
+				name, value := p.cstring(), p.cstring()
+				if name == "user" {
+					request.user = value
+				} else if name == "database" {
+					request.database = value
+				}
+			}
+			if !send(request) || request.code == postgresCancelRequest || request.code == postgresGSSENCRequest {
+				// gss encrypted data can not be told from startup message, not parsed even if the server refuse
+				return
+			}
+			if request.code == postgresSSLRequest {
+				// tls ClientHello if the server accept
+				if data, err := reader.Peek(1); err != nil || data[0] == tlsRecordTypeHandshake {
+					return
+				}
+			}
+		case 'Q':
+			if !send(&postgresRequest{queries: []string{p.cstring()}, timing: timing}) {
+				return
+			}
+		case 'F':
+			if !send(&postgresRequest{function: true, timing: timing}) {
+				return
+			}
+		case 'P', 'B', 'C', 'S':
+			if batch == nil {
+				batch = &postgresRequest{timing: timing}
+				prepared = nil
+			}
+			batch.timing.lastByte = timing.lastByte
+			switch message.kind {
+			case 'P':
+				name := p.cstring()
+				statements[name] = p.cstring()
+				prepared = append(prepared, name)
+			case 'B':
+				p.cstring() // portal
+				name := p.cstring()
+				batch.queries = append(batch.queries, statements[name])
+				batch.parameters = append(batch.parameters, parsePostgresBind(p)...)
+				for i, parsed := range prepared {
+					if parsed == name {
+						prepared = append(prepared[:i], prepared[i+1:]...)
+						break
+					}
+				}
+			case 'C':
+				if target := p.bytes(1); target != nil && target[0] == 'S' {
+					delete(statements, p.cstring())
+				}
+			case 'S':
+				for _, name := range prepared {
+					batch.prepares = append(batch.prepares, statements[name])
+				}
+				if !send(batch) {
+					return
+				}
+				batch = nil
+			}
+		case 'X':
+			return
+		}
+		// messages not waiting for response: password, copy data, describe, execute, flush
+	}
+}
+
+// values of parameters in Bind message, after portal and statement name
+func parsePostgresBind(p *postgresParser) []string {
+	formats := make([]int, p.count())
+	for i := range formats {
+		formats[i] = p.int16()
+	}
+	count := p.count()
+	var values []string
+	for i := 0; i < count && !p.failed; i++ {
+		length := p.int32()
+		format := 0
+		if len(formats) == 1 {
+			format = formats[0]
+		} else if i < len(formats) {
+			format = formats[i]
+		}
+		switch {
+		case length < 0:
+			values = append(values, "NULL")
+		case format == 0:
+			values = append(values, strconv.Quote(string(p.bytes(length))))
+		default:
+			p.bytes(length)
+			values = append(values, "(binary "+strconv.Itoa(length)+" bytes)")
+		}
+	}
+	return values
+}
+
+func (h *postgresHandler) describeRequest(request *postgresRequest) *sqlTransaction {
+	transaction := &sqlTransaction{requestTiming: request.timing}
+	add := func(name, value string) {
+		transaction.request = append(transaction.request, sqlField{name, value})
+	}
+	switch {
+	case request.code == postgresSSLRequest:
+		transaction.statement = "SSL REQUEST"
+		add("command", "SSL request")
+	case request.code == postgresGSSENCRequest:
+		transaction.statement = "GSSENC REQUEST"
+		add("command", "GSS encryption request")
+	case request.code == postgresCancelRequest:
+		transaction.statement = "CANCEL REQUEST"
+		add("command", "cancel request")
+	case request.code != 0:
+		transaction.statement = "LOGIN " + request.user
+		add("login", request.user)
+		if request.database != "" {
+			add("database", request.database)
+		}
+	case request.function:
+		transaction.statement = "FUNCTION CALL"
+		add("command", "function call")
+	default:
+		for _, query := range request.queries {
+			add("query", query)
+		}
+		for _, query := range request.prepares {
+			add("prepare", query)
+		}
+		if len(request.queries) > 0 {
+			transaction.statement = request.queries[0]
+		} else if len(request.prepares) > 0 {
+			transaction.statement = "PREPARE " + request.prepares[0]
+		} else {
+			transaction.statement = "SYNC"
+			add("command", "sync")
+		}
+		if len(request.parameters) > 0 {
+			transaction.details = append(transaction.details,
+				sqlField{"parameters", strings.Join(request.parameters, ", ")})
+		}
+	}
+	return transaction
+}
+
+// server reply a byte to ssl and gss encryption request, return true if the rest of connection is encrypted
+func (h *postgresHandler) readEncryptionResponse(reader *streamReader, transaction *sqlTransaction) (bool, error) {
+	answer, err := reader.ReadByte()
+	if err != nil {
+		return false, unexpectedEOF(err)
+	}
+	switch answer {
+	case 'S', 'G':
+		transaction.response = []sqlField{{"result", "accepted, the rest of the connection is encrypted"}}
+		return true, nil
+	case 'N':
+		transaction.response = []sqlField{{"result", "refused"}}
+		return false, nil
+	}
+	return false, errPostgresMessageInvalid
+}
+
+// read messages until ReadyForQuery
+func (h *postgresHandler) readResponse(reader *streamReader, transaction *sqlTransaction) error {
+	add := func(name, value string) {
+		transaction.response = append(transaction.response, sqlField{name, value})
+	}
+	detail := func(name, value string) {
+		transaction.details = append(transaction.details, sqlField{name, value})
+	}
+	for {
+		message, err := readPostgresMessage(reader.Reader)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		p := &postgresParser{data: message.body}
+		switch message.kind {
+		case 'Z':
+			if len(transaction.response) == 0 {
+				add("result", "OK")
+			}
+			return nil
+		case 'C':
+			add("result", p.cstring())
+		case 'E':
+			add("result", parsePostgresError(message.body))
+		case 'I':
+			add("result", "empty query")
+		case 'V':
+			add("result", "function result")
+		case 'T':
+			columns := make([]string, p.count())
+			for i := 0; i < len(columns) && !p.failed; i++ {
+				columns[i] = p.cstring()
+				// table oid, column number, type oid, type size, type modifier, format
+				p.bytes(4 + 2 + 4 + 2 + 4 + 2)
+			}
+			detail("columns", strings.Join(columns, ", "))
+		case 't':
+			detail("parameter types", strconv.Itoa(p.int16()))
+		case 'N':
+			detail("notice", parsePostgresError(message.body))
+		case 'R':
+			switch p.int32() {
+			case 3:
+				detail("authentication", "cleartext password")
+			case 5:
+				detail("authentication", "md5")
+			case 10:
+				detail("authentication", "SASL "+p.cstring())
+			}
+		case 'S':
+			if name := p.cstring(); name == "server_version" {
+				detail("server", p.cstring())
+			}
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/binary"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// postgres message of type, kind 0 for messages without type byte
+func pgMessage(kind byte, body string) string {
+	var length [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)+4))
+	if kind == 0 {
+		return string(length[:]) + body
+	}
+	return string(kind) + string(length[:]) + body
+}
+
+func postgresMessages(messages ...string) string {
+	var builder strings.Builder
+	for i := 0; i+1 < len(messages); i += 2 {
+		builder.WriteString(pgMessage(messages[i][0], messages[i+1]))
+	}
+	return builder.String()
+}
+
+func TestPostgres(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.server.port = 5432
+	conversation.handshake()
+	conversation.exchange(pgMessage(0, "\x04\xd2\x16\x2f"), "N", 1460)
+	conversation.exchange(pgMessage(0, "\x00\x03\x00\x00user\x00app\x00database\x00shop\x00\x00"),
+		postgresMessages("R", "\x00\x00\x00\x05salt"), 1460)
+	conversation.exchange(postgresMessages("p", "md5xxxx\x00"),
+		postgresMessages("R", "\x00\x00\x00\x00", "S", "server_version\x0015.2\x00", "K", "\x00\x00\x00\x01abcd",
+			"Z", "I"), 1460)
+	conversation.exchange(postgresMessages("Q", "SELECT id FROM users\x00"),
+		postgresMessages("T", "\x00\x01id\x00\x00\x00\x00\x00\x00\x01\x00\x00\x00\x17\x00\x04\xff\xff\xff\xff\x00\x00",
+			"D", "\x00\x01\x00\x00\x00\x011", "D", "\x00\x01\x00\x00\x00\x012", "C", "SELECT 2\x00", "Z", "I"), 1460)
+	conversation.exchange(postgresMessages("Q", "SELECT * FROM missing\x00"),
+		postgresMessages("E", "SERROR\x00VERROR\x00C42P01\x00Mrelation \"missing\" does not exist\x00\x00",
+			"Z", "I"), 1460)
+	// extended query: parse, bind, describe, execute, sync
+	conversation.exchange(postgresMessages(
+		"P", "\x00UPDATE users SET name = $1 WHERE id = $2\x00\x00\x00",
+		"B", "\x00\x00\x00\x00\x00\x02\x00\x00\x00\x03bob\xff\xff\xff\xff\x00\x00",
+		"D", "P\x00", "E", "\x00\x00\x00\x00\x00", "S", ""),
+		postgresMessages("1", "", "2", "", "n", "", "C", "UPDATE 0\x00", "Z", "I"), 1460)
+	conversation.exchange(postgresMessages("X", ""), "", 1460)
+	conversation.close()
+
+	output := runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "POSTGRES SSL REQUEST -> refused, latency: 2ms\n"+
+		"POSTGRES LOGIN app -> OK, latency: 6ms\n"+
+		"POSTGRES SELECT id FROM users -> SELECT 2, latency: 2ms\n"+
+		"POSTGRES SELECT * FROM missing -> ERROR 42P01: relation \"missing\" does not exist, latency: 2ms\n"+
+		"POSTGRES UPDATE users SET name = $1 WHERE id = $2 -> UPDATE 0, latency: 2ms\n", output)
+
+	messages := runConversationMessages(t, &Option{Level: "all"}, conversation)
+	assert.Equal(t, 5, len(messages))
+	assert.True(t, strings.HasSuffix(messages[1], "\nlogin: app\ndatabase: shop\nresult: OK\n"+
+		"authentication: md5\nserver: 15.2\n"), messages[1])
+	assert.True(t, strings.HasSuffix(messages[2], "\nquery: SELECT id FROM users\nresult: SELECT 2\n"+
+		"columns: id\n"), messages[2])
+	assert.True(t, strings.HasSuffix(messages[4], "\nquery: UPDATE users SET name = $1 WHERE id = $2\n"+
+		"result: UPDATE 0\nparameters: \"bob\", NULL\n"), messages[4])
+}
+
+func TestPostgresPipeline(t *testing.T) {
+	// connection start not captured, prepared statement is executed in later batches
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.server.port = 5432
+	conversation.add(conversation.send(true, postgresMessages(
+		"P", "s1\x00SELECT name FROM users WHERE id = $1\x00\x00\x00", "D", "Ss1\x00", "S", "",
+		"B", "\x00s1\x00\x00\x00\x00\x01\x00\x00\x00\x011\x00\x00", "E", "\x00\x00\x00\x00\x00", "S", "",
+		"Q", "\x00"), 1460)...)
+	conversation.add(conversation.send(false, postgresMessages(
+		"1", "", "t", "\x00\x01\x00\x00\x00\x17", "T", "\x00\x00", "Z", "I",
+		"2", "", "D", "\x00\x01\x00\x00\x00\x03bob", "C", "SELECT 1\x00", "Z", "I",
+		"I", "", "Z", "I"), 1460)...)
+	conversation.close()
+	output := runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "POSTGRES PREPARE SELECT name FROM users WHERE id = $1 -> OK, latency: 1ms\n"+
+		"POSTGRES SELECT name FROM users WHERE id = $1 -> SELECT 1, latency: 1ms\n"+
+		"POSTGRES  -> empty query, latency: 1ms\n", output)
+}
+
+func TestPostgresDetect(t *testing.T) {
+	assert.True(t, isPostgresStartMessage([]byte(pgMessage(0, "\x00\x03\x00\x00user\x00a\x00\x00"))))
+	assert.True(t, isPostgresStartMessage([]byte(pgMessage(0, "\x04\xd2\x16\x2f"))))
+	assert.False(t, isPostgresStartMessage([]byte(pgMessage(0, "\x00\x02\x00\x00user\x00a\x00\x00"))))
+	assert.True(t, isPostgresQuery([]byte(postgresMessages("Q", "SELECT 1\x00"))))
+	assert.True(t, isPostgresQuery([]byte(postgresMessages("P", "\x00SELECT 1\x00\x00\x00", "S", ""))))
+	assert.False(t, isPostgresQuery([]byte(postgresMessages("Q", "SELECT 1"))))
+	assert.False(t, isPostgresQuery([]byte(postgresMessages("Q", "SELECT 1\x00", "x", ""))))
+}
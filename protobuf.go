@@ -0,0 +1,589 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// protobuf wire types
+const (
+	protoVarint     = 0
+	protoFixed64    = 1
+	protoBytes      = 2
+	protoStartGroup = 3
+	protoEndGroup   = 4
+	protoFixed32    = 5
+)
+
+// nested messages deeper than this are shown as bytes, and groups deeper than this are invalid
+const maxProtoDepth = 32
+
+var errProtoInvalid = errors.New("invalid protobuf data")
+
+// protoField is a field of protobuf message in wire format, without schema
+type protoField struct {
+	number   uint64
+	wireType byte
+	value    uint64       // value of varint, fixed64 and fixed32
+	data     []byte       // value of length-delimited
+	group    []protoField // fields of group
+}
+
+// parse fields of a message, which is nested in depth messages or groups
+func parseProtoFields(data []byte, depth int) ([]protoField, error) {
+	fields, rest, err := parseProtoGroup(data, 0, depth)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, errProtoInvalid
+	}
+	return fields, nil
+}
+
+// parse fields until end of data, or the end group of field number. return the data after the end group
+func parseProtoGroup(data []byte, number uint64, depth int) ([]protoField, []byte, error) {
+	if depth > maxProtoDepth {
+		return nil, nil, errProtoInvalid
+	}
+	var fields []protoField
+	for len(data) > 0 {
+		key, n := protoReadVarint(data)
+		if n == 0 {
+			return nil, nil, errProtoInvalid
+		}
+		data = data[n:]
+		field := protoField{number: key >> 3, wireType: byte(key & 7)}
+		if field.number == 0 {
+			return nil, nil, errProtoInvalid
+		}
+		switch field.wireType {
+		case protoVarint:
+			if field.value, n = protoReadVarint(data); n == 0 {
+				return nil, nil, errProtoInvalid
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return nil, nil, errProtoInvalid
+			}
+			for i := 7; i >= 0; i-- {
+				field.value = field.value<<8 | uint64(data[i])
+			}
+			data = data[8:]
+		case protoFixed32:
+			if len(data) < 4 {
+				return nil, nil, errProtoInvalid
+			}
+			for i := 3; i >= 0; i-- {
+				field.value = field.value<<8 | uint64(data[i])
+			}
+			data = data[4:]
+		case protoBytes:
+			length, n := protoReadVarint(data)
+			if n == 0 || length > uint64(len(data)-n) {
+				return nil, nil, errProtoInvalid
+			}
+			field.data = data[n : n+int(length)]
+			data = data[n+int(length):]
+		case protoStartGroup:
+			group, rest, err := parseProtoGroup(data, field.number, depth+1)
+			if err != nil {
+				return nil, nil, err
+			}
+			field.group = group
+			data = rest
+		case protoEndGroup:
+			if field.number != number {
+				return nil, nil, errProtoInvalid
+			}
+			return fields, data, nil
+		default:
+			return nil, nil, errProtoInvalid
+		}
+		fields = append(fields, field)
+	}
+	if number != 0 {
+		// group not ended
+		return nil, nil, errProtoInvalid
+	}
+	return fields, data, nil
+}
+
+// read a varint, return the value and bytes used. bytes used is 0 if data is not valid
+func protoReadVarint(data []byte) (uint64, int) {
+	var value uint64
+	for i := 0; i < len(data) && i < 10; i++ {
+		value |= uint64(data[i]&0x7f) << (7 * uint(i))
+		if data[i] < 0x80 {
+			return value, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// field types in FieldDescriptorProto
+const (
+	protoTypeDouble   = 1
+	protoTypeFloat    = 2
+	protoTypeInt64    = 3
+	protoTypeUint64   = 4
+	protoTypeInt32    = 5
+	protoTypeFixed64  = 6
+	protoTypeFixed32  = 7
+	protoTypeBool     = 8
+	protoTypeString   = 9
+	protoTypeGroup    = 10
+	protoTypeMessage  = 11
+	protoTypeBytes    = 12
+	protoTypeUint32   = 13
+	protoTypeEnum     = 14
+	protoTypeSfixed32 = 15
+	protoTypeSfixed64 = 16
+	protoTypeSint32   = 17
+	protoTypeSint64   = 18
+)
+
+var protoTypeNames = map[int]string{
+	protoTypeDouble: "double", protoTypeFloat: "float", protoTypeInt64: "int64", protoTypeUint64: "uint64",
+	protoTypeInt32: "int32", protoTypeFixed64: "fixed64", protoTypeFixed32: "fixed32", protoTypeBool: "bool",
+	protoTypeString: "string", protoTypeGroup: "group", protoTypeMessage: "message", protoTypeBytes: "bytes",
+	protoTypeUint32: "uint32", protoTypeEnum: "enum", protoTypeSfixed32: "sfixed32", protoTypeSfixed64: "sfixed64",
+	protoTypeSint32: "sint32", protoTypeSint64: "sint64",
+}
+
+// the wire type of field type, if not packed
+func protoTypeWireType(fieldType int) byte {
+	switch fieldType {
+	case protoTypeDouble, protoTypeFixed64, protoTypeSfixed64:
+		return protoFixed64
+	case protoTypeFloat, protoTypeFixed32, protoTypeSfixed32:
+		return protoFixed32
+	case protoTypeString, protoTypeBytes, protoTypeMessage:
+		return protoBytes
+	case protoTypeGroup:
+		return protoStartGroup
+	default:
+		return protoVarint
+	}
+}
+
+// protoRegistry has message types and grpc methods loaded from descriptor sets
+type protoRegistry struct {
+	messages map[string]*protoMessageType // by full name
+	enums    map[string]map[int64]string  // enum value names, by enum full name
+	methods  map[string]*protoMethod      // by grpc path: /package.Service/Method
+}
+
+type protoMessageType struct {
+	name   string
+	fields map[uint64]*protoFieldType
+}
+
+type protoFieldType struct {
+	name      string
+	fieldType int
+	typeName  string // full name of message or enum type
+}
+
+type protoMethod struct {
+	input  string
+	output string
+}
+
+func newProtoRegistry() *protoRegistry {
+	return &protoRegistry{
+		messages: map[string]*protoMessageType{},
+		enums:    map[string]map[int64]string{},
+		methods:  map[string]*protoMethod{},
+	}
+}
+
+// load descriptor set files separated by comma, which are generated by protoc --descriptor_set_out
+func loadProtoDescriptorSets(paths string) (*protoRegistry, error) {
+	registry := newProtoRegistry()
+	for _, path := range strings.Split(paths, ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if err := registry.addDescriptorSet(data); err != nil {
+			return nil, fmt.Errorf("load descriptor set %v failed: %w", path, err)
+		}
+	}
+	return registry, nil
+}
+
+// add types in FileDescriptorSet
+func (r *protoRegistry) addDescriptorSet(data []byte) error {
+	fields, err := parseProtoFields(data, 0)
+	if err != nil {
+		return err
+	}
+	for _, file := range fields {
+		if file.number != 1 || file.wireType != protoBytes {
+			continue
+		}
+		if err := r.addFile(file.data); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add types in FileDescriptorProto
+func (r *protoRegistry) addFile(data []byte) error {
+	fields, err := parseProtoFields(data, 0)
+	if err != nil {
+		return err
+	}
+	var pkg string
+	for _, field := range fields {
+		if field.number == 2 && field.wireType == protoBytes {
+			pkg = string(field.data)
+		}
+	}
+	for _, field := range fields {
+		if field.wireType != protoBytes {
+			continue
+		}
+		switch field.number {
+		case 4:
+			err = r.addMessage(pkg, field.data)
+		case 5:
+			err = r.addEnum(pkg, field.data)
+		case 6:
+			err = r.addService(pkg, field.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add DescriptorProto, and its nested types
+func (r *protoRegistry) addMessage(scope string, data []byte) error {
+	fields, err := parseProtoFields(data, 0)
+	if err != nil {
+		return err
+	}
+	messageType := &protoMessageType{fields: map[uint64]*protoFieldType{}}
+	messageType.name = protoFullName(scope, protoStringField(fields, 1))
+	r.messages[messageType.name] = messageType
+	for _, field := range fields {
+		if field.wireType != protoBytes {
+			continue
+		}
+		switch field.number {
+		case 2:
+			var fieldFields []protoField
+			if fieldFields, err = parseProtoFields(field.data, 0); err != nil {
+				return err
+			}
+			messageType.fields[protoVarintField(fieldFields, 3)] = &protoFieldType{
+				name:      protoStringField(fieldFields, 1),
+				fieldType: int(protoVarintField(fieldFields, 5)),
+				typeName:  strings.TrimPrefix(protoStringField(fieldFields, 6), "."),
+			}
+		case 3:
+			err = r.addMessage(messageType.name, field.data)
+		case 4:
+			err = r.addEnum(messageType.name, field.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add EnumDescriptorProto
+func (r *protoRegistry) addEnum(scope string, data []byte) error {
+	fields, err := parseProtoFields(data, 0)
+	if err != nil {
+		return err
+	}
+	values := map[int64]string{}
+	for _, field := range fields {
+		if field.number != 2 || field.wireType != protoBytes {
+			continue
+		}
+		valueFields, err := parseProtoFields(field.data, 0)
+		if err != nil {
+			return err
+		}
+		values[int64(int32(protoVarintField(valueFields, 2)))] = protoStringField(valueFields, 1)
+	}
+	r.enums[protoFullName(scope, protoStringField(fields, 1))] = values
+	return nil
+}
+
+// add methods in ServiceDescriptorProto
+func (r *protoRegistry) addService(pkg string, data []byte) error {
+	fields, err := parseProtoFields(data, 0)
+	if err != nil {
+		return err
+	}
+	service := protoFullName(pkg, protoStringField(fields, 1))
+	for _, field := range fields {
+		if field.number != 2 || field.wireType != protoBytes {
+			continue
+		}
+		methodFields, err := parseProtoFields(field.data, 0)
+		if err != nil {
+			return err
+		}
+		r.methods["/"+service+"/"+protoStringField(methodFields, 1)] = &protoMethod{
+			input:  strings.TrimPrefix(protoStringField(methodFields, 2), "."),
+			output: strings.TrimPrefix(protoStringField(methodFields, 3), "."),
+		}
+	}
+	return nil
+}
+
+// message types of request and response of grpc method. return nil if not found
+func (r *protoRegistry) methodTypes(path string) (*protoMessageType, *protoMessageType) {
+	if r == nil {
+		return nil, nil
+	}
+	method := r.methods[path]
+	if method == nil {
+		return nil, nil
+	}
+	return r.messages[method.input], r.messages[method.output]
+}
+
+func protoFullName(scope, name string) string {
+	if scope == "" {
+		return name
+	}
+	return scope + "." + name
+}
+
+// the last value of string field
+func protoStringField(fields []protoField, number uint64) string {
+	var value string
+	for _, field := range fields {
+		if field.number == number && field.wireType == protoBytes {
+			value = string(field.data)
+		}
+	}
+	return value
+}
+
+// the last value of varint field
+func protoVarintField(fields []protoField, number uint64) uint64 {
+	var value uint64
+	for _, field := range fields {
+		if field.number == number && field.wireType == protoVarint {
+			value = field.value
+		}
+	}
+	return value
+}
+
+// protoFormatter format protobuf message as text, one field a line.
+// Fields are shown with number and wire type, or name and type if the message type is known
+type protoFormatter struct {
+	registry *protoRegistry
+	builder  strings.Builder
+}
+
+// format message of type, which can be nil if unknown. Return false if data is not a valid message
+func formatProtoMessage(data []byte, messageType *protoMessageType, registry *protoRegistry) (string, bool) {
+	fields, err := parseProtoFields(data, 0)
+	if err != nil {
+		return "", false
+	}
+	formatter := &protoFormatter{registry: registry}
+	formatter.writeFields(fields, messageType, "", 0)
+	return formatter.builder.String(), true
+}
+
+func (f *protoFormatter) writeFields(fields []protoField, messageType *protoMessageType, indent string, depth int) {
+	for _, field := range fields {
+		var fieldType *protoFieldType
+		if messageType != nil {
+			fieldType = messageType.fields[field.number]
+		}
+		if fieldType != nil && f.writeTypedField(field, fieldType, indent, depth) {
+			continue
+		}
+		f.writeRawField(field, strconv.FormatUint(field.number, 10), indent, depth)
+	}
+}
+
+// write field by wire type only
+func (f *protoFormatter) writeRawField(field protoField, label string, indent string, depth int) {
+	switch field.wireType {
+	case protoVarint:
+		f.writeLine(indent, label, "varint", strconv.FormatUint(field.value, 10))
+	case protoFixed64:
+		f.writeLine(indent, label, "fixed64", fmt.Sprintf("0x%016x", field.value))
+	case protoFixed32:
+		f.writeLine(indent, label, "fixed32", fmt.Sprintf("0x%08x", field.value))
+	case protoStartGroup:
+		if depth >= maxProtoDepth {
+			f.writeLine(indent, label, "group", "{...}")
+			return
+		}
+		f.writeNested(field.group, nil, label, "group", indent, depth)
+	case protoBytes:
+		if isPrintableString(field.data) {
+			f.writeLine(indent, label, "string", strconv.Quote(string(field.data)))
+			return
+		}
+		if depth < maxProtoDepth {
+			if nested, err := parseProtoFields(field.data, depth+1); err == nil {
+				f.writeNested(nested, nil, label, "message", indent, depth)
+				return
+			}
+		}
+		f.writeLine(indent, label, "bytes", fmt.Sprintf("%x", field.data))
+	}
+}
+
+// write field by its type in schema. return false if wire type not match
+func (f *protoFormatter) writeTypedField(field protoField, fieldType *protoFieldType, indent string,
+	depth int) bool {
+	label := fieldType.name + "(" + strconv.FormatUint(field.number, 10) + ")"
+	typeName := protoTypeNames[fieldType.fieldType]
+	wireType := protoTypeWireType(fieldType.fieldType)
+	if field.wireType == protoBytes && wireType != protoBytes {
+		// packed repeated scalars
+		values, ok := f.packedValues(field.data, fieldType)
+		if !ok {
+			return false
+		}
+		f.writeLine(indent, label, typeName, "["+strings.Join(values, ", ")+"]")
+		return true
+	}
+	if field.wireType != wireType {
+		return false
+	}
+
+	switch fieldType.fieldType {
+	case protoTypeString:
+		if !utf8.Valid(field.data) {
+			return false
+		}
+		f.writeLine(indent, label, typeName, strconv.Quote(string(field.data)))
+	case protoTypeBytes:
+		f.writeLine(indent, label, typeName, fmt.Sprintf("%q", field.data))
+	case protoTypeMessage:
+		if depth >= maxProtoDepth {
+			return false
+		}
+		nested, err := parseProtoFields(field.data, depth+1)
+		if err != nil {
+			return false
+		}
+		f.writeNested(nested, f.registry.messages[fieldType.typeName], label, typeName, indent, depth)
+	case protoTypeGroup:
+		if depth >= maxProtoDepth {
+			return false
+		}
+		f.writeNested(field.group, f.registry.messages[fieldType.typeName], label, typeName, indent, depth)
+	default:
+		f.writeLine(indent, label, typeName, f.scalarValue(field.value, fieldType))
+	}
+	return true
+}
+
+func (f *protoFormatter) writeNested(fields []protoField, messageType *protoMessageType, label, typeName string,
+	indent string, depth int) {
+	f.builder.WriteString(indent + label + " " + typeName + " {\n")
+	f.writeFields(fields, messageType, indent+"  ", depth+1)
+	f.builder.WriteString(indent + "}\n")
+}
+
+func (f *protoFormatter) writeLine(indent, label, typeName, value string) {
+	f.builder.WriteString(indent + label + " " + typeName + ": " + value + "\n")
+}
+
+// decode packed values
+func (f *protoFormatter) packedValues(data []byte, fieldType *protoFieldType) ([]string, bool) {
+	var values []string
+	for len(data) > 0 {
+		var value uint64
+		switch protoTypeWireType(fieldType.fieldType) {
+		case protoVarint:
+			var n int
+			if value, n = protoReadVarint(data); n == 0 {
+				return nil, false
+			}
+			data = data[n:]
+		case protoFixed64:
+			if len(data) < 8 {
+				return nil, false
+			}
+			for i := 7; i >= 0; i-- {
+				value = value<<8 | uint64(data[i])
+			}
+			data = data[8:]
+		case protoFixed32:
+			if len(data) < 4 {
+				return nil, false
+			}
+			for i := 3; i >= 0; i-- {
+				value = value<<8 | uint64(data[i])
+			}
+			data = data[4:]
+		default:
+			return nil, false
+		}
+		values = append(values, f.scalarValue(value, fieldType))
+	}
+	return values, true
+}
+
+// format number value by field type
+func (f *protoFormatter) scalarValue(value uint64, fieldType *protoFieldType) string {
+	switch fieldType.fieldType {
+	case protoTypeDouble:
+		return strconv.FormatFloat(math.Float64frombits(value), 'g', -1, 64)
+	case protoTypeFloat:
+		return strconv.FormatFloat(float64(math.Float32frombits(uint32(value))), 'g', -1, 32)
+	case protoTypeInt64, protoTypeSfixed64:
+		return strconv.FormatInt(int64(value), 10)
+	case protoTypeInt32, protoTypeSfixed32:
+		return strconv.FormatInt(int64(int32(value)), 10)
+	case protoTypeUint32, protoTypeFixed32:
+		return strconv.FormatUint(uint64(uint32(value)), 10)
+	case protoTypeSint32, protoTypeSint64:
+		return strconv.FormatInt(int64(value>>1)^-int64(value&1), 10)
+	case protoTypeBool:
+		return strconv.FormatBool(value != 0)
+	case protoTypeEnum:
+		number := int64(int32(value))
+		if name, ok := f.registry.enums[fieldType.typeName][number]; ok {
+			return name
+		}
+		return strconv.FormatInt(number, 10)
+	default:
+		return strconv.FormatUint(value, 10)
+	}
+}
+
+// if data is valid utf-8 text without control characters except whitespaces
+func isPrintableString(data []byte) bool {
+	if !utf8.Valid(data) {
+		return false
+	}
+	for _, r := range string(data) {
+		if r < ' ' && r != '\n' && r != '\r' && r != '\t' || r == 0x7f {
+			return false
+		}
+	}
+	return true
+}
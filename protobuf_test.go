@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// protoBuilder encode protobuf fields, for tests
+type protoBuilder []byte
+
+func (b protoBuilder) key(number uint64, wireType byte) protoBuilder {
+	return b.rawVarint(number<<3 | uint64(wireType))
+}
+
+func (b protoBuilder) rawVarint(value uint64) protoBuilder {
+	for value >= 0x80 {
+		b = append(b, byte(value)|0x80)
+		value >>= 7
+	}
+	return append(b, byte(value))
+}
+
+func (b protoBuilder) varint(number uint64, value uint64) protoBuilder {
+	return b.key(number, protoVarint).rawVarint(value)
+}
+
+func (b protoBuilder) bytes(number uint64, value []byte) protoBuilder {
+	return append(b.key(number, protoBytes).rawVarint(uint64(len(value))), value...)
+}
+
+func (b protoBuilder) string(number uint64, value string) protoBuilder {
+	return b.bytes(number, []byte(value))
+}
+
+func (b protoBuilder) fixed64(number uint64, value uint64) protoBuilder {
+	b = b.key(number, protoFixed64)
+	for i := 0; i < 8; i++ {
+		b = append(b, byte(value>>(8*uint(i))))
+	}
+	return b
+}
+
+func TestFormatProtoMessageWithoutSchema(t *testing.T) {
+	data := protoBuilder{}.varint(1, 150).string(2, "hello").
+		bytes(3, protoBuilder{}.varint(1, 2).string(2, "nested")).
+		bytes(4, []byte{0xff, 0x00}).
+		fixed64(5, 1).
+		key(6, protoFixed32).rawVarint(0)
+	data = append(data, 0, 0, 0)
+	data = data.key(7, protoStartGroup).varint(1, 1).key(7, protoEndGroup)
+
+	text, ok := formatProtoMessage(data, nil, nil)
+	assert.True(t, ok)
+	assert.Equal(t, "1 varint: 150\n"+
+		"2 string: \"hello\"\n"+
+		"3 message {\n  1 varint: 2\n  2 string: \"nested\"\n}\n"+
+		"4 bytes: ff00\n"+
+		"5 fixed64: 0x0000000000000001\n"+
+		"6 fixed32: 0x00000000\n"+
+		"7 group {\n  1 varint: 1\n}\n", text)
+
+	for _, invalid := range [][]byte{
+		{0x08},             // varint missing
+		{0x12, 0x05, 'a'},  // length exceeded
+		{0x00, 0x01},       // field number 0
+		{0x0f},             // wire type 7
+		{0x1b, 0x08, 0x01}, // group not ended
+		{0x08, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x01}, // varint too long
+	} {
+		_, ok := formatProtoMessage(invalid, nil, nil)
+		assert.False(t, ok, invalid)
+	}
+}
+
+func TestFormatProtoMessageNestedGroups(t *testing.T) {
+	// start group tags only, should not overflow the stack
+	_, ok := formatProtoMessage(bytes.Repeat([]byte{0x0b}, 1<<20), nil, nil)
+	assert.False(t, ok)
+
+	// groups nested in messages count in the depth too
+	group := func(depth int, inner protoBuilder) protoBuilder {
+		data := append(protoBuilder(bytes.Repeat([]byte{0x0b}, depth)), inner...)
+		return append(data, bytes.Repeat([]byte{0x0c}, depth)...)
+	}
+	_, ok = formatProtoMessage(group(maxProtoDepth, protoBuilder{}.varint(1, 1)), nil, nil)
+	assert.True(t, ok)
+	_, ok = formatProtoMessage(group(maxProtoDepth+1, protoBuilder{}.varint(1, 1)), nil, nil)
+	assert.False(t, ok)
+	text, ok := formatProtoMessage(protoBuilder{}.bytes(2, group(maxProtoDepth, protoBuilder{}.varint(1, 1))), nil, nil)
+	assert.True(t, ok)
+	assert.Contains(t, text, "2 bytes: 0b0b")
+}
+
+// descriptor set of:
+//
+//	package demo;
+//	enum Kind { UNKNOWN = 0; FAST = 1; }
+//	message HelloRequest { string name = 1; sint32 delta = 2; repeated int64 ids = 3; Kind kind = 4; Inner inner = 5;
+//	                       message Inner { double score = 1; } }
+//	message HelloReply { string message = 1; }
+//	service Greeter { rpc SayHello(HelloRequest) returns (HelloReply); }
+func testDescriptorSet() []byte {
+	field := func(name string, number uint64, fieldType uint64, typeName string) []byte {
+		b := protoBuilder{}.string(1, name).varint(3, number).varint(5, fieldType)
+		if typeName != "" {
+			b = b.string(6, typeName)
+		}
+		return b
+	}
+	inner := protoBuilder{}.string(1, "Inner").bytes(2, field("score", 1, protoTypeDouble, ""))
+	request := protoBuilder{}.string(1, "HelloRequest").
+		bytes(2, field("name", 1, protoTypeString, "")).
+		bytes(2, field("delta", 2, protoTypeSint32, "")).
+		bytes(2, field("ids", 3, protoTypeInt64, "")).
+		bytes(2, field("kind", 4, protoTypeEnum, ".demo.Kind")).
+		bytes(2, field("inner", 5, protoTypeMessage, ".demo.HelloRequest.Inner")).
+		bytes(3, inner)
+	reply := protoBuilder{}.string(1, "HelloReply").bytes(2, field("message", 1, protoTypeString, ""))
+	kind := protoBuilder{}.string(1, "Kind").
+		bytes(2, protoBuilder{}.string(1, "UNKNOWN").varint(2, 0)).
+		bytes(2, protoBuilder{}.string(1, "FAST").varint(2, 1))
+	service := protoBuilder{}.string(1, "Greeter").bytes(2, protoBuilder{}.string(1, "SayHello").
+		string(2, ".demo.HelloRequest").string(3, ".demo.HelloReply"))
+	file := protoBuilder{}.string(1, "demo.proto").string(2, "demo").
+		bytes(4, request).bytes(4, reply).bytes(5, kind).bytes(6, service)
+	return protoBuilder{}.bytes(1, file)
+}
+
+func TestFormatProtoMessageWithSchema(t *testing.T) {
+	registry := newProtoRegistry()
+	assert.NoError(t, registry.addDescriptorSet(testDescriptorSet()))
+	requestType, responseType := registry.methodTypes("/demo.Greeter/SayHello")
+	assert.NotNil(t, requestType)
+	assert.NotNil(t, responseType)
+
+	data := protoBuilder{}.string(1, "world").
+		varint(2, 3). // zigzag of -2
+		bytes(3, protoBuilder{}.rawVarint(1).rawVarint(2).rawVarint(300)).
+		varint(4, 1).
+		bytes(5, protoBuilder{}.fixed64(1, math.Float64bits(0.5))).
+		varint(9, 7)
+	text, ok := formatProtoMessage(data, requestType, registry)
+	assert.True(t, ok)
+	assert.Equal(t, "name(1) string: \"world\"\n"+
+		"delta(2) sint32: -2\n"+
+		"ids(3) int64: [1, 2, 300]\n"+
+		"kind(4) enum: FAST\n"+
+		"inner(5) message {\n  score(1) double: 0.5\n}\n"+
+		"9 varint: 7\n", text)
+
+	// wire type not match schema
+	text, ok = formatProtoMessage(protoBuilder{}.varint(1, 1), responseType, registry)
+	assert.True(t, ok)
+	assert.Equal(t, "1 varint: 1\n", text)
+
+	requestType, responseType = registry.methodTypes("/demo.Greeter/Unknown")
+	assert.Nil(t, requestType)
+	assert.Nil(t, responseType)
+}
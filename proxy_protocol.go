@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// PROXY protocol, which load balancers such as haproxy send at the start of connections to backends, to pass the
+// addresses of the original connection. Version 1 is a text line, version 2 is binary
+
+// max length of v1 header, including CRLF
+const proxyV1MaxLength = 107
+
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyHeader is a PROXY protocol header
+type proxyHeader struct {
+	length      int      // bytes of the header
+	source      Endpoint // client of the original connection
+	destination Endpoint // the address client connected to, usually the load balancer
+	hasAddress  bool     // false for v1 UNKNOWN, v2 LOCAL, or address families other than tcp over ip
+}
+
+// parse PROXY protocol header at the start of data. return nil if data do not start with a complete valid header
+func parseProxyHeader(data []byte) *proxyHeader {
+	if bytes.HasPrefix(data, proxyV2Signature) {
+		return parseProxyV2Header(data)
+	}
+	if strings.HasPrefix(string(data), "PROXY ") {
+		return parseProxyV1Header(data)
+	}
+	return nil
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func parseProxyV1Header(data []byte) *proxyHeader {
+	if len(data) > proxyV1MaxLength {
+		data = data[:proxyV1MaxLength]
+	}
+	end := bytes.Index(data, []byte("\r\n"))
+	if end < 0 {
+		return nil
+	}
+	header := &proxyHeader{length: end + 2}
+	fields := strings.Split(string(data[:end]), " ")
+	switch fields[1] {
+	case "UNKNOWN":
+		// the rest of the line is ignored
+		return header
+	case "TCP4", "TCP6":
+		if len(fields) != 6 {
+			return nil
+		}
+	default:
+		return nil
+	}
+	var ok bool
+	if header.source, ok = parseProxyV1Address(fields[2], fields[4]); !ok {
+		return nil
+	}
+	if header.destination, ok = parseProxyV1Address(fields[3], fields[5]); !ok {
+		return nil
+	}
+	header.hasAddress = true
+	return header
+}
+
+func parseProxyV1Address(ip, port string) (Endpoint, bool) {
+	parsedIP := net.ParseIP(ip)
+	parsedPort, err := strconv.ParseUint(port, 10, 16)
+	if parsedIP == nil || err != nil {
+		return Endpoint{}, false
+	}
+	return newEndpoint(parsedIP, uint16(parsedPort)), true
+}
+
+// signature, version and command, address family and transport, length of addresses and TLVs, then addresses.
+// TLVs after addresses are skipped
+func parseProxyV2Header(data []byte) *proxyHeader {
+	if len(data) < 16 || data[12]>>4 != 2 {
+		return nil
+	}
+	length := 16 + int(binary.BigEndian.Uint16(data[14:16]))
+	if len(data) < length {
+		return nil
+	}
+	header := &proxyHeader{length: length}
+	switch data[12] & 0x0f {
+	case 0:
+		// LOCAL, connection made by the load balancer itself, such as health checks
+		return header
+	case 1:
+		// PROXY
+	default:
+		return nil
+	}
+	addresses := data[16:length]
+	switch data[13] {
+	case 0x11:
+		// tcp over ipv4
+		if len(addresses) < 12 {
+			return nil
+		}
+		header.source = newEndpoint(net.IP(addresses[0:4]), binary.BigEndian.Uint16(addresses[8:10]))
+		header.destination = newEndpoint(net.IP(addresses[4:8]), binary.BigEndian.Uint16(addresses[10:12]))
+		header.hasAddress = true
+	case 0x21:
+		// tcp over ipv6
+		if len(addresses) < 36 {
+			return nil
+		}
+		header.source = newEndpoint(net.IP(addresses[0:16]), binary.BigEndian.Uint16(addresses[32:34]))
+		header.destination = newEndpoint(net.IP(addresses[16:32]), binary.BigEndian.Uint16(addresses[34:36]))
+		header.hasAddress = true
+	}
+	return header
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const proxyV2TCP4 = "\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c\xc0\xa8\x00\x01\xc0\xa8\x00\x0b\xdc\x04\x01\xbb"
+
+func TestParseProxyHeader(t *testing.T) {
+	header := parseProxyHeader([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"))
+	assert.Equal(t, &proxyHeader{length: 47, source: newEndpoint(net.ParseIP("192.168.0.1"), 56324),
+		destination: newEndpoint(net.ParseIP("192.168.0.11"), 443), hasAddress: true}, header)
+	header = parseProxyHeader([]byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"))
+	assert.Equal(t, "2001:db8::1:56324", header.source.String())
+	assert.Equal(t, &proxyHeader{length: 15}, parseProxyHeader([]byte("PROXY UNKNOWN\r\n")))
+	assert.Nil(t, parseProxyHeader([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324\r\n")))
+	assert.Nil(t, parseProxyHeader([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 65536\r\n")))
+	assert.Nil(t, parseProxyHeader([]byte("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443")))
+	assert.Nil(t, parseProxyHeader([]byte("GET / HTTP/1.1\r\n")))
+
+	header = parseProxyHeader([]byte(proxyV2TCP4 + "GET"))
+	assert.Equal(t, &proxyHeader{length: 28, source: newEndpoint(net.ParseIP("192.168.0.1"), 56324),
+		destination: newEndpoint(net.ParseIP("192.168.0.11"), 443), hasAddress: true}, header)
+	// with a TLV after addresses
+	header = parseProxyHeader([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x10\xc0\xa8\x00\x01\xc0\xa8\x00\x0b" +
+		"\xdc\x04\x01\xbb\x04\x00\x01\x00"))
+	assert.Equal(t, 32, header.length)
+	assert.True(t, header.hasAddress)
+	// LOCAL
+	assert.Equal(t, &proxyHeader{length: 16}, parseProxyHeader([]byte("\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00")))
+	assert.Nil(t, parseProxyHeader([]byte(proxyV2TCP4[:20])))
+	assert.Nil(t, parseProxyHeader([]byte("\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00")))
+}
+
+func TestProxyProtocolConnection(t *testing.T) {
+	// header and request in the same packet
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.handshake()
+	conversation.exchange("PROXY TCP4 192.168.0.1 192.168.0.11 56324 80\r\nGET / HTTP/1.1\r\nHost: a\r\n\r\n",
+		"HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", 1460)
+	conversation.close()
+	output := runDissectors(conversation)
+	assert.Contains(t, output, " 192.168.0.1:56324  ----->  10.0.0.2:80 ")
+	assert.Contains(t, output, "\nGET / HTTP/1.1\n")
+	assert.NotContains(t, output, "PROXY")
+
+	// header in its own packet, then the server send greeting first
+	conversation = newTCPConversation(10000, 1000, 5000)
+	conversation.handshake()
+	conversation.add(conversation.send(true, proxyV2TCP4, 1460)...)
+	conversation.add(conversation.ack(false))
+	conversation.add(conversation.send(false, "220 ready\r\n", 1460)...)
+	conversation.add(conversation.send(true, "HELO test\r\n", 1460)...)
+	conversation.close()
+	assert.Equal(t, "192.168.0.1:56324 -> 10.0.0.2:80\nHELO test\r\n220 ready\r\n", runDissectors(conversation))
+
+	// retransmitted header is stripped too
+	conversation = newTCPConversation(10000, 1000, 5000)
+	conversation.handshake()
+	packets := conversation.send(true, proxyV2TCP4+"GET / HTTP/1.1\r\nHost: a\r\n\r\n", 1460)
+	conversation.add(packets...)
+	conversation.add(conversation.resend(packets[0]))
+	conversation.add(conversation.send(false, "HTTP/1.1 200 OK\r\nContent-Length: 0\r\n\r\n", 1460)...)
+	conversation.add(conversation.ack(true))
+	conversation.close()
+	output = runDissectors(conversation)
+	assert.Contains(t, output, " 192.168.0.1:56324  ----->  10.0.0.2:80 ")
+	assert.Contains(t, output, "\nGET / HTTP/1.1\n")
+	assert.NotContains(t, output, "QUIT")
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// redisDissector parse redis connections: client send commands as RESP arrays, server send replies in order
+type redisDissector struct {
+	option  *Option
+	printer *Printer
+}
+
+func (d *redisDissector) detect(data []byte, fromClient bool) bool {
+	return fromClient && isRESPCommand(data)
+}
+
+func (d *redisDissector) handle(key ConnectionKey, connection *TCPConnection) {
+	handler := &redisHandler{key: key, option: d.option, printer: d.printer}
+	handler.handle(connection)
+}
+
+// commands whose first argument is not a key
+var redisKeylessCommands = map[string]bool{
+	"ACL": true, "AUTH": true, "BGREWRITEAOF": true, "BGSAVE": true, "CLIENT": true, "CLUSTER": true,
+	"COMMAND": true, "CONFIG": true, "DBSIZE": true, "DEBUG": true, "DISCARD": true, "ECHO": true, "EXEC": true,
+	"FAILOVER": true, "FLUSHALL": true, "FLUSHDB": true, "FUNCTION": true, "HELLO": true, "INFO": true,
+	"KEYS": true, "LASTSAVE": true, "LATENCY": true, "MEMORY": true, "MODULE": true, "MONITOR": true,
+	"MULTI": true, "OBJECT": true, "PING": true, "PSUBSCRIBE": true, "PUBLISH": true, "PUBSUB": true,
+	"PUNSUBSCRIBE": true, "QUIT": true, "RANDOMKEY": true, "READONLY": true, "READWRITE": true,
+	"REPLICAOF": true, "RESET": true, "ROLE": true, "SAVE": true, "SCAN": true, "SCRIPT": true, "SELECT": true,
+	"SHUTDOWN": true, "SLAVEOF": true, "SLOWLOG": true, "SPUBLISH": true, "SSUBSCRIBE": true,
+	"SUBSCRIBE": true, "SUNSUBSCRIBE": true, "SWAPDB": true, "TIME": true, "UNSUBSCRIBE": true,
+	"UNWATCH": true, "WAIT": true,
+}
+
+// commands with script/function, numkeys, and keys
+var redisScriptCommands = map[string]bool{"EVAL": true, "EVALSHA": true, "EVAL_RO": true, "EVALSHA_RO": true,
+	"FCALL": true, "FCALL_RO": true}
+
+// subscribe commands get a confirmation reply for each channel
+var redisSubscribeCommands = map[string]bool{"SUBSCRIBE": true, "PSUBSCRIBE": true, "SSUBSCRIBE": true,
+	"UNSUBSCRIBE": true, "PUNSUBSCRIBE": true, "SUNSUBSCRIBE": true}
+
+// redisCommand is a command and its arguments, with the command name upper-cased
+type redisCommand struct {
+	name   string
+	args   []*respValue // arguments after the name, the first respMaxElements ones
+	count  int64        // number of arguments
+	timing messageTiming
+}
+
+func newRedisCommand(value *respValue, timing messageTiming) (*redisCommand, error) {
+	if value.kind != '*' || value.size <= 0 {
+		return nil, errRESPInvalid
+	}
+	for _, arg := range value.elements {
+		if arg.kind != '$' || arg.isNull() {
+			return nil, errRESPInvalid
+		}
+	}
+	return &redisCommand{name: strings.ToUpper(string(value.elements[0].data)), args: value.elements[1:],
+		count: value.size - 1, timing: timing}, nil
+}
+
+// the key the command operates on, empty if none
+func (c *redisCommand) key() string {
+	if redisKeylessCommands[c.name] || len(c.args) == 0 {
+		return ""
+	}
+	if redisScriptCommands[c.name] {
+		if len(c.args) > 2 && string(c.args[1].data) != "0" {
+			return c.argString(2)
+		}
+		return ""
+	}
+	if c.name == "XREAD" || c.name == "XREADGROUP" {
+		for i, arg := range c.args {
+			if strings.EqualFold(string(arg.data), "STREAMS") && i+1 < len(c.args) {
+				return c.argString(i + 1)
+			}
+		}
+		return ""
+	}
+	return c.argString(0)
+}
+
+func (c *redisCommand) argString(i int) string {
+	if c.hidden(i) {
+		return "(hidden)"
+	}
+	return string(c.args[i].data)
+}
+
+// if the argument is a password
+func (c *redisCommand) hidden(i int) bool {
+	switch c.name {
+	case "AUTH":
+		return true
+	case "HELLO":
+		// HELLO protover AUTH username password
+		return i >= 3 && strings.EqualFold(string(c.args[i-2].data), "AUTH")
+	}
+	return false
+}
+
+// sizes of arguments, in bytes
+func (c *redisCommand) argSizes() string {
+	sizes := make([]string, len(c.args))
+	for i, arg := range c.args {
+		sizes[i] = strconv.FormatInt(arg.size, 10)
+	}
+	if c.count > int64(len(c.args)) {
+		sizes = append(sizes, "...")
+	}
+	return strings.Join(sizes, ", ")
+}
+
+// the command line, arguments quoted
+func (c *redisCommand) format() string {
+	parts := []string{c.name}
+	for i, arg := range c.args {
+		if c.hidden(i) {
+			parts = append(parts, "(hidden)")
+		} else {
+			parts = append(parts, arg.quoted())
+		}
+	}
+	if omitted := c.count - int64(len(c.args)); omitted > 0 {
+		parts = append(parts, "... "+strconv.FormatInt(omitted, 10)+" more")
+	}
+	return strings.Join(parts, " ")
+}
+
+// redisReply is a reply with the capture time
+type redisReply struct {
+	value  *respValue
+	timing messageTiming
+}
+
+// redisHandler pair commands and replies of a redis connection, and send to printer
+type redisHandler struct {
+	key     ConnectionKey
+	option  *Option
+	printer *Printer
+	buffer  *bytes.Buffer
+	// pub/sub and monitor mode, server send messages without commands
+	subscriptions int
+	monitoring    bool
+}
+
+func (h *redisHandler) handle(connection *TCPConnection) {
+	commandReader := newStreamReader(connection.upStream)
+	replyReader := newStreamReader(connection.downStream)
+
+	// commands are read ahead by another goroutine, replies come in the same order
+	queue := make(chan *redisCommand, maxPendingRequests)
+	stop := make(chan struct{})
+	commandsDone := make(chan struct{})
+	go func() {
+		defer close(commandsDone)
+		h.readCommands(commandReader, queue, stop)
+		close(queue)
+	}()
+	defer func() {
+		close(stop)
+		discardAll(replyReader)
+		<-commandsDone
+		discardAll(commandReader)
+	}()
+
+	var command *redisCommand
+	var remain int // replies to the current command not received yet
+	for {
+		replyStart := replyReader.position()
+		value, err := readRESP(replyReader.Reader)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+				fmt.Fprintln(os.Stderr, "Error parsing redis reply:", err, h.key.srcString())
+			}
+			if remain == 0 {
+				command = nil
+			}
+			h.printPendingCommands(command, queue, err == errStreamDropped)
+			return
+		}
+		reply := &redisReply{value: value, timing: messageTiming{firstByte: replyReader.timestampAt(replyStart),
+			lastByte: replyReader.lastTimestamp()}}
+		if h.isMessage(value) {
+			h.printMessage(reply)
+			continue
+		}
+		if remain == 0 {
+			var ok bool
+			if command, ok = <-queue; !ok {
+				// reply to a command not captured
+				h.printMessage(reply)
+				continue
+			}
+			remain = h.expectedReplies(command)
+		}
+		remain--
+		h.updateMode(command, value)
+		h.printTransaction(command, reply)
+	}
+}
+
+func (h *redisHandler) readCommands(reader *streamReader, queue chan<- *redisCommand, stop <-chan struct{}) {
+	for {
+		start := reader.position()
+		value, err := readRESP(reader.Reader)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+				fmt.Fprintln(os.Stderr, "Error parsing redis command:", err, h.key.srcString())
+			}
+			return
+		}
+		timing := messageTiming{firstByte: reader.timestampAt(start), lastByte: reader.lastTimestamp()}
+		command, err := newRedisCommand(value, timing)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Error parsing redis command:", err, h.key.srcString())
+			return
+		}
+		select {
+		case queue <- command:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// number of replies the command get
+func (h *redisHandler) expectedReplies(command *redisCommand) int {
+	if !redisSubscribeCommands[command.name] {
+		return 1
+	}
+	if command.count > 0 {
+		return int(command.count)
+	}
+	// unsubscribe from all channels
+	if h.subscriptions > 0 {
+		return h.subscriptions
+	}
+	return 1
+}
+
+// track pub/sub and monitor mode by replies
+func (h *redisHandler) updateMode(command *redisCommand, value *respValue) {
+	if command.name == "MONITOR" && value.kind == '+' {
+		h.monitoring = true
+	}
+	if redisSubscribeCommands[command.name] && len(value.elements) == 3 && value.elements[2].kind == ':' {
+		// the number of channels still subscribed
+		h.subscriptions, _ = strconv.Atoi(string(value.elements[2].data))
+	}
+}
+
+// if the value is sent by server without command: RESP3 push, pub/sub message, or command in monitor mode
+func (h *redisHandler) isMessage(value *respValue) bool {
+	if h.monitoring {
+		return true
+	}
+	if value.kind != '>' && (value.kind != '*' || h.subscriptions == 0) || len(value.elements) == 0 {
+		return value.kind == '>'
+	}
+	kind := string(value.elements[0].data)
+	if redisSubscribeCommands[strings.ToUpper(kind)] {
+		// confirmation of subscribe commands, which is push in RESP3
+		return false
+	}
+	return value.kind == '>' || kind == "message" || kind == "pmessage" || kind == "smessage"
+}
+
+// print commands the replies of which are not captured
+func (h *redisHandler) printPendingCommands(command *redisCommand, queue <-chan *redisCommand, dropped bool) {
+	if command != nil {
+		h.printTransaction(command, nil)
+	}
+	if !dropped {
+		for command := range queue {
+			h.printTransaction(command, nil)
+		}
+	}
+	if dropped && !httpFiltersSet(h.option) {
+		h.buffer = new(bytes.Buffer)
+		h.writeLine("{Connection", h.key.srcString(), "-", h.key.dstString(),
+			"dropped: handler can not keep up with traffic}")
+		h.printer.send(h.buffer.String())
+	}
+}
+
+// print command and its reply. reply is nil if not captured
+func (h *redisHandler) printTransaction(command *redisCommand, reply *redisReply) {
+	if httpFiltersSet(h.option) {
+		return
+	}
+	h.buffer = new(bytes.Buffer)
+	replySummary, latency := "no reply", ""
+	if reply != nil {
+		replySummary = reply.value.summary()
+		latency = reply.timing.lastByte.Sub(command.timing.firstByte).String()
+	}
+	key := command.key()
+
+	if h.option.Level == "url" {
+		line := "REDIS " + command.name
+		if key != "" {
+			line += " " + key
+		}
+		line += " -> " + replySummary
+		if reply != nil {
+			line += ", latency: " + latency
+		}
+		h.writeLine(line)
+		h.printer.send(h.buffer.String())
+		return
+	}
+
+	h.writeLine()
+	title := command.timing.firstByte.Format(time.RFC3339Nano)
+	if reply != nil {
+		title += " - " + reply.timing.lastByte.Format(time.RFC3339Nano) + " = " + latency
+	}
+	h.writeLine(strings.Repeat("*", 10), " REDIS ", h.key.srcString(), " -----> ", h.key.dstString(), " // ", title)
+	h.writeLine("command:", command.name)
+	if key != "" {
+		h.writeLine("key:", key)
+	}
+	if command.count > 0 {
+		h.writeLine("arguments:", command.count, "(bytes: "+command.argSizes()+")")
+	}
+	h.writeLine("reply:", replySummary)
+	if h.option.Level == "all" {
+		h.writeLine()
+		h.writeLine(">", command.format())
+		if reply != nil {
+			h.writeLine(reply.value.format())
+		}
+	}
+	h.printer.send(h.buffer.String())
+}
+
+// print value server send without command
+func (h *redisHandler) printMessage(reply *redisReply) {
+	if httpFiltersSet(h.option) {
+		return
+	}
+	h.buffer = new(bytes.Buffer)
+	if h.option.Level == "url" {
+		h.writeLine("REDIS PUSH", reply.value.summary())
+		h.printer.send(h.buffer.String())
+		return
+	}
+	h.writeLine()
+	h.writeLine(strings.Repeat("*", 10), " REDIS PUSH ", h.key.srcString(), " <----- ", h.key.dstString(), " // ",
+		reply.timing.firstByte.Format(time.RFC3339Nano))
+	h.writeLine("message:", reply.value.summary())
+	if h.option.Level == "all" {
+		h.writeLine()
+		h.writeLine(reply.value.format())
+	}
+	h.printer.send(h.buffer.String())
+}
+
+func (h *redisHandler) writeLine(a ...interface{}) {
+	fmt.Fprintln(h.buffer, a...)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// redis conversation, client send commands and server send replies
+func redisConversation(exchanges ...string) *tcpConversation {
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.server.port = 6379
+	conversation.handshake()
+	for i := 0; i+1 < len(exchanges); i += 2 {
+		conversation.exchange(exchanges[i], exchanges[i+1], 1460)
+	}
+	return conversation.close()
+}
+
+func TestRedisPipeline(t *testing.T) {
+	conversation := redisConversation(
+		"*3\r\n$3\r\nSET\r\n$6\r\nuser:1\r\n$5\r\nhello\r\n*2\r\n$3\r\nget\r\n$6\r\nuser:1\r\n"+
+			"*1\r\n$4\r\nPING\r\n",
+		"+OK\r\n$5\r\nhello\r\n+PONG\r\n")
+	messages := runConversationMessages(t, &Option{Level: "header"}, conversation)
+	assert.Equal(t, 3, len(messages))
+	assert.Regexp(t, "^\n\\*+  REDIS  10.0.0.1:10000  ----->  10.0.0.2:6379  //  "+
+		"2020-01-01T00:00:00.004Z - 2020-01-01T00:00:00.006Z = 2ms\n"+
+		"command: SET\nkey: user:1\narguments: 2 \\(bytes: 6, 5\\)\nreply: simple string OK\n$", messages[0])
+	assert.Contains(t, messages[1], "command: GET\nkey: user:1\narguments: 1 (bytes: 6)\nreply: bulk string (5 bytes)\n")
+	assert.Contains(t, messages[2], "command: PING\nreply: simple string PONG\n")
+
+	output := runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "REDIS SET user:1 -> simple string OK, latency: 2ms\n"+
+		"REDIS GET user:1 -> bulk string (5 bytes), latency: 2ms\n"+
+		"REDIS PING -> simple string PONG, latency: 2ms\n", output)
+
+	output = runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "\n> GET \"user:1\"\n\"hello\"\n")
+
+	// http filters do not match redis
+	assert.Equal(t, "", runConversations(t, &Option{Level: "url", Host: "*"}, conversation))
+}
+
+func TestRedisPubSub(t *testing.T) {
+	conversation := redisConversation(
+		"*3\r\n$9\r\nSUBSCRIBE\r\n$1\r\na\r\n$1\r\nb\r\n",
+		"*3\r\n$9\r\nsubscribe\r\n$1\r\na\r\n:1\r\n*3\r\n$9\r\nsubscribe\r\n$1\r\nb\r\n:2\r\n"+
+			"*3\r\n$7\r\nmessage\r\n$1\r\na\r\n$2\r\nhi\r\n",
+		"*1\r\n$11\r\nUNSUBSCRIBE\r\n",
+		"*3\r\n$11\r\nunsubscribe\r\n$1\r\na\r\n:1\r\n*3\r\n$11\r\nunsubscribe\r\n$1\r\nb\r\n:0\r\n",
+		"*2\r\n$4\r\nAUTH\r\n$6\r\nsecret\r\n",
+		"+OK\r\n")
+	output := runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "REDIS SUBSCRIBE -> array (3 elements), latency: 2ms\n"+
+		"REDIS SUBSCRIBE -> array (3 elements), latency: 2ms\n"+
+		"REDIS PUSH array (3 elements)\n"+
+		"REDIS UNSUBSCRIBE -> array (3 elements), latency: 2ms\n"+
+		"REDIS UNSUBSCRIBE -> array (3 elements), latency: 2ms\n"+
+		"REDIS AUTH -> simple string OK, latency: 2ms\n", output)
+
+	output = runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "\nmessage: array (3 elements)\n\n1) \"message\"\n2) \"a\"\n3) \"hi\"\n")
+	assert.Contains(t, output, "\n> AUTH (hidden)\n")
+	assert.False(t, strings.Contains(output, "secret"))
+}
+
+func TestRedisNoReply(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.server.port = 6379
+	conversation.handshake()
+	conversation.add(conversation.send(true, "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n*2\r\n$3\r\nGET\r\n$1\r\nj\r\n", 1460)...)
+	conversation.add(conversation.send(false, "$-1\r\n", 1460)...)
+	conversation.close()
+	output := runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "REDIS GET k -> null, latency: 1ms\nREDIS GET j -> no reply\n", output)
+}
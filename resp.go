@@ -0,0 +1,378 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// RESP, the redis serialization protocol. Values of RESP2 and RESP3 are parsed, only the beginning of large
+// values are kept for printing
+
+const (
+	respMaxValue    = 1024 // bytes kept of string values
+	respMaxElements = 100  // elements kept of aggregate values
+	respMaxDepth    = 32   // nesting of aggregate values
+)
+
+var errRESPInvalid = errors.New("redis: invalid RESP data")
+
+// respValue is one RESP value
+type respValue struct {
+	kind byte // type prefix, such as '+', '$', '*'
+	// content of simple types, or the first respMaxValue bytes of blob types
+	data []byte
+	// bytes of blob types, or number of elements of aggregate types. -1 for RESP2 null bulk string and array
+	size int64
+	// the first respMaxElements elements of aggregate types. map and attribute have keys and values in turn
+	elements []*respValue
+}
+
+// if data start a RESP array of bulk strings, which is how clients send commands: *<count>\r\n$<len>\r\n<name>
+func isRESPCommand(data []byte) bool {
+	data, ok := skipRESPLength(data, '*')
+	if !ok {
+		return false
+	}
+	if data, ok = skipRESPLength(data, '$'); !ok || len(data) == 0 {
+		return false
+	}
+	for i, c := range data {
+		switch {
+		case c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '.' || c == '_' || c == '-'):
+		case i > 0 && c == '\r':
+			return true
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// skip the header of a RESP aggregate or blob: prefix, a positive length, and CRLF
+func skipRESPLength(data []byte, prefix byte) ([]byte, bool) {
+	if len(data) < 2 || data[0] != prefix || data[1] < '1' || data[1] > '9' {
+		return nil, false
+	}
+	i := 2
+	for i < len(data) && i < 12 && data[i] >= '0' && data[i] <= '9' {
+		i++
+	}
+	if !strings.HasPrefix(string(data[i:]), "\r\n") {
+		return nil, false
+	}
+	return data[i+2:], true
+}
+
+// read one line, without the line ending. Only the first respMaxValue bytes are kept of long lines
+func readRESPLine(reader *bufio.Reader) ([]byte, error) {
+	var line []byte
+	var length int
+	for {
+		chunk, err := reader.ReadSlice('\n')
+		length += len(chunk)
+		if len(line) < respMaxValue+2 {
+			line = append(line, chunk...)
+		}
+		if err == bufio.ErrBufferFull {
+			continue
+		}
+		if err != nil {
+			if err == io.EOF && length > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		break
+	}
+	if length > respMaxValue+2 {
+		return line[:respMaxValue], nil
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return line, nil
+}
+
+// read one RESP value. RESP3 attributes before the value are skipped
+func readRESP(reader *bufio.Reader) (*respValue, error) {
+	return readRESPValue(reader, 0)
+}
+
+func readRESPValue(reader *bufio.Reader, depth int) (*respValue, error) {
+	if depth > respMaxDepth {
+		return nil, errRESPInvalid
+	}
+	line, err := readRESPLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if len(line) == 0 {
+		return nil, errRESPInvalid
+	}
+	value := &respValue{kind: line[0]}
+	content := line[1:]
+	switch value.kind {
+	case '+', '-', ':', ',', '#', '(', '_':
+		value.data = content
+		return value, nil
+	case '$', '!', '=':
+		if string(content) == "?" {
+			err = readRESPStreamedString(reader, value)
+		} else if value.size, err = parseRESPLength(content); err == nil && value.size >= 0 {
+			value.data, err = readRESPBlob(reader, value.size)
+		}
+		return value, err
+	case '*', '~', '>', '%', '|':
+		if string(content) == "?" {
+			err = readRESPStreamedElements(reader, value, depth)
+		} else if value.size, err = parseRESPLength(content); err == nil {
+			err = readRESPElements(reader, value, depth)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if value.kind == '|' {
+			// attribute is auxiliary data of the value after it
+			return readRESPValue(reader, depth)
+		}
+		return value, nil
+	}
+	return nil, errRESPInvalid
+}
+
+func parseRESPLength(data []byte) (int64, error) {
+	length, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil || length < -1 || length > 1<<32 {
+		return 0, errRESPInvalid
+	}
+	return length, nil
+}
+
+// read blob of length and the CRLF after it, keep the first respMaxValue bytes
+func readRESPBlob(reader *bufio.Reader, length int64) ([]byte, error) {
+	kept := length
+	if kept > respMaxValue {
+		kept = respMaxValue
+	}
+	data := make([]byte, kept)
+	if _, err := io.ReadFull(reader, data); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if _, err := reader.Discard(int(length - kept)); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	var crlf [2]byte
+	if _, err := io.ReadFull(reader, crlf[:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if string(crlf[:]) != "\r\n" {
+		return nil, errRESPInvalid
+	}
+	return data, nil
+}
+
+// RESP3 streamed string: chunks of ;<length> and data, end with ;0
+func readRESPStreamedString(reader *bufio.Reader, value *respValue) error {
+	for {
+		line, err := readRESPLine(reader)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if len(line) == 0 || line[0] != ';' {
+			return errRESPInvalid
+		}
+		length, err := parseRESPLength(line[1:])
+		if err != nil || length < 0 {
+			return errRESPInvalid
+		}
+		if length == 0 {
+			return nil
+		}
+		chunk, err := readRESPBlob(reader, length)
+		if err != nil {
+			return err
+		}
+		if len(value.data) < respMaxValue {
+			value.data = append(value.data, chunk...)
+			if len(value.data) > respMaxValue {
+				value.data = value.data[:respMaxValue]
+			}
+		}
+		value.size += length
+	}
+}
+
+func readRESPElements(reader *bufio.Reader, value *respValue, depth int) error {
+	count, kept := value.size, int64(respMaxElements)
+	if value.kind == '%' || value.kind == '|' {
+		count, kept = 2*count, 2*kept
+	}
+	for i := int64(0); i < count; i++ {
+		element, err := readRESPValue(reader, depth+1)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if i < kept {
+			value.elements = append(value.elements, element)
+		}
+	}
+	return nil
+}
+
+// RESP3 streamed aggregate: elements end with '.'
+func readRESPStreamedElements(reader *bufio.Reader, value *respValue, depth int) error {
+	kept := respMaxElements
+	if value.kind == '%' || value.kind == '|' {
+		kept *= 2
+	}
+	for i := 0; ; i++ {
+		if data, err := reader.Peek(1); err != nil {
+			return unexpectedEOF(err)
+		} else if data[0] == '.' {
+			if line, err := readRESPLine(reader); err != nil || len(line) != 1 {
+				return errRESPInvalid
+			}
+			break
+		}
+		element, err := readRESPValue(reader, depth+1)
+		if err != nil {
+			return unexpectedEOF(err)
+		}
+		if i < kept {
+			value.elements = append(value.elements, element)
+		}
+		if value.kind != '%' && value.kind != '|' || i%2 == 1 {
+			value.size++
+		}
+	}
+	return nil
+}
+
+func (v *respValue) isNull() bool {
+	return v.kind == '_' || v.size < 0
+}
+
+// if blob value is larger than bytes kept
+func (v *respValue) truncated() bool {
+	switch v.kind {
+	case '$', '!', '=':
+		return int64(len(v.data)) < v.size
+	}
+	return false
+}
+
+// short description: type, and the value of small types or size of large types
+func (v *respValue) summary() string {
+	if v.isNull() {
+		return "null"
+	}
+	switch v.kind {
+	case '+':
+		return "simple string " + string(v.data)
+	case '-':
+		return "error " + string(v.data)
+	case ':':
+		return "integer " + string(v.data)
+	case ',':
+		return "double " + string(v.data)
+	case '#':
+		return "boolean " + strconv.FormatBool(string(v.data) == "t")
+	case '(':
+		return "big number " + string(v.data)
+	case '$':
+		return "bulk string (" + strconv.FormatInt(v.size, 10) + " bytes)"
+	case '!':
+		return "blob error " + strconv.Quote(string(v.data))
+	case '=':
+		return "verbatim string (" + strconv.FormatInt(v.size, 10) + " bytes)"
+	case '*':
+		return "array (" + strconv.FormatInt(v.size, 10) + " elements)"
+	case '~':
+		return "set (" + strconv.FormatInt(v.size, 10) + " elements)"
+	case '>':
+		return "push (" + strconv.FormatInt(v.size, 10) + " elements)"
+	case '%':
+		return "map (" + strconv.FormatInt(v.size, 10) + " entries)"
+	}
+	return "unknown"
+}
+
+// value in the form of redis-cli, aggregate values take multiple lines
+func (v *respValue) format() string {
+	var builder strings.Builder
+	v.formatTo(&builder, "")
+	return builder.String()
+}
+
+func (v *respValue) formatTo(builder *strings.Builder, indent string) {
+	if v.isNull() {
+		builder.WriteString("(nil)")
+		return
+	}
+	switch v.kind {
+	case '+':
+		builder.Write(v.data)
+	case '-', '!':
+		builder.WriteString("(error) ")
+		builder.Write(v.data)
+	case ':':
+		builder.WriteString("(integer) ")
+		builder.Write(v.data)
+	case ',':
+		builder.WriteString("(double) ")
+		builder.Write(v.data)
+	case '#':
+		builder.WriteString("(boolean) ")
+		builder.WriteString(strconv.FormatBool(string(v.data) == "t"))
+	case '(':
+		builder.WriteString("(big number) ")
+		builder.Write(v.data)
+	case '$', '=':
+		builder.WriteString(v.quoted())
+	case '*', '~', '>', '%':
+		if v.size == 0 {
+			builder.WriteString("(empty)")
+			return
+		}
+		entries := v.elements
+		step := 1
+		if v.kind == '%' {
+			step = 2
+		}
+		for i := 0; i+step <= len(entries); i += step {
+			if i > 0 {
+				builder.WriteString("\n" + indent)
+			}
+			prefix := strconv.Itoa(i/step+1) + ") "
+			builder.WriteString(prefix)
+			elementIndent := indent + strings.Repeat(" ", len(prefix))
+			entries[i].formatTo(builder, elementIndent)
+			if step == 2 {
+				builder.WriteString(" => ")
+				entries[i+1].formatTo(builder, elementIndent)
+			}
+		}
+		if omitted := v.size - int64(len(entries)/step); omitted > 0 {
+			builder.WriteString("\n" + indent + "... " + strconv.FormatInt(omitted, 10) + " more")
+		}
+	}
+}
+
+// string value quoted, with the size if truncated
+func (v *respValue) quoted() string {
+	data := v.data
+	if v.kind == '=' && len(data) >= 4 && data[3] == ':' {
+		// verbatim string start with format, such as txt:
+		data = data[4:]
+	}
+	quoted := strconv.Quote(string(data))
+	if v.truncated() {
+		quoted += "... (" + strconv.FormatInt(v.size, 10) + " bytes)"
+	}
+	return quoted
+}
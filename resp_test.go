@@ -0,0 +1,86 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsRESPCommand(t *testing.T) {
+	for data, expected := range map[string]bool{
+		"*1\r\n$4\r\nPING\r\n":                      true,
+		"*3\r\n$3\r\nset\r\n$1\r\nk\r\n$1\r\nv\r\n": true,
+		"*2\r\n$8\r\nJSON.GET\r\n":                  true,
+		"*2\r\n$3\r\nGE":                            true,
+		"*0\r\n":                                    false,
+		"*1\r\n:1\r\n":                              false,
+		"*1\r\n$1\r\n1\r\n":                         false,
+		"+OK\r\n":                                   false,
+		"PING\r\n":                                  false,
+		"*1\n$4\nPING\n":                            false,
+	} {
+		assert.Equal(t, expected, isRESPCommand([]byte(data)), data)
+	}
+}
+
+func TestReadRESP(t *testing.T) {
+	read := func(data string) *respValue {
+		value, err := readRESP(bufio.NewReader(strings.NewReader(data)))
+		assert.NoError(t, err, data)
+		return value
+	}
+	for data, expected := range map[string]string{
+		"+OK\r\n":                               "simple string OK",
+		"-ERR unknown command\r\n":              "error ERR unknown command",
+		":-5\r\n":                               "integer -5",
+		"$5\r\nhello\r\n":                       "bulk string (5 bytes)",
+		"$-1\r\n":                               "null",
+		"*-1\r\n":                               "null",
+		"_\r\n":                                 "null",
+		"*2\r\n:1\r\n$1\r\na\r\n":               "array (2 elements)",
+		",3.14\r\n":                             "double 3.14",
+		"#t\r\n":                                "boolean true",
+		"(12345678901234567890\r\n":             "big number 12345678901234567890",
+		"!9\r\nSYNTAX xx\r\n":                   "blob error \"SYNTAX xx\"",
+		"=8\r\ntxt:some\r\n":                    "verbatim string (8 bytes)",
+		"%1\r\n+a\r\n:1\r\n":                    "map (1 entries)",
+		"~2\r\n+a\r\n+b\r\n":                    "set (2 elements)",
+		">3\r\n+message\r\n+ch\r\n+hi\r\n":      "push (3 elements)",
+		"|1\r\n+ttl\r\n:3\r\n+OK\r\n":           "simple string OK",
+		"$?\r\n;4\r\nHell\r\n;1\r\no\r\n;0\r\n": "bulk string (5 bytes)",
+		"*?\r\n:1\r\n:2\r\n.\r\n":               "array (2 elements)",
+	} {
+		assert.Equal(t, expected, read(data).summary(), data)
+	}
+
+	assert.Equal(t, "1) \"a\"\n2) 1) (integer) 1\n   2) (nil)\n3) (empty)",
+		read("*3\r\n$1\r\na\r\n*2\r\n:1\r\n_\r\n*0\r\n").format())
+	assert.Equal(t, "1) \"k\" => (double) 1.5", read("%1\r\n$1\r\nk\r\n,1.5\r\n").format())
+	assert.Equal(t, "\"Hello\"", read("$?\r\n;4\r\nHell\r\n;1\r\no\r\n;0\r\n").format())
+	assert.Equal(t, "\"some\"", read("=8\r\ntxt:some\r\n").format())
+
+	// large values are truncated
+	value := read("$2000\r\n" + strings.Repeat("a", 2000) + "\r\n")
+	assert.Equal(t, respMaxValue, len(value.data))
+	assert.True(t, strings.HasSuffix(value.format(), "\"... (2000 bytes)"))
+	value = read("*150\r\n" + strings.Repeat(":1\r\n", 150))
+	assert.Equal(t, respMaxElements, len(value.elements))
+	assert.True(t, strings.HasSuffix(value.format(), "\n... 50 more"))
+
+	for _, data := range []string{"", "$5\r\nhel", "*2\r\n:1\r\n"} {
+		_, err := readRESP(bufio.NewReader(strings.NewReader(data)))
+		if data == "" {
+			assert.Equal(t, io.EOF, err)
+		} else {
+			assert.Equal(t, io.ErrUnexpectedEOF, err, data)
+		}
+	}
+	for _, data := range []string{"\r\n", "@1\r\n", "$3\r\nabcd\r\n", "*x\r\n", "$?\r\n:1\r\n",
+		strings.Repeat("*1\r\n", respMaxDepth+2)} {
+		_, err := readRESP(bufio.NewReader(strings.NewReader(data)))
+		assert.Equal(t, errRESPInvalid, err, data)
+	}
+}
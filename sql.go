@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// bytes kept of a message of sql protocols, such as a query. The rest is skipped
+const sqlMaxKept = 64 * 1024
+
+// sqlField is one line of a transaction: name and value
+type sqlField struct {
+	name  string
+	value string
+}
+
+// sqlTransaction is a request client send to sql database, such as a query, and the response
+type sqlTransaction struct {
+	statement      string     // query or command, printed in one line at url level
+	request        []sqlField // describe the request
+	response       []sqlField // describe the response, empty if not captured
+	details        []sqlField // printed at level all, such as parameters and columns
+	requestTiming  messageTiming
+	responseTiming messageTiming
+}
+
+// sqlPrinter print transactions of a sql database connection
+type sqlPrinter struct {
+	protocol string // name in output, such as MYSQL
+	key      ConnectionKey
+	option   *Option
+	printer  *Printer
+}
+
+func (p *sqlPrinter) print(t *sqlTransaction) {
+	if httpFiltersSet(p.option) {
+		return
+	}
+	buffer := new(bytes.Buffer)
+	result, latency := "no response", ""
+	if len(t.response) > 0 {
+		result = t.response[0].value
+		latency = t.responseTiming.lastByte.Sub(t.requestTiming.firstByte).String()
+	}
+
+	if p.option.Level == "url" {
+		line := p.protocol + " " + strings.Join(strings.Fields(t.statement), " ") + " -> " + result
+		if latency != "" {
+			line += ", latency: " + latency
+		}
+		fmt.Fprintln(buffer, line)
+		p.printer.send(buffer.String())
+		return
+	}
+
+	title := t.requestTiming.firstByte.Format(time.RFC3339Nano)
+	if latency != "" {
+		title += " - " + t.responseTiming.lastByte.Format(time.RFC3339Nano) + " = " + latency
+	}
+	fmt.Fprintln(buffer)
+	fmt.Fprintln(buffer, strings.Repeat("*", 10), " "+p.protocol+" ", p.key.srcString(), " -----> ",
+		p.key.dstString(), " // ", title)
+	fields := append(append([]sqlField(nil), t.request...), t.response...)
+	if len(t.response) == 0 {
+		fields = append(fields, sqlField{"response", result})
+	}
+	if p.option.Level == "all" {
+		fields = append(fields, t.details...)
+	}
+	for _, field := range fields {
+		fmt.Fprintln(buffer, field.name+":", field.value)
+	}
+	p.printer.send(buffer.String())
+}
+
+// print mark for connection dropped by backpressure policy
+func (p *sqlPrinter) printDroppedMark() {
+	if httpFiltersSet(p.option) {
+		return
+	}
+	p.printer.send(fmt.Sprintln("{Connection", p.key.srcString(), "-", p.key.dstString(),
+		"dropped: handler can not keep up with traffic}"))
+}
+
+// read message content of length, append to kept until it has sqlMaxKept bytes, the rest is skipped
+func readSQLContent(reader *bufio.Reader, kept []byte, length int) ([]byte, error) {
+	keep := sqlMaxKept - len(kept)
+	if keep > length {
+		keep = length
+	}
+	if keep < 0 {
+		keep = 0
+	}
+	start := len(kept)
+	kept = append(kept, make([]byte, keep)...)
+	if _, err := io.ReadFull(reader, kept[start:]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if _, err := reader.Discard(length - keep); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	return kept, nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"strings"
+)
+
+// serverSentEvent is an event of text/event-stream, with fields in the order received
+type serverSentEvent struct {
+	fields []string // lines of event, data, id and retry fields
+	start  int64    // offset in the stream body of the first field
+}
+
+// eventStreamReader read events of text/event-stream
+type eventStreamReader struct {
+	reader *bufio.Reader
+	offset int64 // offset in the stream body of the next line
+}
+
+func newEventStreamReader(reader io.Reader) *eventStreamReader {
+	return &eventStreamReader{reader: bufio.NewReader(reader)}
+}
+
+// read the next event, which is ended by an empty line. Comment lines are skipped,
+// and event without fields is not returned
+func (r *eventStreamReader) next() (*serverSentEvent, error) {
+	event := &serverSentEvent{}
+	for {
+		lineStart := r.offset
+		line, err := r.reader.ReadString('\n')
+		r.offset += int64(len(line))
+		if err != nil {
+			// event not ended by empty line is discarded
+			return nil, err
+		}
+		line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+		if line == "" {
+			if len(event.fields) > 0 {
+				return event, nil
+			}
+			continue
+		}
+		if strings.HasPrefix(line, ":") {
+			// comment, usually for keep-alive
+			continue
+		}
+		if len(event.fields) == 0 {
+			event.start = lineStart
+		}
+		event.fields = append(event.fields, line)
+	}
+}
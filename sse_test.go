@@ -0,0 +1,24 @@
+package main
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEventStreamReader(t *testing.T) {
+	reader := newEventStreamReader(strings.NewReader(": keep-alive\n\n" +
+		"event: update\r\nid: 1\r\ndata: line1\r\ndata: line2\r\n\r\n" +
+		"\n\ndata: {\"a\": 1}\n\n" +
+		"data: not ended\n"))
+	event, err := reader.next()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"event: update", "id: 1", "data: line1", "data: line2"}, event.fields)
+	event, err = reader.next()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data: {\"a\": 1}"}, event.fields)
+	_, err = reader.next()
+	assert.Equal(t, io.EOF, err)
+}
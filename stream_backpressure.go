@@ -0,0 +1,180 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// backpressurePolicy decide what to do when stream data arrive faster than the connection handler can consume
+type backpressurePolicy int
+
+const (
+	// wait for the handler. This stalls all connections handled by the same assembler shard
+	backpressureBlock backpressurePolicy = iota
+	// buffer the data exceed stream queue to temp file
+	backpressureSpill
+	// stop processing the connection, the handler get errStreamDropped after read all data already queued
+	backpressureDrop
+)
+
+// parse backpressure policy option
+func parseBackpressurePolicy(str string) (backpressurePolicy, error) {
+	switch str {
+	case "", "block":
+		return backpressureBlock, nil
+	case "spill":
+		return backpressureSpill, nil
+	case "drop":
+		return backpressureDrop, nil
+	default:
+		return 0, errors.New("unknown backpressure policy: " + str)
+	}
+}
+
+// errStreamDropped is returned by NetworkStream.Read, when the connection was dropped by backpressure policy
+var errStreamDropped = errors.New("connection dropped, handler can not keep up with traffic")
+
+// spillQueue hold packets can not be put into stream channel in a temp file, for the spill policy.
+// Once there are packets in the file, new packets are appended to the file too, until the reader drain the file,
+// so the reader always get packets in order.
+type spillQueue struct {
+	lock        sync.Mutex
+	file        *os.File
+	writeOffset int64
+	readOffset  int64
+	closed      bool
+}
+
+// size of record header: capture time in unix nano, and payload len
+const spillHeaderLen = 12
+
+// put packet to channel if there are no spilled packets and channel is not full, otherwise spill to file
+func (q *spillQueue) push(packet *streamPacket, c chan *streamPacket) {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return
+	}
+	if q.empty() {
+		select {
+		case c <- packet:
+			q.lock.Unlock()
+			return
+		default:
+		}
+	}
+	err := q.write(packet)
+	spilled := !q.empty()
+	q.lock.Unlock()
+
+	if err != nil {
+		if !spilled {
+			// nothing spilled, can just wait for the reader
+			c <- packet
+			return
+		}
+		fmt.Fprintln(os.Stderr, "spill stream data to file failed, data lost:", err)
+	}
+}
+
+// get next packet, in the order they were pushed. return false if no more packets
+func (q *spillQueue) pop(c chan *streamPacket) (*streamPacket, bool) {
+	q.lock.Lock()
+	select {
+	case packet, ok := <-c:
+		if ok {
+			q.lock.Unlock()
+			return packet, true
+		}
+	default:
+		if !q.empty() {
+			packet := q.read()
+			q.lock.Unlock()
+			return packet, packet != nil
+		}
+		// queue is empty, packets will come from channel first
+		q.lock.Unlock()
+		packet, ok := <-c
+		if ok {
+			return packet, true
+		}
+		q.lock.Lock()
+	}
+
+	// channel closed, no more packets will be pushed
+	defer q.lock.Unlock()
+	if !q.empty() {
+		packet := q.read()
+		return packet, packet != nil
+	}
+	return nil, false
+}
+
+func (q *spillQueue) empty() bool {
+	return q.writeOffset == q.readOffset
+}
+
+func (q *spillQueue) write(packet *streamPacket) error {
+	if q.file == nil {
+		file, err := ioutil.TempFile("", "httpdump-spill-")
+		if err != nil {
+			return err
+		}
+		q.file = file
+	}
+	var header [spillHeaderLen]byte
+	binary.BigEndian.PutUint64(header[:8], uint64(packet.timestamp.UnixNano()))
+	binary.BigEndian.PutUint32(header[8:], uint32(len(packet.Payload)))
+	if _, err := q.file.WriteAt(header[:], q.writeOffset); err != nil {
+		return err
+	}
+	if _, err := q.file.WriteAt(packet.Payload, q.writeOffset+spillHeaderLen); err != nil {
+		return err
+	}
+	q.writeOffset += spillHeaderLen + int64(len(packet.Payload))
+	return nil
+}
+
+// read one packet from file. return nil if read failed
+func (q *spillQueue) read() *streamPacket {
+	var header [spillHeaderLen]byte
+	if _, err := q.file.ReadAt(header[:], q.readOffset); err != nil {
+		fmt.Fprintln(os.Stderr, "read spilled stream data failed:", err)
+		q.readOffset = q.writeOffset
+		return nil
+	}
+	timestamp := time.Unix(0, int64(binary.BigEndian.Uint64(header[:8])))
+	payload := make([]byte, binary.BigEndian.Uint32(header[8:]))
+	if _, err := q.file.ReadAt(payload, q.readOffset+spillHeaderLen); err != nil {
+		fmt.Fprintln(os.Stderr, "read spilled stream data failed:", err)
+		q.readOffset = q.writeOffset
+		return nil
+	}
+	q.readOffset += spillHeaderLen + int64(len(payload))
+	if q.empty() {
+		// all spilled data consumed, reuse the file from start
+		q.readOffset = 0
+		q.writeOffset = 0
+	}
+	return &streamPacket{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: payload}}, timestamp: timestamp}
+}
+
+// discard all data and remove the temp file
+func (q *spillQueue) close() {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	q.closed = true
+	q.readOffset = q.writeOffset
+	if q.file != nil {
+		_ = q.file.Close()
+		_ = os.Remove(q.file.Name())
+		q.file = nil
+	}
+}
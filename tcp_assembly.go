@@ -3,11 +3,13 @@ package main
 import (
 	"bytes"
 	"io"
+	"net"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
-	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
 )
 
@@ -15,111 +17,249 @@ import (
 // So it is hard to match http request and response. we make our own connection here
 
 const maxTCPSeq uint32 = 0xFFFFFFFF
-const tcpSeqWindow = 0x0000FFFF
 
-// TCPAssembler do tcp package assemble
+// TCPAssembler do tcp package assemble.
+// Packets are hashed by connection to shards, each shard run in its own goroutine with its own connection table,
+// so packets of one connection are always handled by the same shard in capture order.
 type TCPAssembler struct {
-	connectionDict    map[string]*TCPConnection
-	lock              sync.Mutex
+	shards            []*assemblerShard
+	shardWaitGroup    sync.WaitGroup
 	connectionHandler ConnectionHandler
-	filterIP          string
+	filterIP          net.IP
 	filterPort        uint16
+	idle              time.Duration
+	backpressure      backpressurePolicy
+	events            *connectionEvents // nil if connection events are not needed
+	dissectors        []Dissector       // protocols to parse, tried in order on the first data of connections
+}
+
+// the interval shards check for idle connections
+const idleCheckInterval = time.Second * 10
+
+// packets can be queued for one shard
+const shardQueueSize = 4096
+
+// create assembler with shardNum shards; if shardNum <= 0, use cpu num.
+// connections received no packet in idle time will be flushed.
+func newTCPAssembler(connectionHandler ConnectionHandler, shardNum int, idle time.Duration) *TCPAssembler {
+	if shardNum <= 0 {
+		shardNum = runtime.NumCPU()
+	}
+	assembler := &TCPAssembler{connectionHandler: connectionHandler, idle: idle}
+	assembler.shards = make([]*assemblerShard, shardNum)
+	for i := range assembler.shards {
+		assembler.shards[i] = &assemblerShard{
+			assembler:         assembler,
+			connectionDict:    map[ConnectionID]*TCPConnection{},
+			connectionHandler: connectionHandler,
+			packets:           make(chan tcpPacket, shardQueueSize),
+			idle:              idle,
+		}
+	}
+	assembler.shardWaitGroup.Add(shardNum)
+	for _, shard := range assembler.shards {
+		go shard.run(&assembler.shardWaitGroup)
+	}
+	return assembler
 }
 
-func newTCPAssembler(connectionHandler ConnectionHandler) *TCPAssembler {
-	return &TCPAssembler{connectionDict: map[string]*TCPConnection{}, connectionHandler: connectionHandler}
-}
-
-func (assembler *TCPAssembler) assemble(flow gopacket.Flow, tcp *layers.TCP, timestamp time.Time) {
-	src := Endpoint{ip: flow.Src().String(), port: uint16(tcp.SrcPort)}
-	dst := Endpoint{ip: flow.Dst().String(), port: uint16(tcp.DstPort)}
-	dropped := false
-	if assembler.filterIP != "" {
-		if src.ip != assembler.filterIP && dst.ip != assembler.filterIP {
-			dropped = true
+// if packet between the two endpoints should be dropped by ip/port filter
+func (assembler *TCPAssembler) filtered(src, dst Endpoint) bool {
+	if assembler.filterIP != nil {
+		if !src.hasIP(assembler.filterIP) && !dst.hasIP(assembler.filterIP) {
+			return true
 		}
 	}
 	if assembler.filterPort != 0 {
 		if src.port != assembler.filterPort && dst.port != assembler.filterPort {
-			dropped = true
+			return true
 		}
 	}
-	if dropped {
-		return
+	return false
+}
+
+// if the payload, sent by either side, starts a connection of protocols the assembler care about.
+// Data of a connection before it can be ignored
+func (assembler *TCPAssembler) isStartData(payload []byte) bool {
+	return parseProxyHeader(payload) != nil || detectDissector(assembler.dissectors, payload, true) != nil ||
+		detectDissector(assembler.dissectors, payload, false) != nil
+}
+
+// dispatch packet to the shard its connection belongs to.
+// the tcp packet will be passed to other goroutine, caller should not modify or reuse it
+func (assembler *TCPAssembler) assemble(src, dst Endpoint, tcp *layers.TCP, timestamp time.Time) {
+	id := newConnectionID(src, dst)
+	shard := assembler.shards[id.hash()%uint32(len(assembler.shards))]
+	shard.packets <- tcpPacket{src: src, dst: dst, id: id, tcp: tcp, timestamp: timestamp}
+}
+
+// stop all shards, finish all connections remained
+func (assembler *TCPAssembler) finishAll() {
+	for _, shard := range assembler.shards {
+		close(shard.packets)
 	}
+	assembler.shardWaitGroup.Wait()
+	assembler.connectionHandler.finish()
+}
 
-	srcString := src.String()
-	dstString := dst.String()
-	var key string
-	if srcString < dstString {
-		key = srcString + "-" + dstString
-	} else {
-		key = dstString + "-" + srcString
+// tcpPacket is a tcp packet dispatched to shard, with the connection info already resolved
+type tcpPacket struct {
+	src       Endpoint
+	dst       Endpoint
+	id        ConnectionID
+	tcp       *layers.TCP
+	timestamp time.Time
+}
+
+// assemblerShard owns a part of tcp connections. All fields are only accessed by the shard goroutine
+type assemblerShard struct {
+	assembler         *TCPAssembler
+	connectionDict    map[ConnectionID]*TCPConnection
+	connectionHandler ConnectionHandler
+	packets           chan tcpPacket
+	idle              time.Duration
+}
+
+// process packets, and flush idle connections periodically, until packets channel is closed
+func (shard *assemblerShard) run(waitGroup *sync.WaitGroup) {
+	defer waitGroup.Done()
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case packet, ok := <-shard.packets:
+			if !ok {
+				shard.finishAll()
+				return
+			}
+			shard.assemble(packet)
+		case now := <-ticker.C:
+			// flush connections that haven't been activity in the idle time
+			shard.flushOlderThan(now.Add(-shard.idle))
+		}
 	}
+}
 
-	var createNewConn = tcp.SYN && !tcp.ACK || isHTTPRequestData(tcp.Payload)
-	connection := assembler.retrieveConnection(src, dst, key, createNewConn)
+func (shard *assemblerShard) assemble(packet tcpPacket) {
+	tcp := packet.tcp
+	proxy := shard.parseProxy(packet)
+	dissector, client := shard.detect(packet, proxy)
+	var createNewConn = tcp.SYN && !tcp.ACK || dissector != nil || proxy != nil
+	connection := shard.retrieveConnection(packet.src, packet.dst, packet.id, createNewConn, packet.timestamp)
 	if connection == nil {
 		return
 	}
+	if proxy != nil {
+		connection.proxy = proxy
+		connection.proxyEnd = tcp.Seq + uint32(proxy.length)
+	}
+	if dissector != nil {
+		connection.detect(dissector, client)
+	}
 
-	connection.onReceive(src, dst, tcp, timestamp)
+	connection.onReceive(packet.src, packet.dst, tcp, packet.timestamp)
 
 	if connection.closed() {
-		assembler.deleteConnection(key)
+		shard.deleteConnection(packet.id, packet.timestamp)
 		connection.finish()
 	}
 }
 
+// the PROXY protocol header, if the packet has the first data of a connection not detected yet and start with it.
+// The header is sent by client before any other data
+func (shard *assemblerShard) parseProxy(packet tcpPacket) *proxyHeader {
+	if len(packet.tcp.Payload) == 0 {
+		return nil
+	}
+	connection := shard.connectionDict[packet.id]
+	if connection != nil && (connection.dissector != nil || connection.proxy != nil ||
+		!connection.clientID.equals(packet.src)) {
+		return nil
+	}
+	return parseProxyHeader(packet.tcp.Payload)
+}
+
+// find the dissector if the packet has the first data of a connection not detected yet, and the client endpoint.
+// If the connection is started by SYN, the client is known; otherwise the data may be sent by either side.
+// If the packet start with PROXY protocol header, data after the header are detected
+func (shard *assemblerShard) detect(packet tcpPacket, proxy *proxyHeader) (Dissector, Endpoint) {
+	if len(packet.tcp.Payload) == 0 {
+		return nil, Endpoint{}
+	}
+	dissectors := shard.assembler.dissectors
+	if proxy != nil {
+		payload := packet.tcp.Payload[proxy.length:]
+		if len(payload) == 0 {
+			return nil, Endpoint{}
+		}
+		return detectDissector(dissectors, payload, true), packet.src
+	}
+	connection := shard.connectionDict[packet.id]
+	if connection != nil {
+		if connection.dissector != nil {
+			return nil, Endpoint{}
+		}
+		fromClient := connection.clientID.equals(packet.src)
+		dissector := detectDissector(dissectors, packet.tcp.Payload, fromClient)
+		return dissector, connection.clientID
+	}
+	if dissector := detectDissector(dissectors, packet.tcp.Payload, true); dissector != nil {
+		return dissector, packet.src
+	}
+	return detectDissector(dissectors, packet.tcp.Payload, false), packet.dst
+}
+
 // get connection this packet belong to; create new one if is new connection
-func (assembler *TCPAssembler) retrieveConnection(src, dst Endpoint, key string, init bool) *TCPConnection {
-	assembler.lock.Lock()
-	defer assembler.lock.Unlock()
-	connection := assembler.connectionDict[key]
+func (shard *assemblerShard) retrieveConnection(src, dst Endpoint, id ConnectionID, init bool,
+	timestamp time.Time) *TCPConnection {
+	connection := shard.connectionDict[id]
 	if connection == nil {
 		if init {
-			connection = newTCPConnection(key)
-			assembler.connectionDict[key] = connection
-			assembler.connectionHandler.handle(src, dst, connection)
+			connection = newTCPConnection(id, shard.assembler.backpressure)
+			connection.clientID = src
+			connection.firstTimestamp = timestamp
+			shard.connectionDict[id] = connection
+			shard.assembler.events.opened(src, dst, timestamp)
+			shard.connectionHandler.handle(src, dst, connection)
 		}
 	}
 	return connection
 }
 
 // remove connection (when is closed or timeout)
-func (assembler *TCPAssembler) deleteConnection(key string) {
-	assembler.lock.Lock()
-	defer assembler.lock.Unlock()
-	delete(assembler.connectionDict, key)
+func (shard *assemblerShard) deleteConnection(id ConnectionID, timestamp time.Time) {
+	connection := shard.connectionDict[id]
+	delete(shard.connectionDict, id)
+	if connection != nil {
+		kind := connectionClose
+		if connection.stats.hasRST {
+			kind = connectionReset
+		} else if atomic.LoadInt32(&connection.upStream.dropped) != 0 {
+			kind = connectionDropped
+		}
+		shard.assembler.events.closed(connection, kind, timestamp)
+	}
 }
 
 // flush timeout connections
-func (assembler *TCPAssembler) flushOlderThan(time time.Time) {
-	var connections []*TCPConnection
-	assembler.lock.Lock()
-	for _, connection := range assembler.connectionDict {
+func (shard *assemblerShard) flushOlderThan(time time.Time) {
+	for id, connection := range shard.connectionDict {
 		if connection.lastTimestamp.Before(time) {
-			connections = append(connections, connection)
+			delete(shard.connectionDict, id)
+			connection.stats.closeReason = "idle timeout"
+			shard.assembler.events.closed(connection, connectionIdleTimeout, connection.lastTimestamp)
+			connection.flushOlderThan()
 		}
 	}
-	for _, connection := range connections {
-		delete(assembler.connectionDict, connection.key)
-	}
-	assembler.lock.Unlock()
-
-	for _, connection := range connections {
-		connection.flushOlderThan()
-	}
 }
 
-func (assembler *TCPAssembler) finishAll() {
-	assembler.lock.Lock()
-	defer assembler.lock.Unlock()
-	for _, connection := range assembler.connectionDict {
+func (shard *assemblerShard) finishAll() {
+	for _, connection := range shard.connectionDict {
+		connection.stats.closeReason = "capture end"
+		shard.assembler.events.closed(connection, connectionCaptureEnd, connection.lastTimestamp)
 		connection.finish()
 	}
-	assembler.connectionDict = nil
-	assembler.connectionHandler.finish()
+	shard.connectionDict = nil
 }
 
 // ConnectionHandler is interface for handle tcp connection
@@ -130,56 +270,136 @@ type ConnectionHandler interface {
 
 // TCPConnection hold info for one tcp connection
 type TCPConnection struct {
-	upStream      *NetworkStream // stream from client to server
-	downStream    *NetworkStream // stream from server to client
-	clientID      Endpoint       // the client key(by ip and port)
-	lastTimestamp time.Time      // timestamp receive last packet
-	isHTTP        bool
-	key           string
-}
-
-// Endpoint is one endpoint of a tcp connection
+	upStream       *NetworkStream // stream from client to server
+	downStream     *NetworkStream // stream from server to client
+	clientID       Endpoint       // the client key(by ip and port)
+	firstTimestamp time.Time      // timestamp receive first packet
+	lastTimestamp  time.Time      // timestamp receive last packet
+	dissector      Dissector      // detected by the first data, nil before detected
+	detected       chan struct{}  // closed when dissector detected, or connection finished without data detected
+	proxy          *proxyHeader   // PROXY protocol header client sent, nil if none
+	proxyEnd       uint32         // sequence of the first client byte after PROXY protocol header
+	id             ConnectionID
+	stats          tcpStats // written by assembler, can be read by handler after streams finished
+	transactions   int32    // http transactions parsed by handler, accessed atomically
+}
+
+// Endpoint is one endpoint of a tcp connection. ipv4 address is stored in ipv4-mapped ipv6 form,
+// so Endpoint is a fixed size value, can be compared and used as map key
 type Endpoint struct {
-	ip   string
+	ip   [net.IPv6len]byte
 	port uint16
 }
 
+// create endpoint from 4 or 16 bytes ip
+func newEndpoint(ip net.IP, port uint16) Endpoint {
+	endpoint := Endpoint{port: port}
+	if len(ip) == net.IPv4len {
+		copy(endpoint.ip[:], v4InV6Prefix)
+		copy(endpoint.ip[len(v4InV6Prefix):], ip)
+	} else {
+		copy(endpoint.ip[:], ip)
+	}
+	return endpoint
+}
+
+var v4InV6Prefix = []byte{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0xff, 0xff}
+
 func (p Endpoint) equals(p2 Endpoint) bool {
-	return p.ip == p2.ip && p.port == p2.port
+	return p == p2
+}
+
+// if p is before p2, ordered by ip bytes, then port
+func (p Endpoint) less(p2 Endpoint) bool {
+	if c := bytes.Compare(p.ip[:], p2.ip[:]); c != 0 {
+		return c < 0
+	}
+	return p.port < p2.port
+}
+
+// if endpoint has the ip. the ip should be in 16 bytes form, as net.ParseIP returns
+func (p Endpoint) hasIP(ip net.IP) bool {
+	return bytes.Equal(p.ip[:], ip)
 }
 
 func (p Endpoint) String() string {
-	return p.ip + ":" + strconv.Itoa(int(p.port))
+	return net.IP(p.ip[:]).String() + ":" + strconv.Itoa(int(p.port))
 }
 
-// ConnectionID identify a tcp connection
+// ConnectionID identify a tcp connection, no matter the direction of packet.
+// The lower endpoint is always put in src
 type ConnectionID struct {
 	src Endpoint
 	dst Endpoint
 }
 
+// create ConnectionID by endpoints of one packet
+func newConnectionID(src, dst Endpoint) ConnectionID {
+	if dst.less(src) {
+		return ConnectionID{src: dst, dst: src}
+	}
+	return ConnectionID{src: src, dst: dst}
+}
+
+// 0 if endpoint is the lower one of connection, else 1
+func (id ConnectionID) indexOf(endpoint Endpoint) int {
+	if id.src.equals(endpoint) {
+		return 0
+	}
+	return 1
+}
+
+// fnv-1a hash of the connection endpoints
+func (id ConnectionID) hash() uint32 {
+	var hash uint32 = 2166136261
+	for _, endpoint := range [2]Endpoint{id.src, id.dst} {
+		for _, b := range endpoint.ip {
+			hash ^= uint32(b)
+			hash *= 16777619
+		}
+		hash ^= uint32(endpoint.port >> 8)
+		hash *= 16777619
+		hash ^= uint32(endpoint.port & 0xff)
+		hash *= 16777619
+	}
+	return hash
+}
+
 // create tcp connection, by the first tcp packet. this packet should from client to server
-func newTCPConnection(key string) *TCPConnection {
+func newTCPConnection(id ConnectionID, policy backpressurePolicy) *TCPConnection {
 	connection := &TCPConnection{
-		upStream:   newNetworkStream(),
-		downStream: newNetworkStream(),
-		key:        key,
+		upStream:   newNetworkStream(policy),
+		downStream: newNetworkStream(policy),
+		id:         id,
+		detected:   make(chan struct{}),
 	}
 	return connection
 }
 
-// when receive tcp packet
+// the first data of the protocol received, data before is ignored
+func (connection *TCPConnection) detect(dissector Dissector, client Endpoint) {
+	connection.dissector = dissector
+	connection.clientID = client
+	close(connection.detected)
+}
+
+// the endpoint other than client
+func (connection *TCPConnection) serverID() Endpoint {
+	if connection.id.src.equals(connection.clientID) {
+		return connection.id.dst
+	}
+	return connection.id.src
+}
+
+// when receive tcp packet. data is ignored until the protocol is detected
 func (connection *TCPConnection) onReceive(src, dst Endpoint, tcp *layers.TCP, timestamp time.Time) {
 	connection.lastTimestamp = timestamp
-	payload := tcp.Payload
-	if !connection.isHTTP {
-		// skip no-http data
-		if !isHTTPRequestData(payload) {
-			return
-		}
-		// receive first valid http data packet
-		connection.clientID = src
-		connection.isHTTP = true
+	connection.stats.record(src, tcp, timestamp)
+	if connection.dissector == nil {
+		return
+	}
+	if connection.proxy != nil && connection.clientID.equals(src) {
+		connection.stripProxyHeader(tcp)
 	}
 
 	var sendStream, confirmStream *NetworkStream
@@ -194,7 +414,7 @@ func (connection *TCPConnection) onReceive(src, dst Endpoint, tcp *layers.TCP, t
 		//up = false
 	}
 
-	sendStream.appendPacket(tcp)
+	sendStream.appendPacket(tcp, timestamp)
 
 	if tcp.SYN {
 		// do nothing
@@ -203,12 +423,35 @@ func (connection *TCPConnection) onReceive(src, dst Endpoint, tcp *layers.TCP, t
 	if tcp.ACK {
 		// confirm
 		confirmStream.confirmPacket(tcp.Ack)
+		if confirmStream.overflow {
+			// handler is too slow, give up this connection
+			connection.drop()
+			return
+		}
 	}
 
 	// terminate connection
-	if tcp.FIN || tcp.RST {
+	if tcp.FIN {
+		sendStream.closed = true
+	}
+	if tcp.RST {
+		// reset abort both directions
 		sendStream.closed = true
+		confirmStream.closed = true
+	}
+}
+
+// remove bytes of PROXY protocol header from client packet, the packet may be retransmitted
+func (connection *TCPConnection) stripProxyHeader(tcp *layers.TCP) {
+	if compareTCPSeq(tcp.Seq, connection.proxyEnd) >= 0 {
+		return
+	}
+	if compareTCPSeq(tcp.Seq+uint32(len(tcp.Payload)), connection.proxyEnd) <= 0 {
+		tcp.Payload = nil
+		return
 	}
+	tcp.Payload = tcp.Payload[connection.proxyEnd-tcp.Seq:]
+	tcp.Seq = connection.proxyEnd
 }
 
 // just close this connection?
@@ -223,54 +466,130 @@ func (connection *TCPConnection) flushOlderThan() {
 
 }
 
+// stop processing data of this connection, by backpressure drop policy
+func (connection *TCPConnection) drop() {
+	connection.stats.closeReason = "dropped by backpressure policy"
+	connection.upStream.drop()
+	connection.downStream.drop()
+}
+
 func (connection *TCPConnection) closed() bool {
 	return connection.upStream.closed && connection.downStream.closed
 }
 
 func (connection *TCPConnection) finish() {
+	if connection.dissector == nil {
+		close(connection.detected)
+	}
 	connection.upStream.finish()
 	connection.downStream.finish()
 }
 
 // NetworkStream tread one-direction tcp data as stream. impl reader closer
 type NetworkStream struct {
-	window *ReceiveWindow
-	c      chan *layers.TCP
-	remain []byte
-	ignore bool
-	closed bool
-}
-
-func newNetworkStream() *NetworkStream {
-	return &NetworkStream{window: newReceiveWindow(64), c: make(chan *layers.TCP, 1024)}
-}
-
-func (stream *NetworkStream) appendPacket(tcp *layers.TCP) {
+	window   *ReceiveWindow
+	c        chan *streamPacket
+	remain   []byte
+	offset   int64        // bytes have been read by reader
+	marks    []packetMark // start offset and capture time of packets read, for finding the capture time of bytes
+	ignore   bool
+	closed   bool
+	policy   backpressurePolicy
+	spill    *spillQueue   // only for spill policy
+	overflow bool          // stream channel is full, for drop policy
+	dropped  int32         // set when stream is dropped, accessed atomically
+	stats    streamStats   // packets sent by this stream
+	eof      chan struct{} // closed when reader reach the end of stream
+	eofRead  bool
+}
+
+// packets can be queued for stream reader
+const streamQueueSize = 1024
+
+func newNetworkStream(policy backpressurePolicy) *NetworkStream {
+	stream := &NetworkStream{window: newReceiveWindow(64), c: make(chan *streamPacket, streamQueueSize), policy: policy,
+		eof: make(chan struct{})}
+	if policy == backpressureSpill {
+		stream.spill = &spillQueue{}
+	}
+	return stream
+}
+
+func (stream *NetworkStream) appendPacket(tcp *layers.TCP, timestamp time.Time) {
 	if stream.ignore {
 		return
 	}
-	stream.window.insert(tcp)
+	kind := stream.window.insert(tcp, timestamp)
+	stream.stats.record(tcp, kind)
 }
 
 func (stream *NetworkStream) confirmPacket(ack uint32) {
 	if stream.ignore {
 		return
 	}
-	stream.window.confirm(ack, stream.c)
+	stream.window.confirm(ack, stream.deliver)
+}
+
+// send confirmed packet to reader, by the backpressure policy
+func (stream *NetworkStream) deliver(packet *streamPacket) {
+	switch stream.policy {
+	case backpressureSpill:
+		stream.spill.push(packet, stream.c)
+	case backpressureDrop:
+		if stream.overflow {
+			return
+		}
+		select {
+		case stream.c <- packet:
+		default:
+			stream.overflow = true
+		}
+	default:
+		stream.c <- packet
+	}
+}
+
+// stop receiving data, reader will get errStreamDropped after data already queued
+func (stream *NetworkStream) drop() {
+	atomic.StoreInt32(&stream.dropped, 1)
+	stream.ignore = true
+	stream.closed = true
 }
 
 func (stream *NetworkStream) finish() {
 	close(stream.c)
 }
 
+// get next packet for reader. return false if stream is finished
+func (stream *NetworkStream) nextPacket() (*streamPacket, bool) {
+	if stream.spill != nil {
+		return stream.spill.pop(stream.c)
+	}
+	packet, ok := <-stream.c
+	return packet, ok
+}
+
 func (stream *NetworkStream) Read(p []byte) (n int, err error) {
 	for len(stream.remain) == 0 {
-		packet, ok := <-stream.c
+		packet, ok := stream.nextPacket()
 		if !ok {
-			err = io.EOF
+			if !stream.eofRead {
+				stream.eofRead = true
+				close(stream.eof)
+			}
+			if atomic.LoadInt32(&stream.dropped) != 0 {
+				err = errStreamDropped
+			} else {
+				err = io.EOF
+			}
 			return
 		}
 		stream.remain = packet.Payload
+		if len(stream.marks) == cap(stream.marks) {
+			// trim before the slice grows, so marks of streams not asking timestamps, such as drained ones, are bounded
+			stream.trimMarks(stream.offset - markRetention)
+		}
+		stream.marks = append(stream.marks, packetMark{offset: stream.offset, timestamp: packet.timestamp})
 	}
 
 	if len(stream.remain) > len(p) {
@@ -280,26 +599,69 @@ func (stream *NetworkStream) Read(p []byte) (n int, err error) {
 		n = copy(p, stream.remain)
 		stream.remain = nil
 	}
+	stream.offset += int64(n)
 	return
 }
 
+// packetMark record the stream offset a packet's data begins at
+type packetMark struct {
+	offset    int64
+	timestamp time.Time
+}
+
+// marks of data read more than this before the read offset are discarded, even if timestampAt is not called.
+// The reader may ask capture time of bytes buffered or of a message just parsed, which are usually within this range
+const markRetention = 256 << 10
+
+// capture time of the packet contains the byte at offset, the byte should have been read.
+// Should be called by reader with non-decreasing offsets, marks of packets before the offset are discarded.
+// For offset of data discarded by markRetention, the time of the earliest mark kept is returned
+func (stream *NetworkStream) timestampAt(offset int64) time.Time {
+	stream.trimMarks(offset)
+	if len(stream.marks) == 0 {
+		return time.Time{}
+	}
+	return stream.marks[0].timestamp
+}
+
+// discard marks of packets before the one contains the byte at offset
+func (stream *NetworkStream) trimMarks(offset int64) {
+	idx := 0
+	for idx+1 < len(stream.marks) && stream.marks[idx+1].offset <= offset {
+		idx++
+	}
+	if idx > 0 {
+		stream.marks = append(stream.marks[:0], stream.marks[idx:]...)
+	}
+}
+
 // Close the stream
 func (stream *NetworkStream) Close() error {
 	stream.ignore = true
+	if stream.spill != nil {
+		stream.spill.close()
+	}
 	return nil
 }
 
+// streamPacket is tcp packet in stream, with its capture time
+type streamPacket struct {
+	*layers.TCP
+	timestamp time.Time
+}
+
 // ReceiveWindow simulate tcp receivec window
 type ReceiveWindow struct {
 	size        int
 	start       int
-	buffer      []*layers.TCP
+	buffer      []*streamPacket
 	lastAck     uint32
-	expectBegin uint32
+	expectBegin uint32 // sequence of next byte to deliver, valid if hasExpect
+	hasExpect   bool
 }
 
 func newReceiveWindow(initialSize int) *ReceiveWindow {
-	buffer := make([]*layers.TCP, initialSize)
+	buffer := make([]*streamPacket, initialSize)
 	return &ReceiveWindow{buffer: buffer}
 }
 
@@ -309,16 +671,25 @@ func (w *ReceiveWindow) destroy() {
 	w.buffer = nil
 }
 
-func (w *ReceiveWindow) insert(packet *layers.TCP) {
-
-	if w.expectBegin != 0 && compareTCPSeq(w.expectBegin, packet.Seq+uint32(len(packet.Payload))) >= 0 {
-		// dropped
-		return
-	}
+// insert packet into window, return how the packet fits into the received data
+func (w *ReceiveWindow) insert(tcp *layers.TCP, timestamp time.Time) segmentKind {
+	packet := &streamPacket{TCP: tcp, timestamp: timestamp}
 
 	if len(packet.Payload) == 0 {
 		//ignore empty data packet
-		return
+		return segmentEmpty
+	}
+
+	kind := segmentInOrder
+	if w.hasExpect {
+		if compareTCPSeq(w.expectBegin, packet.Seq+uint32(len(packet.Payload))) >= 0 {
+			// dropped
+			return segmentRetransmitted
+		}
+		if compareTCPSeq(w.expectBegin, packet.Seq) > 0 {
+			// contains some data confirmed
+			kind = segmentRetransmitted
+		}
 	}
 
 	idx := w.size
@@ -327,8 +698,11 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 		prev := w.buffer[index]
 		result := compareTCPSeq(prev.Seq, packet.Seq)
 		if result == 0 {
-			// duplicated
-			return
+			// duplicated. retransmission may be repacketized to carry more data, keep the longer one
+			if len(packet.Payload) > len(prev.Payload) {
+				w.buffer[index] = packet
+			}
+			return segmentDuplicated
 		}
 		if result < 0 {
 			// insert at index
@@ -345,6 +719,9 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 		index := (idx + w.start) % len(w.buffer)
 		w.buffer[index] = packet
 	} else {
+		if kind == segmentInOrder {
+			kind = segmentOutOfOrder
+		}
 		// insert at index
 		for i := w.size - 1; i >= idx; i-- {
 			next := (i + w.start + 1) % len(w.buffer)
@@ -356,10 +733,11 @@ func (w *ReceiveWindow) insert(packet *layers.TCP) {
 	}
 
 	w.size++
+	return kind
 }
 
 // send confirmed packets to reader, when receive ack
-func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
+func (w *ReceiveWindow) confirm(ack uint32, deliver func(*streamPacket)) {
 	idx := 0
 	for ; idx < w.size; idx++ {
 		index := (idx + w.start) % len(w.buffer)
@@ -370,13 +748,10 @@ func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
 		}
 		w.buffer[index] = nil
 		newExpect := packet.Seq + uint32(len(packet.Payload))
-		if w.expectBegin != 0 {
+		if w.hasExpect {
 			diff := compareTCPSeq(w.expectBegin, packet.Seq)
 			if diff > 0 {
 				duplicatedSize := w.expectBegin - packet.Seq
-				if duplicatedSize < 0 {
-					duplicatedSize += maxTCPSeq
-				}
 				if duplicatedSize >= uint32(len(packet.Payload)) {
 					continue
 				}
@@ -385,8 +760,9 @@ func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
 				//TODO: we lose packet here
 			}
 		}
-		c <- packet
+		deliver(packet)
 		w.expectBegin = newExpect
+		w.hasExpect = true
 	}
 	w.start = (w.start + idx) % len(w.buffer)
 	w.size = w.size - idx
@@ -396,7 +772,7 @@ func (w *ReceiveWindow) confirm(ack uint32, c chan *layers.TCP) {
 }
 
 func (w *ReceiveWindow) expand() {
-	buffer := make([]*layers.TCP, len(w.buffer)*2)
+	buffer := make([]*streamPacket, len(w.buffer)*2)
 	end := w.start + w.size
 	if end < len(w.buffer) {
 		copy(buffer, w.buffer[w.start:w.start+w.size])
@@ -408,30 +784,8 @@ func (w *ReceiveWindow) expand() {
 	w.buffer = buffer
 }
 
-// compare two tcp sequences, if seq1 is earlier, return num < 0, if seq1 == seq2, return 0, else return num > 0
+// compare two tcp sequences, if seq1 is earlier, return num < 0, if seq1 == seq2, return 0, else return num > 0.
+// Sequences wrap around, seq1 is earlier if it is less than half of the sequence space before seq2 (RFC 1982)
 func compareTCPSeq(seq1, seq2 uint32) int {
-	if seq1 < tcpSeqWindow && seq2 > maxTCPSeq-tcpSeqWindow {
-		return int(int32(seq1 + maxTCPSeq - seq2))
-	} else if seq2 < tcpSeqWindow && seq1 > maxTCPSeq-tcpSeqWindow {
-		return int(int32(seq1 - (maxTCPSeq + seq2)))
-	}
 	return int(int32(seq1 - seq2))
 }
-
-var httpMethods = map[string]bool{"GET": true, "POST": true, "PUT": true, "DELETE": true, "HEAD": true,
-	"TRACE": true, "OPTIONS": true, "PATCH": true}
-
-// if is first http request packet
-func isHTTPRequestData(body []byte) bool {
-	if len(body) < 8 {
-		return false
-	}
-	data := body[0:8]
-	idx := bytes.IndexByte(data, byte(' '))
-	if idx < 0 {
-		return false
-	}
-
-	method := string(data[:idx])
-	return httpMethods[method]
-}
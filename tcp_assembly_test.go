@@ -1,38 +1,256 @@
 package main
 
 import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
 	"github.com/google/gopacket/layers"
 	"github.com/stretchr/testify/assert"
-	"testing"
 )
 
 func TestReceiveWindow(t *testing.T) {
 
 	window := newReceiveWindow(4)
+	now := time.Now()
 
 	// init insert
-	window.insert(&layers.TCP{Seq: 10005, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}})
-	window.insert(&layers.TCP{Seq: 10000, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}})
-	window.insert(&layers.TCP{Seq: 10010, BaseLayer: layers.BaseLayer{Payload: []byte{2, 3, 4, 5}}})
-	window.insert(&layers.TCP{Seq: 10005, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}})
+	window.insert(&layers.TCP{Seq: 10005, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}}, now)
+	window.insert(&layers.TCP{Seq: 10000, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}}, now)
+	window.insert(&layers.TCP{Seq: 10010, BaseLayer: layers.BaseLayer{Payload: []byte{2, 3, 4, 5}}}, now)
+	window.insert(&layers.TCP{Seq: 10005, BaseLayer: layers.BaseLayer{Payload: []byte{1, 2}}}, now)
 	assert.Equal(t, 3, window.size)
 	assert.Equal(t, 0, window.start)
 	assert.Equal(t, uint32(10000), window.buffer[0].Seq)
 	assert.Equal(t, uint32(10005), window.buffer[1].Seq)
 	assert.Equal(t, uint32(10010), window.buffer[2].Seq)
 
-	window.insert(&layers.TCP{Seq: 10009, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}})
+	window.insert(&layers.TCP{Seq: 10009, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}}, now)
 	assert.Equal(t, uint32(10000), window.buffer[0].Seq)
 	assert.Equal(t, uint32(10005), window.buffer[1].Seq)
 
 	// expand
-	window.insert(&layers.TCP{Seq: 10030, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}})
+	window.insert(&layers.TCP{Seq: 10030, BaseLayer: layers.BaseLayer{Payload: []byte{7, 8, 9, 0}}}, now)
 	assert.Equal(t, 5, window.size)
 	assert.Equal(t, 0, window.start)
 
-	c := make(chan *layers.TCP, 1000)
+	var confirmed []*streamPacket
 	// confirm
-	window.confirm(10020, c)
+	window.confirm(10020, func(packet *streamPacket) { confirmed = append(confirmed, packet) })
 	assert.Equal(t, 1, window.size)
 	assert.Equal(t, 4, window.start)
+	assert.Equal(t, 4, len(confirmed))
+}
+
+// ConnectionHandler collect upstream data of each connection
+type collectConnectionHandler struct {
+	lock      sync.Mutex
+	waitGroup sync.WaitGroup
+	upData    map[string][]byte
+}
+
+func (h *collectConnectionHandler) handle(src Endpoint, dst Endpoint, connection *TCPConnection) {
+	h.waitGroup.Add(1)
+	go func() {
+		defer h.waitGroup.Done()
+		data, _ := ioutil.ReadAll(connection.upStream)
+		discardAll(connection.downStream)
+		h.lock.Lock()
+		h.upData[src.String()] = data
+		h.lock.Unlock()
+	}()
+}
+
+func (h *collectConnectionHandler) finish() {
+}
+
+func TestTCPAssemblerShards(t *testing.T) {
+	handler := &collectConnectionHandler{upData: map[string][]byte{}}
+	assembler := newTCPAssembler(handler, 4, time.Minute)
+	assembler.dissectors = httpDissectors()
+	now := time.Now()
+	for port := 10000; port < 10020; port++ {
+		client := newEndpoint(net.IP{10, 0, 0, 1}, uint16(port))
+		server := newEndpoint(net.IP{10, 0, 0, 2}, 80)
+		request := []byte("GET /" + strconv.Itoa(port) + " HTTP/1.1\r\n\r\n")
+		assembler.assemble(client, server, &layers.TCP{Seq: 1, ACK: true, Ack: 1,
+			BaseLayer: layers.BaseLayer{Payload: request}}, now)
+		assembler.assemble(server, client, &layers.TCP{Seq: 1, ACK: true, Ack: 1 + uint32(len(request))}, now)
+	}
+	assembler.finishAll()
+	handler.waitGroup.Wait()
+
+	assert.Equal(t, 20, len(handler.upData))
+	for port := 10000; port < 10020; port++ {
+		assert.Equal(t, "GET /"+strconv.Itoa(port)+" HTTP/1.1\r\n\r\n", string(handler.upData["10.0.0.1:"+strconv.Itoa(port)]))
+	}
+}
+
+func TestNetworkStreamSpill(t *testing.T) {
+	stream := newNetworkStream(backpressureSpill)
+	stream.c = make(chan *streamPacket, 2)
+	var expected []byte
+	for i := 0; i < 10; i++ {
+		payload := []byte(strconv.Itoa(i))
+		expected = append(expected, payload...)
+		stream.deliver(&streamPacket{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: payload}}})
+	}
+	// read some data, so following packets are delivered while there are spilled data
+	buf := make([]byte, 3)
+	n, err := io.ReadFull(stream, buf)
+	assert.NoError(t, err)
+	var actual = append([]byte(nil), buf[:n]...)
+	for i := 10; i < 20; i++ {
+		payload := []byte(strconv.Itoa(i))
+		expected = append(expected, payload...)
+		stream.deliver(&streamPacket{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: payload}}})
+	}
+	stream.finish()
+	remain, err := ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	actual = append(actual, remain...)
+	assert.Equal(t, string(expected), string(actual))
+	assert.NoError(t, stream.Close())
+	assert.Nil(t, stream.spill.file)
+}
+
+func TestTCPConnectionDrop(t *testing.T) {
+	client := newEndpoint(net.IP{10, 0, 0, 1}, 10000)
+	server := newEndpoint(net.IP{10, 0, 0, 2}, 80)
+	connection := newTCPConnection(newConnectionID(client, server), backpressureDrop)
+	connection.upStream.c = make(chan *streamPacket, 1)
+	connection.detect(&httpDissector{option: &Option{}}, client)
+
+	seq := uint32(1)
+	for _, data := range []string{"GET / HTTP/1.1\r\n", "Host: test\r\n", "\r\n"} {
+		connection.onReceive(client, server, &layers.TCP{Seq: seq, ACK: true, Ack: 1,
+			BaseLayer: layers.BaseLayer{Payload: []byte(data)}}, time.Now())
+		seq += uint32(len(data))
+		connection.onReceive(server, client, &layers.TCP{Seq: 1, ACK: true, Ack: seq}, time.Now())
+	}
+	assert.True(t, connection.closed())
+	connection.finish()
+
+	data, err := ioutil.ReadAll(connection.upStream)
+	assert.Equal(t, errStreamDropped, err)
+	assert.Equal(t, "GET / HTTP/1.1\r\n", string(data))
+	_, err = ioutil.ReadAll(connection.downStream)
+	assert.Equal(t, errStreamDropped, err)
+}
+
+func TestNetworkStreamTimestamp(t *testing.T) {
+	stream := newNetworkStream(backpressureBlock)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i, data := range []string{"abc", "de", "fghi"} {
+		stream.c <- &streamPacket{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: []byte(data)}},
+			timestamp: start.Add(time.Duration(i) * time.Second)}
+	}
+	stream.finish()
+	data, err := ioutil.ReadAll(stream)
+	assert.NoError(t, err)
+	assert.Equal(t, "abcdefghi", string(data))
+	assert.Equal(t, start, stream.timestampAt(0))
+	assert.Equal(t, start, stream.timestampAt(2))
+	assert.Equal(t, start.Add(time.Second), stream.timestampAt(3))
+	assert.Equal(t, start.Add(2*time.Second), stream.timestampAt(8))
+}
+
+func TestNetworkStreamMarksTrimmed(t *testing.T) {
+	stream := newNetworkStream(backpressureBlock)
+	done := make(chan int)
+	go func() {
+		// drained without asking timestamps, as tunnel data
+		done <- discardAll(stream)
+	}()
+	payload := make([]byte, 100)
+	for i := 0; i < 100000; i++ {
+		stream.c <- &streamPacket{TCP: &layers.TCP{BaseLayer: layers.BaseLayer{Payload: payload}}, timestamp: time.Now()}
+	}
+	stream.finish()
+	assert.Equal(t, 100*100000, <-done)
+	assert.True(t, len(stream.marks) <= 2*(markRetention/100+1), len(stream.marks))
+}
+
+func FuzzCompareTCPSeq(f *testing.F) {
+	f.Add(uint32(0), uint32(1))
+	f.Add(maxTCPSeq, uint32(1))
+	f.Add(maxTCPSeq-10, uint32(100))
+	f.Add(uint32(1000), uint32(1<<31-1))
+	f.Fuzz(func(t *testing.T, seq uint32, distance uint32) {
+		assert.Equal(t, 0, compareTCPSeq(seq, seq))
+		// later sequences are less than half of sequence space after
+		distance = distance%(1<<31-1) + 1
+		assert.True(t, compareTCPSeq(seq, seq+distance) < 0)
+		assert.True(t, compareTCPSeq(seq+distance, seq) > 0)
+	})
+}
+
+// Split data into segments by ops, insert them into window in the order by ops, and confirm data received.
+// All data should be delivered in order whatever how segments overlap, duplicate or arrive out of order.
+func FuzzReceiveWindow(f *testing.F) {
+	f.Add(uint32(1000), uint16(100), []byte{10, 20, 30, 40})
+	f.Add(maxTCPSeq-10, uint16(50), []byte{9, 1, 10, 200, 3, 7, 7, 0})
+	f.Add(uint32(0), uint16(300), []byte{255, 1, 128, 64, 32, 16, 8, 4, 2, 1})
+	f.Fuzz(func(t *testing.T, begin uint32, size uint16, ops []byte) {
+		if size == 0 || len(ops) == 0 || len(ops) > 256 {
+			return
+		}
+		data := make([]byte, size)
+		for i := range data {
+			data[i] = byte(i*31 + i>>8)
+		}
+
+		type segment struct{ start, end int }
+		var segments []segment
+		// segments covering all data, with sizes by ops
+		for start, i := 0, 0; start < len(data); i++ {
+			end := start + int(ops[i%len(ops)]) + 1
+			if end > len(data) {
+				end = len(data)
+			}
+			segments = append(segments, segment{start, end})
+			start = end
+		}
+		// overlapping segments
+		for i := 0; i+1 < len(ops); i += 2 {
+			start := int(ops[i]) * len(data) / 256
+			end := start + int(ops[i+1]) + 1
+			if end > len(data) {
+				end = len(data)
+			}
+			segments = append(segments, segment{start, end})
+		}
+		// shuffle
+		for i := range segments {
+			j := int(ops[i%len(ops)]) % len(segments)
+			segments[i], segments[j] = segments[j], segments[i]
+		}
+
+		window := newReceiveWindow(4)
+		received := make([]bool, len(data))
+		acked := 0
+		var delivered []byte
+		deliver := func(packet *streamPacket) { delivered = append(delivered, packet.Payload...) }
+		now := time.Now()
+		for i, s := range segments {
+			window.insert(&layers.TCP{Seq: begin + uint32(s.start),
+				BaseLayer: layers.BaseLayer{Payload: data[s.start:s.end]}}, now)
+			for j := s.start; j < s.end; j++ {
+				received[j] = true
+			}
+			// ack all continuous data received, sometimes
+			if ops[i%len(ops)]%3 == 0 {
+				for acked < len(data) && received[acked] {
+					acked++
+				}
+				window.confirm(begin+uint32(acked), deliver)
+			}
+		}
+		window.confirm(begin+uint32(len(data)), deliver)
+		assert.Equal(t, data, delivered)
+	})
 }
@@ -0,0 +1,718 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+// testPacket is a tcp packet to feed assembler
+type testPacket struct {
+	src       Endpoint
+	dst       Endpoint
+	tcp       *layers.TCP
+	timestamp time.Time
+}
+
+// tcpConversation build packets of one tcp connection, tracking sequences of both sides.
+// Packets are created by send/ack/fin/rst, and added to the conversation in the order they should be captured,
+// so tests can reorder, duplicate or drop them.
+type tcpConversation struct {
+	client    Endpoint
+	server    Endpoint
+	clientSeq uint32 // next sequence client will send
+	serverSeq uint32 // next sequence server will send
+	timestamp time.Time
+	packets   []*testPacket
+}
+
+var conversationStartTime = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func newTCPConversation(clientPort uint16, clientISN, serverISN uint32) *tcpConversation {
+	return &tcpConversation{
+		client:    newEndpoint(net.IP{10, 0, 0, 1}, clientPort),
+		server:    newEndpoint(net.IP{10, 0, 0, 2}, 80),
+		clientSeq: clientISN,
+		serverSeq: serverISN,
+		timestamp: conversationStartTime,
+	}
+}
+
+// create a packet, with sequence and ack of current state. Each packet is captured 1ms after the previous one
+func (c *tcpConversation) packet(fromClient bool, seq uint32, payload []byte) *testPacket {
+	c.timestamp = c.timestamp.Add(time.Millisecond)
+	tcp := &layers.TCP{Seq: seq, ACK: true, Window: 65535, BaseLayer: layers.BaseLayer{Payload: payload}}
+	if fromClient {
+		tcp.Ack = c.serverSeq
+		return &testPacket{src: c.client, dst: c.server, tcp: tcp, timestamp: c.timestamp}
+	}
+	tcp.Ack = c.clientSeq
+	return &testPacket{src: c.server, dst: c.client, tcp: tcp, timestamp: c.timestamp}
+}
+
+func (c *tcpConversation) nextSeq(fromClient bool) *uint32 {
+	if fromClient {
+		return &c.clientSeq
+	}
+	return &c.serverSeq
+}
+
+// add packets to the conversation
+func (c *tcpConversation) add(packets ...*testPacket) *tcpConversation {
+	c.packets = append(c.packets, packets...)
+	return c
+}
+
+// three-way handshake
+func (c *tcpConversation) handshake() *tcpConversation {
+	syn := c.packet(true, c.clientSeq, nil)
+	syn.tcp.ACK = false
+	syn.tcp.Ack = 0
+	syn.tcp.SYN = true
+	c.clientSeq++
+	synAck := c.packet(false, c.serverSeq, nil)
+	synAck.tcp.SYN = true
+	c.serverSeq++
+	return c.add(syn, synAck, c.ack(true))
+}
+
+// split data to segments no longer than mss, and advance the sequence. The segments are not added
+func (c *tcpConversation) send(fromClient bool, data string, mss int) []*testPacket {
+	seq := c.nextSeq(fromClient)
+	var segments []*testPacket
+	for len(data) > 0 {
+		size := mss
+		if size > len(data) {
+			size = len(data)
+		}
+		segments = append(segments, c.packet(fromClient, *seq, []byte(data[:size])))
+		*seq += uint32(size)
+		data = data[size:]
+	}
+	return segments
+}
+
+// a copy of packet, captured now
+func (c *tcpConversation) resend(packet *testPacket) *testPacket {
+	c.timestamp = c.timestamp.Add(time.Millisecond)
+	tcp := *packet.tcp
+	return &testPacket{src: packet.src, dst: packet.dst, tcp: &tcp, timestamp: c.timestamp}
+}
+
+// packet ack all data received
+func (c *tcpConversation) ack(fromClient bool) *testPacket {
+	return c.packet(fromClient, *c.nextSeq(fromClient), nil)
+}
+
+func (c *tcpConversation) fin(fromClient bool) *testPacket {
+	seq := c.nextSeq(fromClient)
+	packet := c.packet(fromClient, *seq, nil)
+	packet.tcp.FIN = true
+	*seq++
+	return packet
+}
+
+func (c *tcpConversation) rst(fromClient bool) *testPacket {
+	packet := c.packet(fromClient, *c.nextSeq(fromClient), nil)
+	packet.tcp.RST = true
+	return packet
+}
+
+// client send request and server send response, each side ack the data received
+func (c *tcpConversation) exchange(request, response string, mss int) *tcpConversation {
+	c.add(c.send(true, request, mss)...)
+	c.add(c.ack(false))
+	c.add(c.send(false, response, mss)...)
+	return c.add(c.ack(true))
+}
+
+// both sides close the connection
+func (c *tcpConversation) close() *tcpConversation {
+	c.add(c.fin(true))
+	c.add(c.fin(false))
+	return c.add(c.ack(true))
+}
+
+// run conversations through assembler and http handler, return the printed output of each connection
+func runConversations(t *testing.T, option *Option, conversations ...*tcpConversation) string {
+	return strings.Join(runConversationMessages(t, option, conversations...), "")
+}
+
+// run conversations, return the messages sent to printer
+func runConversationMessages(t *testing.T, option *Option, conversations ...*tcpConversation) []string {
+	printer := &Printer{outputQueue: make(chan string, 1024)}
+	handler := &DissectorConnectionHandler{option: option, printer: printer}
+	assembler := newTCPAssembler(handler, 2, time.Minute)
+	assembler.dissectors = newDissectors(option, printer)
+	for _, conversation := range conversations {
+		for _, packet := range conversation.packets {
+			assembler.assemble(packet.src, packet.dst, packet.tcp, packet.timestamp)
+		}
+	}
+	assembler.finishAll()
+	waitGroup.Wait()
+	close(printer.outputQueue)
+
+	var messages []string
+	for msg := range printer.outputQueue {
+		if msg != "" {
+			messages = append(messages, msg)
+		}
+	}
+	return messages
+}
+
+const (
+	testRequest = "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\nContent-Length: 26\r\n\r\n" +
+		"abcdefghijklmnopqrstuvwxyz"
+	testResponse = "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 20\r\n\r\n" +
+		"0123456789ABCDEFGHIJ"
+)
+
+// assert the output contains the whole test request and response
+func assertTestTransaction(t *testing.T, output string) {
+	assert.Contains(t, output, "POST /upload HTTP/1.1\n")
+	assert.Contains(t, output, "\nabcdefghijklmnopqrstuvwxyz\n")
+	assert.Contains(t, output, "HTTP/1.1 200 OK\n")
+	assert.Contains(t, output, "\n0123456789ABCDEFGHIJ\n")
+}
+
+func TestConversationInOrder(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(testRequest, testResponse, 1460).
+		exchange(strings.Replace(testRequest, "upload", "second", 1), testResponse, 1460).
+		close()
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assertTestTransaction(t, output)
+	assert.Contains(t, output, "POST /second HTTP/1.1\n")
+	assert.Equal(t, 2, strings.Count(output, " RESPONSE "))
+}
+
+func TestConversationReordering(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake()
+	request := conversation.send(true, testRequest, 20)
+	conversation.add(request[0])
+	// segments after the first one arrive in reverse order
+	for i := len(request) - 1; i > 0; i-- {
+		conversation.add(request[i])
+	}
+	conversation.add(conversation.ack(false))
+	response := conversation.send(false, testResponse, 20)
+	conversation.add(response[1], response[0])
+	conversation.add(response[2:]...)
+	conversation.add(conversation.ack(true))
+	conversation.close()
+
+	assertTestTransaction(t, runConversations(t, &Option{Level: "all"}, conversation))
+}
+
+func TestConversationRetransmission(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake()
+	request := conversation.send(true, testRequest, 30)
+	// duplicated before confirmed
+	conversation.add(request[0], conversation.resend(request[0]))
+	conversation.add(request[1:]...)
+	conversation.add(conversation.ack(false))
+	// retransmitted after confirmed
+	conversation.add(conversation.resend(request[1]))
+	conversation.add(conversation.resend(request[len(request)-1]))
+	response := conversation.send(false, testResponse, 30)
+	conversation.add(response...)
+	conversation.add(conversation.ack(true))
+	conversation.add(conversation.resend(response[0]))
+	conversation.close()
+
+	assertTestTransaction(t, runConversations(t, &Option{Level: "all"}, conversation))
+}
+
+func TestConversationOverlappingSegments(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake()
+	start := conversation.clientSeq
+	request := conversation.send(true, testRequest, 40)
+	// retransmission repacketized to larger segments, overlap with the original ones
+	for i := 0; i < len(request); i += 2 {
+		conversation.add(request[i])
+		seq := request[i].tcp.Seq
+		end := seq - start + 80
+		if end > uint32(len(testRequest)) {
+			end = uint32(len(testRequest))
+		}
+		conversation.add(conversation.packet(true, seq, []byte(testRequest[seq-start:end])))
+	}
+	// a segment start from the middle of data received
+	conversation.add(conversation.packet(true, start+10, []byte(testRequest[10:50])))
+	conversation.add(conversation.ack(false))
+	conversation.add(conversation.send(false, testResponse, 1460)...)
+	conversation.add(conversation.ack(true))
+	conversation.close()
+
+	assertTestTransaction(t, runConversations(t, &Option{Level: "all"}, conversation))
+}
+
+func TestConversationSequenceWraparound(t *testing.T) {
+	conversation := newTCPConversation(10000, maxTCPSeq-10, maxTCPSeq-50).handshake()
+	// the second segment is the last byte before sequence wraps around, the third one start at 0
+	request := conversation.send(true, testRequest[:9], 9)
+	request = append(request, conversation.send(true, testRequest[9:10], 1)...)
+	request = append(request, conversation.send(true, testRequest[10:], 10)...)
+	conversation.add(request[0], request[2], request[1])
+	// confirm data end exactly at 0, then retransmit confirmed data
+	ack := conversation.packet(false, conversation.serverSeq, nil)
+	ack.tcp.Ack = 0
+	conversation.add(ack, conversation.resend(request[1]))
+	conversation.add(request[3:]...)
+	conversation.add(conversation.ack(false))
+	conversation.add(conversation.send(false, testResponse, 16)...)
+	conversation.add(conversation.ack(true))
+	conversation.close()
+
+	assertTestTransaction(t, runConversations(t, &Option{Level: "all"}, conversation))
+}
+
+func TestConversationResetMidResponse(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake()
+	conversation.add(conversation.send(true, testRequest, 1460)...)
+	conversation.add(conversation.ack(false))
+	// server reset after sent part of the body
+	conversation.add(conversation.send(false, testResponse[:len(testResponse)-10], 1460)...)
+	conversation.add(conversation.ack(true))
+	conversation.add(conversation.rst(false))
+
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "POST /upload HTTP/1.1\n")
+	assert.Contains(t, output, "HTTP/1.1 200 OK\n")
+	assert.NotContains(t, output, "0123456789ABCDEFGHIJ")
+}
+
+func TestConversationMultipleConnections(t *testing.T) {
+	var conversations []*tcpConversation
+	for i := 0; i < 10; i++ {
+		conversation := newTCPConversation(uint16(10000+i), uint32(i)*100000, 5000).handshake().
+			exchange(testRequest, testResponse, 20).
+			close()
+		conversations = append(conversations, conversation)
+	}
+	output := runConversations(t, &Option{Level: "all"}, conversations...)
+	assert.Equal(t, 10, strings.Count(output, "\nabcdefghijklmnopqrstuvwxyz\n"))
+	assert.Equal(t, 10, strings.Count(output, "\n0123456789ABCDEFGHIJ\n"))
+}
+
+func TestConversationConnectTunnel(t *testing.T) {
+	hello := clientHelloRecord(t, "example.com")
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("CONNECT example.com:443 HTTP/1.1\r\nHost: example.com:443\r\n\r\n",
+			"HTTP/1.1 200 Connection established\r\n\r\n", 1460).
+		exchange(string(hello), string(bytes.Repeat([]byte{0x16, 0x03, 0x03, 0x00}, 500)), 1460).
+		exchange(string(bytes.Repeat([]byte{0x17, 0x03}, 100)), string(bytes.Repeat([]byte{0x17}, 1000)), 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "header"}, conversation)
+	assert.Equal(t, 1, strings.Count(output, "CONNECT example.com:443 HTTP/1.1\n"))
+	assert.Equal(t, 1, strings.Count(output, " TUNNEL "))
+	assert.Contains(t, output, "target: example.com:443\n")
+	assert.Contains(t, output, "sni: example.com, duration: 9ms, bytes: "+strconv.Itoa(len(hello)+200)+"/3000 (client/server)\n")
+
+	output = runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "CONNECT example.com:443\n\nTUNNEL example.com:443 sni: example.com, duration: 9ms, bytes: "+
+		strconv.Itoa(len(hello)+200)+"/3000 (client/server)\n", output)
+}
+
+func TestConversationWebsocket(t *testing.T) {
+	compressed := deflateMessages(t, true, "compressed message")[0]
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("GET /chat HTTP/1.1\r\nHost: example.com\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+			"Sec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\nSec-WebSocket-Version: 13\r\n"+
+			"Sec-WebSocket-Extensions: permessage-deflate; client_max_window_bits\r\n\r\n",
+			"HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n"+
+				"Sec-WebSocket-Accept: s3pPLMBiTxaQ9kYGzzhZRbK+xOo=\r\n"+
+				"Sec-WebSocket-Extensions: permessage-deflate; server_no_context_takeover\r\n\r\n", 1460).
+		exchange(string(websocketFrameData(true, false, websocketText, []byte("hello server"), true)),
+			string(websocketFrameData(true, true, websocketText, compressed, false)), 1460).
+		exchange(string(websocketFrameData(true, false, websocketClose, []byte{0x03, 0xe8}, true)),
+			string(websocketFrameData(true, false, websocketClose, []byte{0x03, 0xe8}, false)), 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Equal(t, 1, strings.Count(output, "GET /chat HTTP/1.1\n"))
+	assert.Equal(t, 1, strings.Count(output, "HTTP/1.1 101 Switching Protocols\n"))
+	assert.Contains(t, output, "**********  WEBSOCKET  10.0.0.1:10000  ----->  10.0.0.2:80  //  "+
+		"2020-01-01T00:00:00.008Z TEXT size: 12\nhello server\n")
+	assert.Contains(t, output, "**********  WEBSOCKET  10.0.0.1:10000  <-----  10.0.0.2:80  //  "+
+		"2020-01-01T00:00:00.01Z TEXT(compressed) size: 18\ncompressed message\n")
+	assert.Equal(t, 2, strings.Count(output, "CLOSE size: 2\ncode: 1000 reason: \n"))
+
+	output = runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "GET example.com/chat\n\n", output)
+}
+
+const testExpectRequestHeader = "POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Type: text/plain\r\n" +
+	"Content-Length: 26\r\nExpect: 100-continue\r\n\r\n"
+
+func TestConversationExpectContinue(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(testExpectRequestHeader, "HTTP/1.1 100 Continue\r\n\r\n", 1460).
+		exchange("abcdefghijklmnopqrstuvwxyz", testResponse, 1460).
+		exchange("GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"HTTP/1.1 204 No Content\r\n\r\n", 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assertTestTransaction(t, output)
+	assert.Contains(t, output, "**********  INTERIM RESPONSE  10.0.0.1:10000  <-----  10.0.0.2:80  //  "+
+		"2020-01-01T00:00:00.006Z\nHTTP/1.1 100 Continue\n\n**********  RESPONSE ")
+	assert.Equal(t, 2, strings.Count(output, "*  RESPONSE  10.0.0.1"))
+	// the next transaction is paired correctly
+	assert.Regexp(t, "GET /next HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 204 No Content\n", output)
+}
+
+func TestConversationExpectContinueLargeBody(t *testing.T) {
+	// the body is larger than the buffer of stream, it should be read before the final response come
+	body := strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789", 3<<20/36)
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("PUT /file HTTP/1.1\r\nHost: example.com\r\nContent-Length: "+strconv.Itoa(len(body))+
+			"\r\nExpect: 100-continue\r\n\r\n", "HTTP/1.1 100 Continue\r\n\r\n", 1460).
+		exchange(body, testResponse, 1460).
+		exchange("GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n", 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "header"}, conversation)
+	assert.Contains(t, output, "\n// body size: "+strconv.Itoa(len(body))+" , set [level = all] to display http body\n")
+	assert.Regexp(t, "PUT /file HTTP/1.1\n[^*]*\n\\*+  INTERIM RESPONSE [^\n]*\nHTTP/1.1 100 Continue\n\n"+
+		"\\*+  RESPONSE [^\n]*\nHTTP/1.1 200 OK\n", output)
+	assert.Regexp(t, "GET /next HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 204 No Content\n", output)
+}
+
+func TestConversationExpectContinueNotWaited(t *testing.T) {
+	// client send the body without waiting for 100 Continue, and server send the final response only
+	body := strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789", 3<<20/36)
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("PUT /file HTTP/1.1\r\nHost: example.com\r\nContent-Length: "+strconv.Itoa(len(body))+
+			"\r\nExpect: 100-continue\r\n\r\n"+body, testResponse, 1460).
+		exchange("GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n", 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "header"}, conversation)
+	assert.Contains(t, output, "\n// body size: "+strconv.Itoa(len(body))+" , set [level = all] to display http body\n")
+	assert.Regexp(t, "PUT /file HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 200 OK\n", output)
+	assert.Regexp(t, "GET /next HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 204 No Content\n", output)
+}
+
+func TestConversationExpectationFailed(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(testExpectRequestHeader, "HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n", 1460).
+		// client do not send body, and send next request
+		exchange("GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n", 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "header"}, conversation)
+	assert.Regexp(t, "POST /upload HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 417 Expectation Failed\n", output)
+	assert.Regexp(t, "GET /next HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 204 No Content\n", output)
+	assert.NotContains(t, output, "body size")
+
+	// closed after 417
+	conversation = newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(testExpectRequestHeader, "HTTP/1.1 417 Expectation Failed\r\nContent-Length: 0\r\n\r\n", 1460).
+		close()
+	output = runConversations(t, &Option{Level: "header"}, conversation)
+	assert.Regexp(t, "POST /upload HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 417 Expectation Failed\n", output)
+}
+
+func TestConversationEarlyHints(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("GET /page HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"HTTP/1.1 103 Early Hints\r\nLink: </style.css>; rel=preload\r\n\r\n"+
+				"HTTP/1.1 102 Processing\r\n\r\n"+testResponse, 1460).
+		exchange("GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n", 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "HTTP/1.1 103 Early Hints\nLink: </style.css>; rel=preload\n\n")
+	assert.Contains(t, output, "HTTP/1.1 102 Processing\n")
+	assert.Equal(t, 2, strings.Count(output, " INTERIM RESPONSE "))
+	assert.Regexp(t, "GET /page HTTP/1.1\n[^*]*\n(\\*+  INTERIM RESPONSE [^\n]*\n[^*]*)+"+
+		"\\*+  RESPONSE [^\n]*\nHTTP/1.1 200 OK\n", output)
+	assert.Regexp(t, "GET /next HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 204 No Content\n", output)
+
+	output = runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "GET example.com/page\n\nGET example.com/next\n\n", output)
+}
+
+func TestConversationHeadResponse(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		// response of HEAD has Content-Length of the resource, but no body
+		exchange("HEAD /file HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Length: 1000\r\n\r\n", 1460).
+		exchange(testRequest, testResponse, 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assertTestTransaction(t, output)
+	assert.Regexp(t, "HEAD /file HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 200 OK\nContent-Length: 1000\n", output)
+	assert.Equal(t, 2, strings.Count(output, " RESPONSE "))
+}
+
+func TestConversationPipelining(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake()
+	// client send all requests before the first response
+	conversation.add(conversation.send(true, "GET /first HTTP/1.1\r\nHost: example.com\r\n\r\n"+
+		"HEAD /second HTTP/1.1\r\nHost: example.com\r\n\r\n"+testRequest, 1460)...)
+	conversation.add(conversation.ack(false))
+	conversation.add(conversation.send(false, "HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nContent-Length: 5\r\n\r\nfirst"+
+		"HTTP/1.1 200 OK\r\nContent-Length: 100\r\n\r\n"+testResponse, 1460)...)
+	conversation.add(conversation.ack(true))
+	conversation.close()
+
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assertTestTransaction(t, output)
+	assert.Regexp(t, "GET /first HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 200 OK\n[^*]*\nfirst\n", output)
+	assert.Regexp(t, "HEAD /second HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 200 OK\nContent-Length: 100\n", output)
+	assert.Regexp(t, "POST /upload HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 200 OK\n[^*]*\n0123456789ABCDEFGHIJ\n",
+		output)
+
+	output = runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "GET example.com/first\n\nHEAD example.com/second\n\nPOST example.com/upload\n\n", output)
+}
+
+func TestConversationLargeRequestBody(t *testing.T) {
+	// larger than the buffer of stream, the body should be read without waiting for the response
+	body := strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789", 3<<20/36)
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("POST /upload HTTP/1.1\r\nHost: example.com\r\nContent-Length: "+strconv.Itoa(len(body))+
+			"\r\n\r\n"+body, testResponse, 1460).
+		exchange("GET /next HTTP/1.1\r\nHost: example.com\r\n\r\n", "HTTP/1.1 204 No Content\r\n\r\n", 1460).
+		close()
+
+	spilled, _ := filepath.Glob(filepath.Join(os.TempDir(), "httpdump-body-*"))
+	output := runConversations(t, &Option{Level: "header"}, conversation)
+	// the part larger than memory buffer is spilled, the whole body is printed
+	assert.Contains(t, output, "\n// body size: "+strconv.Itoa(len(body))+" , set [level = all] to display http body\n")
+	assert.NotContains(t, output, "Body truncated")
+	assert.Regexp(t, "POST /upload HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 200 OK\n", output)
+	// the temp files are removed
+	remained, _ := filepath.Glob(filepath.Join(os.TempDir(), "httpdump-body-*"))
+	assert.Equal(t, len(spilled), len(remained))
+	assert.Regexp(t, "GET /next HTTP/1.1\n[^*]*\n\\*+  RESPONSE [^\n]*\nHTTP/1.1 204 No Content\n", output)
+}
+
+func TestConversationHTTP2PriorKnowledge(t *testing.T) {
+	settings := encodeHTTP2Frame(0x4, 0, 0, nil)
+	// stream 1: GET /first. the :path and :authority are added to dynamic table
+	firstRequest := append([]byte{0x82, 0x86, 0x44}, hpackString("/first")...)
+	firstRequest = append(append(firstRequest, 0x41), hpackString("example.com")...)
+	// stream 3: POST /upload, with header block split to CONTINUATION, and :authority from dynamic table
+	secondRequest := append([]byte{0x83, 0x86, 0xbe, 0x44}, hpackString("/upload")...)
+	secondRequest = append(append(secondRequest, 0x5f), hpackString("text/plain")...)
+	clientData := http2Preface + settings +
+		encodeHTTP2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, firstRequest) +
+		encodeHTTP2Frame(http2FrameHeaders, 0, 3, secondRequest[:4]) +
+		encodeHTTP2Frame(http2FrameContinuation, http2FlagEndHeaders, 3, secondRequest[4:]) +
+		encodeHTTP2Frame(http2FrameData, 0, 3, []byte("abcdefghijklm")) +
+		encodeHTTP2Frame(http2FrameData, http2FlagEndStream, 3, []byte("nopqrstuvwxyz"))
+
+	secondResponse := append([]byte{0x88, 0x5f}, hpackString("text/plain")...)
+	serverData := settings +
+		encodeHTTP2Frame(http2FrameHeaders, http2FlagEndHeaders, 3, secondResponse) +
+		encodeHTTP2Frame(http2FrameData, http2FlagEndStream, 3, []byte("0123456789ABCDEFGHIJ")) +
+		encodeHTTP2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, []byte{0x89})
+
+	// the first packet has no SYN, the connection is found by the preface
+	conversation := newTCPConversation(10000, 1000, 5000).
+		exchange(clientData, serverData, 40).
+		close()
+
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Regexp(t, "POST /upload HTTP/2.0\n[^*]*\nabcdefghijklmnopqrstuvwxyz\n[^*]*\\*+  RESPONSE [^\n]*\n"+
+		"HTTP/2.0 200\ncontent-type: text/plain\n\n0123456789ABCDEFGHIJ\n", output)
+	assert.Contains(t, output, ":authority: example.com\n")
+	assert.Regexp(t, "GET /first HTTP/2.0\n[^*]*\\*+  RESPONSE [^\n]*\nHTTP/2.0 204\n", output)
+
+	// streams are printed when finished
+	output = runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "POST example.com/upload\n\nGET example.com/first\n\n", output)
+}
+
+func TestConversationHTTP2UpgradeWithBody(t *testing.T) {
+	// the body is sent before the upgrade response, it should be read without waiting for the response
+	body := strings.Repeat("abcdefghijklmnopqrstuvwxyz0123456789", 3<<20/36)
+	settings := encodeHTTP2Frame(0x4, 0, 0, nil)
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("POST /upload HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+			"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\nContent-Length: "+strconv.Itoa(len(body))+"\r\n\r\n"+body,
+			"HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"+settings+
+				encodeHTTP2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, []byte{0x89}), 1460).
+		exchange(http2Preface+settings, encodeHTTP2Frame(0x7, 0, 0, make([]byte, 8)), 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "header"}, conversation)
+	assert.Contains(t, output, "\n// body size: "+strconv.Itoa(len(body))+" , set [level = all] to display http body\n")
+	assert.Regexp(t, "POST /upload HTTP/1.1\n[^*]*\\*+  RESPONSE [^\n]*\nHTTP/1.1 101 Switching Protocols\n", output)
+	assert.Regexp(t, "POST /upload HTTP/2.0\n[^*]*\\*+  RESPONSE [^\n]*\nHTTP/2.0 204\n", output)
+}
+
+func TestConversationHTTP2Upgrade(t *testing.T) {
+	settings := encodeHTTP2Frame(0x4, 0, 0, nil)
+	response := append([]byte{0x88, 0x5f}, hpackString("text/plain")...)
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("GET /page HTTP/1.1\r\nHost: example.com\r\nConnection: Upgrade, HTTP2-Settings\r\n"+
+			"Upgrade: h2c\r\nHTTP2-Settings: AAMAAABkAAQAAP__\r\n\r\n",
+			"HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: h2c\r\n\r\n"+settings+
+				encodeHTTP2Frame(http2FrameHeaders, http2FlagEndHeaders, 1, response)+
+				encodeHTTP2Frame(http2FrameData, http2FlagEndStream, 1, []byte("0123456789ABCDEFGHIJ")), 1460).
+		exchange(http2Preface+settings, encodeHTTP2Frame(0x7, 0, 0, make([]byte, 8)), 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Regexp(t, "GET /page HTTP/1.1\n[^*]*\\*+  RESPONSE [^\n]*\nHTTP/1.1 101 Switching Protocols\n", output)
+	assert.Regexp(t, "GET /page HTTP/2.0\n[^*]*\\*+  RESPONSE [^\n]*\nHTTP/2.0 200\ncontent-type: text/plain\n\n"+
+		"0123456789ABCDEFGHIJ\n", output)
+
+	output = runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Equal(t, "GET example.com/page\n\nGET example.com/page\n\n", output)
+}
+
+func TestConversationGRPC(t *testing.T) {
+	registry := newProtoRegistry()
+	assert.NoError(t, registry.addDescriptorSet(testDescriptorSet()))
+
+	literal := func(name, value string) []byte {
+		return append(append([]byte{0x00}, hpackString(name)...), hpackString(value)...)
+	}
+	grpcMessageData := func(compressed bool, data []byte) []byte {
+		prefix := []byte{0, byte(len(data) >> 24), byte(len(data) >> 16), byte(len(data) >> 8), byte(len(data))}
+		if compressed {
+			prefix[0] = 1
+		}
+		return append(prefix, data...)
+	}
+
+	request := append([]byte{0x83, 0x86}, literal(":path", "/demo.Greeter/SayHello")...)
+	request = append(request, literal(":authority", "backend:50051")...)
+	request = append(request, literal("content-type", "application/grpc")...)
+	requestBody := grpcMessageData(false, protoBuilder{}.string(1, "world").varint(4, 1))
+
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	_, _ = writer.Write(protoBuilder{}.string(1, "hello world"))
+	_ = writer.Close()
+	response := append([]byte{0x88}, literal("content-type", "application/grpc")...)
+	response = append(response, literal("grpc-encoding", "gzip")...)
+	trailers := append(literal("grpc-status", "0"), literal("grpc-message", "all%20good")...)
+
+	settings := encodeHTTP2Frame(0x4, 0, 0, nil)
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(http2Preface+settings+
+			encodeHTTP2Frame(http2FrameHeaders, http2FlagEndHeaders, 1, request)+
+			encodeHTTP2Frame(http2FrameData, http2FlagEndStream, 1, requestBody),
+			settings+
+				encodeHTTP2Frame(http2FrameHeaders, http2FlagEndHeaders, 1, response)+
+				encodeHTTP2Frame(http2FrameData, 0, 1, grpcMessageData(true, compressed.Bytes()))+
+				encodeHTTP2Frame(http2FrameHeaders, http2FlagEndHeaders|http2FlagEndStream, 1, trailers), 1460).
+		close()
+
+	output := runConversations(t, &Option{Level: "all", ProtoRegistry: registry}, conversation)
+	assert.Contains(t, output, "POST /demo.Greeter/SayHello HTTP/2.0\n")
+	assert.Contains(t, output, "// message 1, len: 9\nname(1) string: \"world\"\nkind(4) enum: FAST\n")
+	assert.Contains(t, output, "// message 1, len: 13\nmessage(1) string: \"hello world\"\n")
+	assert.Contains(t, output, "// trailers\ngrpc-status: 0 (OK)\ngrpc-message: all good\n")
+
+	// without descriptors
+	output = runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "// message 1, len: 9\n1 string: \"world\"\n4 varint: 1\n")
+}
+
+// data in chunked encoding
+func chunkData(data string) string {
+	return strconv.FormatInt(int64(len(data)), 16) + "\r\n" + data + "\r\n"
+}
+
+func TestConversationServerSentEvents(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("GET /events HTTP/1.1\r\nHost: example.com\r\nAccept: text/event-stream\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n", 1460)
+	// each chunk is sent in its own packet, and a chunk may have part of an event
+	for _, data := range []string{"event: update\nid: 1\ndata: first\n\n", ": keep-alive\n\n", "data: sec",
+		"ond\ndata: ", "more\n\n", ""} {
+		conversation.add(conversation.send(false, chunkData(data), 1460)...)
+		conversation.add(conversation.ack(true))
+	}
+	conversation.close()
+
+	messages := runConversationMessages(t, &Option{Level: "all"}, conversation)
+	assert.Equal(t, 4, len(messages))
+	assert.Regexp(t, "GET /events HTTP/1.1\n[^*]*\\*+  RESPONSE  10.0.0.1:10000  <-----  10.0.0.2:80  //  "+
+		"2020-01-01T00:00:00.006Z \\(streaming\\)\nHTTP/1.1 200 OK\n", messages[0])
+	assert.Equal(t, "// event 1, 2020-01-01T00:00:00.008Z\nevent: update\nid: 1\ndata: first\n\n", messages[1])
+	// time of the packet the event starts in
+	assert.Equal(t, "// event 2, 2020-01-01T00:00:00.012Z\ndata: second\ndata: more\n\n", messages[2])
+	assert.Equal(t, "**********  END OF STREAM  10.0.0.1:10000  <-----  10.0.0.2:80  //  "+
+		"2020-01-01T00:00:00.004Z - 2020-01-01T00:00:00.018Z = 14ms (send: 0s, wait: 2ms, receive: 12ms)\n",
+		messages[3])
+}
+
+func TestConversationServerSentEventsReadAhead(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("GET /events HTTP/1.1\r\nHost: example.com\r\nAccept: text/event-stream\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Type: text/event-stream\r\nTransfer-Encoding: chunked\r\n\r\n", 1460)
+	// the second chunk is split to two packets, it is read together with the first event
+	second := chunkData("data: second\n\n")
+	for _, data := range []string{chunkData("data: first\n\n") + second[:10], second[10:] + chunkData("")} {
+		conversation.add(conversation.send(false, data, 1460)...)
+		conversation.add(conversation.ack(true))
+	}
+	conversation.close()
+
+	messages := runConversationMessages(t, &Option{Level: "all"}, conversation)
+	assert.Equal(t, 4, len(messages))
+	assert.Equal(t, "// event 1, 2020-01-01T00:00:00.008Z\ndata: first\n\n", messages[1])
+	assert.Equal(t, "// event 2, 2020-01-01T00:00:00.008Z\ndata: second\n\n", messages[2])
+}
+
+func TestConversationStreamChunks(t *testing.T) {
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange("GET /logs HTTP/1.1\r\nHost: example.com\r\n\r\n",
+			"HTTP/1.1 200 OK\r\nContent-Type: text/plain\r\nTransfer-Encoding: chunked\r\n\r\n", 1460)
+	// the first chunk is split to two packets, and the last two chunks are in one packet
+	for _, data := range []string{"b\r\nhello ", "world\r\n", chunkData("line2\n") + chunkData("\x00\x01\x02") + chunkData("")} {
+		conversation.add(conversation.send(false, data, 1460)...)
+		conversation.add(conversation.ack(true))
+	}
+	conversation.close()
+
+	messages := runConversationMessages(t, &Option{Level: "all", Stream: true}, conversation)
+	assert.Equal(t, 5, len(messages))
+	assert.Equal(t, "// chunk 1, len: 11, 2020-01-01T00:00:00.01Z\nhello world\n\n", messages[1])
+	assert.Equal(t, "// chunk 2, len: 6, 2020-01-01T00:00:00.012Z\nline2\n\n", messages[2])
+	assert.Equal(t, "// chunk 3, len: 3, 2020-01-01T00:00:00.012Z\n{Non-text chunk, set [force] to display}\n\n",
+		messages[3])
+	assert.Contains(t, messages[4], " END OF STREAM ")
+
+	// printed as a whole without stream option
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "\nhello worldline2\n\x00\x01\x02\n")
+	assert.NotContains(t, output, "// chunk")
+}
+
+func TestConversationURLEncoded(t *testing.T) {
+	body := "user=alice&city=S%C3%A3o+Paulo&role=admin&role=dev"
+	request := "POST /login?next=%2Fhome%3Fa%3D1&lang=en HTTP/1.1\r\nHost: example.com\r\n" +
+		"Content-Type: application/x-www-form-urlencoded\r\nContent-Length: " + strconv.Itoa(len(body)) + "\r\n\r\n" +
+		body
+	conversation := newTCPConversation(10000, 1000, 5000).handshake().
+		exchange(request, testResponse, 1460).
+		close()
+	output := runConversations(t, &Option{Level: "all"}, conversation)
+	assert.Contains(t, output, "\n\n// query, 2 fields\nnext: /home?a=1\nlang: en\n\n"+
+		"// form, 4 fields\nuser: alice\ncity: São Paulo\nrole: admin\nrole: dev\n\n")
+
+	output = runConversations(t, &Option{Level: "header"}, conversation)
+	assert.NotContains(t, output, "// query")
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// segmentKind is how a data packet fits into the receive window
+type segmentKind int
+
+const (
+	segmentEmpty         segmentKind = iota // no payload
+	segmentInOrder                          // after all data received
+	segmentOutOfOrder                       // before some data already received, fill a hole
+	segmentRetransmitted                    // contains data already confirmed
+	segmentDuplicated                       // same as a packet in window, not confirmed yet
+)
+
+// streamStats count tcp packets of one direction
+type streamStats struct {
+	packets       int
+	bytes         int64 // payload bytes, not include retransmitted and duplicated data
+	retransmitted int
+	duplicated    int
+	outOfOrder    int
+	zeroWindow    int // times the sender of this stream advertise zero receive window
+}
+
+// record one packet sent
+func (s *streamStats) record(tcp *layers.TCP, kind segmentKind) {
+	s.packets++
+	switch kind {
+	case segmentInOrder:
+		s.bytes += int64(len(tcp.Payload))
+	case segmentOutOfOrder:
+		s.bytes += int64(len(tcp.Payload))
+		s.outOfOrder++
+	case segmentRetransmitted:
+		s.retransmitted++
+	case segmentDuplicated:
+		s.duplicated++
+	}
+	if tcp.Window == 0 && !tcp.RST {
+		s.zeroWindow++
+	}
+}
+
+// tcpStats is tcp level diagnostics of a connection, to tell network problems from application problems
+type tcpStats struct {
+	synFrom    Endpoint
+	synTime    time.Time // SYN from client
+	synAckTime time.Time // SYN-ACK from server
+	ackTime    time.Time // ACK from client, for SYN-ACK
+
+	finFrom Endpoint // who sends FIN first
+	hasFIN  bool
+	rstFrom Endpoint
+	hasRST  bool
+	// why connection is closed, if not closed by FIN or RST
+	closeReason string
+}
+
+// record handshake and close packets
+func (s *tcpStats) record(src Endpoint, tcp *layers.TCP, timestamp time.Time) {
+	switch {
+	case tcp.SYN && !tcp.ACK:
+		if s.synTime.IsZero() {
+			s.synTime = timestamp
+			s.synFrom = src
+		}
+	case tcp.SYN && tcp.ACK:
+		if !s.synTime.IsZero() && s.synAckTime.IsZero() {
+			s.synAckTime = timestamp
+		}
+	case tcp.ACK && !s.synAckTime.IsZero() && s.ackTime.IsZero() && src.equals(s.synFrom):
+		s.ackTime = timestamp
+	}
+	if tcp.FIN && !s.hasFIN {
+		s.hasFIN = true
+		s.finFrom = src
+	}
+	if tcp.RST && !s.hasRST {
+		s.hasRST = true
+		s.rstFrom = src
+	}
+}
+
+// format stats of the connection in one line. client is used to name the side of endpoints
+func (s *tcpStats) format(client Endpoint, up, down *streamStats) string {
+	side := func(endpoint Endpoint) string {
+		if endpoint.equals(client) {
+			return "client"
+		}
+		return "server"
+	}
+	var sb strings.Builder
+	switch {
+	case s.hasRST:
+		sb.WriteString("reset by " + side(s.rstFrom))
+	case s.hasFIN:
+		sb.WriteString("closed by " + side(s.finFrom))
+	case s.closeReason != "":
+		sb.WriteString(s.closeReason)
+	default:
+		sb.WriteString("not closed")
+	}
+
+	sb.WriteString(", handshake: ")
+	if s.ackTime.IsZero() {
+		sb.WriteString("not captured")
+	} else {
+		sb.WriteString(s.ackTime.Sub(s.synTime).String())
+		sb.WriteString(" (server rtt: " + s.synAckTime.Sub(s.synTime).String())
+		sb.WriteString(", client rtt: " + s.ackTime.Sub(s.synAckTime).String() + ")")
+	}
+
+	pair := func(name string, upValue, downValue int64) {
+		sb.WriteString(", " + name + ": " + strconv.FormatInt(upValue, 10) + "/" + strconv.FormatInt(downValue, 10))
+	}
+	pair("packets", int64(up.packets), int64(down.packets))
+	pair("bytes", up.bytes, down.bytes)
+	pair("retransmitted", int64(up.retransmitted), int64(down.retransmitted))
+	pair("duplicated", int64(up.duplicated), int64(down.duplicated))
+	pair("out-of-order", int64(up.outOfOrder), int64(down.outOfOrder))
+	pair("zero-window", int64(up.zeroWindow), int64(down.zeroWindow))
+	sb.WriteString(" (client/server)")
+	return sb.String()
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket/layers"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReceiveWindowSegmentKind(t *testing.T) {
+	window := newReceiveWindow(4)
+	now := time.Now()
+	newPacket := func(seq uint32, payload string) *layers.TCP {
+		return &layers.TCP{Seq: seq, BaseLayer: layers.BaseLayer{Payload: []byte(payload)}}
+	}
+	assert.Equal(t, segmentEmpty, window.insert(newPacket(1000, ""), now))
+	assert.Equal(t, segmentInOrder, window.insert(newPacket(1000, "abcd"), now))
+	assert.Equal(t, segmentInOrder, window.insert(newPacket(1008, "ijkl"), now))
+	assert.Equal(t, segmentOutOfOrder, window.insert(newPacket(1004, "efgh"), now))
+	assert.Equal(t, segmentDuplicated, window.insert(newPacket(1004, "efgh"), now))
+
+	window.confirm(1012, func(packet *streamPacket) {})
+	assert.Equal(t, segmentRetransmitted, window.insert(newPacket(1004, "efgh"), now))
+	assert.Equal(t, segmentRetransmitted, window.insert(newPacket(1010, "klmn"), now))
+}
+
+func TestTCPStats(t *testing.T) {
+	client := newEndpoint(net.IP{10, 0, 0, 1}, 10000)
+	server := newEndpoint(net.IP{10, 0, 0, 2}, 80)
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	var stats tcpStats
+	stats.record(client, &layers.TCP{SYN: true}, start)
+	stats.record(server, &layers.TCP{SYN: true, ACK: true}, start.Add(10*time.Millisecond))
+	stats.record(client, &layers.TCP{ACK: true}, start.Add(15*time.Millisecond))
+	stats.record(client, &layers.TCP{ACK: true}, start.Add(20*time.Millisecond))
+	stats.record(server, &layers.TCP{ACK: true, FIN: true}, start.Add(30*time.Millisecond))
+	stats.record(client, &layers.TCP{ACK: true, FIN: true}, start.Add(40*time.Millisecond))
+	assert.Equal(t, start.Add(15*time.Millisecond), stats.ackTime)
+
+	var up, down streamStats
+	up.record(&layers.TCP{Window: 100, BaseLayer: layers.BaseLayer{Payload: []byte("abcd")}}, segmentInOrder)
+	up.record(&layers.TCP{Window: 100, BaseLayer: layers.BaseLayer{Payload: []byte("abcd")}}, segmentRetransmitted)
+	down.record(&layers.TCP{Window: 0}, segmentEmpty)
+	assert.Equal(t, "closed by server, handshake: 15ms (server rtt: 10ms, client rtt: 5ms), packets: 2/1, bytes: 4/0, "+
+		"retransmitted: 1/0, duplicated: 0/0, out-of-order: 0/0, zero-window: 0/1 (client/server)",
+		stats.format(client, &up, &down))
+
+	stats.record(client, &layers.TCP{RST: true}, start.Add(50*time.Millisecond))
+	assert.Equal(t, "reset by client", stats.format(client, &up, &down)[:15])
+}
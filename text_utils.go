@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"io"
 	"io/ioutil"
+	"net/url"
 	"strings"
 
 	//"github.com/saintfish/chardet" // not work, realy stupid...
@@ -42,8 +43,6 @@ func parseMimeType(contentTypeStr string) mimeType {
 	return mimeType{contentTypeStr[:idx], subType, scope}
 }
 
-//TODO: multipart/form-data
-
 var textTypes = map[string]bool{"text": true}
 var textSubTypes = map[string]bool{
 	"html":                true,
@@ -167,6 +166,44 @@ func byteToStringWithCharset(data []byte, charset string) (string, error) {
 	return readToStringWithCharset(reader, charset)
 }
 
+// urlEncodedField is a key and its value, of url-encoded form or query string
+type urlEncodedField struct {
+	key   string
+	value string
+}
+
+// decode application/x-www-form-urlencoded data, in order and repeated keys are kept. Percent-encoded bytes are
+// decoded by charset; key or value can not be decoded is kept as it is
+func decodeURLEncoded(data string, charset string) []urlEncodedField {
+	var fields []urlEncodedField
+	for _, pair := range strings.Split(data, "&") {
+		if pair == "" {
+			continue
+		}
+		key, value := pair, ""
+		if idx := strings.IndexByte(pair, '='); idx >= 0 {
+			key, value = pair[:idx], pair[idx+1:]
+		}
+		fields = append(fields, urlEncodedField{unescapeWithCharset(key, charset), unescapeWithCharset(value, charset)})
+	}
+	return fields
+}
+
+func unescapeWithCharset(str string, charset string) string {
+	unescaped, err := url.QueryUnescape(str)
+	if err != nil {
+		return str
+	}
+	if charset == "" {
+		return unescaped
+	}
+	decoded, err := byteToStringWithCharset([]byte(unescaped), charset)
+	if err != nil {
+		return unescaped
+	}
+	return decoded
+}
+
 // parse content type to mimeType and charset
 func parseContentType(contentType string) (string, string) {
 	var mimeTypeStr, charset string
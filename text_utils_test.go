@@ -42,3 +42,10 @@ func TestWildcardMatch(t *testing.T) {
 	assert.False(t, wildcardMatch("test", "tt*"))
 	assert.False(t, wildcardMatch("test", "es"))
 }
+
+func TestDecodeURLEncoded(t *testing.T) {
+	assert.Equal(t, []urlEncodedField{{"name", "a b"}, {"tag", "x&y"}, {"tag", "z"}, {"empty", ""}, {"bad", "%zz"}},
+		decodeURLEncoded("name=a+b&tag=x%26y&tag=z&&empty&bad=%zz", ""))
+	// percent-encoded bytes in gbk
+	assert.Equal(t, []urlEncodedField{{"q", "中文"}}, decodeURLEncoded("q=%D6%D0%CE%C4", "GBK"))
+}
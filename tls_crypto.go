@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"hash"
+)
+
+var errTLSRecordInvalid = errors.New("tls: invalid record")
+
+// tlsCipherSuite is an AEAD cipher suite can be decrypted
+type tlsCipherSuite struct {
+	keyLen int
+	ivLen  int // fixed part of nonce, in tls 1.2
+	hash   func() hash.Hash
+	aead   func(key []byte) (cipher.AEAD, error)
+	// tls 1.2 AES-GCM send the rest part of nonce in each record
+	explicitNonce bool
+}
+
+var (
+	tlsAES128GCMSHA256        = &tlsCipherSuite{16, 4, sha256.New, newAESGCM, true}
+	tlsAES256GCMSHA384        = &tlsCipherSuite{32, 4, sha512.New384, newAESGCM, true}
+	tlsChaCha20Poly1305SHA256 = &tlsCipherSuite{32, 12, sha256.New, newChaCha20Poly1305, false}
+)
+
+var tlsCipherSuites = map[uint16]*tlsCipherSuite{
+	// tls 1.3
+	0x1301: tlsAES128GCMSHA256,
+	0x1302: tlsAES256GCMSHA384,
+	0x1303: tlsChaCha20Poly1305SHA256,
+	// tls 1.2, ECDHE/DHE/RSA key exchange
+	0xc02b: tlsAES128GCMSHA256,
+	0xc02f: tlsAES128GCMSHA256,
+	0x009c: tlsAES128GCMSHA256,
+	0x009e: tlsAES128GCMSHA256,
+	0xc02c: tlsAES256GCMSHA384,
+	0xc030: tlsAES256GCMSHA384,
+	0x009d: tlsAES256GCMSHA384,
+	0x009f: tlsAES256GCMSHA384,
+	0xcca8: tlsChaCha20Poly1305SHA256,
+	0xcca9: tlsChaCha20Poly1305SHA256,
+	0xccaa: tlsChaCha20Poly1305SHA256,
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// tlsRecordCipher decrypt records of one direction, with keys of one epoch
+type tlsRecordCipher struct {
+	aead    cipher.AEAD
+	iv      []byte
+	seq     uint64
+	version uint16
+	// nonce is fixed iv and explicit part in record, instead of iv xor sequence number
+	explicitNonce bool
+}
+
+// cipher of tls 1.3 traffic secret
+func newTLS13RecordCipher(suite *tlsCipherSuite, secret []byte) (*tlsRecordCipher, error) {
+	key := hkdfExpandLabel(suite.hash, secret, "key", suite.keyLen)
+	aead, err := suite.aead(key)
+	if err != nil {
+		return nil, err
+	}
+	return &tlsRecordCipher{aead: aead, iv: hkdfExpandLabel(suite.hash, secret, "iv", 12), version: tlsVersion13}, nil
+}
+
+// tls 1.2 ciphers of client and server, by master secret
+func newTLS12RecordCiphers(suite *tlsCipherSuite, masterSecret, clientRandom,
+	serverRandom []byte) (client *tlsRecordCipher, server *tlsRecordCipher, err error) {
+	seed := append(append([]byte(nil), serverRandom...), clientRandom...)
+	keyBlock := tls12PRF(suite.hash, masterSecret, "key expansion", seed, 2*suite.keyLen+2*suite.ivLen)
+	clientKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	serverKey, keyBlock := keyBlock[:suite.keyLen], keyBlock[suite.keyLen:]
+	clientIV, serverIV := keyBlock[:suite.ivLen], keyBlock[suite.ivLen:]
+
+	clientAEAD, err := suite.aead(clientKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverAEAD, err := suite.aead(serverKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	client = &tlsRecordCipher{aead: clientAEAD, iv: clientIV, version: tlsVersion12, explicitNonce: suite.explicitNonce}
+	server = &tlsRecordCipher{aead: serverAEAD, iv: serverIV, version: tlsVersion12, explicitNonce: suite.explicitNonce}
+	return client, server, nil
+}
+
+// decrypt record, return the real content type and the plaintext
+func (c *tlsRecordCipher) decrypt(header, fragment []byte) (byte, []byte, error) {
+	var nonce []byte
+	if c.explicitNonce {
+		if len(fragment) < 8 {
+			return 0, nil, errTLSRecordInvalid
+		}
+		nonce = append(append([]byte(nil), c.iv...), fragment[:8]...)
+		fragment = fragment[8:]
+	} else {
+		nonce = append([]byte(nil), c.iv...)
+		for i := 0; i < 8; i++ {
+			nonce[len(nonce)-1-i] ^= byte(c.seq >> (8 * i))
+		}
+	}
+
+	additionalData := header
+	if c.version != tlsVersion13 {
+		if len(fragment) < c.aead.Overhead() {
+			return 0, nil, errTLSRecordInvalid
+		}
+		additionalData = make([]byte, 8+tlsRecordHeaderLen)
+		binary.BigEndian.PutUint64(additionalData, c.seq)
+		copy(additionalData[8:], header[:3])
+		binary.BigEndian.PutUint16(additionalData[11:], uint16(len(fragment)-c.aead.Overhead()))
+	}
+	plaintext, err := c.aead.Open(nil, nonce, fragment, additionalData)
+	if err != nil {
+		return 0, nil, err
+	}
+	c.seq++
+	if c.version != tlsVersion13 {
+		return header[0], plaintext, nil
+	}
+
+	// TLSInnerPlaintext: content, content type, and zero paddings
+	i := len(plaintext) - 1
+	for i >= 0 && plaintext[i] == 0 {
+		i--
+	}
+	if i < 0 {
+		return 0, nil, errTLSRecordInvalid
+	}
+	return plaintext[i], plaintext[:i], nil
+}
+
+// HKDF-Expand-Label of RFC 8446, with empty context
+func hkdfExpandLabel(hash func() hash.Hash, secret []byte, label string, length int) []byte {
+	label = "tls13 " + label
+	info := make([]byte, 0, 4+len(label))
+	info = append(info, byte(length>>8), byte(length), byte(len(label)))
+	info = append(info, label...)
+	info = append(info, 0)
+
+	// HKDF-Expand of RFC 5869
+	var out, block []byte
+	mac := hmac.New(hash, secret)
+	for i := byte(1); len(out) < length; i++ {
+		mac.Reset()
+		mac.Write(block)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		block = mac.Sum(nil)
+		out = append(out, block...)
+	}
+	return out[:length]
+}
+
+// the next traffic secret, after KeyUpdate of tls 1.3
+func nextTrafficSecret(hash func() hash.Hash, secret []byte) []byte {
+	return hkdfExpandLabel(hash, secret, "traffic upd", hash().Size())
+}
+
+// PRF of tls 1.2, RFC 5246 section 5
+func tls12PRF(hash func() hash.Hash, secret []byte, label string, seed []byte, length int) []byte {
+	seed = append([]byte(label), seed...)
+	mac := hmac.New(hash, secret)
+	var out []byte
+	a := seed
+	for len(out) < length {
+		mac.Reset()
+		mac.Write(a)
+		a = mac.Sum(nil)
+		mac.Reset()
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:length]
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"crypto/x509"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// if the stream starts with a tls handshake record
+func isTLSHandshakeStart(reader *streamReader) bool {
+	data, err := reader.Peek(tlsRecordHeaderLen + 1)
+	return err == nil && isClientHelloRecord(data)
+}
+
+// tlsDecrypter decrypt both directions of a tls connection by secrets in key log, and deliver the plaintext of
+// application data to new streams, so http can be parsed from them as from plain tcp connection.
+// Without key log, or the secrets not found, only the plaintext handshake are parsed.
+// Fields of handshake info should be read after the plaintext streams end
+type tlsDecrypter struct {
+	keyLog *keyLog // nil if not decrypting
+
+	// set by client direction before clientHelloDone closed
+	clientHello     *clientHello
+	started         time.Time // capture time of ClientHello
+	clientHelloDone chan struct{}
+	clientHelloOnce sync.Once
+	// set by server direction before serverHelloDone closed, suite is nil if can not decrypt
+	serverHello     *serverHello
+	suite           *tlsCipherSuite
+	serverHelloDone chan struct{}
+	serverHelloOnce sync.Once
+	certificate     *x509.Certificate // server certificate, only visible in tls 1.2
+
+	// tls 1.2 ciphers of both directions, derived once from master secret
+	tls12Once   sync.Once
+	tls12Client *tlsRecordCipher
+	tls12Server *tlsRecordCipher
+
+	client    *tlsDirection
+	server    *tlsDirection
+	decrypted int32 // set when keys of any direction are derived, accessed atomically
+	failOnce  sync.Once
+	failure   string // why the connection can not be decrypted
+}
+
+func newTLSDecrypter(keyLog *keyLog) *tlsDecrypter {
+	return &tlsDecrypter{keyLog: keyLog, clientHelloDone: make(chan struct{}), serverHelloDone: make(chan struct{})}
+}
+
+// start decrypting the two directions, return readers of the plaintext.
+// The plaintext streams end after the tls streams are read to the end, they have the backpressure policy of the
+// tls streams
+func (d *tlsDecrypter) start(requestReader, responseReader *streamReader) (*streamReader, *streamReader) {
+	d.client = &tlsDirection{decrypter: d, fromClient: true, reader: requestReader,
+		out: newNetworkStream(requestReader.stream.policy)}
+	d.server = &tlsDirection{decrypter: d, reader: responseReader, out: newNetworkStream(responseReader.stream.policy)}
+	go d.client.run()
+	go d.server.run()
+	return newStreamReader(d.client.out), newStreamReader(d.server.out)
+}
+
+// read the plaintext streams to the end and close them, so the spill files are removed
+func (d *tlsDecrypter) close() {
+	discardAll(d.client.out)
+	discardAll(d.server.out)
+	d.client.out.Close()
+	d.server.out.Close()
+}
+
+// record why the connection can not be decrypted, only the first one
+func (d *tlsDecrypter) fail(reason string) {
+	d.failOnce.Do(func() {
+		d.failure = reason
+	})
+}
+
+// if any direction is decrypted
+func (d *tlsDecrypter) isDecrypted() bool {
+	return atomic.LoadInt32(&d.decrypted) != 0
+}
+
+func (d *tlsDecrypter) setClientHello(hello *clientHello, timestamp time.Time) {
+	d.clientHelloOnce.Do(func() {
+		d.clientHello = hello
+		d.started = timestamp
+		close(d.clientHelloDone)
+	})
+}
+
+// the ServerHello decide version and cipher suite. return false if the connection can not be decrypted
+func (d *tlsDecrypter) setServerHello(hello *serverHello) bool {
+	<-d.clientHelloDone
+	ok := false
+	d.serverHelloOnce.Do(func() {
+		defer close(d.serverHelloDone)
+		d.serverHello = hello
+		if d.keyLog == nil {
+			return
+		}
+		if d.clientHello == nil {
+			d.fail("ClientHello not captured")
+			return
+		}
+		if hello.version != tlsVersion12 && hello.version != tlsVersion13 {
+			d.fail("unsupported version " + tlsVersionName(hello.version))
+			return
+		}
+		suite := tlsCipherSuites[hello.cipherSuite]
+		if suite == nil {
+			d.fail("unsupported cipher suite " + tlsCipherSuiteName(hello.cipherSuite))
+			return
+		}
+		d.suite = suite
+		ok = true
+	})
+	return ok
+}
+
+// wait for ServerHello, return false if the connection can not be decrypted
+func (d *tlsDecrypter) waitServerHello() bool {
+	<-d.serverHelloDone
+	return d.suite != nil
+}
+
+// the secret in key log of the connection, nil and fail if not found
+func (d *tlsDecrypter) secret(label string) []byte {
+	secret := d.keyLog.secret(label, d.clientHello.random)
+	if secret == nil {
+		d.fail("no key in key log")
+	}
+	return secret
+}
+
+// ciphers of tls 1.2 by master secret, nil if can not be derived
+func (d *tlsDecrypter) tls12Ciphers() (client *tlsRecordCipher, server *tlsRecordCipher) {
+	d.tls12Once.Do(func() {
+		masterSecret := d.secret(keyLogClientRandom)
+		if masterSecret == nil {
+			return
+		}
+		var err error
+		d.tls12Client, d.tls12Server, err = newTLS12RecordCiphers(d.suite, masterSecret, d.clientHello.random,
+			d.serverHello.random)
+		if err != nil {
+			d.fail(err.Error())
+		}
+	})
+	return d.tls12Client, d.tls12Server
+}
+
+// tlsDirection decrypt records of one direction
+type tlsDirection struct {
+	decrypter  *tlsDecrypter
+	fromClient bool
+	reader     *streamReader
+	out        *NetworkStream
+	handshake  tlsHandshakeBuffer
+	cipher     *tlsRecordCipher // nil before encryption start
+	// tls 1.3 traffic secret of the cipher, and if it is secret of application data instead of handshake
+	secret          []byte
+	applicationKeys bool
+}
+
+func (t *tlsDirection) run() {
+	defer func() {
+		// read tls stream to the end, as the handler do for plain connection
+		discardAll(t.reader)
+		if atomic.LoadInt32(&t.reader.stream.dropped) != 0 {
+			atomic.StoreInt32(&t.out.dropped, 1)
+		}
+		t.out.finish()
+	}()
+	defer t.helloDone()
+
+	for {
+		header, fragment, err := readTLSRecord(t.reader)
+		if err != nil {
+			if err != io.EOF && err != io.ErrUnexpectedEOF && err != errStreamDropped {
+				t.decrypter.fail(err.Error())
+			}
+			return
+		}
+		if !t.handleRecord(header, fragment) {
+			return
+		}
+	}
+}
+
+// the hello message of this direction will not come, stop the other direction waiting for it
+func (t *tlsDirection) helloDone() {
+	if t.fromClient {
+		t.decrypter.clientHelloOnce.Do(func() { close(t.decrypter.clientHelloDone) })
+	} else {
+		t.decrypter.serverHelloOnce.Do(func() { close(t.decrypter.serverHelloDone) })
+	}
+}
+
+// return false if can not decrypt records any more
+func (t *tlsDirection) handleRecord(header, fragment []byte) bool {
+	contentType := header[0]
+	if contentType == tlsRecordTypeChangeCipherSpec {
+		// tls 1.2 encrypt records after it, tls 1.3 send it only for compatibility
+		return t.changeCipherSpec()
+	}
+	if t.cipher == nil && contentType == tlsRecordTypeApplicationData {
+		// tls 1.3 encrypt all records after ServerHello
+		if !t.useHandshakeKeys() {
+			return false
+		}
+	}
+
+	data := fragment
+	if t.cipher != nil {
+		var err error
+		contentType, data, err = t.cipher.decrypt(header, fragment)
+		if err != nil {
+			if t.fromClient && t.cipher.version == tlsVersion13 && !t.applicationKeys {
+				// 0-RTT early data, encrypted by early secret, skip it
+				return true
+			}
+			t.decrypter.fail("decryption failed")
+			return false
+		}
+		atomic.StoreInt32(&t.decrypter.decrypted, 1)
+	}
+
+	switch contentType {
+	case tlsRecordTypeHandshake:
+		t.handshake.write(data)
+		for message := t.handshake.next(); message != nil; message = t.handshake.next() {
+			if !t.handleHandshakeMessage(message) {
+				return false
+			}
+		}
+	case tlsRecordTypeApplicationData:
+		if len(data) > 0 {
+			tcp := &layers.TCP{BaseLayer: layers.BaseLayer{Payload: data}}
+			t.out.deliver(&streamPacket{TCP: tcp, timestamp: t.reader.lastTimestamp()})
+			if t.out.overflow {
+				// handler is too slow for drop policy, the plaintext reader get errStreamDropped after data queued
+				atomic.StoreInt32(&t.out.dropped, 1)
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (t *tlsDirection) handleHandshakeMessage(message []byte) bool {
+	switch message[0] {
+	case tlsHandshakeTypeClientHello:
+		if t.fromClient && t.cipher == nil {
+			if hello := parseClientHello(message); hello != nil {
+				t.decrypter.setClientHello(hello, t.reader.lastTimestamp())
+			}
+		}
+	case tlsHandshakeTypeServerHello:
+		if !t.fromClient && t.cipher == nil {
+			hello := parseServerHello(message)
+			if hello == nil {
+				t.decrypter.fail("invalid ServerHello")
+				return false
+			}
+			if hello.isHelloRetryRequest() {
+				// real ServerHello come after client send ClientHello again
+				return true
+			}
+			// if can not decrypt, the plaintext handshake messages are still parsed until encryption start
+			t.decrypter.setServerHello(hello)
+		}
+	case tlsHandshakeTypeCertificate:
+		if !t.fromClient && t.cipher == nil && t.decrypter.certificate == nil {
+			t.decrypter.certificate = parseCertificate(message)
+		}
+	case tlsHandshakeTypeFinished:
+		// tls 1.3 use traffic secrets after handshake finished
+		if t.cipher != nil && t.cipher.version == tlsVersion13 && !t.applicationKeys {
+			label := keyLogServerTrafficSecret0
+			if t.fromClient {
+				label = keyLogClientTrafficSecret0
+			}
+			if t.secret = t.decrypter.secret(label); t.secret == nil {
+				return false
+			}
+			t.applicationKeys = true
+			return t.useTLS13Secret()
+		}
+	case tlsHandshakeTypeKeyUpdate:
+		if t.applicationKeys {
+			t.secret = nextTrafficSecret(t.decrypter.suite.hash, t.secret)
+			return t.useTLS13Secret()
+		}
+	}
+	return true
+}
+
+func (t *tlsDirection) changeCipherSpec() bool {
+	if !t.decrypter.waitServerHello() {
+		return false
+	}
+	if t.decrypter.serverHello.version == tlsVersion13 {
+		return true
+	}
+	client, server := t.decrypter.tls12Ciphers()
+	if t.fromClient {
+		t.cipher = client
+	} else {
+		t.cipher = server
+	}
+	return t.cipher != nil
+}
+
+func (t *tlsDirection) useHandshakeKeys() bool {
+	if !t.decrypter.waitServerHello() {
+		return false
+	}
+	if t.decrypter.serverHello.version != tlsVersion13 {
+		t.decrypter.fail("application data before ChangeCipherSpec")
+		return false
+	}
+	label := keyLogServerHandshakeTrafficSecret
+	if t.fromClient {
+		label = keyLogClientHandshakeTrafficSecret
+	}
+	if t.secret = t.decrypter.secret(label); t.secret == nil {
+		return false
+	}
+	return t.useTLS13Secret()
+}
+
+func (t *tlsDirection) useTLS13Secret() bool {
+	cipher, err := newTLS13RecordCipher(t.decrypter.suite, t.secret)
+	if err != nil {
+		t.decrypter.fail(err.Error())
+		return false
+	}
+	t.cipher = cipher
+	return true
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// tlsRecording is the data sent by each side of a tls connection, in the order they are written
+type tlsRecording struct {
+	lock   sync.Mutex
+	writes []tlsWrite
+}
+
+type tlsWrite struct {
+	fromClient bool
+	data       []byte
+}
+
+// recordingConn record data written to conn
+type recordingConn struct {
+	net.Conn
+	recording  *tlsRecording
+	fromClient bool
+}
+
+func (c *recordingConn) Write(p []byte) (int, error) {
+	c.recording.lock.Lock()
+	c.recording.writes = append(c.recording.writes, tlsWrite{c.fromClient, append([]byte(nil), p...)})
+	c.recording.lock.Unlock()
+	return c.Conn.Write(p)
+}
+
+func testCertificate(t *testing.T) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{SerialNumber: big.NewInt(1), Subject: pkix.Name{CommonName: "example.com"},
+		NotBefore: time.Now().Add(-time.Hour), NotAfter: time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC),
+		DNSNames: []string{"example.com"}}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// run a tls connection, client send request and server send response then close.
+// return the conversation captured, and the key log
+func recordTLSConversation(t *testing.T, config *tls.Config, request, response string) (*tcpConversation, string) {
+	var keyLog bytes.Buffer
+	recording := &tlsRecording{}
+	clientConn, serverConn := net.Pipe()
+
+	serverConfig := &tls.Config{Certificates: []tls.Certificate{testCertificate(t)}, NextProtos: []string{"h2"}}
+	go func() {
+		server := tls.Server(&recordingConn{Conn: serverConn, recording: recording}, serverConfig)
+		if _, err := io.ReadFull(server, make([]byte, len(request))); err == nil {
+			_, _ = server.Write([]byte(response))
+		}
+		_ = server.Close()
+	}()
+
+	config.ServerName = "example.com"
+	config.InsecureSkipVerify = true
+	config.KeyLogWriter = &keyLog
+	client := tls.Client(&recordingConn{Conn: clientConn, recording: recording, fromClient: true}, config)
+	_, err := client.Write([]byte(request))
+	assert.NoError(t, err)
+	received, _ := ioutil.ReadAll(client)
+	assert.Equal(t, response, string(received))
+	_ = client.Close()
+
+	conversation := newTCPConversation(10000, 1000, 5000)
+	conversation.server.port = 443
+	conversation.handshake()
+	for _, write := range recording.writes {
+		conversation.add(conversation.send(write.fromClient, string(write.data), 1460)...)
+		conversation.add(conversation.ack(!write.fromClient))
+	}
+	return conversation.close(), keyLog.String()
+}
+
+func keyLogOption(t *testing.T, content string) *Option {
+	file, err := ioutil.TempFile("", "keylog")
+	assert.NoError(t, err)
+	defer os.Remove(file.Name())
+	_, _ = file.WriteString(content)
+	_ = file.Close()
+	keyLog, err := loadKeyLog(file.Name())
+	assert.NoError(t, err)
+	return &Option{Level: "all", KeyLogSecrets: keyLog}
+}
+
+func TestTLSDecrypt(t *testing.T) {
+	configs := map[string]*tls.Config{
+		"tls13": {MinVersion: tls.VersionTLS13},
+		"tls12-aes128-gcm": {MaxVersion: tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}},
+		"tls12-aes256-gcm": {MaxVersion: tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}},
+		"tls12-chacha20": {MaxVersion: tls.VersionTLS12,
+			CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305}},
+	}
+	for name, config := range configs {
+		t.Run(name, func(t *testing.T) {
+			conversation, keyLog := recordTLSConversation(t, config, testRequest, testResponse)
+			output := runConversations(t, keyLogOption(t, keyLog), conversation)
+			assertTestTransaction(t, output)
+			assert.Contains(t, output, "10.0.0.1:10000  ----->  10.0.0.2:443")
+		})
+	}
+}
+
+func TestTLSDecryptNoKey(t *testing.T) {
+	conversation, _ := recordTLSConversation(t, &tls.Config{}, testRequest, testResponse)
+	output := runConversations(t, keyLogOption(t, ""), conversation)
+	assert.Contains(t, output, "sni: example.com\n")
+	assert.Contains(t, output, "\nnot decrypted: no key in key log\n")
+	assert.NotContains(t, output, "POST /upload")
+}
+
+func TestTLSDecrypterBackpressure(t *testing.T) {
+	for _, policy := range []backpressurePolicy{backpressureBlock, backpressureSpill, backpressureDrop} {
+		upStream, downStream := newNetworkStream(policy), newNetworkStream(policy)
+		decrypter := newTLSDecrypter(nil)
+		requestReader, responseReader := decrypter.start(newStreamReader(upStream), newStreamReader(downStream))
+		// plaintext streams follow the policy of the connection
+		assert.Equal(t, policy, requestReader.stream.policy)
+		assert.Equal(t, policy, responseReader.stream.policy)
+		assert.Equal(t, policy == backpressureSpill, responseReader.stream.spill != nil)
+		upStream.finish()
+		downStream.finish()
+		decrypter.close()
+	}
+}
+
+func TestTLSConnectionInfo(t *testing.T) {
+	config := &tls.Config{MaxVersion: tls.VersionTLS12, NextProtos: []string{"h2", "http/1.1"},
+		CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}
+	conversation, _ := recordTLSConversation(t, config, testRequest, testResponse)
+	output := runConversations(t, &Option{Level: "header"}, conversation)
+	assert.Regexp(t, "^\n\\*+  TLS  10.0.0.1:10000  ----->  10.0.0.2:443  //  2020-01-01T00:00:00.004Z\n"+
+		"sni: example.com\n"+
+		"alpn: h2 \\(offered: h2,http/1.1\\)\n"+
+		"version: TLS 1.2\n"+
+		"cipher: TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256\n"+
+		"certificate: subject: CN=example.com, san: example.com, expire: 2030-01-01T00:00:00Z\n"+
+		"ja3: [0-9a-f]{32} \\(771,49195,[0-9-]+,[0-9-]+,0\\)\n"+
+		"ja3s: [0-9a-f]{32} \\(771,49195,[0-9-]+\\)\n"+
+		"duration: [0-9]+ms, bytes: [0-9]+/[0-9]+ \\(client/server\\)\n$", output)
+
+	output = runConversations(t, &Option{Level: "url"}, conversation)
+	assert.Regexp(t, "^TLS example.com TLS 1.2, TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, duration: [0-9]+ms", output)
+
+	// tls 1.3 encrypt the certificate
+	conversation, _ = recordTLSConversation(t, &tls.Config{MinVersion: tls.VersionTLS13}, testRequest, testResponse)
+	output = runConversations(t, &Option{Level: "header"}, conversation)
+	assert.Contains(t, output, "version: TLS 1.3\ncipher: TLS_")
+	assert.Contains(t, output, "\ncertificate: not visible\n")
+
+	// matched by sni
+	assert.NotEqual(t, "", runConversations(t, &Option{Level: "url", Host: "*.com"}, conversation))
+	assert.Equal(t, "", runConversations(t, &Option{Level: "url", Host: "*.org"}, conversation))
+}
+
+func TestKeyLog(t *testing.T) {
+	random := strings.Repeat("ab", 32)
+	option := keyLogOption(t, "# comment\n"+
+		"CLIENT_RANDOM "+random+" 0102\n"+
+		"CLIENT_TRAFFIC_SECRET_0 "+random+" 0304\n"+
+		"CLIENT_RANDOM 00 0506\n")
+	keyLog := option.KeyLogSecrets
+	clientRandom := bytes.Repeat([]byte{0xab}, 32)
+	assert.Equal(t, []byte{1, 2}, keyLog.secret(keyLogClientRandom, clientRandom))
+	assert.Equal(t, []byte{3, 4}, keyLog.secret(keyLogClientTrafficSecret0, clientRandom))
+	assert.Nil(t, keyLog.secret(keyLogServerTrafficSecret0, clientRandom))
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	tlsRecordHeaderLen            = 5
+	tlsRecordTypeChangeCipherSpec = 20
+	tlsRecordTypeHandshake        = 22
+	tlsRecordTypeApplicationData  = 23
+	tlsHandshakeHeaderLen         = 4
+	tlsHandshakeTypeClientHello   = 1
+	tlsHandshakeTypeServerHello   = 2
+	tlsHandshakeTypeCertificate   = 11
+	tlsHandshakeTypeFinished      = 20
+	tlsHandshakeTypeKeyUpdate     = 24
+	tlsExtensionServerName        = 0
+	tlsExtensionSupportedGroups   = 10
+	tlsExtensionECPointFormats    = 11
+	tlsExtensionALPN              = 16
+	tlsExtensionSupportedVersions = 43
+	tlsVersion12                  = 0x0303
+	tlsVersion13                  = 0x0304
+)
+
+// the random of ServerHello which is a HelloRetryRequest of tls 1.3
+var tlsHelloRetryRequestRandom = []byte{0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e,
+	0x65, 0xb8, 0x91, 0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c}
+
+var tlsVersionNames = map[uint16]string{
+	0x0300: "SSL 3.0",
+	0x0301: "TLS 1.0",
+	0x0302: "TLS 1.1",
+	0x0303: "TLS 1.2",
+	0x0304: "TLS 1.3",
+}
+
+var tlsCipherSuiteNames = map[uint16]string{
+	0x1301: "TLS_AES_128_GCM_SHA256",
+	0x1302: "TLS_AES_256_GCM_SHA384",
+	0x1303: "TLS_CHACHA20_POLY1305_SHA256",
+	0xc02b: "TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256",
+	0xc02f: "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256",
+	0xc02c: "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384",
+	0xc030: "TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384",
+	0xcca8: "TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	0xcca9: "TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256",
+	0xccaa: "TLS_DHE_RSA_WITH_CHACHA20_POLY1305_SHA256",
+	0x009c: "TLS_RSA_WITH_AES_128_GCM_SHA256",
+	0x009d: "TLS_RSA_WITH_AES_256_GCM_SHA384",
+	0x009e: "TLS_DHE_RSA_WITH_AES_128_GCM_SHA256",
+	0x009f: "TLS_DHE_RSA_WITH_AES_256_GCM_SHA384",
+	0xc009: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA",
+	0xc00a: "TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA",
+	0xc013: "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA",
+	0xc014: "TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA",
+	0xc023: "TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256",
+	0xc027: "TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256",
+	0x002f: "TLS_RSA_WITH_AES_128_CBC_SHA",
+	0x0035: "TLS_RSA_WITH_AES_256_CBC_SHA",
+	0x003c: "TLS_RSA_WITH_AES_128_CBC_SHA256",
+	0x000a: "TLS_RSA_WITH_3DES_EDE_CBC_SHA",
+	0xc012: "TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA",
+	0x0005: "TLS_RSA_WITH_RC4_128_SHA",
+	0xc007: "TLS_ECDHE_ECDSA_WITH_RC4_128_SHA",
+	0xc011: "TLS_ECDHE_RSA_WITH_RC4_128_SHA",
+}
+
+// clientHello is info of tls ClientHello message
+type clientHello struct {
+	version      uint16 // legacy version field, TLS 1.2 for tls 1.3
+	random       []byte
+	cipherSuites []uint16
+	extensions   []uint16 // extension types, in order
+	curves       []uint16 // supported groups
+	pointFormats []uint16
+	serverName   string   // SNI
+	alpn         []string // protocols offered
+}
+
+// serverHello is info of tls ServerHello message
+type serverHello struct {
+	legacyVersion uint16
+	random        []byte
+	version       uint16 // the negotiated version, from supported_versions extension for tls 1.3
+	cipherSuite   uint16
+	extensions    []uint16
+	alpn          string // protocol selected, tls 1.3 send it encrypted
+}
+
+// if payload is the start of a tls record contains ClientHello
+func isClientHelloRecord(payload []byte) bool {
+	return len(payload) > tlsRecordHeaderLen && payload[0] == tlsRecordTypeHandshake && payload[1] == 3 &&
+		payload[tlsRecordHeaderLen] == tlsHandshakeTypeClientHello
+}
+
+// read a tls record, return the record header and the fragment
+func readTLSRecord(reader io.Reader) (header []byte, fragment []byte, err error) {
+	header = make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	if header[1] != 3 {
+		return nil, nil, errTLSRecordInvalid
+	}
+	fragment = make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(reader, fragment); err != nil {
+		return nil, nil, unexpectedEOF(err)
+	}
+	return header, fragment, nil
+}
+
+// read the first tls record from reader, and parse the ClientHello in it.
+// return nil if data is not tls ClientHello
+func readClientHello(reader io.Reader) *clientHello {
+	var header [tlsRecordHeaderLen]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil
+	}
+	if header[0] != tlsRecordTypeHandshake || header[1] != 3 {
+		return nil
+	}
+	record := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(reader, record); err != nil {
+		return nil
+	}
+	return parseClientHello(record)
+}
+
+// parse ClientHello handshake message. If the message is longer than data, parse the part in data.
+// return nil if data is not ClientHello
+func parseClientHello(data []byte) *clientHello {
+	p := &tlsParser{data: data}
+	if p.uint8() != tlsHandshakeTypeClientHello {
+		return nil
+	}
+	p.uint24() // length
+	hello := &clientHello{version: p.uint16(), random: p.bytes(32)}
+	p.skip(int(p.uint8())) // session id
+	cipherSuites := &tlsParser{data: p.bytes(int(p.uint16()))}
+	p.skip(int(p.uint8())) // compression methods
+	if p.failed {
+		return nil
+	}
+	hello.cipherSuites = cipherSuites.uint16List()
+
+	extensions := &tlsParser{data: p.bytes(int(p.uint16()))}
+	if p.failed {
+		// message truncated, parse extensions in data
+		extensions = &tlsParser{data: p.data}
+	}
+	for len(extensions.data) >= 4 {
+		extensionType := extensions.uint16()
+		extension := &tlsParser{data: extensions.bytes(int(extensions.uint16()))}
+		if extensions.failed {
+			break
+		}
+		hello.extensions = append(hello.extensions, extensionType)
+		switch extensionType {
+		case tlsExtensionServerName:
+			names := &tlsParser{data: extension.bytes(int(extension.uint16()))}
+			for len(names.data) > 0 && !names.failed {
+				nameType := names.uint8()
+				name := names.bytes(int(names.uint16()))
+				if nameType == 0 && !names.failed {
+					hello.serverName = string(name)
+					break
+				}
+			}
+		case tlsExtensionSupportedGroups:
+			hello.curves = (&tlsParser{data: extension.bytes(int(extension.uint16()))}).uint16List()
+		case tlsExtensionECPointFormats:
+			for _, format := range extension.bytes(int(extension.uint8())) {
+				hello.pointFormats = append(hello.pointFormats, uint16(format))
+			}
+		case tlsExtensionALPN:
+			hello.alpn = parseALPN(extension)
+		}
+	}
+	return hello
+}
+
+// parse ServerHello handshake message. return nil if data is not a complete ServerHello
+func parseServerHello(data []byte) *serverHello {
+	p := &tlsParser{data: data}
+	if p.uint8() != tlsHandshakeTypeServerHello {
+		return nil
+	}
+	p = &tlsParser{data: p.bytes(int(p.uint24()))}
+	hello := &serverHello{legacyVersion: p.uint16(), random: p.bytes(32)}
+	hello.version = hello.legacyVersion
+	p.skip(int(p.uint8())) // session id
+	hello.cipherSuite = p.uint16()
+	p.skip(1) // compression method
+	if p.failed {
+		return nil
+	}
+	extensions := &tlsParser{data: p.bytes(int(p.uint16()))}
+	for len(extensions.data) >= 4 {
+		extensionType := extensions.uint16()
+		extension := &tlsParser{data: extensions.bytes(int(extensions.uint16()))}
+		if extensions.failed {
+			break
+		}
+		hello.extensions = append(hello.extensions, extensionType)
+		switch extensionType {
+		case tlsExtensionSupportedVersions:
+			hello.version = extension.uint16()
+		case tlsExtensionALPN:
+			if protocols := parseALPN(extension); len(protocols) > 0 {
+				hello.alpn = protocols[0]
+			}
+		}
+	}
+	return hello
+}
+
+// protocol names in ALPN extension
+func parseALPN(extension *tlsParser) []string {
+	var protocols []string
+	list := &tlsParser{data: extension.bytes(int(extension.uint16()))}
+	for len(list.data) > 0 {
+		protocol := list.bytes(int(list.uint8()))
+		if list.failed {
+			break
+		}
+		protocols = append(protocols, string(protocol))
+	}
+	return protocols
+}
+
+// parse the server certificate, the first one in tls 1.2 Certificate message. return nil if failed
+func parseCertificate(data []byte) *x509.Certificate {
+	p := &tlsParser{data: data}
+	if p.uint8() != tlsHandshakeTypeCertificate {
+		return nil
+	}
+	p = &tlsParser{data: p.bytes(int(p.uint24()))}
+	list := &tlsParser{data: p.bytes(int(p.uint24()))}
+	der := list.bytes(int(list.uint24()))
+	if list.failed {
+		return nil
+	}
+	certificate, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil
+	}
+	return certificate
+}
+
+// JA3 fingerprint of client: version, cipher suites, extensions, curves and point formats
+func (h *clientHello) ja3() string {
+	return strings.Join([]string{strconv.Itoa(int(h.version)), joinTLSValues(h.cipherSuites),
+		joinTLSValues(h.extensions), joinTLSValues(h.curves), joinTLSValues(h.pointFormats)}, ",")
+}
+
+// JA3S fingerprint of server: version, cipher suite and extensions
+func (h *serverHello) ja3s() string {
+	return strings.Join([]string{strconv.Itoa(int(h.legacyVersion)), strconv.Itoa(int(h.cipherSuite)),
+		joinTLSValues(h.extensions)}, ",")
+}
+
+// values in JA3 string, joined by '-', with GREASE values(RFC 8701) skipped
+func joinTLSValues(values []uint16) string {
+	var items []string
+	for _, value := range values {
+		if value&0x0f0f == 0x0a0a && value>>8 == value&0xff {
+			continue
+		}
+		items = append(items, strconv.Itoa(int(value)))
+	}
+	return strings.Join(items, "-")
+}
+
+// JA3 fingerprints are shown as md5 hash of the string
+func ja3Hash(ja3 string) string {
+	sum := md5.Sum([]byte(ja3))
+	return hex.EncodeToString(sum[:])
+}
+
+func tlsVersionName(version uint16) string {
+	if name, ok := tlsVersionNames[version]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", version)
+}
+
+func tlsCipherSuiteName(cipherSuite uint16) string {
+	if name, ok := tlsCipherSuiteNames[cipherSuite]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04x", cipherSuite)
+}
+
+// if the ServerHello is a HelloRetryRequest, the server ask client to send ClientHello again
+func (h *serverHello) isHelloRetryRequest() bool {
+	return bytes.Equal(h.random, tlsHelloRetryRequestRandom)
+}
+
+// tlsHandshakeBuffer collect handshake messages, which may be fragmented into or coalesced in records
+type tlsHandshakeBuffer struct {
+	data []byte
+}
+
+func (b *tlsHandshakeBuffer) write(data []byte) {
+	b.data = append(b.data, data...)
+}
+
+// the next complete message with its header, nil if not received yet
+func (b *tlsHandshakeBuffer) next() []byte {
+	if len(b.data) < tlsHandshakeHeaderLen {
+		return nil
+	}
+	length := tlsHandshakeHeaderLen + (int(b.data[1])<<16 | int(b.data[2])<<8 | int(b.data[3]))
+	if len(b.data) < length {
+		return nil
+	}
+	message := b.data[:length:length]
+	b.data = b.data[length:]
+	return message
+}
+
+// tlsParser read big endian numbers and bytes from tls message.
+// once data is not enough, failed is set, and all reads return zero values
+type tlsParser struct {
+	data   []byte
+	failed bool
+}
+
+func (p *tlsParser) bytes(n int) []byte {
+	if p.failed || len(p.data) < n {
+		p.failed = true
+		return nil
+	}
+	value := p.data[:n]
+	p.data = p.data[n:]
+	return value
+}
+
+func (p *tlsParser) skip(n int) {
+	p.bytes(n)
+}
+
+func (p *tlsParser) uint8() uint8 {
+	value := p.bytes(1)
+	if value == nil {
+		return 0
+	}
+	return value[0]
+}
+
+func (p *tlsParser) uint16() uint16 {
+	value := p.bytes(2)
+	if value == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint16(value)
+}
+
+// the rest data as a list of uint16
+func (p *tlsParser) uint16List() []uint16 {
+	var values []uint16
+	for len(p.data) >= 2 {
+		values = append(values, p.uint16())
+	}
+	return values
+}
+
+func (p *tlsParser) uint24() uint32 {
+	value := p.bytes(3)
+	if value == nil {
+		return 0
+	}
+	return uint32(value[0])<<16 | uint32(value[1])<<8 | uint32(value[2])
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// the first tls record sent by crypto/tls client, which contains ClientHello
+func clientHelloRecord(tb testing.TB, serverName string) []byte {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		config := &tls.Config{ServerName: serverName, InsecureSkipVerify: serverName == ""}
+		_ = tls.Client(client, config).Handshake()
+		_ = client.Close()
+	}()
+	header := make([]byte, tlsRecordHeaderLen)
+	if _, err := io.ReadFull(server, header); err != nil {
+		tb.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint16(header[3:]))
+	if _, err := io.ReadFull(server, body); err != nil {
+		tb.Fatal(err)
+	}
+	return append(header, body...)
+}
+
+func TestReadClientHello(t *testing.T) {
+	record := clientHelloRecord(t, "example.com")
+	hello := readClientHello(bytes.NewReader(record))
+	assert.NotNil(t, hello)
+	assert.Equal(t, "example.com", hello.serverName)
+
+	hello = readClientHello(bytes.NewReader(clientHelloRecord(t, "")))
+	assert.NotNil(t, hello)
+	assert.Equal(t, "", hello.serverName)
+
+	// not tls
+	assert.Nil(t, readClientHello(bytes.NewReader([]byte("GET / HTTP/1.1\r\n\r\n"))))
+	// record truncated
+	assert.Nil(t, readClientHello(bytes.NewReader(record[:100])))
+}
+
+func TestParseClientHelloTruncated(t *testing.T) {
+	record := clientHelloRecord(t, "example.com")
+	message := record[tlsRecordHeaderLen:]
+	// the message is split into multiple records, parse the part received
+	for size := 0; size < len(message); size++ {
+		hello := parseClientHello(message[:size])
+		if hello != nil && hello.serverName != "" {
+			assert.Equal(t, "example.com", hello.serverName)
+		}
+	}
+	assert.Equal(t, "example.com", parseClientHello(message).serverName)
+}
+
+func TestParseHellos(t *testing.T) {
+	record := clientHelloRecord(t, "example.com")
+	hello := parseClientHello(record[tlsRecordHeaderLen:])
+	assert.Equal(t, uint16(tlsVersion12), hello.version)
+	assert.Len(t, hello.random, 32)
+	assert.NotEmpty(t, hello.cipherSuites)
+	assert.Contains(t, hello.extensions, uint16(tlsExtensionServerName))
+	assert.NotEmpty(t, hello.curves)
+	assert.Equal(t, []uint16{0}, hello.pointFormats)
+
+	// ServerHello, TLS 1.3 by supported_versions, with ALPN h2
+	message := []byte{tlsHandshakeTypeServerHello, 0, 0, 0, 3, 3}
+	message = append(message, bytes.Repeat([]byte{1}, 32)...)
+	message = append(message, 0, 0x13, 0x01, 0)
+	message = append(message, 0, 15, 0, 43, 0, 2, 3, 4, 0, 16, 0, 5, 0, 3, 2, 'h', '2')
+	message[3] = byte(len(message) - tlsHandshakeHeaderLen)
+	server := parseServerHello(message)
+	assert.Equal(t, uint16(tlsVersion13), server.version)
+	assert.Equal(t, uint16(0x1301), server.cipherSuite)
+	assert.Equal(t, "h2", server.alpn)
+	assert.Equal(t, "771,4865,43-16", server.ja3s())
+	assert.False(t, server.isHelloRetryRequest())
+	assert.Nil(t, parseServerHello(message[:20]))
+}
+
+func TestJA3(t *testing.T) {
+	// GREASE values are skipped
+	hello := &clientHello{version: tlsVersion12, cipherSuites: []uint16{0x0a0a, 4865, 4866},
+		extensions: []uint16{0xfafa, 0, 10, 11}, curves: []uint16{0x1a1a, 29, 23}, pointFormats: []uint16{0}}
+	assert.Equal(t, "771,4865-4866,0-10-11,29-23,0", hello.ja3())
+	assert.Equal(t, "d41d8cd98f00b204e9800998ecf8427e", ja3Hash(""))
+	assert.Equal(t, "TLS 1.3", tlsVersionName(tlsVersion13))
+	assert.Equal(t, "TLS_AES_128_GCM_SHA256", tlsCipherSuiteName(0x1301))
+	assert.Equal(t, "0xffff", tlsCipherSuiteName(0xffff))
+}
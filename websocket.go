@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"time"
+)
+
+// websocket frame opcodes
+const (
+	websocketContinuation = 0x0
+	websocketText         = 0x1
+	websocketBinary       = 0x2
+	websocketClose        = 0x8
+	websocketPing         = 0x9
+	websocketPong         = 0xA
+)
+
+var websocketOpcodeNames = map[byte]string{
+	websocketText:   "TEXT",
+	websocketBinary: "BINARY",
+	websocketClose:  "CLOSE",
+	websocketPing:   "PING",
+	websocketPong:   "PONG",
+}
+
+// frames larger than this are not decoded, the direction is given up
+const maxWebsocketFrameLen = 64 << 20
+
+// the sliding window size of deflate
+const deflateWindowSize = 32 << 10
+
+var errWebsocketFrameTooLarge = errors.New("websocket frame too large")
+
+// websocketFrame is one RFC 6455 frame, with payload unmasked
+type websocketFrame struct {
+	fin     bool
+	rsv1    bool // set on the first frame of a compressed message, if permessage-deflate is used
+	opcode  byte
+	payload []byte
+}
+
+// read one frame
+func readWebsocketFrame(reader io.Reader) (*websocketFrame, error) {
+	var header [14]byte
+	if _, err := io.ReadFull(reader, header[:2]); err != nil {
+		return nil, err
+	}
+	frame := &websocketFrame{
+		fin:    header[0]&0x80 != 0,
+		rsv1:   header[0]&0x40 != 0,
+		opcode: header[0] & 0x0F,
+	}
+	masked := header[1]&0x80 != 0
+	length := uint64(header[1] & 0x7F)
+	extra := 0
+	switch length {
+	case 126:
+		extra = 2
+	case 127:
+		extra = 8
+	}
+	if masked {
+		extra += 4
+	}
+	if _, err := io.ReadFull(reader, header[2:2+extra]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	rest := header[2 : 2+extra]
+	switch length {
+	case 126:
+		length = uint64(binary.BigEndian.Uint16(rest))
+		rest = rest[2:]
+	case 127:
+		length = binary.BigEndian.Uint64(rest)
+		rest = rest[8:]
+	}
+	if length > maxWebsocketFrameLen {
+		return nil, errWebsocketFrameTooLarge
+	}
+
+	frame.payload = make([]byte, length)
+	if _, err := io.ReadFull(reader, frame.payload); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if masked {
+		for i := range frame.payload {
+			frame.payload[i] ^= rest[i%4]
+		}
+	}
+	return frame, nil
+}
+
+// EOF in the middle of a frame is unexpected
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// websocketMessage is a data message reassembled from frames, or a control frame
+type websocketMessage struct {
+	opcode     byte
+	compressed bool
+	payload    []byte
+	timestamp  time.Time // capture time of the first frame
+}
+
+// websocketDecoder decode frames of one direction to messages
+type websocketDecoder struct {
+	reader            *streamReader
+	deflate           bool // permessage-deflate negotiated
+	noContextTakeover bool // compressor reset its window after each message
+	window            []byte
+	inflater          io.ReadCloser
+	fragmented        *websocketMessage // data message not finished
+}
+
+// read next message. Control frames are returned once received, even in the middle of a fragmented message
+func (d *websocketDecoder) next() (*websocketMessage, error) {
+	for {
+		start := d.reader.position()
+		frame, err := readWebsocketFrame(d.reader)
+		if err != nil {
+			return nil, err
+		}
+		timestamp := d.reader.timestampAt(start)
+
+		if frame.opcode >= websocketClose {
+			// control frames are not fragmented
+			return &websocketMessage{opcode: frame.opcode, payload: frame.payload, timestamp: timestamp}, nil
+		}
+
+		message := d.fragmented
+		if frame.opcode != websocketContinuation {
+			// a new message. if previous message not finished, it is lost
+			message = &websocketMessage{opcode: frame.opcode, compressed: frame.rsv1 && d.deflate,
+				timestamp: timestamp}
+		} else if message == nil {
+			// continuation of a message we did not see the start
+			continue
+		}
+		message.payload = append(message.payload, frame.payload...)
+		if !frame.fin {
+			d.fragmented = message
+			continue
+		}
+		d.fragmented = nil
+
+		if message.compressed {
+			if message.payload, err = d.inflate(message.payload); err != nil {
+				return nil, err
+			}
+		}
+		return message, nil
+	}
+}
+
+// decompress payload of a permessage-deflate message (RFC 7692)
+func (d *websocketDecoder) inflate(payload []byte) ([]byte, error) {
+	// the sender removed the tail of sync flush; add it back, with an empty final block so reader stop at the end
+	input := io.MultiReader(bytes.NewReader(payload), strings.NewReader("\x00\x00\xff\xff\x01\x00\x00\xff\xff"))
+	if d.noContextTakeover {
+		d.window = nil
+	}
+	if d.inflater == nil {
+		d.inflater = flate.NewReader(input)
+	}
+	if err := d.inflater.(flate.Resetter).Reset(input, d.window); err != nil {
+		return nil, err
+	}
+	data, err := ioutil.ReadAll(d.inflater)
+	if err != nil {
+		return nil, err
+	}
+	if !d.noContextTakeover {
+		// following messages may refer to data of this message
+		d.window = append(d.window, data...)
+		if len(d.window) > deflateWindowSize {
+			d.window = append([]byte(nil), d.window[len(d.window)-deflateWindowSize:]...)
+		}
+	}
+	return data, nil
+}
+
+// permessage-deflate parameters, in the Sec-WebSocket-Extensions header of handshake response
+type websocketDeflate struct {
+	enabled                 bool
+	clientNoContextTakeover bool
+	serverNoContextTakeover bool
+}
+
+func parseWebsocketDeflate(extensions string) websocketDeflate {
+	var deflate websocketDeflate
+	for _, extension := range strings.Split(extensions, ",") {
+		params := strings.Split(extension, ";")
+		if strings.TrimSpace(params[0]) != "permessage-deflate" {
+			continue
+		}
+		deflate.enabled = true
+		for _, param := range params[1:] {
+			switch strings.TrimSpace(param) {
+			case "client_no_context_takeover":
+				deflate.clientNoContextTakeover = true
+			case "server_no_context_takeover":
+				deflate.serverNoContextTakeover = true
+			}
+		}
+		break
+	}
+	return deflate
+}
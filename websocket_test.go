@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// build a websocket frame. client frames are masked
+func websocketFrameData(fin, rsv1 bool, opcode byte, payload []byte, masked bool) []byte {
+	var buffer bytes.Buffer
+	first := opcode
+	if fin {
+		first |= 0x80
+	}
+	if rsv1 {
+		first |= 0x40
+	}
+	buffer.WriteByte(first)
+	var maskBit byte
+	if masked {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		buffer.WriteByte(maskBit | byte(len(payload)))
+	case len(payload) <= 0xFFFF:
+		buffer.WriteByte(maskBit | 126)
+		_ = binary.Write(&buffer, binary.BigEndian, uint16(len(payload)))
+	default:
+		buffer.WriteByte(maskBit | 127)
+		_ = binary.Write(&buffer, binary.BigEndian, uint64(len(payload)))
+	}
+	if !masked {
+		buffer.Write(payload)
+		return buffer.Bytes()
+	}
+	key := []byte{0x12, 0x34, 0x56, 0x78}
+	buffer.Write(key)
+	for i, b := range payload {
+		buffer.WriteByte(b ^ key[i%4])
+	}
+	return buffer.Bytes()
+}
+
+// compress messages by permessage-deflate. If contextTakeover, messages share the compressor
+func deflateMessages(t *testing.T, contextTakeover bool, messages ...string) [][]byte {
+	var result [][]byte
+	var buffer bytes.Buffer
+	writer, _ := flate.NewWriter(&buffer, flate.BestCompression)
+	for _, message := range messages {
+		if !contextTakeover {
+			writer.Reset(&buffer)
+		}
+		_, _ = writer.Write([]byte(message))
+		if err := writer.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		data := buffer.Bytes()
+		assert.True(t, bytes.HasSuffix(data, []byte{0, 0, 0xff, 0xff}))
+		result = append(result, append([]byte(nil), data[:len(data)-4]...))
+		buffer.Reset()
+	}
+	return result
+}
+
+func newTestWebsocketDecoder(data []byte, deflate websocketDeflate) *websocketDecoder {
+	stream := newNetworkStream(backpressureBlock)
+	close(stream.c)
+	reader := &streamReader{Reader: bufio.NewReader(io.MultiReader(bytes.NewReader(data), stream)), stream: stream}
+	return &websocketDecoder{reader: reader, deflate: deflate.enabled, noContextTakeover: deflate.clientNoContextTakeover}
+}
+
+func TestWebsocketDecoder(t *testing.T) {
+	long := strings.Repeat("x", 70000)
+	var data []byte
+	data = append(data, websocketFrameData(true, false, websocketText, []byte("hello"), true)...)
+	data = append(data, websocketFrameData(true, false, websocketBinary, []byte(long[:300]), false)...)
+	data = append(data, websocketFrameData(true, false, websocketText, []byte(long), true)...)
+	// fragmented, with a ping in the middle
+	data = append(data, websocketFrameData(false, false, websocketText, []byte("frag"), true)...)
+	data = append(data, websocketFrameData(true, false, websocketPing, []byte("ping"), true)...)
+	data = append(data, websocketFrameData(false, false, websocketContinuation, []byte("men"), true)...)
+	data = append(data, websocketFrameData(true, false, websocketContinuation, []byte("ted"), true)...)
+	data = append(data, websocketFrameData(true, false, websocketClose, []byte{0x03, 0xe8, 'b', 'y', 'e'}, true)...)
+
+	decoder := newTestWebsocketDecoder(data, websocketDeflate{})
+	for _, expected := range []struct {
+		opcode  byte
+		payload string
+	}{
+		{websocketText, "hello"},
+		{websocketBinary, long[:300]},
+		{websocketText, long},
+		{websocketPing, "ping"},
+		{websocketText, "fragmented"},
+		{websocketClose, "\x03\xe8bye"},
+	} {
+		message, err := decoder.next()
+		assert.NoError(t, err)
+		assert.Equal(t, expected.opcode, message.opcode)
+		assert.Equal(t, expected.payload, string(message.payload))
+	}
+	_, err := decoder.next()
+	assert.Equal(t, io.EOF, err)
+
+	// truncated frame
+	decoder = newTestWebsocketDecoder(websocketFrameData(true, false, websocketText, []byte("hello"), true)[:5],
+		websocketDeflate{})
+	_, err = decoder.next()
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestWebsocketDecoderDeflate(t *testing.T) {
+	messages := []string{"hello websocket", "hello websocket, again", strings.Repeat("hello websocket ", 5000)}
+	for _, contextTakeover := range []bool{true, false} {
+		compressed := deflateMessages(t, contextTakeover, messages...)
+		var data []byte
+		data = append(data, websocketFrameData(true, true, websocketText, compressed[0], true)...)
+		data = append(data, websocketFrameData(true, true, websocketText, compressed[1], true)...)
+		// fragmented compressed message, only the first frame has rsv1 set
+		half := len(compressed[2]) / 2
+		data = append(data, websocketFrameData(false, true, websocketText, compressed[2][:half], true)...)
+		data = append(data, websocketFrameData(true, false, websocketContinuation, compressed[2][half:], true)...)
+		// not compressed
+		data = append(data, websocketFrameData(true, false, websocketText, []byte("plain"), true)...)
+
+		deflate := websocketDeflate{enabled: true, clientNoContextTakeover: !contextTakeover}
+		decoder := newTestWebsocketDecoder(data, deflate)
+		for _, expected := range append(messages, "plain") {
+			message, err := decoder.next()
+			assert.NoError(t, err)
+			assert.Equal(t, expected, string(message.payload))
+		}
+	}
+}
+
+func TestParseWebsocketDeflate(t *testing.T) {
+	assert.Equal(t, websocketDeflate{}, parseWebsocketDeflate(""))
+	assert.Equal(t, websocketDeflate{enabled: true, serverNoContextTakeover: true},
+		parseWebsocketDeflate("permessage-deflate; client_max_window_bits=15; server_no_context_takeover"))
+	assert.Equal(t, websocketDeflate{enabled: true, clientNoContextTakeover: true},
+		parseWebsocketDeflate("x-webkit-deflate-frame, permessage-deflate;client_no_context_takeover"))
+}
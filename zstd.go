@@ -0,0 +1,782 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math/bits"
+	"sync"
+)
+
+// zstandard decoder, RFC 8878. Frames with dictionary are not supported
+
+var errZstdInvalid = errors.New("zstd: invalid data")
+
+const zstdMagic = 0xFD2FB528
+
+// decode zstd frames, return errDecodedTooLarge if the output is more than limit
+func zstdDecode(data []byte, limit int) ([]byte, error) {
+	d := &zstdDecoder{limit: limit}
+	for len(data) > 0 {
+		if len(data) < 4 {
+			return nil, errZstdInvalid
+		}
+		magic := binary.LittleEndian.Uint32(data)
+		if magic&0xFFFFFFF0 == 0x184D2A50 {
+			// skippable frame
+			if len(data) < 8 || uint64(len(data)-8) < uint64(binary.LittleEndian.Uint32(data[4:])) {
+				return nil, errZstdInvalid
+			}
+			data = data[8+binary.LittleEndian.Uint32(data[4:]):]
+			continue
+		}
+		if magic != zstdMagic {
+			return nil, errZstdInvalid
+		}
+		var err error
+		if data, err = d.decodeFrame(data[4:]); err != nil {
+			return nil, err
+		}
+	}
+	return d.out, nil
+}
+
+// zstdDecoder keep output, and states carried between blocks of a frame
+type zstdDecoder struct {
+	out        []byte
+	limit      int
+	frameStart int              // output position of the current frame
+	huffman    *zstdHuffman     // literals table of the previous block
+	tables     [3]*zstdFSETable // literals length, offset and match length tables of the previous block
+	repeats    [3]int           // repeated offsets
+}
+
+// decode one frame after the magic number, return data after the frame
+func (d *zstdDecoder) decodeFrame(data []byte) ([]byte, error) {
+	if len(data) < 1 {
+		return nil, errZstdInvalid
+	}
+	descriptor := data[0]
+	pos := 1
+	if descriptor&0x08 != 0 {
+		return nil, errZstdInvalid
+	}
+	singleSegment := descriptor&0x20 != 0
+	if !singleSegment {
+		// window descriptor, the whole frame is kept in memory so window size is not used
+		pos++
+	}
+	dictionaryIDSize := [4]int{0, 1, 2, 4}[descriptor&3]
+	contentSizeSize := [4]int{0, 2, 4, 8}[descriptor>>6]
+	if contentSizeSize == 0 && singleSegment {
+		contentSizeSize = 1
+	}
+	if len(data) < pos+dictionaryIDSize+contentSizeSize {
+		return nil, errZstdInvalid
+	}
+	for _, b := range data[pos : pos+dictionaryIDSize] {
+		if b != 0 {
+			return nil, errors.New("zstd: dictionary is not supported")
+		}
+	}
+	pos += dictionaryIDSize + contentSizeSize
+
+	d.frameStart = len(d.out)
+	d.huffman = nil
+	d.tables = [3]*zstdFSETable{}
+	d.repeats = [3]int{1, 4, 8}
+	for {
+		if len(data) < pos+3 {
+			return nil, errZstdInvalid
+		}
+		header := int(data[pos]) | int(data[pos+1])<<8 | int(data[pos+2])<<16
+		pos += 3
+		last := header&1 != 0
+		size := header >> 3
+		switch header >> 1 & 3 {
+		case 0:
+			// raw
+			if len(data) < pos+size {
+				return nil, errZstdInvalid
+			}
+			if err := d.grow(size); err != nil {
+				return nil, err
+			}
+			d.out = append(d.out, data[pos:pos+size]...)
+			pos += size
+		case 1:
+			// rle, one byte repeated size times
+			if len(data) < pos+1 {
+				return nil, errZstdInvalid
+			}
+			if err := d.grow(size); err != nil {
+				return nil, err
+			}
+			d.out = append(d.out, bytes.Repeat(data[pos:pos+1], size)...)
+			pos++
+		case 2:
+			if len(data) < pos+size {
+				return nil, errZstdInvalid
+			}
+			if err := d.decodeBlock(data[pos : pos+size]); err != nil {
+				return nil, err
+			}
+			pos += size
+		default:
+			return nil, errZstdInvalid
+		}
+		if last {
+			break
+		}
+	}
+	if descriptor&0x04 != 0 {
+		// content checksum, the lower 32 bits of xxh64
+		if len(data) < pos+4 {
+			return nil, errZstdInvalid
+		}
+		if uint32(xxh64(d.out[d.frameStart:])) != binary.LittleEndian.Uint32(data[pos:]) {
+			return nil, errors.New("zstd: checksum mismatch")
+		}
+		pos += 4
+	}
+	return data[pos:], nil
+}
+
+// check if output can grow n bytes
+func (d *zstdDecoder) grow(n int) error {
+	if n > d.limit-len(d.out) {
+		return errDecodedTooLarge
+	}
+	return nil
+}
+
+func (d *zstdDecoder) decodeBlock(block []byte) error {
+	literals, rest, err := d.decodeLiterals(block)
+	if err != nil {
+		return err
+	}
+	return d.decodeSequences(rest, literals)
+}
+
+// decode literals section, return literals and data after the section
+func (d *zstdDecoder) decodeLiterals(block []byte) ([]byte, []byte, error) {
+	if len(block) < 1 {
+		return nil, nil, errZstdInvalid
+	}
+	literalsType := block[0] & 3
+	sizeFormat := block[0] >> 2 & 3
+
+	if literalsType < 2 {
+		// raw or rle
+		var size, headerSize int
+		switch sizeFormat {
+		case 0, 2:
+			size, headerSize = int(block[0]>>3), 1
+		case 1:
+			if len(block) < 2 {
+				return nil, nil, errZstdInvalid
+			}
+			size, headerSize = int(block[0]>>4)|int(block[1])<<4, 2
+		case 3:
+			if len(block) < 3 {
+				return nil, nil, errZstdInvalid
+			}
+			size, headerSize = int(block[0]>>4)|int(block[1])<<4|int(block[2])<<12, 3
+		}
+		if literalsType == 0 {
+			if len(block) < headerSize+size {
+				return nil, nil, errZstdInvalid
+			}
+			return block[headerSize : headerSize+size], block[headerSize+size:], nil
+		}
+		if len(block) < headerSize+1 {
+			return nil, nil, errZstdInvalid
+		}
+		return bytes.Repeat(block[headerSize:headerSize+1], size), block[headerSize+1:], nil
+	}
+
+	// compressed, or treeless which uses the huffman table of the previous block
+	var header uint64
+	headerSize := [4]int{3, 3, 4, 5}[sizeFormat]
+	if len(block) < headerSize {
+		return nil, nil, errZstdInvalid
+	}
+	for i := headerSize - 1; i >= 0; i-- {
+		header = header<<8 | uint64(block[i])
+	}
+	header >>= 4
+	sizeBits := [4]uint{10, 10, 14, 18}[sizeFormat]
+	size := int(header & (1<<sizeBits - 1))
+	compressedSize := int(header >> sizeBits)
+	if len(block) < headerSize+compressedSize {
+		return nil, nil, errZstdInvalid
+	}
+	data, rest := block[headerSize:headerSize+compressedSize], block[headerSize+compressedSize:]
+	if literalsType == 2 {
+		table, n, err := readZstdHuffman(data)
+		if err != nil {
+			return nil, nil, err
+		}
+		d.huffman = table
+		data = data[n:]
+	} else if d.huffman == nil {
+		return nil, nil, errZstdInvalid
+	}
+
+	literals := make([]byte, size)
+	if sizeFormat == 0 {
+		return literals, rest, d.huffman.decode(data, literals)
+	}
+	// four streams, with jump table of the sizes of the first three
+	if len(data) < 6 {
+		return nil, nil, errZstdInvalid
+	}
+	segment := (size + 3) / 4
+	if 3*segment > size {
+		return nil, nil, errZstdInvalid
+	}
+	streams := data[6:]
+	for i := 0; i < 4; i++ {
+		streamSize := len(streams)
+		if i < 3 {
+			streamSize = int(binary.LittleEndian.Uint16(data[2*i:]))
+		}
+		if streamSize > len(streams) {
+			return nil, nil, errZstdInvalid
+		}
+		end := (i + 1) * segment
+		if i == 3 {
+			end = size
+		}
+		if err := d.huffman.decode(streams[:streamSize], literals[i*segment:end]); err != nil {
+			return nil, nil, err
+		}
+		streams = streams[streamSize:]
+	}
+	return literals, rest, nil
+}
+
+// zstdHuffman is a literals decoding table, indexed by the next maxBits bits
+type zstdHuffman struct {
+	maxBits uint
+	symbols []byte
+	bits    []uint8
+}
+
+// read huffman tree description, return the table and bytes read
+func readZstdHuffman(data []byte) (*zstdHuffman, int, error) {
+	if len(data) < 1 {
+		return nil, 0, errZstdInvalid
+	}
+	var weights []byte
+	var n int
+	if header := int(data[0]); header < 128 {
+		// weights compressed by fse
+		if len(data) < 1+header {
+			return nil, 0, errZstdInvalid
+		}
+		var err error
+		if weights, err = decodeZstdHuffmanWeights(data[1 : 1+header]); err != nil {
+			return nil, 0, err
+		}
+		n = 1 + header
+	} else {
+		// 4 bits each
+		weights = make([]byte, header-127)
+		n = 1 + (len(weights)+1)/2
+		if len(data) < n {
+			return nil, 0, errZstdInvalid
+		}
+		for i := range weights {
+			if i%2 == 0 {
+				weights[i] = data[1+i/2] >> 4
+			} else {
+				weights[i] = data[1+i/2] & 0xf
+			}
+		}
+	}
+
+	// weight of the last symbol is implied, to make the sum a power of 2
+	total := 0
+	for _, weight := range weights {
+		if weight > 11 {
+			return nil, 0, errZstdInvalid
+		}
+		if weight > 0 {
+			total += 1 << (weight - 1)
+		}
+	}
+	if total == 0 {
+		return nil, 0, errZstdInvalid
+	}
+	maxBits := uint(bits.Len(uint(total)))
+	remain := 1<<maxBits - total
+	if maxBits > 11 || remain&(remain-1) != 0 {
+		return nil, 0, errZstdInvalid
+	}
+	weights = append(weights, byte(bits.Len(uint(remain))))
+
+	var counts [13]int
+	for _, weight := range weights {
+		counts[weight]++
+	}
+	// codes of the same weight take consecutive ranges, from the lowest weight
+	var starts [13]int
+	next := 0
+	for weight := uint(1); weight <= maxBits; weight++ {
+		starts[weight] = next
+		next += counts[weight] << (weight - 1)
+	}
+	h := &zstdHuffman{maxBits: maxBits, symbols: make([]byte, 1<<maxBits), bits: make([]uint8, 1<<maxBits)}
+	for symbol, weight := range weights {
+		if weight == 0 {
+			continue
+		}
+		if uint(weight) > maxBits {
+			return nil, 0, errZstdInvalid
+		}
+		start := starts[weight]
+		for i := start; i < start+1<<(weight-1); i++ {
+			h.symbols[i] = byte(symbol)
+			h.bits[i] = uint8(maxBits + 1 - uint(weight))
+		}
+		starts[weight] += 1 << (weight - 1)
+	}
+	return h, n, nil
+}
+
+// huffman weights compressed by fse, decoded by two interleaved states
+func decodeZstdHuffmanWeights(data []byte) ([]byte, error) {
+	table, n, err := readZstdFSETable(data, 255, 6)
+	if err != nil {
+		return nil, err
+	}
+	r, err := newZstdBitReader(data[n:])
+	if err != nil {
+		return nil, err
+	}
+	states := [2]int{r.readBits(table.log), r.readBits(table.log)}
+	var weights []byte
+	for i := 0; ; i = 1 - i {
+		if len(weights) >= 255 {
+			return nil, errZstdInvalid
+		}
+		entry := table.entries[states[i]]
+		weights = append(weights, entry.symbol)
+		states[i] = int(entry.baseline) + r.readBits(uint(entry.bits))
+		if r.pos < 0 {
+			// the stream ends, the other state holds the last weight
+			weights = append(weights, table.entries[states[1-i]].symbol)
+			return weights, nil
+		}
+	}
+}
+
+func (h *zstdHuffman) decode(data []byte, out []byte) error {
+	r, err := newZstdBitReader(data)
+	if err != nil {
+		return err
+	}
+	for i := range out {
+		index := r.peekBits(h.maxBits)
+		out[i] = h.symbols[index]
+		r.pos -= int(h.bits[index])
+	}
+	if r.pos != 0 {
+		return errZstdInvalid
+	}
+	return nil
+}
+
+// zstdBitReader read bits backward, from the highest bit below the end mark in the last byte
+type zstdBitReader struct {
+	data []byte
+	pos  int // bits not read, negative when read beyond the start
+}
+
+func newZstdBitReader(data []byte) (*zstdBitReader, error) {
+	if len(data) == 0 || data[len(data)-1] == 0 {
+		return nil, errZstdInvalid
+	}
+	return &zstdBitReader{data: data, pos: (len(data)-1)*8 + bits.Len8(data[len(data)-1]) - 1}, nil
+}
+
+// the next n bits, n <= 56. Bits beyond the start are zero
+func (r *zstdBitReader) peekBits(n uint) int {
+	if n == 0 || r.pos <= 0 {
+		return 0
+	}
+	if start := r.pos - int(n); start >= 0 {
+		return int(zstdLoadBits(r.data, start, n))
+	}
+	return int(zstdLoadBits(r.data, 0, uint(r.pos)) << uint(int(n)-r.pos))
+}
+
+func (r *zstdBitReader) readBits(n uint) int {
+	value := r.peekBits(n)
+	r.pos -= int(n)
+	return value
+}
+
+// n bits from bit position start, n <= 56
+func zstdLoadBits(data []byte, start int, n uint) uint64 {
+	index := start >> 3
+	var value uint64
+	for i := 0; i < 8 && index+i < len(data); i++ {
+		value |= uint64(data[index+i]) << (8 * uint(i))
+	}
+	return value >> uint(start&7) & (1<<n - 1)
+}
+
+// zstdFSETable is a fse decoding table, indexed by state
+type zstdFSETable struct {
+	log     uint
+	entries []zstdFSEEntry
+}
+
+type zstdFSEEntry struct {
+	symbol   byte
+	bits     uint8
+	baseline uint16
+}
+
+// read fse table description, return the table and bytes read
+func readZstdFSETable(data []byte, maxSymbol int, maxLog uint) (*zstdFSETable, int, error) {
+	pos := 0
+	readBits := func(n uint) int {
+		value := int(zstdLoadBits(data, pos, n))
+		pos += int(n)
+		return value
+	}
+	log := uint(readBits(4)) + 5
+	if log > maxLog {
+		return nil, 0, errZstdInvalid
+	}
+	remaining := 1<<log + 1
+	threshold := 1 << log
+	bitCount := log + 1
+	var counts []int
+	previousZero := false
+	for remaining > 1 && len(counts) <= maxSymbol {
+		if previousZero {
+			// number of zero counts follow, 2 bits each, repeated while the value is 3
+			for {
+				repeat := readBits(2)
+				for i := 0; i < repeat; i++ {
+					counts = append(counts, 0)
+				}
+				if repeat != 3 {
+					break
+				}
+			}
+			if len(counts) > maxSymbol {
+				return nil, 0, errZstdInvalid
+			}
+		}
+		max := 2*threshold - 1 - remaining
+		value := int(zstdLoadBits(data, pos, bitCount))
+		var count int
+		if value&(threshold-1) < max {
+			count = value & (threshold - 1)
+			pos += int(bitCount) - 1
+		} else {
+			count = value & (2*threshold - 1)
+			if count >= threshold {
+				count -= max
+			}
+			pos += int(bitCount)
+		}
+		count--
+		if count < 0 {
+			remaining += count
+		} else {
+			remaining -= count
+		}
+		counts = append(counts, count)
+		previousZero = count == 0
+		for remaining < threshold {
+			bitCount--
+			threshold >>= 1
+		}
+	}
+	if remaining != 1 || pos > 8*len(data) {
+		return nil, 0, errZstdInvalid
+	}
+	table, err := newZstdFSETable(counts, log)
+	return table, (pos + 7) / 8, err
+}
+
+// build decoding table from normalized counts, -1 for symbols of less than 1 probability
+func newZstdFSETable(counts []int, log uint) (*zstdFSETable, error) {
+	size := 1 << log
+	table := &zstdFSETable{log: log, entries: make([]zstdFSEEntry, size)}
+	next := make([]int, len(counts))
+	high := size - 1
+	for symbol, count := range counts {
+		if count == -1 {
+			table.entries[high].symbol = byte(symbol)
+			high--
+			next[symbol] = 1
+		} else {
+			next[symbol] = count
+		}
+	}
+	position, step, mask := 0, size>>1+size>>3+3, size-1
+	for symbol, count := range counts {
+		for i := 0; i < count; i++ {
+			table.entries[position].symbol = byte(symbol)
+			position = (position + step) & mask
+			for position > high {
+				position = (position + step) & mask
+			}
+		}
+	}
+	if position != 0 {
+		return nil, errZstdInvalid
+	}
+	for i := range table.entries {
+		entry := &table.entries[i]
+		n := next[entry.symbol]
+		next[entry.symbol]++
+		if n == 0 {
+			return nil, errZstdInvalid
+		}
+		entry.bits = uint8(log - uint(bits.Len(uint(n))-1))
+		entry.baseline = uint16(n<<entry.bits - size)
+	}
+	return table, nil
+}
+
+// predefined distributions of literals length, offset and match length codes
+var zstdDefaultCounts = [3][]int{
+	{4, 3, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 3, 2, 1, 1, 1, 1, 1, -1, -1, -1, -1},
+	{1, 1, 1, 1, 1, 1, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1},
+	{1, 4, 3, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		1, 1, 1, 1, 1, 1, 1, 1, -1, -1, -1, -1, -1, -1, -1},
+}
+var zstdDefaultLogs = [3]uint{6, 5, 6}
+
+// max symbol and accuracy log of literals length, offset and match length tables
+var zstdMaxSymbols = [3]int{35, 31, 52}
+var zstdMaxLogs = [3]uint{9, 8, 9}
+
+var (
+	zstdDefaultTablesOnce sync.Once
+	zstdDefaultTables     [3]*zstdFSETable
+)
+
+func zstdDefaultTable(kind int) *zstdFSETable {
+	zstdDefaultTablesOnce.Do(func() {
+		for i := range zstdDefaultTables {
+			zstdDefaultTables[i], _ = newZstdFSETable(zstdDefaultCounts[i], zstdDefaultLogs[i])
+		}
+	})
+	return zstdDefaultTables[kind]
+}
+
+// baseline and extra bits of literals length codes and match length codes
+var zstdLiteralsLengthBase = [36]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 18, 20, 22, 24, 28, 32,
+	40, 48, 64, 128, 256, 512, 1024, 2048, 4096, 8192, 16384, 32768, 65536}
+var zstdLiteralsLengthBits = [36]uint{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 6,
+	7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+var zstdMatchLengthBase = [53]int{3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20, 21, 22, 23, 24, 25,
+	26, 27, 28, 29, 30, 31, 32, 33, 34, 35, 37, 39, 41, 43, 47, 51, 59, 67, 83, 99, 131, 259, 515, 1027, 2051, 4099,
+	8195, 16387, 32771, 65539}
+var zstdMatchLengthBits = [53]uint{0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 1, 1, 1, 1, 2, 2, 3, 3, 4, 4, 5, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16}
+
+// decode sequences section and execute sequences with literals
+func (d *zstdDecoder) decodeSequences(data []byte, literals []byte) error {
+	if len(data) < 1 {
+		return errZstdInvalid
+	}
+	count, pos := int(data[0]), 1
+	if count == 255 {
+		if len(data) < 3 {
+			return errZstdInvalid
+		}
+		count, pos = int(binary.LittleEndian.Uint16(data[1:]))+0x7F00, 3
+	} else if count >= 128 {
+		if len(data) < 2 {
+			return errZstdInvalid
+		}
+		count, pos = (count-128)<<8|int(data[1]), 2
+	}
+	if count == 0 {
+		if err := d.grow(len(literals)); err != nil {
+			return err
+		}
+		d.out = append(d.out, literals...)
+		return nil
+	}
+
+	if len(data) < pos+1 {
+		return errZstdInvalid
+	}
+	modes := data[pos]
+	pos++
+	if modes&3 != 0 {
+		return errZstdInvalid
+	}
+	// literals length, offset, match length
+	for kind := 0; kind < 3; kind++ {
+		switch modes >> uint(6-2*kind) & 3 {
+		case 0:
+			d.tables[kind] = zstdDefaultTable(kind)
+		case 1:
+			// one symbol
+			if len(data) < pos+1 || int(data[pos]) > zstdMaxSymbols[kind] {
+				return errZstdInvalid
+			}
+			d.tables[kind] = &zstdFSETable{entries: []zstdFSEEntry{{symbol: data[pos]}}}
+			pos++
+		case 2:
+			table, n, err := readZstdFSETable(data[pos:], zstdMaxSymbols[kind], zstdMaxLogs[kind])
+			if err != nil {
+				return err
+			}
+			d.tables[kind] = table
+			pos += n
+		case 3:
+			// the table of the previous block
+			if d.tables[kind] == nil {
+				return errZstdInvalid
+			}
+		}
+	}
+
+	r, err := newZstdBitReader(data[pos:])
+	if err != nil {
+		return err
+	}
+	literalsTable, offsetTable, matchTable := d.tables[0], d.tables[1], d.tables[2]
+	literalsState := r.readBits(literalsTable.log)
+	offsetState := r.readBits(offsetTable.log)
+	matchState := r.readBits(matchTable.log)
+	for i := 0; i < count; i++ {
+		literalsEntry := literalsTable.entries[literalsState]
+		offsetEntry := offsetTable.entries[offsetState]
+		matchEntry := matchTable.entries[matchState]
+		if offsetEntry.symbol > 31 || int(matchEntry.symbol) > zstdMaxSymbols[2] ||
+			int(literalsEntry.symbol) > zstdMaxSymbols[0] {
+			return errZstdInvalid
+		}
+		offsetValue := 1<<offsetEntry.symbol + r.readBits(uint(offsetEntry.symbol))
+		matchLength := zstdMatchLengthBase[matchEntry.symbol] + r.readBits(zstdMatchLengthBits[matchEntry.symbol])
+		literalsLength := zstdLiteralsLengthBase[literalsEntry.symbol] +
+			r.readBits(zstdLiteralsLengthBits[literalsEntry.symbol])
+		offset := d.offset(offsetValue, literalsLength)
+		if i < count-1 {
+			literalsState = int(literalsEntry.baseline) + r.readBits(uint(literalsEntry.bits))
+			matchState = int(matchEntry.baseline) + r.readBits(uint(matchEntry.bits))
+			offsetState = int(offsetEntry.baseline) + r.readBits(uint(offsetEntry.bits))
+		}
+		if r.pos < 0 || literalsLength > len(literals) {
+			return errZstdInvalid
+		}
+
+		if err := d.grow(literalsLength + matchLength); err != nil {
+			return err
+		}
+		d.out = append(d.out, literals[:literalsLength]...)
+		literals = literals[literalsLength:]
+		if offset <= 0 || offset > len(d.out)-d.frameStart {
+			return errZstdInvalid
+		}
+		for j := 0; j < matchLength; j++ {
+			d.out = append(d.out, d.out[len(d.out)-offset])
+		}
+	}
+	if r.pos != 0 {
+		return errZstdInvalid
+	}
+	if err := d.grow(len(literals)); err != nil {
+		return err
+	}
+	d.out = append(d.out, literals...)
+	return nil
+}
+
+// offset of offset value, values 1-3 are repeated offsets
+func (d *zstdDecoder) offset(value int, literalsLength int) int {
+	if value > 3 {
+		d.repeats = [3]int{value - 3, d.repeats[0], d.repeats[1]}
+		return value - 3
+	}
+	index := value - 1
+	if literalsLength == 0 {
+		index++
+	}
+	var offset int
+	switch index {
+	case 0:
+		return d.repeats[0]
+	case 3:
+		offset = d.repeats[0] - 1
+	default:
+		offset = d.repeats[index]
+	}
+	if index == 1 {
+		d.repeats = [3]int{offset, d.repeats[0], d.repeats[2]}
+	} else {
+		d.repeats = [3]int{offset, d.repeats[0], d.repeats[1]}
+	}
+	return offset
+}
+
+var (
+	xxhPrime1 uint64 = 11400714785074694791
+	xxhPrime2 uint64 = 14029467366897019727
+	xxhPrime3 uint64 = 1609587929392839161
+	xxhPrime4 uint64 = 9650029242287828579
+	xxhPrime5 uint64 = 2870177450012600261
+)
+
+// xxh64 hash with seed 0, for content checksum
+func xxh64(data []byte) uint64 {
+	n := uint64(len(data))
+	var h uint64
+	if len(data) >= 32 {
+		v1 := xxhPrime1 + xxhPrime2
+		v2 := xxhPrime2
+		v3 := uint64(0)
+		v4 := -xxhPrime1
+		for ; len(data) >= 32; data = data[32:] {
+			v1 = xxhRound(v1, binary.LittleEndian.Uint64(data))
+			v2 = xxhRound(v2, binary.LittleEndian.Uint64(data[8:]))
+			v3 = xxhRound(v3, binary.LittleEndian.Uint64(data[16:]))
+			v4 = xxhRound(v4, binary.LittleEndian.Uint64(data[24:]))
+		}
+		h = bits.RotateLeft64(v1, 1) + bits.RotateLeft64(v2, 7) + bits.RotateLeft64(v3, 12) + bits.RotateLeft64(v4, 18)
+		for _, v := range []uint64{v1, v2, v3, v4} {
+			h = (h^xxhRound(0, v))*xxhPrime1 + xxhPrime4
+		}
+	} else {
+		h = xxhPrime5
+	}
+	h += n
+	for ; len(data) >= 8; data = data[8:] {
+		h ^= xxhRound(0, binary.LittleEndian.Uint64(data))
+		h = bits.RotateLeft64(h, 27)*xxhPrime1 + xxhPrime4
+	}
+	if len(data) >= 4 {
+		h ^= uint64(binary.LittleEndian.Uint32(data)) * xxhPrime1
+		h = bits.RotateLeft64(h, 23)*xxhPrime2 + xxhPrime3
+		data = data[4:]
+	}
+	for _, b := range data {
+		h ^= uint64(b) * xxhPrime5
+		h = bits.RotateLeft64(h, 11) * xxhPrime1
+	}
+	h ^= h >> 33
+	h *= xxhPrime2
+	h ^= h >> 29
+	h *= xxhPrime3
+	h ^= h >> 32
+	return h
+}
+
+func xxhRound(acc, input uint64) uint64 {
+	acc += input * xxhPrime2
+	return bits.RotateLeft64(acc, 31) * xxhPrime1
+}